@@ -0,0 +1,403 @@
+// Package client talks to a filer deployment through the API described in
+// openapi.json. The request and response types are generated from the
+// document by tools/openapigen.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Client of a filer deployment
+type Client struct {
+	// root of the deployment, such as https://filer.example.com
+	BaseURL string
+	// sent in X-Api-Key with uploads, when set
+	APIKey string
+	// bearer token of a signed-in user, when set
+	Token string
+	// http.DefaultClient when nil
+	HTTPClient *http.Client
+}
+
+// New returns a client of the deployment at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+func (e *Error) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("%s (status %d, request %s)", e.Message, e.Code, e.RequestID)
+	}
+	return fmt.Sprintf("%s (status %d)", e.Message, e.Code)
+}
+
+// UploadOptions are the optional fields of an upload.
+type UploadOptions struct {
+	// lifetime such as 30m, 24h or 7d
+	TTL          string
+	MaxDownloads int
+	Passphrase   string
+	// encrypt at rest with a key derived from the secret
+	Encrypt bool
+	// also issue a word code
+	WordCode bool
+	// content type of the file, detected by the service when empty
+	ContentType string
+	// name the file is downloaded under, the uploaded name when empty
+	DownloadAs string
+	// shown in FileInfo, admins can search files by tag
+	Description string
+	Tags        []string
+	Meta        map[string]string
+	// CIDR ranges or addresses and ISO 3166-1 country codes downloads are
+	// restricted to
+	AllowedNetworks  []string
+	AllowedCountries []string
+	// retries of an upload sent with the same key get its answer instead
+	// of sharing the file again, a UUID per file
+	IdempotencyKey string
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// route of the file shared under secret
+func fileRoute(secret string) string {
+	return "v1/files/" + url.PathEscape(secret)
+}
+
+func (c *Client) newRequest(ctx context.Context, method, route string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := c.BaseURL + "/api/" + route
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.APIKey != "" {
+		req.Header.Set("X-Api-Key", c.APIKey)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return req, nil
+}
+
+// send req and return the response of a successful request, an *Error otherwise
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	apiErr := &Error{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 64<<10)).Decode(apiErr); err != nil || apiErr.Message == "" {
+		apiErr = &Error{Message: http.StatusText(res.StatusCode)}
+	}
+	apiErr.Code = res.StatusCode
+	return nil, apiErr
+}
+
+// send req and decode its JSON answer into v
+func (c *Client) doJSON(req *http.Request, v interface{}) error {
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// Upload shares the contents read from r under name. The body is streamed,
+// so r may be larger than memory.
+func (c *Client) Upload(ctx context.Context, name string, r io.Reader, opts *UploadOptions) (*Upload, error) {
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	fields := url.Values{}
+	if opts.TTL != "" {
+		fields.Set("ttl", opts.TTL)
+	}
+	if opts.MaxDownloads > 0 {
+		fields.Set("max_downloads", strconv.Itoa(opts.MaxDownloads))
+	}
+	if opts.Passphrase != "" {
+		fields.Set("passphrase", opts.Passphrase)
+	}
+	if opts.Encrypt {
+		fields.Set("encrypt", "true")
+	}
+	if opts.WordCode {
+		fields.Set("word_code", "true")
+	}
+	if opts.DownloadAs != "" {
+		fields.Set("download_as", opts.DownloadAs)
+	}
+	if opts.Description != "" {
+		fields.Set("description", opts.Description)
+	}
+	if len(opts.Tags) > 0 {
+		fields.Set("tags", strings.Join(opts.Tags, ","))
+	}
+	for key, value := range opts.Meta {
+		fields.Set("meta["+key+"]", value)
+	}
+	if len(opts.AllowedNetworks) > 0 {
+		fields.Set("allowed_networks", strings.Join(opts.AllowedNetworks, ","))
+	}
+	if len(opts.AllowedCountries) > 0 {
+		fields.Set("allowed_countries", strings.Join(opts.AllowedCountries, ","))
+	}
+
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeUploadForm(form, fields, name, opts.ContentType, r))
+	}()
+	defer pr.Close()
+
+	req, err := c.newRequest(ctx, http.MethodPost, "v1/files", nil, pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if opts.IdempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", opts.IdempotencyKey)
+	}
+	var uploaded Upload
+	if err := c.doJSON(req, &uploaded); err != nil {
+		return nil, err
+	}
+	return &uploaded, nil
+}
+
+func writeUploadForm(form *multipart.Writer, fields url.Values, name, contentType string, r io.Reader) error {
+	for key := range fields {
+		if err := form.WriteField(key, fields.Get(key)); err != nil {
+			return err
+		}
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": "file", "filename": name}))
+	header.Set("Content-Type", contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, r); err != nil {
+		return err
+	}
+	return form.Close()
+}
+
+// Paste shares a text snippet.
+func (c *Client) Paste(ctx context.Context, paste *PasteRequest) (*Upload, error) {
+	return c.postJSON(ctx, "PasteTrigger", paste)
+}
+
+// Fetch shares the file at a public URL, downloaded by the service.
+func (c *Client) Fetch(ctx context.Context, fetch *FetchRequest) (*Upload, error) {
+	return c.postJSON(ctx, "FetchTrigger", fetch)
+}
+
+// Precheck shares contents the same principal uploaded before, named by
+// their SHA-256 and size, without sending them again. It fails with an
+// *Error of Code 404 when they have to be uploaded.
+func (c *Client) Precheck(ctx context.Context, precheck *PrecheckRequest) (*Upload, error) {
+	return c.postJSON(ctx, "v1/uploads/precheck", precheck)
+}
+
+func (c *Client) postJSON(ctx context.Context, route string, v interface{}) (*Upload, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, route, nil, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var uploaded Upload
+	if err := c.doJSON(req, &uploaded); err != nil {
+		return nil, err
+	}
+	return &uploaded, nil
+}
+
+// Info returns the details of the file shared under secret.
+func (c *Client) Info(ctx context.Context, secret string) (*FileInfo, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "FileInfo", url.Values{"secret": {secret}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var info FileInfo
+	if err := c.doJSON(req, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// route of the collection shared under secret
+func collectionRoute(secret string) string {
+	return "v1/collections/" + url.PathEscape(secret)
+}
+
+// CreateCollection creates a collection of the user signed in with Token,
+// its secret is only returned here.
+func (c *Client) CreateCollection(ctx context.Context, name string) (*Collection, error) {
+	body, err := json.Marshal(CollectionForm{Name: name})
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "v1/collections", nil, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var collection Collection
+	if err := c.doJSON(req, &collection); err != nil {
+		return nil, err
+	}
+	return &collection, nil
+}
+
+// AddToCollection adds the file shared under fileSecret to the collection
+// shared under secret, both of the user signed in with Token.
+func (c *Client) AddToCollection(ctx context.Context, secret, fileSecret string) error {
+	body, err := json.Marshal(CollectionFileForm{Secret: fileSecret})
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, collectionRoute(secret)+"/files", nil, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Collection returns the files of the collection shared under secret.
+func (c *Client) Collection(ctx context.Context, secret string) (*CollectionListing, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, collectionRoute(secret), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var listing CollectionListing
+	if err := c.doJSON(req, &listing); err != nil {
+		return nil, err
+	}
+	return &listing, nil
+}
+
+// Download is a file being downloaded.
+type Download struct {
+	io.ReadCloser
+	// name of the file, from Content-Disposition
+	Name        string
+	ContentType string
+	// -1 when unknown, for example when the response is compressed
+	Size int64
+}
+
+// Download opens the file shared under secret, passphrase is only needed
+// for protected files. The caller closes the returned Download.
+func (c *Client) Download(ctx context.Context, secret, passphrase string) (*Download, error) {
+	var req *http.Request
+	var err error
+	if passphrase == "" {
+		req, err = c.newRequest(ctx, http.MethodGet, fileRoute(secret), nil, nil)
+	} else {
+		form := url.Values{"passphrase": {passphrase}}
+		req, err = c.newRequest(ctx, http.MethodPost, fileRoute(secret), nil, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	d := &Download{ReadCloser: res.Body, ContentType: res.Header.Get("Content-Type"), Size: res.ContentLength}
+	if _, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition")); err == nil {
+		d.Name = params["filename"]
+	}
+	return d, nil
+}
+
+// DownloadToken exchanges secret for a short-lived download token.
+func (c *Client) DownloadToken(ctx context.Context, secret, passphrase string) (*DownloadToken, error) {
+	form := url.Values{}
+	if passphrase != "" {
+		form.Set("passphrase", passphrase)
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, fileRoute(secret)+"/tokens", nil, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var token DownloadToken
+	if err := c.doJSON(req, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// Delete deletes the file shared under secret with the DeleteToken of its upload.
+func (c *Client) Delete(ctx context.Context, secret, deleteToken string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, fileRoute(secret), url.Values{"token": {deleteToken}}, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Rotate revokes secret and shares its file under a new secret, returned
+// with its share link. deleteToken may be empty when signed in as the owner.
+func (c *Client) Rotate(ctx context.Context, secret, deleteToken string) (*Upload, error) {
+	var query url.Values
+	if deleteToken != "" {
+		query = url.Values{"token": {deleteToken}}
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, fileRoute(secret)+"/rotate", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	var rotated Upload
+	if err := c.doJSON(req, &rotated); err != nil {
+		return nil, err
+	}
+	return &rotated, nil
+}
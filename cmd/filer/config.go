@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const defaultProfile = "default"
+
+// settings of a deployment in the config file
+type profile struct {
+	URL    string
+	APIKey string
+}
+
+type profiles map[string]*profile
+
+// the config file, $XDG_CONFIG_HOME/filer/config unless path is set
+// A missing default file is no error, everything may come from the environment.
+func loadProfiles(path string) (profiles, error) {
+	explicit := path != ""
+	if !explicit {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return profiles{}, nil
+		}
+		path = filepath.Join(dir, "filer", "config")
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && !explicit {
+		return profiles{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseProfiles(f.Name(), bufio.NewScanner(f))
+}
+
+// parse INI sections of key = value lines, # and ; start comments
+func parseProfiles(path string, s *bufio.Scanner) (profiles, error) {
+	ps := profiles{}
+	var current *profile
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || text[0] == '#' || text[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			name := strings.TrimSpace(text[1 : len(text)-1])
+			if ps[name] == nil {
+				ps[name] = &profile{}
+			}
+			current = ps[name]
+			continue
+		}
+		i := strings.Index(text, "=")
+		if i < 0 || current == nil {
+			return nil, fmt.Errorf("%s:%d: expected [profile] or key = value", path, line)
+		}
+		key, value := strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:])
+		switch key {
+		case "url":
+			current.URL = value
+		case "api_key":
+			current.APIKey = value
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown key %q", path, line, key)
+		}
+	}
+	return ps, s.Err()
+}
+
+// the profile called name, the default one when name is empty, with the
+// FILER_URL and FILER_API_KEY overrides applied
+func (ps profiles) resolve(name string) (profile, error) {
+	var p profile
+	if name == "" {
+		name = defaultProfile
+		if d := ps[name]; d != nil {
+			p = *d
+		}
+	} else if named := ps[name]; named != nil {
+		p = *named
+	} else {
+		return p, fmt.Errorf("unknown profile %q", name)
+	}
+	if v := os.Getenv("FILER_URL"); v != "" {
+		p.URL = v
+	}
+	if v := os.Getenv("FILER_API_KEY"); v != "" {
+		p.APIKey = v
+	}
+	return p, nil
+}
+
+func (ps profiles) names() []string {
+	names := make([]string, 0, len(ps))
+	for name := range ps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,342 @@
+// Command filer shares files through a filer deployment from the terminal.
+//
+//	filer put file.bin             share a file, - reads stdin
+//	filer get SECRET -o out.bin    download a file
+//	filer info SECRET              show the details of a file
+//	filer rm SECRET TOKEN          delete a file with its deletion token
+//
+// The deployment and API key come from a profile of the config file,
+// $XDG_CONFIG_HOME/filer/config by default:
+//
+//	[default]
+//	url = https://filer.example.com
+//	api_key = ...
+//
+//	[ci]
+//	url = https://filer.internal
+//
+// -profile or FILER_PROFILE picks a profile, FILER_URL and FILER_API_KEY
+// override its values.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"filer/client"
+)
+
+const usage = `usage: filer [-profile name] [-url url] command [arguments]
+
+commands:
+  put [-ttl d] [-max-downloads n] [-passphrase p] [-encrypt] [-word-code] [-download-as n] [-description d] [-tags t,...] [-name n] file...
+  get [-o file] [-f] [-passphrase p] secret
+  info secret
+  rm secret token
+  profiles
+
+Passphrases may also be set in FILER_PASSPHRASE. Progress is shown on
+terminals unless -q is given.
+`
+
+// exit status of command line mistakes
+const exitUsage = 2
+
+type cli struct {
+	client *client.Client
+	quiet  bool
+	json   bool
+}
+
+func main() {
+	global := flag.NewFlagSet("filer", flag.ContinueOnError)
+	global.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	profileName := global.String("profile", os.Getenv("FILER_PROFILE"), "profile of the config file")
+	configPath := global.String("config", "", "config file, $XDG_CONFIG_HOME/filer/config by default")
+	baseURL := global.String("url", "", "root URL of the deployment, overrides the profile")
+	quiet := global.Bool("q", false, "do not show progress")
+	asJSON := global.Bool("json", false, "print answers as JSON")
+	if err := global.Parse(os.Args[1:]); err != nil {
+		os.Exit(exitUsage)
+	}
+	args := global.Args()
+	if len(args) == 0 {
+		global.Usage()
+		os.Exit(exitUsage)
+	}
+
+	profiles, err := loadProfiles(*configPath)
+	if err != nil {
+		fatal(err)
+	}
+	if args[0] == "profiles" {
+		for _, name := range profiles.names() {
+			fmt.Printf("%s\t%s\n", name, profiles[name].URL)
+		}
+		return
+	}
+	p, err := profiles.resolve(*profileName)
+	if err != nil {
+		fatal(err)
+	}
+	if *baseURL != "" {
+		p.URL = *baseURL
+	}
+	if p.URL == "" {
+		fatal(errors.New("no deployment URL, set url in the config file, FILER_URL or -url"))
+	}
+	c := client.New(p.URL)
+	c.APIKey = p.APIKey
+	app := &cli{client: c, quiet: *quiet || !isTerminal(os.Stderr), json: *asJSON}
+
+	// an interrupted transfer is abandoned rather than left running
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	commands := map[string]func(context.Context, []string) error{
+		"put":  app.put,
+		"get":  app.get,
+		"info": app.info,
+		"rm":   app.rm,
+	}
+	run, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "filer: unknown command %q\n", args[0])
+		global.Usage()
+		os.Exit(exitUsage)
+	}
+	if err := run(ctx, args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) || errors.Is(err, errUsage) {
+			os.Exit(exitUsage)
+		}
+		fatal(err)
+	}
+}
+
+var errUsage = errors.New("usage")
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "filer:", err)
+	os.Exit(1)
+}
+
+// parse the flags of a command, which requires n arguments, or at least one when n is -1
+func parseCommand(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	rest := fs.Args()
+	if n < 0 && len(rest) == 0 || n >= 0 && len(rest) != n {
+		fmt.Fprint(os.Stderr, usage)
+		return nil, errUsage
+	}
+	return rest, nil
+}
+
+func passphraseFlag(fs *flag.FlagSet) *string {
+	return fs.String("passphrase", os.Getenv("FILER_PASSPHRASE"), "passphrase of the file")
+}
+
+func (c *cli) print(v interface{}, human func()) error {
+	if c.json {
+		return json.NewEncoder(os.Stdout).Encode(v)
+	}
+	human()
+	return nil
+}
+
+func (c *cli) put(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("put", flag.ContinueOnError)
+	var opts client.UploadOptions
+	fs.StringVar(&opts.TTL, "ttl", "", "lifetime such as 30m, 24h or 7d")
+	fs.IntVar(&opts.MaxDownloads, "max-downloads", 0, "downloads before the file is deleted")
+	fs.BoolVar(&opts.Encrypt, "encrypt", false, "encrypt at rest with a key derived from the secret")
+	fs.BoolVar(&opts.WordCode, "word-code", false, "also issue a word code")
+	fs.StringVar(&opts.DownloadAs, "download-as", "", "name the file is downloaded under")
+	fs.StringVar(&opts.Description, "description", "", "description shown to recipients")
+	tags := fs.String("tags", "", "comma separated tags")
+	passphrase := passphraseFlag(fs)
+	name := fs.String("name", "", "file name of stdin")
+	paths, err := parseCommand(fs, args, -1)
+	if err != nil {
+		return err
+	}
+	opts.Passphrase = *passphrase
+	if *tags != "" {
+		opts.Tags = strings.Split(*tags, ",")
+	}
+
+	for _, path := range paths {
+		r, fileName, size, err := openUpload(path, *name)
+		if err != nil {
+			return err
+		}
+		bar := newProgress(fileName, size, c.quiet)
+		uploaded, err := c.client.Upload(ctx, fileName, bar.reader(r), &opts)
+		bar.done()
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		err = c.print(uploaded, func() {
+			fmt.Printf("%s\n  secret:       %s\n  delete token: %s\n", fileName, uploaded.Secret, uploaded.DeleteToken)
+			if uploaded.URL != "" {
+				fmt.Printf("  url:          %s\n", uploaded.URL)
+			}
+			if uploaded.Code != "" {
+				fmt.Printf("  word code:    %s\n", uploaded.Code)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the contents, name and size of a file to upload, -1 when the size is unknown
+func openUpload(path, name string) (io.ReadCloser, string, int64, error) {
+	if path == "-" {
+		if name == "" {
+			name = "stdin"
+		}
+		return os.Stdin, name, -1, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, "", 0, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, "", 0, fmt.Errorf("%s is a directory", path)
+	}
+	if name == "" {
+		name = filepath.Base(path)
+	}
+	return f, name, info.Size(), nil
+}
+
+func (c *cli) get(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	out := fs.String("o", "", "output file, - for stdout, the name of the file by default")
+	force := fs.Bool("f", false, "overwrite the output file")
+	passphrase := passphraseFlag(fs)
+	rest, err := parseCommand(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	d, err := c.client.Download(ctx, rest[0], *passphrase)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	path := *out
+	if path == "" {
+		// never let the server pick a path outside the working directory
+		path = filepath.Base(d.Name)
+		if path == "" || path == "." || path == string(filepath.Separator) {
+			path = rest[0]
+		}
+	}
+	if path != "-" {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if *force {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+		f, err := os.OpenFile(path, flags, 0644)
+		if os.IsExist(err) {
+			return fmt.Errorf("%s exists, -f overwrites it", path)
+		}
+		if err != nil {
+			return err
+		}
+		if err := c.save(f, d, path); err != nil {
+			f.Close()
+			os.Remove(path)
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if !c.quiet {
+			fmt.Fprintf(os.Stderr, "saved %s\n", path)
+		}
+		return nil
+	}
+	return c.save(os.Stdout, d, d.Name)
+}
+
+func (c *cli) save(w io.Writer, d *client.Download, name string) error {
+	bar := newProgress(name, d.Size, c.quiet)
+	_, err := io.Copy(w, bar.reader(d))
+	bar.done()
+	return err
+}
+
+func (c *cli) info(ctx context.Context, args []string) error {
+	rest, err := parseCommand(flag.NewFlagSet("info", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	info, err := c.client.Info(ctx, rest[0])
+	if err != nil {
+		return err
+	}
+	return c.print(info, func() {
+		fmt.Printf("%s\n  size:         %s\n  type:         %s\n  uploaded:     %s\n",
+			info.FileName, formatBytes(info.Size), info.ContentType, info.UploadedAt.Local().Format("2006-01-02 15:04:05"))
+		if info.ExpiresAt != nil {
+			fmt.Printf("  expires:      %s\n", info.ExpiresAt.Local().Format("2006-01-02 15:04:05"))
+		}
+		if info.RemainingDownloads != nil {
+			fmt.Printf("  downloads:    %d left\n", *info.RemainingDownloads)
+		}
+		if info.PassphraseRequired {
+			fmt.Println("  passphrase:   required")
+		}
+		if info.SHA256 != "" {
+			fmt.Printf("  sha256:       %s\n", info.SHA256)
+		}
+		for _, e := range info.Files {
+			fmt.Printf("  %s (%s)\n", e.Name, formatBytes(e.Size))
+		}
+		if info.ScanStatus != "" {
+			fmt.Printf("  scan:         %s\n", info.ScanStatus)
+		}
+	})
+}
+
+func (c *cli) rm(ctx context.Context, args []string) error {
+	rest, err := parseCommand(flag.NewFlagSet("rm", flag.ContinueOnError), args, 2)
+	if err != nil {
+		return err
+	}
+	return c.client.Delete(ctx, rest[0], rest[1])
+}
+
+// whether f is a terminal, progress is not drawn into files and pipes
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0 && !strings.EqualFold(os.Getenv("TERM"), "dumb")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	progressInterval = 100 * time.Millisecond
+	progressWidth    = 30
+)
+
+// progress bar of a transfer drawn on stderr
+type progress struct {
+	name    string
+	total   int64
+	quiet   bool
+	started time.Time
+
+	mu       sync.Mutex
+	finished bool
+	n        int64
+	drawn    time.Time
+}
+
+// a progress bar of a transfer of total bytes, -1 when unknown
+func newProgress(name string, total int64, quiet bool) *progress {
+	return &progress{name: name, total: total, quiet: quiet, started: time.Now()}
+}
+
+// r counting the bytes read into the bar
+func (p *progress) reader(r io.Reader) io.Reader {
+	if p.quiet {
+		return r
+	}
+	return &progressReader{r, p}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.p.add(int64(n))
+	return n, err
+}
+
+func (p *progress) add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.n += n
+	if now := time.Now(); now.Sub(p.drawn) >= progressInterval {
+		p.drawn = now
+		p.draw()
+	}
+}
+
+// draw the final state and end the line
+func (p *progress) done() {
+	if p.quiet {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.finished {
+		return
+	}
+	p.finished = true
+	p.draw()
+	fmt.Fprintln(os.Stderr)
+}
+
+func (p *progress) draw() {
+	elapsed := time.Since(p.started).Seconds()
+	rate := ""
+	if elapsed > 0 {
+		rate = formatBytes(int64(float64(p.n)/elapsed)) + "/s"
+	}
+	name := p.name
+	if len(name) > 24 {
+		name = name[:21] + "..."
+	}
+	if p.total <= 0 {
+		fmt.Fprintf(os.Stderr, "\r%-24s %10s  %10s ", name, formatBytes(p.n), rate)
+		return
+	}
+	ratio := float64(p.n) / float64(p.total)
+	if ratio > 1 {
+		ratio = 1
+	}
+	filled := int(ratio * progressWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < progressWidth {
+		bar += ">" + strings.Repeat(" ", progressWidth-filled-1)
+	}
+	fmt.Fprintf(os.Stderr, "\r%-24s [%s] %3.0f%% %10s / %-10s %10s ", name, bar, ratio*100, formatBytes(p.n), formatBytes(p.total), rate)
+}
+
+// n in binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
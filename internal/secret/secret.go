@@ -0,0 +1,91 @@
+// Package secret creates the secrets and tokens of shared files and hashes
+// them before they are stored.
+package secret
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Random creates a random string of length letters over a URL-safe alphabet.
+func Random(length uint32) (string, error) {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_"
+	// bytes at or above the largest multiple of len(letters) are rejected so every letter is equally likely
+	const limit = 256 - 256%len(letters)
+
+	result := make([]byte, 0, length)
+	b := make([]byte, length)
+	for uint32(len(result)) < length {
+		if _, err := rand.Read(b); err != nil {
+			return "", errors.New("unexpected error...")
+		}
+		for _, v := range b {
+			if int(v) < limit && uint32(len(result)) < length {
+				result = append(result, letters[int(v)%len(letters)])
+			}
+		}
+	}
+	return string(result), nil
+}
+
+// Hasher hashes secrets and passphrases before they are stored. Secrets are
+// keyed with SECRET_HMAC_KEY when set, so a leaked database alone is not
+// enough to brute-force them.
+type Hasher struct {
+	key []byte
+}
+
+// NewHasher returns a Hasher keyed with key, plain SHA-256 when it is empty.
+func NewHasher(key string) *Hasher {
+	h := &Hasher{}
+	if key != "" {
+		h.key = []byte(key)
+	}
+	return h
+}
+
+// Hash returns the hex hash of a secret.
+func (h *Hasher) Hash(secret string) string {
+	var m hash.Hash
+	if h.key != nil {
+		m = hmac.New(sha256.New, h.key)
+	} else {
+		m = sha256.New()
+	}
+	m.Write([]byte(secret))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// HashWordCode returns the hash of a word code. Word codes are matched
+// case-insensitively, people may type them capitalized.
+func (h *Hasher) HashWordCode(code string) string {
+	return h.Hash(strings.ToLower(strings.TrimSpace(code)))
+}
+
+// Verify compares a secret with a stored hash in constant time.
+func (h *Hasher) Verify(secret, hashed string) bool {
+	return hashed != "" && subtle.ConstantTimeCompare([]byte(h.Hash(secret)), []byte(hashed)) == 1
+}
+
+// HashPassphrase hashes a download passphrase. Passphrases are chosen by
+// people, so a slow hash is used rather than the key.
+func (h *Hasher) HashPassphrase(passphrase string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(passphrase), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+// VerifyPassphrase compares a passphrase with its stored hash.
+func (h *Hasher) VerifyPassphrase(passphrase, hashed string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(passphrase)) == nil
+}
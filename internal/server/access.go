@@ -0,0 +1,137 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"filer/internal/store"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// Uploaders may restrict the downloads of a file to networks, as CIDR ranges
+// or single addresses, and to countries, looked up in GEOIP_DATABASE.
+// Addresses outside them are answered 403 with the reason, whatever secret,
+// passphrase or download token they hold.
+const (
+	maxAllowedNetworks  = 50
+	maxAllowedCountries = 50
+)
+
+var restrictedDownloads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "filer_restricted_downloads_total",
+	Help: "Downloads refused by the network or country restrictions of their file by restriction (network, country).",
+}, []string{"restriction"})
+
+// comma separated values of the fields of r, without duplicates
+func formList(r *http.Request, fields ...string) []string {
+	var list []string
+	seen := map[string]bool{}
+	for _, field := range fields {
+		for _, value := range r.Form[field] {
+			for _, v := range strings.Split(value, ",") {
+				if v = strings.TrimSpace(v); v != "" && !seen[v] {
+					seen[v] = true
+					list = append(list, v)
+				}
+			}
+		}
+	}
+	return list
+}
+
+// read the allowed_networks and allowed_countries fields of an upload into file
+// Single addresses are stored as /32 or /128 ranges, countries upper cased.
+func parseRestrictions(r *http.Request, file *store.File, geoip *geoIPDatabase) error {
+	networks := formList(r, "allowed_networks[]", "allowed_networks")
+	if len(networks) > maxAllowedNetworks {
+		return fmt.Errorf("more than %d allowed_networks", maxAllowedNetworks)
+	}
+	for _, n := range networks {
+		if !strings.Contains(n, "/") {
+			ip := net.ParseIP(n)
+			if ip == nil {
+				return fmt.Errorf("invalid network %q", n)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			n = fmt.Sprintf("%s/%d", n, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(n)
+		if err != nil {
+			return fmt.Errorf("invalid network %q", n)
+		}
+		file.AllowedNetworks = append(file.AllowedNetworks, ipNet.String())
+	}
+
+	countries := formList(r, "allowed_countries[]", "allowed_countries")
+	if len(countries) > 0 && geoip == nil {
+		return fmt.Errorf("allowed_countries requires a GeoIP database, which is not configured")
+	}
+	if len(countries) > maxAllowedCountries {
+		return fmt.Errorf("more than %d allowed_countries", maxAllowedCountries)
+	}
+	for _, c := range countries {
+		c = strings.ToUpper(c)
+		if len(c) != 2 || strings.Trim(c, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return fmt.Errorf("invalid country %q, use ISO 3166-1 alpha-2 codes", c)
+		}
+		file.AllowedCountries = append(file.AllowedCountries, c)
+	}
+	sort.Strings(file.AllowedCountries)
+	return nil
+}
+
+// whether the client of r may download file, answering 403 when it may not
+func (s *Server) allowedFrom(w http.ResponseWriter, r *http.Request, file *store.File) bool {
+	if len(file.AllowedNetworks) == 0 && len(file.AllowedCountries) == 0 {
+		return true
+	}
+	addr := s.clientIP(r)
+	ip := net.ParseIP(addr)
+
+	if len(file.AllowedNetworks) > 0 && !inNetworks(ip, file.AllowedNetworks) {
+		restrictedDownloads.WithLabelValues("network").Inc()
+		writeError(w, r, http.StatusForbidden, fmt.Sprintf("downloads of this file are restricted to some networks, %s is not one of them", addr))
+		return false
+	}
+	if len(file.AllowedCountries) > 0 {
+		var country string
+		if ip != nil && s.geoip != nil {
+			var err error
+			if country, err = s.geoip.country(ip); err != nil {
+				s.logFor(r.Context()).Error("failed to look up the country of the client", zap.String("client", addr), zap.Error(err))
+			}
+		}
+		if !containsString(file.AllowedCountries, country) {
+			restrictedDownloads.WithLabelValues("country").Inc()
+			where := "the country of " + addr + " is unknown"
+			if country != "" {
+				where = addr + " is in " + country
+			}
+			writeError(w, r, http.StatusForbidden, fmt.Sprintf("downloads of this file are restricted to %s, %s",
+				strings.Join(file.AllowedCountries, ", "), where))
+			return false
+		}
+	}
+	return true
+}
+
+func inNetworks(ip net.IP, networks []string) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range networks {
+		if _, ipNet, err := net.ParseCIDR(n); err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"filer/internal/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// the Functions host reserves routes starting with "admin", so the admin API
+// is also served under AdminFiles, which is the route of its function
+const (
+	adminRoute          = "AdminFiles"
+	adminPath           = "/api/admin/files"
+	adminFunctionPath   = "/api/" + adminRoute
+	defaultAdminPerPage = 50
+	maxAdminPerPage     = 500
+)
+
+// check the bearer token against ADMIN_API_KEY, the admin API is disabled without it
+func (s *Server) adminAuthorized(r *http.Request) bool {
+	key := s.config.AdminAPIKey
+	auth := r.Header.Get("Authorization")
+	if key == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	// compare digests so the comparison does not leak the key length
+	want, got := sha256.Sum256([]byte(key)), sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(want[:], got[:]) == 1
+}
+
+// answer 401 to requests without the admin bearer token
+func (s *Server) withAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.adminAuthorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, r, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Admin files
+// GET lists files, filtered by older_than, newer_than, min_size, max_size, uploader and tag.
+func (s *Server) adminListFiles(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	filter := store.FileFilter{Uploader: q.Get("uploader"), Tag: strings.ToLower(strings.TrimSpace(q.Get("tag")))}
+	for _, p := range []struct {
+		param string
+		bound *time.Time
+	}{{"older_than", &filter.CreatedBefore}, {"newer_than", &filter.CreatedAfter}} {
+		if v := q.Get(p.param); v != "" {
+			d, err := parseTTL(v)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "invalid "+p.param)
+				return
+			}
+			*p.bound = time.Now().UTC().Add(-d)
+		}
+	}
+	for _, p := range []struct {
+		param string
+		bound **int64
+	}{{"min_size", &filter.MinSize}, {"max_size", &filter.MaxSize}} {
+		if v := q.Get(p.param); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				writeError(w, r, http.StatusBadRequest, "invalid "+p.param)
+				return
+			}
+			*p.bound = &n
+		}
+	}
+
+	page, perPage, err := pageParams(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	list, err := s.listFiles(r.Context(), filter, page, perPage)
+	if err != nil {
+		s.logFor(r.Context()).Error("admin: failed to list files", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to list files")
+		return
+	}
+	writeFileList(w, r, list)
+}
+
+// page and per_page query parameters
+func pageParams(r *http.Request) (int, int, error) {
+	q := r.URL.Query()
+	page, perPage := 1, defaultAdminPerPage
+	if v := q.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return 0, 0, errors.New("invalid page")
+		}
+		page = n
+	}
+	if v := q.Get("per_page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAdminPerPage {
+			return 0, 0, errors.New("invalid per_page")
+		}
+		perPage = n
+	}
+	return page, perPage, nil
+}
+
+// list a page of the files matching filter, newest first
+func (s *Server) listFiles(ctx context.Context, filter store.FileFilter, page, perPage int) (*fileList, error) {
+	files, total, err := s.store.ListFiles(ctx, filter, page, perPage)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &fileList{Files: []fileSummary{}, Page: page, PerPage: perPage, Total: total}
+	for _, file := range files {
+		list.Files = append(list.Files, fileSummary{
+			ID:           file.ID.Hex(),
+			FileName:     file.FileName,
+			Size:         file.Size,
+			ContentType:  downloadContentType(&file),
+			UploadedAt:   file.CreatedAt,
+			ExpiresAt:    file.ExpiresAt,
+			Downloads:    file.Downloads,
+			MaxDownloads: file.MaxDownloads,
+			Uploader:     file.Uploader,
+			Encrypted:    file.Encrypted || file.ClientEncrypted,
+			ScanStatus:   file.ScanStatus,
+			SHA256:       file.SHA256,
+			Files:        file.Entries,
+			Description:  file.Description,
+			Tags:         file.Tags,
+			Meta:         file.Meta,
+			DeletedAt:    file.DeletedAt,
+			Findings:     file.Findings,
+			Review:       file.Review,
+		})
+	}
+	return list, nil
+}
+
+func writeFileList(w http.ResponseWriter, r *http.Request, list *fileList) {
+	res, err := json.Marshal(list)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
+
+// find a file by its id, store.ErrNotFound also covers malformed ids
+func (s *Server) findByID(ctx context.Context, id string) (*store.File, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, store.ErrNotFound
+	}
+	return s.store.FindFileByID(ctx, oid)
+}
+
+// DELETE /api/admin/files/<id> removes a file and its blobs.
+func (s *Server) adminDeleteFile(w http.ResponseWriter, r *http.Request) {
+	id := urlParam(r, "id")
+	file, err := s.findByID(r.Context(), id)
+	if err == store.ErrNotFound {
+		writeError(w, r, http.StatusNotFound, "file not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to look up file")
+		return
+	}
+
+	if err := s.remove(r.Context(), file); err != nil {
+		s.logFor(r.Context()).Error("admin: failed to remove file", zap.String("file_id", id), zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to delete file")
+		return
+	}
+	s.logFor(r.Context()).Info("admin: removed file", zap.String("file_id", id), zap.String("filename", file.FileName))
+	s.audit(r, auditDelete, file)
+	s.emit(eventFileDeleted, file)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"filer/internal/secret"
+
+	"go.uber.org/zap"
+)
+
+func TestWithAdmin(t *testing.T) {
+	tests := []struct {
+		name          string
+		key           string
+		authorization string
+
+		status int
+	}{
+		{name: "bearer key", key: "k3y", authorization: "Bearer k3y", status: http.StatusOK},
+		{name: "bare key", key: "k3y", authorization: "k3y", status: http.StatusUnauthorized},
+		{name: "other scheme", key: "k3y", authorization: "Basic k3y", status: http.StatusUnauthorized},
+		{name: "wrong key", key: "k3y", authorization: "Bearer other", status: http.StatusUnauthorized},
+		{name: "empty bearer", key: "k3y", authorization: "Bearer ", status: http.StatusUnauthorized},
+		{name: "missing header", key: "k3y", status: http.StatusUnauthorized},
+		{name: "admin API disabled", authorization: "Bearer ", status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(t, "-admin-api-key="+tt.key)
+			secrets := secret.NewHasher(config.SecretHMACKey)
+			s, err := New(config, zap.NewNop(), newMemStorage(), newMemStore(secrets), secrets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := s.withAdmin(func(w http.ResponseWriter, r *http.Request) {})
+
+			r := httptest.NewRequest(http.MethodGet, adminPath, nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+type apiKeyIDKey struct{}
+
+// key sent with the request, as a bearer token or in X-Api-Key
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// short identifier of a key, recorded as the uploader instead of the key itself
+func apiKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key:" + hex.EncodeToString(sum[:4])
+}
+
+// id of the API key the request was authorized with, empty for anonymous uploads
+func requestAPIKeyID(ctx context.Context) string {
+	id, _ := ctx.Value(apiKeyIDKey{}).(string)
+	return id
+}
+
+// require one of the upload API keys when UPLOAD_API_KEYS is set, signed-in users need none
+// OPTIONS requests stay anonymous so clients can discover the tus capabilities
+func (s *Server) withUploadAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	keys := s.config.UploadAPIKeys
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(keys) == 0 || r.Method == http.MethodOptions || requestUser(r.Context()) != "" {
+			next(w, r)
+			return
+		}
+		got := sha256.Sum256([]byte(requestAPIKey(r)))
+		for _, key := range keys {
+			want := sha256.Sum256([]byte(key))
+			if subtle.ConstantTimeCompare(want[:], got[:]) == 1 {
+				next(w, r.WithContext(context.WithValue(r.Context(), apiKeyIDKey{}, apiKeyID(key))))
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, r, http.StatusUnauthorized, "missing or invalid API key")
+	}
+}
+
+// uploader recorded with a file, the user, the API key id or the client address
+func (s *Server) uploader(r *http.Request) string {
+	if sub := requestUser(r.Context()); sub != "" {
+		return "user:" + sub
+	}
+	if id := requestAPIKeyID(r.Context()); id != "" {
+		return id
+	}
+	return s.clientIP(r)
+}
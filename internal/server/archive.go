@@ -0,0 +1,281 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"filer/internal/storage"
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// archive=preserve expands zip and tar uploads into a tree of files
+	archivePreserve = "preserve"
+
+	maxArchiveEntries = 10000
+	// archives expanding beyond this ratio are rejected as zip bombs
+	maxArchiveRatio = 100
+)
+
+var (
+	errNotArchive        = errors.New("archive must be a zip, tar or tar.gz file")
+	errArchiveTooLarge   = errors.New("archive expands beyond the upload limit")
+	errTooManyEntries    = errors.New("archive has too many files")
+	errArchiveSizeChange = errors.New("archive entry does not match its declared size")
+	errEmptyArchive      = errors.New("archive contains no files")
+)
+
+// an uploaded archive, spooled to a temporary file and scanned once before
+// it is expanded
+type uploadedArchive struct {
+	file *os.File
+	size int64
+	// number and total uncompressed size of the regular files
+	entries  int
+	expanded int64
+}
+
+// spool the archive read from r and scan it, enforcing the entry and size limits
+// zip archives are read from their end, so they cannot be expanded as they arrive.
+func (s *Server) openArchive(r io.Reader) (*uploadedArchive, error) {
+	f, err := ioutil.TempFile("", "filer-archive-")
+	if err != nil {
+		return nil, err
+	}
+	a := &uploadedArchive{file: f}
+	if a.size, err = io.Copy(f, r); err != nil {
+		a.Close()
+		return nil, err
+	}
+	err = a.walk(func(name string, size int64, r io.Reader) error {
+		a.entries++
+		a.expanded += size
+		if a.entries > maxArchiveEntries {
+			return errTooManyEntries
+		}
+		if limit := s.config.maxUploadBytes(uploadRoute); limit > 0 && a.expanded > limit {
+			return errArchiveTooLarge
+		}
+		if a.expanded > maxArchiveRatio*a.size {
+			return errArchiveTooLarge
+		}
+		return nil
+	})
+	if err == nil && a.entries == 0 {
+		err = errEmptyArchive
+	}
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *uploadedArchive) Close() error {
+	err := a.file.Close()
+	os.Remove(a.file.Name())
+	return err
+}
+
+// call fn with the path, size and contents of every regular file of the archive
+// symlinks and other special files are skipped
+func (a *uploadedArchive) walk(fn func(name string, size int64, r io.Reader) error) error {
+	head := make([]byte, 512)
+	n, err := a.file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	head = head[:n]
+	if _, err := a.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		zr, err := zip.NewReader(a.file, a.size)
+		if err != nil {
+			return errNotArchive
+		}
+		for _, zf := range zr.File {
+			name := archivePath(zf.Name)
+			if !zf.Mode().IsRegular() || name == "" {
+				continue
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(name, int64(zf.UncompressedSize64), rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(a.file)
+		if err != nil {
+			return errNotArchive
+		}
+		defer gz.Close()
+		return walkTar(tar.NewReader(gz), fn)
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return walkTar(tar.NewReader(a.file), fn)
+	default:
+		return errNotArchive
+	}
+}
+
+func walkTar(tr *tar.Reader, fn func(name string, size int64, r io.Reader) error) error {
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errNotArchive
+		}
+		name := archivePath(h.Name)
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA || name == "" {
+			continue
+		}
+		if err := fn(name, h.Size, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// relative path of an archive entry, which cannot escape the tree
+// empty for entries that name no file
+func archivePath(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ReplaceAll(name, "\\", "/"))
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// download name of an expanded archive, which is served back as a zip
+func treeBundleName(name string) string {
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar", ".zip"} {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			name = name[:len(name)-len(ext)]
+			break
+		}
+	}
+	return name + ".zip"
+}
+
+// store every file of an archive as an entry of file, keeping their paths
+// the stored parts are released again when one of them fails
+func (s *Server) storeArchive(ctx context.Context, file *store.File, archive *uploadedArchive, secret string, progress *uploadProgress) ([]*storedPart, error) {
+	var parts []*storedPart
+	err := archive.walk(func(name string, size int64, r io.Reader) error {
+		part, n, err := s.uploadPart(ctx, file.Container, io.LimitReader(r, size+1), name, "", secret, file.Encrypted, progress)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, part)
+		if n != size {
+			return errArchiveSizeChange
+		}
+		file.Size += size
+		file.Entries = append(file.Entries, store.Entry{Name: name, Blob: part.blob, SHA256: part.sums.sha256, MD5: part.sums.md5Base64(), Size: size, ContentType: part.contentType, Compressed: part.compressed})
+		addFindings(file, part.findings)
+		return nil
+	})
+	if err != nil {
+		s.discardParts(file.Container, parts)
+		return nil, err
+	}
+	file.Tree = true
+	return parts, nil
+}
+
+// write the status of a rejected archive
+func (s *Server) writeArchiveError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errArchiveTooLarge, errTooManyEntries:
+		writeError(w, r, http.StatusRequestEntityTooLarge, err.Error())
+	case errNotArchive, errArchiveSizeChange, errEmptyArchive:
+		writeError(w, r, http.StatusBadRequest, err.Error())
+	default:
+		s.logFor(r.Context()).Error("failed to read archive", zap.Error(err))
+		writeError(w, r, http.StatusBadRequest, "failed to read archive")
+	}
+}
+
+// stream a single file of a multi-file share
+func (s *Server) writeEntry(w http.ResponseWriter, r *http.Request, file *store.File, e *store.Entry, secret string, inline bool) {
+	blob, err := s.download(r.Context(), file.Container, e.BlobName())
+	if err == storage.ErrBlobNotFound {
+		writeError(w, r, http.StatusNotFound, "file not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, "failed to read file")
+		return
+	}
+	defer blob.Close()
+
+	var body io.Reader = blob
+	size := blob.Size
+	if file.Encrypted {
+		body = newDecryptReader(blob, secret)
+		size = plaintextSize(blob.Size)
+	}
+	if e.Compressed {
+		if body, err = newDecompressReader(body); err != nil {
+			s.logFor(r.Context()).Error("failed to decompress entry", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+			writeError(w, r, http.StatusBadGateway, "failed to read file")
+			return
+		}
+		size = e.Size
+	}
+
+	contentType := e.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	disposition := attachmentDisposition(e.Name)
+	if inline && inlineSafe(contentType) {
+		disposition = inlineDisposition(e.Name)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if v, ok := entryValidators(file, e); ok {
+		v.write(w.Header())
+	} else if e.SHA256 != "" {
+		w.Header().Set("ETag", strconv.Quote(e.SHA256))
+	}
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	n, err := io.Copy(w, body)
+	downloadedBytes.Add(float64(n))
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to stream entry", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+		return
+	}
+	downloads.WithLabelValues("entry").Inc()
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+const (
+	adminAuditRoute = "AdminAudit"
+	adminAuditPath  = "/api/admin/audit"
+	adminAuditFn    = "/api/" + adminAuditRoute
+
+	// 90 days
+	defaultAuditRetention = 90 * 24 * time.Hour
+	maxAuditUserAgent     = 256
+	auditTimeout          = 5 * time.Second
+)
+
+// actions of the audit log
+const (
+	auditUpload        = "upload"
+	auditDownload      = "download"
+	auditDelete        = "delete"
+	auditRestore       = "restore"
+	auditRotate        = "rotate"
+	auditApprove       = "approve"
+	auditFailedAttempt = "failed_attempt"
+)
+
+// cut a user agent to maxAuditUserAgent bytes, keeping it valid UTF-8
+func truncateUserAgent(ua string) string {
+	if len(ua) <= maxAuditUserAgent {
+		return ua
+	}
+	return strings.ToValidUTF8(ua[:maxAuditUserAgent], "")
+}
+
+// record action on file in the audit log
+// not bound to the request, a download is recorded after the client is gone
+func (s *Server) audit(r *http.Request, action string, file *store.File) {
+	s.auditEvent(r, &store.AuditEvent{Action: action}, file)
+}
+
+// record a request for an unknown secret or with a wrong passphrase or token
+func (s *Server) auditFailure(r *http.Request, status int) {
+	s.auditEvent(r, &store.AuditEvent{Action: auditFailedAttempt, Path: loggedPath(r), Status: status}, nil)
+}
+
+func (s *Server) auditEvent(r *http.Request, e *store.AuditEvent, file *store.File) {
+	if !s.config.AuditLog {
+		return
+	}
+	e.Time = time.Now().UTC()
+	e.Principal = s.uploader(r)
+	e.Client = s.clientIP(r)
+	e.UserAgent = truncateUserAgent(r.UserAgent())
+	e.RequestID = requestID(r.Context())
+	if file != nil {
+		e.FileID = file.ID.Hex()
+		e.FileName = file.FileName
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+	defer cancel()
+	if err := s.store.RecordAudit(ctx, e); err != nil {
+		s.logFor(r.Context()).Error("failed to record audit event", zap.String("action", e.Action), zap.String("file_id", e.FileID), zap.Error(err))
+	}
+}
+
+// drop audit events older than AUDIT_RETENTION, run by the janitor
+func (s *Server) pruneAudit(ctx context.Context) {
+	if !s.config.AuditLog || s.config.AuditRetention <= 0 {
+		return
+	}
+	n, err := s.store.PruneAudit(ctx, time.Now().UTC().Add(-s.config.AuditRetention))
+	if err != nil {
+		s.logger.Error("janitor: failed to prune audit log", zap.Error(err))
+		return
+	}
+	if n > 0 {
+		s.logger.Info("janitor: pruned audit log", zap.Int64("count", n))
+	}
+}
+
+// Admin audit
+// GET lists the audit log, newest first, filtered by action, file_id,
+// client, principal, older_than and newer_than.
+func (s *Server) adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.config.AuditLog {
+		writeError(w, r, http.StatusNotFound, "audit log is disabled")
+		return
+	}
+
+	q := r.URL.Query()
+	filter := store.AuditFilter{Action: q.Get("action"), FileID: q.Get("file_id"), Client: q.Get("client"), Principal: q.Get("principal")}
+	for _, p := range []struct {
+		param string
+		bound *time.Time
+	}{{"older_than", &filter.Before}, {"newer_than", &filter.After}} {
+		if v := q.Get(p.param); v != "" {
+			d, err := parseTTL(v)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "invalid "+p.param)
+				return
+			}
+			*p.bound = time.Now().UTC().Add(-d)
+		}
+	}
+	page, perPage, err := pageParams(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	events, total, err := s.store.ListAudit(r.Context(), filter, page, perPage)
+	if err != nil {
+		s.logFor(r.Context()).Error("admin: failed to list audit events", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to list audit events")
+		return
+	}
+	res, err := json.Marshal(auditList{Events: events, Page: page, PerPage: perPage, Total: total})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
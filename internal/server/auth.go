@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+type userKey struct{}
+
+// create the verifier of tokens issued by OIDC_ISSUER for OIDC_AUDIENCE
+// returns nil when login is not configured
+func newOIDCVerifier(ctx context.Context, config *Config) (*oidc.IDTokenVerifier, error) {
+	if config.OIDCIssuer == "" {
+		return nil, nil
+	}
+	provider, err := oidc.NewProvider(ctx, config.OIDCIssuer)
+	if err != nil {
+		return nil, err
+	}
+	return provider.Verifier(&oidc.Config{ClientID: config.OIDCAudience}), nil
+}
+
+// subject of the user the request was authenticated as, empty for anonymous requests
+func requestUser(ctx context.Context) string {
+	sub, _ := ctx.Value(userKey{}).(string)
+	return sub
+}
+
+// authenticate requests carrying a bearer token issued by the OIDC provider
+// other requests pass through anonymously, the token may also be an API key
+func (s *Server) withUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if s.verifier == nil || !strings.HasPrefix(auth, "Bearer ") {
+			next(w, r)
+			return
+		}
+		token, err := s.verifier.Verify(r.Context(), strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			next(w, r)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), userKey{}, token.Subject)))
+	}
+}
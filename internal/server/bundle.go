@@ -0,0 +1,56 @@
+package server
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+
+	"filer/internal/store"
+)
+
+// stream the entries of a multi-file share as a zip archive
+// the archive is built on the fly, so it never touches memory or disk as a whole
+// entry names are sanitized so archives cannot write outside the extraction directory,
+// expanded archives keep their relative paths
+func (s *Server) writeBundle(ctx context.Context, w io.Writer, file *store.File, secret string) error {
+	zw := zip.NewWriter(w)
+	for _, e := range file.Entries {
+		if err := s.writeBundleEntry(ctx, zw, file, e, secret); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func (s *Server) writeBundleEntry(ctx context.Context, zw *zip.Writer, file *store.File, e store.Entry, secret string) error {
+	blob, err := s.download(ctx, file.Container, e.BlobName())
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	var body io.Reader = blob
+	if file.Encrypted {
+		body = newDecryptReader(blob, secret)
+	}
+	if e.Compressed {
+		if body, err = newDecompressReader(body); err != nil {
+			return err
+		}
+	}
+
+	name := sanitizeFileName(e.Name)
+	if file.Tree {
+		name = archivePath(e.Name)
+	}
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: file.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, body)
+	return err
+}
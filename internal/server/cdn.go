@@ -0,0 +1,16 @@
+package server
+
+import "net/url"
+
+// the signed storage URL of a blob on CDN_BASE_URL instead of the storage
+// account, so recipients download from the nearest edge
+// The SAS stays in the query string and is checked by the storage account
+// when the CDN goes to the origin, which is why the endpoint must keep query
+// strings in its cache key: otherwise a cached blob would be served without one.
+func (s *Server) cdnURL(signed string) (string, error) {
+	u, err := url.Parse(signed)
+	if err != nil {
+		return "", err
+	}
+	return s.config.CDNBaseURL + u.EscapedPath() + "?" + u.RawQuery, nil
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+)
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// checksums of the contents of a file
+type checksums struct {
+	// hex encoded SHA-256
+	sha256 string
+	// MD5 as sent in Content-MD5
+	md5 []byte
+}
+
+// base64 MD5, the encoding used by Content-MD5
+func (c checksums) md5Base64() string {
+	if c.md5 == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(c.md5)
+}
+
+// checksums of everything read from r
+func computeChecksums(r io.Reader) (checksums, error) {
+	s, m := sha256.New(), md5.New()
+	if _, err := io.Copy(io.MultiWriter(s, m), r); err != nil {
+		return checksums{}, err
+	}
+	return checksums{sha256: hex.EncodeToString(s.Sum(nil)), md5: m.Sum(nil)}, nil
+}
+
+// verifyReader hashes what is read and fails instead of returning the last
+// bytes when the SHA-256 does not match, so a corrupt download is cut short
+type verifyReader struct {
+	r    *bufio.Reader
+	h    hash.Hash
+	want string
+}
+
+func newVerifyReader(r io.Reader, sha256Hex string) io.Reader {
+	return &verifyReader{r: bufio.NewReader(r), h: sha256.New(), want: sha256Hex}
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == nil {
+		if _, perr := v.r.Peek(1); perr == io.EOF {
+			err = io.EOF
+		}
+	}
+	if err == io.EOF && hex.EncodeToString(v.h.Sum(nil)) != v.want {
+		return 0, errChecksumMismatch
+	}
+	// report EOF on the next call, once the peeked end is reached
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,384 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"filer/internal/secret"
+	"filer/internal/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// A collection shares several files of a signed-in user under a single
+// secret, like a folder. Its recipients see every file still shared with a
+// link of its own, so passphrases and download limits apply as if the files
+// had been shared one by one. Files are stored under hashed secrets, so a
+// collection keeps the secrets of its files sealed with its own secret.
+const (
+	collectionsRoute = "Collections"
+	collectionsPath  = v1Path + "/collections"
+	// collections are listed at /c/<secret>, next to the share links
+	collectionPageRoute = "c"
+	collectionPagePath  = "/api/" + collectionPageRoute
+	// most files a collection holds
+	maxCollectionFiles = 1000
+	// prefix of the keys the secrets of the files are sealed with
+	collectionScope = "collection\x00"
+)
+
+var errCollectionNotFound = errors.New("collection not found")
+
+var collectionTemplate = template.Must(template.New("collection").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{if .Found}}{{.Name}}{{else}}Collection not found{{end}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 40rem; margin: 4rem auto; padding: 0 1rem; color: #222; }
+ul { list-style: none; padding: 0; }
+li { padding: .5rem 0; border-bottom: 1px solid #eee; }
+.size { color: #666; }
+</style>
+</head>
+<body>
+{{if .Found}}
+<h1>{{.Name}}</h1>
+{{if .Files}}
+<ul>
+{{range .Files}}<li><a href="{{.URL}}">{{.FileName}}</a> <span class="size">{{.Size}}{{if .PassphraseRequired}} &middot; passphrase required{{end}}</span></li>
+{{end}}</ul>
+{{else}}
+<p>No files are shared in this collection anymore.</p>
+{{end}}
+{{else}}
+<h1>Collection not found</h1>
+<p>The link is wrong or the collection was deleted.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// values shown on the listing page of a collection
+type collectionPage struct {
+	Found bool
+	Name  string
+	Files []collectionPageFile
+}
+
+type collectionPageFile struct {
+	FileName           string
+	Size               string
+	PassphraseRequired bool
+	URL                string
+}
+
+// read the JSON or form body of r into v, setting the fields of a form with set
+func readCollectionForm(r *http.Request, v interface{}, set func()) error {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxClientMetadataBytes)).Decode(v); err != nil {
+			return errors.New("invalid JSON body")
+		}
+		return nil
+	}
+	set()
+	return nil
+}
+
+// signed-in user of r, answering 401 when there is none
+func loginRequired(w http.ResponseWriter, r *http.Request) string {
+	owner := requestUser(r.Context())
+	if owner == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, r, http.StatusUnauthorized, "login required")
+	}
+	return owner
+}
+
+// the collection of the secret in the path, nil after answering when it is missing
+func (s *Server) findCollection(w http.ResponseWriter, r *http.Request) *store.Collection {
+	collection, err := s.store.FindCollection(r.Context(), urlParam(r, "secret"))
+	if err == store.ErrNotFound {
+		failedGuess(r)
+		writeError(w, r, http.StatusNotFound, errCollectionNotFound.Error())
+		return nil
+	}
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to look up collection", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to look up collection")
+		return nil
+	}
+	return collection
+}
+
+// the collection of the secret in the path when it belongs to owner,
+// collections of other users are reported as missing
+func (s *Server) ownCollection(w http.ResponseWriter, r *http.Request, owner string) *store.Collection {
+	collection := s.findCollection(w, r)
+	if collection != nil && collection.Owner != owner {
+		writeError(w, r, http.StatusNotFound, errCollectionNotFound.Error())
+		return nil
+	}
+	return collection
+}
+
+// Collections
+// GET lists the collections of the signed-in user, POST with name creates one.
+func (s *Server) collectionsHandler(w http.ResponseWriter, r *http.Request) {
+	owner := loginRequired(w, r)
+	if owner == "" {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		collections, err := s.store.ListCollections(r.Context(), owner)
+		if err != nil {
+			s.logFor(r.Context()).Error("failed to list collections", zap.String("owner", owner), zap.Error(err))
+			writeError(w, r, http.StatusInternalServerError, "failed to list collections")
+			return
+		}
+		list := collectionList{Collections: make([]collectionSummary, len(collections))}
+		for i := range collections {
+			list.Collections[i] = newCollectionSummary(&collections[i])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	var form collectionForm
+	if err := readCollectionForm(r, &form, func() { form.Name = r.FormValue("name") }); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	form.Name = strings.TrimSpace(form.Name)
+	if form.Name == "" || len(form.Name) > 200 {
+		writeError(w, r, http.StatusBadRequest, "name must be 1 to 200 characters")
+		return
+	}
+
+	collectionSecret, err := secret.Random(32)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to generate secret")
+		return
+	}
+	collection := store.Collection{
+		SecretHash: s.secrets.Hash(collectionSecret),
+		Owner:      owner,
+		Name:       form.Name,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if err := s.store.CreateCollection(r.Context(), &collection); err != nil {
+		s.logFor(r.Context()).Error("failed to create collection", zap.String("owner", owner), zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to create collection")
+		return
+	}
+	summary := newCollectionSummary(&collection)
+	summary.Secret = collectionSecret
+	summary.URL = s.requestPageURL(r, collectionPageRoute, collectionSecret)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(summary)
+}
+
+func newCollectionSummary(c *store.Collection) collectionSummary {
+	return collectionSummary{ID: c.ID.Hex(), Name: c.Name, CreatedAt: c.CreatedAt, Files: len(c.Items)}
+}
+
+// Collection
+// GET /api/v1/collections/<secret> lists the files of a collection to anyone
+// holding its secret, DELETE removes it for its owner.
+func (s *Server) collectionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		owner := loginRequired(w, r)
+		if owner == "" {
+			return
+		}
+		collection := s.ownCollection(w, r, owner)
+		if collection == nil {
+			return
+		}
+		if _, err := s.store.DeleteCollection(r.Context(), collection.ID); err != nil {
+			s.logFor(r.Context()).Error("failed to delete collection", zap.String("collection_id", collection.ID.Hex()), zap.Error(err))
+			writeError(w, r, http.StatusInternalServerError, "failed to delete collection")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	collection := s.findCollection(w, r)
+	if collection == nil {
+		return
+	}
+	files, err := s.collectionFiles(r, collection, urlParam(r, "secret"))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to list collection")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(collectionListing{Name: collection.Name, CreatedAt: collection.CreatedAt, Files: files})
+}
+
+// the files of collection still shared, in the order they were added
+func (s *Server) collectionFiles(r *http.Request, collection *store.Collection, collectionSecret string) ([]collectionFile, error) {
+	files := []collectionFile{}
+	for _, item := range collection.Items {
+		fileSecret, err := openValue(collectionScope+collectionSecret, item.Secret)
+		if err != nil {
+			s.logFor(r.Context()).Error("failed to open the secret of a collection file", zap.String("collection_id", collection.ID.Hex()),
+				zap.String("file_id", item.FileID.Hex()), zap.Error(err))
+			continue
+		}
+		file, err := s.find(r.Context(), string(fileSecret))
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			s.logFor(r.Context()).Error("failed to look up collection file", zap.String("file_id", item.FileID.Hex()), zap.Error(err))
+			return nil, err
+		}
+		files = append(files, collectionFile{
+			ID:                 file.ID.Hex(),
+			FileName:           file.FileName,
+			Size:               file.Size,
+			ContentType:        downloadContentType(file),
+			ExpiresAt:          file.ExpiresAt,
+			PassphraseRequired: file.PassphraseHash != "",
+			Secret:             string(fileSecret),
+			URL:                s.requestShareURL(r, string(fileSecret)),
+		})
+	}
+	return files, nil
+}
+
+// Collection files
+// POST /api/v1/collections/<secret>/files with the secret of a file of the
+// signed-in user adds it, DELETE /api/v1/collections/<secret>/files/<id> takes it out.
+func (s *Server) collectionFilesHandler(w http.ResponseWriter, r *http.Request) {
+	owner := loginRequired(w, r)
+	if owner == "" {
+		return
+	}
+	collection := s.ownCollection(w, r, owner)
+	if collection == nil {
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		fileID, err := primitive.ObjectIDFromHex(urlParam(r, "id"))
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, "file not found")
+			return
+		}
+		removed, err := s.store.RemoveFromCollection(r.Context(), collection.ID, fileID)
+		if err != nil {
+			s.logFor(r.Context()).Error("failed to remove file from collection", zap.String("collection_id", collection.ID.Hex()), zap.Error(err))
+			writeError(w, r, http.StatusInternalServerError, "failed to remove file from collection")
+			return
+		}
+		if !removed {
+			writeError(w, r, http.StatusNotFound, "file not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var form collectionFileForm
+	if err := readCollectionForm(r, &form, func() { form.Secret = r.FormValue("secret") }); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if form.Secret == "" {
+		writeError(w, r, http.StatusBadRequest, "secret is required")
+		return
+	}
+	// files of other users are reported as missing
+	file, err := s.find(r.Context(), form.Secret)
+	if err == store.ErrNotFound {
+		failedGuess(r)
+	}
+	if err == nil && file.Owner != owner {
+		err = store.ErrNotFound
+	}
+	if err == store.ErrNotFound {
+		writeError(w, r, http.StatusNotFound, "file not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to look up file")
+		return
+	}
+	if len(collection.Items) >= maxCollectionFiles {
+		writeError(w, r, http.StatusConflict, "the collection is full")
+		return
+	}
+
+	sealed, err := sealValue(collectionScope+urlParam(r, "secret"), []byte(form.Secret))
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to seal the secret of a collection file", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to add file to collection")
+		return
+	}
+	item := store.CollectionItem{FileID: file.ID, Secret: sealed, AddedAt: time.Now().UTC()}
+	// adding a file twice leaves it where it was
+	if _, err := s.store.AddToCollection(r.Context(), collection.ID, item); err != nil {
+		s.logFor(r.Context()).Error("failed to add file to collection", zap.String("collection_id", collection.ID.Hex()), zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to add file to collection")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Collection page
+// GET /c/<secret> lists the files of a collection with links to their share pages.
+func (s *Server) collectionPageHandler(w http.ResponseWriter, r *http.Request) {
+	collectionSecret := urlParam(r, "secret")
+	collection, err := s.store.FindCollection(r.Context(), collectionSecret)
+	if err == store.ErrNotFound {
+		failedGuess(r)
+		s.writeCollectionPage(w, http.StatusNotFound, collectionPage{})
+		return
+	}
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to look up collection", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to look up collection")
+		return
+	}
+	files, err := s.collectionFiles(r, collection, collectionSecret)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to list collection")
+		return
+	}
+
+	page := collectionPage{Found: true, Name: collection.Name}
+	for _, f := range files {
+		page.Files = append(page.Files, collectionPageFile{
+			FileName:           f.FileName,
+			Size:               humanSize(f.Size),
+			PassphraseRequired: f.PassphraseRequired,
+			URL:                f.URL,
+		})
+	}
+	s.writeCollectionPage(w, http.StatusOK, page)
+}
+
+func (s *Server) writeCollectionPage(w http.ResponseWriter, code int, page collectionPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := collectionTemplate.Execute(w, page); err != nil {
+		s.logger.Error("failed to render collection page", zap.Error(err))
+	}
+}
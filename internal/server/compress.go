@@ -0,0 +1,218 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// smaller bodies gain little and may even grow
+	minCompressBytes = 1024
+
+	gzipContentType = "application/gzip"
+	// blobs compressed at rest are not shared with uncompressed copies of the same contents
+	compressedBlobSuffix = ".gz"
+)
+
+// types that are not compressed already, besides text/* and the +json and +xml suffixes
+var compressibleTypes = map[string]bool{
+	"application/json":       true,
+	"application/x-ndjson":   true,
+	"application/xml":        true,
+	"application/javascript": true,
+	"application/yaml":       true,
+	"application/x-yaml":     true,
+	"application/toml":       true,
+	"application/sql":        true,
+	"application/x-sh":       true,
+	"application/rtf":        true,
+	"application/postscript": true,
+	"application/wasm":       true,
+	"image/svg+xml":          true,
+	"image/bmp":              true,
+	"font/ttf":               true,
+	"font/otf":               true,
+}
+
+// whether files of contentType are worth compressing
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType] ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// content coding of a response to r, gzip is preferred over deflate
+// empty when the client accepts neither
+func negotiateEncoding(r *http.Request) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, q := part, 1.0
+		if i := strings.Index(part, ";"); i >= 0 {
+			coding = part[:i]
+			if v := strings.TrimSpace(part[i+1:]); strings.HasPrefix(v, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(v[2:], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(coding))] = q > 0
+	}
+	for _, coding := range []string{"gzip", "deflate"} {
+		if ok, listed := accepted[coding]; ok || !listed && accepted["*"] {
+			return coding
+		}
+	}
+	return ""
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	zlibWriters = sync.Pool{New: func() interface{} { return zlib.NewWriter(nil) }}
+)
+
+// encoder of a response body, returned to its pool once closed
+type bodyEncoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+func newBodyEncoder(encoding string, w io.Writer) bodyEncoder {
+	pool := &gzipWriters
+	if encoding == "deflate" {
+		pool = &zlibWriters
+	}
+	enc := pool.Get().(bodyEncoder)
+	enc.Reset(w)
+	return enc
+}
+
+func releaseBodyEncoder(encoding string, enc bodyEncoder) {
+	enc.Reset(nil)
+	if encoding == "deflate" {
+		zlibWriters.Put(enc)
+	} else {
+		gzipWriters.Put(enc)
+	}
+}
+
+// compressWriter decides once the headers are written whether the body is compressed
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	enc      bodyEncoder
+	wrote    bool
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.wrote {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	c.wrote = true
+	h := c.Header()
+	if !compressible(h.Get("Content-Type")) {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	// partial and already encoded bodies, for example blobs compressed at rest, are sent as they are
+	small := false
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && n < minCompressBytes {
+		small = true
+	}
+	if c.encoding != "" && code == http.StatusOK && !small && h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" {
+		h.Set("Content-Encoding", c.encoding)
+		// length and digest describe the identity body, ranges would refer to the compressed one
+		h.Del("Content-Length")
+		h.Del("Content-MD5")
+		h.Del("Accept-Ranges")
+		if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			h.Set("ETag", "W/"+etag)
+		}
+		c.enc = newBodyEncoder(c.encoding, c.ResponseWriter)
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.wrote {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.enc != nil {
+		return c.enc.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// keep streaming responses working through the encoder
+func (c *compressWriter) Flush() {
+	if c.enc != nil {
+		c.enc.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *compressWriter) close() error {
+	if c.enc == nil {
+		return nil
+	}
+	err := c.enc.Close()
+	releaseBodyEncoder(c.encoding, c.enc)
+	c.enc = nil
+	return err
+}
+
+// gzip or deflate responses of compressible types for clients accepting it,
+// which cuts the egress of text-heavy files. Disabled by COMPRESS_DOWNLOADS=false.
+func (s *Server) withCompression(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.config.CompressDownloads {
+			next(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: negotiateEncoding(r)}
+		defer cw.close()
+		next(cw, r)
+	}
+}
+
+// whether an upload of size bytes of contentType is stored gzip compressed
+func (s *Server) compressAtRest(contentType string, size int64) bool {
+	return s.config.CompressAtRest && size >= minCompressBytes && compressible(contentType)
+}
+
+// gzip the contents read from r while they are read
+// Close stops the compression when the reader is abandoned early.
+func newCompressReader(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(pw)
+		_, err := io.Copy(gz, r)
+		if err == nil {
+			err = gz.Close()
+		}
+		gz.Reset(nil)
+		gzipWriters.Put(gz)
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// contents of a blob compressed at rest
+func newDecompressReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
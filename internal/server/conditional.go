@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"filer/internal/store"
+)
+
+// validators of a download, which conditional requests are compared with
+// Uploaded contents never change, so the upload time is their last modification.
+type validators struct {
+	// quoted SHA-256 of the contents, empty when it is not known
+	etag     string
+	modified time.Time
+}
+
+// validators of the whole of a plain file
+// ok is false when copies must not be kept: one-time and passphrase
+// protected files, and the zips generated for bundles.
+func fileValidators(file *store.File) (v validators, ok bool) {
+	if file.MaxDownloads > 0 || file.PassphraseHash != "" || len(file.Entries) > 0 {
+		return validators{}, false
+	}
+	return validators{etag: quotedDigest(file.SHA256), modified: file.CreatedAt}, true
+}
+
+// validators of one file of a multi-file share
+func entryValidators(file *store.File, e *store.Entry) (v validators, ok bool) {
+	if file.MaxDownloads > 0 || file.PassphraseHash != "" {
+		return validators{}, false
+	}
+	return validators{etag: quotedDigest(e.SHA256), modified: file.CreatedAt}, true
+}
+
+func quotedDigest(sha256 string) string {
+	if sha256 == "" {
+		return ""
+	}
+	return strconv.Quote(sha256)
+}
+
+// let clients and caches keep the download as long as they check back before
+// each use, the link may be deleted or expire at any time
+func (v validators) write(h http.Header) {
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Last-Modified", v.modified.UTC().Format(http.TimeFormat))
+	if v.etag != "" {
+		h.Set("ETag", v.etag)
+	}
+}
+
+// whether the copy of the client is current, by If-None-Match or, without
+// it, If-Modified-Since
+// Entity tags are compared weakly, compressed responses carry weak ones.
+func (v validators) notModified(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		if v.etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == v.etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !v.modified.Truncate(time.Second).After(since)
+}
+
+// whether a Range request resumes the current contents, a client holding a
+// stale copy named by If-Range gets the whole file instead
+func (v validators) rangeCurrent(r *http.Request) bool {
+	header := r.Header.Get("If-Range")
+	if header == "" {
+		return true
+	}
+	if strings.HasPrefix(header, `"`) {
+		return v.etag != "" && header == v.etag
+	}
+	at, err := http.ParseTime(header)
+	return err == nil && v.modified.Truncate(time.Second).Equal(at)
+}
+
+// answer 304 Not Modified with the validators of the download
+func writeNotModified(w http.ResponseWriter, v validators) {
+	v.write(w.Header())
+	w.WriteHeader(http.StatusNotModified)
+	downloads.WithLabelValues("not_modified").Inc()
+}
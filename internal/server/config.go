@@ -0,0 +1,914 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"filer/internal/secret"
+	"filer/internal/storage"
+	"filer/internal/store"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/joho/godotenv"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Config is the configuration of the server, loaded once at startup.
+// Flags override environment variables.
+type Config struct {
+	ListenAddr string
+
+	MetadataBackend string
+	// SQLite file or PostgreSQL connection URL of the sql backends
+	MetadataDSN string
+
+	MongoDBConnectionString string
+	MongoDBDatabase         string
+	MongoDBCollection       string
+	MongoDBMaxPoolSize      uint64
+	MongoDBTimeout          time.Duration
+	MigrateSecrets          bool
+
+	// Redis caching secret lookups, disabled when empty
+	RedisURL string
+	CacheTTL time.Duration
+
+	StorageBackend        string
+	LocalStorageDir       string
+	AzureStorageAccount   string
+	AzureStorageAccessKey string
+	// blob service URL, e.g. of the Azurite emulator, derived from the account if empty
+	AzureStorageEndpoint string
+	AzureAuthMode        string
+	// client id of a user-assigned managed identity
+	AzureClientID         string
+	AzureStorageContainer string
+	// containers of the tenants by uploader
+	TenantContainers map[string]string
+	// backend of the same kind in another region, holding replicas of the
+	// blobs. Without an account or directory there is none.
+	SecondaryStorageAccount   string
+	SecondaryStorageAccessKey string
+	SecondaryStorageEndpoint  string
+	SecondaryLocalStorageDir  string
+	// bounds storage calls that do not stream file contents
+	StorageTimeout time.Duration
+
+	SecretLength  uint32
+	SecretHMACKey string
+	// share links are built under it, empty when they are disabled
+	PublicBaseURL      string
+	CORSAllowedOrigins []string
+	// require CSRF tokens of requests without bearer tokens or API keys
+	// filer authenticates no request by cookie, this only matters behind a
+	// proxy signing browsers in with one
+	CSRFProtection bool
+	// 0 disables the janitor
+	JanitorInterval time.Duration
+	// 0 disables the orphan cleanup
+	ReconcileInterval time.Duration
+	// deleted and expired files can be restored for this long, 0 deletes them right away
+	TrashRetention time.Duration
+	// lifetimes of new files by size and type, the shortest matching one applies
+	RetentionRules []retentionRule
+	// files neither uploaded nor downloaded for this long move to the cool
+	// or archive access tier, 0 keeps them where they are
+	TierCoolAfter    time.Duration
+	TierArchiveAfter time.Duration
+	// record uploads, downloads, deletions and failed attempts, events are kept for AuditRetention, 0 forever
+	AuditLog        bool
+	AuditRetention  time.Duration
+	ShutdownTimeout time.Duration
+
+	DownloadRedirect bool
+	SignedURLExpiry  time.Duration
+	// Front Door or CDN endpoint whose origin is the storage account,
+	// downloads are redirected through it when set
+	CDNBaseURL      string
+	VerifyDownloads bool
+	// key of download tokens, which are disabled without it
+	DownloadTokenKey string
+	DownloadTokenTTL time.Duration
+	// gzip text downloads for clients accepting it, and optionally store such blobs compressed
+	CompressDownloads bool
+	CompressAtRest    bool
+	// parallel ranged chunks of proxied downloads
+	DownloadParallelism int
+	DownloadChunkBytes  int64
+	// egress of each download and of all of them, 0 means unlimited
+	DownloadBytesPerSecond       int64
+	GlobalDownloadBytesPerSecond int64
+	// uploads stored at once by an instance, 0 means unlimited
+	MaxConcurrentUploads int
+	// answers of uploads sent with an Idempotency-Key are replayed to
+	// retries for this long, 0 ignores the header
+	IdempotencyTTL time.Duration
+	// scanning is disabled when empty
+	ClamdAddress string
+	// MaxMind country database, files cannot be restricted to countries without it
+	GeoIPDatabase string
+	// what uploads holding card numbers, keys or DLPKeywords get, off, flag
+	// for review or block
+	DLPMode     string
+	DLPKeywords []string
+	// uploads matching BlockedFileTypes are refused, as well as those not
+	// matching AllowedFileTypes when it is set
+	BlockedFileTypes []fileType
+	AllowedFileTypes []fileType
+	// time a remote fetch may take
+	FetchTimeout time.Duration
+	// bounds of image previews, disabled when 0
+	ThumbnailWidth  int
+	ThumbnailHeight int
+
+	AdminAPIKey   string
+	UploadAPIKeys []string
+	OIDCIssuer    string
+	OIDCAudience  string
+	// S3-compatible API signed with the upload API keys, see s3.go
+	S3Gateway bool
+	S3Bucket  string
+	// WebDAV folder of the files of each user and API key, off, read-only or read-write
+	WebDAV string
+	// embedded SFTP server, disabled when the address is empty
+	SFTPAddr           string
+	SFTPHostKey        string
+	SFTPAuthorizedKeys string
+	// registration of the blobs under IngestPrefix named by the messages of
+	// the IngestQueue function, see ingest.go
+	QueueIngestion bool
+	IngestPrefix   string
+
+	// limits, 0 means unlimited
+	UserQuotaBytes   int64
+	GlobalQuotaBytes int64
+	MaxUploadBytes   int64
+	// per route overrides of MaxUploadBytes and RateLimit
+	RouteMaxUploadBytes map[string]int64
+	// "<requests>/<period>", empty or "0" when not limited
+	RateLimit       string
+	RouteRateLimits map[string]string
+	// proxies whose X-Forwarded-For hops are believed, the client address is
+	// that of the request otherwise
+	TrustedProxies []*net.IPNet
+
+	EmailProvider  string
+	EmailFrom      string
+	EmailRateLimit string
+	SMTPHost       string
+	SMTPPort       string
+	SMTPUsername   string
+	SMTPPassword   string
+	SendGridAPIKey string
+
+	WebhookURLs   []string
+	WebhookSecret string
+	// analytics store the file events are exported to in batches, disabled when empty
+	EventSink            string
+	EventSinkURL         string
+	EventSinkTable       string
+	EventSinkCredentials string
+	EventSinkBatchSize   int
+	EventSinkInterval    time.Duration
+	// deliver webhooks and exported events from the outbox kept in the
+	// database, see outbox.go
+	EventOutbox bool
+	// key of purge report signatures, purging is disabled without it
+	ReportSigningKey string
+
+	LogLevel     zapcore.Level
+	OTLPEndpoint string
+	ServiceName  string
+}
+
+// a setting read from a flag or its environment variable
+type setting struct {
+	env   string
+	flag  string
+	def   string
+	usage string
+}
+
+// settings of the server, the flag names are the lowercase variable names
+var settings = []setting{
+	{"FUNCTIONS_CUSTOMHANDLER_PORT", "port", "8080", "port to listen on"},
+	{metadataBackendEnvVarName, "metadata-backend", store.BackendMongo, "metadata store, mongo, sqlite or postgres"},
+	{metadataDSNEnvVarName, "metadata-dsn", "", "SQLite file or PostgreSQL connection URL of the sql metadata stores"},
+	{mongoDBConnectionStringEnvVarName, "mongodb-connection-string", "", "MongoDB connection string (required by the mongo metadata store)"},
+	{mongoDBDatabaseEnvVarName, "mongodb-database", "", "MongoDB database (required by the mongo metadata store)"},
+	{mongoDBCollectionEnvVarName, "mongodb-collection", "", "MongoDB collection of the file links (required by the mongo metadata store)"},
+	{mongoDBMaxPoolSizeEnvVarName, "mongodb-max-pool-size", "", "maximum number of MongoDB connections"},
+	{mongoDBTimeoutEnvVarName, "mongodb-timeout", defaultMongoDBTimeout.String(), "time a MongoDB command may take"},
+	{redisURLEnvVarName, "redis-url", "", "Redis URL of the secret lookup cache, disabled when empty"},
+	{cacheTTLEnvVarName, "cache-ttl", defaultCacheTTL.String(), "time a secret lookup stays cached"},
+	{migrateSecretsEnvVarName, "migrate-secrets", "false", "hash plaintext secrets at startup"},
+	{storageBackendEnvVarName, "storage-backend", "azure", "blob storage backend, azure or local"},
+	{localStorageDirEnvVarName, "local-storage-dir", "data", "directory of the local storage backend"},
+	{storageTimeoutEnvVarName, "storage-timeout", defaultStorageTimeout.String(), "time a storage call other than a transfer may take"},
+	{azureStorageAccount, "azure-storage-account", "", "Azure storage account"},
+	{azureStorageAccessKey, "azure-storage-access-key", "", "Azure storage access key"},
+	{azureStorageEndpointEnvVarName, "azure-storage-endpoint", "", "blob service URL, e.g. http://127.0.0.1:10000/devstoreaccount1 for Azurite"},
+	{azureAuthModeEnvVarName, "azure-auth-mode", storage.AzureAuthSharedKey, "Azure storage authentication, shared-key, managed-identity or default"},
+	{azureClientIDEnvVarName, "azure-client-id", "", "client id of a user-assigned managed identity"},
+	{azureStorageContainerEnvVarName, "azure-storage-container", "filer", "Azure storage container, created if missing"},
+	{tenantContainersEnvVarName, "tenant-containers", "", "containers of tenants as <uploader>=<container>, comma separated"},
+	{secondaryStorageAccount, "secondary-storage-account", "", "Azure storage account replicas are kept in, with the container and authentication of the primary one"},
+	{secondaryStorageAccessKey, "secondary-storage-access-key", "", "access key of the secondary storage account"},
+	{secondaryEndpointEnvVarName, "secondary-storage-endpoint", "", "blob service URL of the secondary storage account"},
+	{secondaryStorageDirEnvVarName, "secondary-local-storage-dir", "", "directory replicas are kept in with the local storage backend"},
+	{secretLengthEnvVarName, "secret-length", strconv.Itoa(defaultSecretLength), "length of generated secrets"},
+	{secretHMACKeyEnvVarName, "secret-hmac-key", "", "key of the secret hashes"},
+	{publicBaseURLEnvVarName, "public-base-url", "", "base URL of share links, including the route prefix"},
+	{corsAllowedOriginsEnvVarName, "cors-allowed-origins", "", "origins allowed to call the API, comma separated or *"},
+	{csrfProtectionEnvVarName, "csrf-protection", "false", "require CSRF tokens of browser requests, only useful behind a proxy authenticating browsers with cookies as filer uses none"},
+	{janitorIntervalEnvVarName, "janitor-interval", defaultJanitorInterval.String(), "interval of the expired file cleanup, 0 disables it"},
+	{reconcileIntervalEnvVarName, "reconcile-interval", defaultReconcileInterval.String(), "interval of the cleanup of blobs without links and links without blobs, 0 disables it"},
+	{retentionRulesEnvVarName, "retention-rules", "", "longest lifetime of new files by size and type, comma separated size>N=<ttl>, type:<content type>=<ttl> or ext:<extension>=<ttl> rules"},
+	{tierCoolAfterEnvVarName, "tier-cool-after", "0", "time without downloads after which files move to the cool access tier, 0 disables it"},
+	{tierArchiveAfterEnvVarName, "tier-archive-after", "0", "time without downloads after which files move to the archive access tier and are rehydrated on their next download, 0 disables it"},
+	{trashRetentionEnvVarName, "trash-retention", "0", "how long deleted and expired files stay in the trash where admins can restore them, 0 deletes them right away"},
+	{auditLogEnvVarName, "audit-log", "false", "record uploads, downloads, deletions and failed attempts in the audit log"},
+	{auditRetentionEnvVarName, "audit-retention", defaultAuditRetention.String(), "age at which the janitor prunes audit events, 0 keeps them"},
+	{shutdownTimeoutEnvVarName, "shutdown-timeout", defaultShutdownTimeout.String(), "time in-flight transfers get on shutdown"},
+	{downloadRedirectEnvVarName, "download-redirect", "false", "redirect downloads to signed storage URLs"},
+	{signedURLExpiryEnvVarName, "signed-url-expiry", defaultSignedURLExpiry.String(), "lifetime of signed download URLs"},
+	{cdnBaseURLEnvVarName, "cdn-base-url", "", "Front Door or CDN endpoint of the storage account that signed download URLs are redirected to"},
+	{downloadParallelismEnvVarName, "download-parallelism", "1", "ranged chunks of a proxied download fetched at once, 1 streams blobs whole"},
+	{downloadChunkBytesEnvVarName, "download-chunk-bytes", strconv.Itoa(defaultDownloadChunkBytes), "size of the chunks of parallel downloads"},
+	{downloadBytesPerSecondEnvVarName, "download-bytes-per-second", "0", "bandwidth of each download, 0 is unlimited"},
+	{globalDownloadBytesEnvVarName, "global-download-bytes-per-second", "0", "bandwidth of all the downloads of an instance, 0 is unlimited"},
+	{maxConcurrentUploadsEnvVarName, "max-concurrent-uploads", "0", "uploads an instance stores at once before answering 503, 0 is unlimited"},
+	{idempotencyTTLEnvVarName, "idempotency-ttl", defaultIdempotencyTTL.String(), "how long uploads sent with an Idempotency-Key answer their retries with the same file, 0 ignores the header"},
+	{verifyDownloadsEnvVarName, "verify-downloads", "false", "check downloads against their SHA-256"},
+	{downloadTokenKeyEnvVarName, "download-token-key", "", "key of download tokens exchanged for secrets, disabled without it"},
+	{downloadTokenTTLEnvVarName, "download-token-ttl", defaultDownloadTokenTTL.String(), "lifetime of download tokens"},
+	{compressDownloadsEnvVarName, "compress-downloads", "true", "gzip or deflate downloads of text-like files for clients accepting it"},
+	{compressAtRestEnvVarName, "compress-at-rest", "false", "store uploads of text-like files gzip compressed"},
+	{thumbnailSizeEnvVarName, "thumbnail-size", defaultThumbnailSize, "maximum <width>x<height> of image previews, 0 disables them"},
+	{fetchTimeoutEnvVarName, "fetch-timeout", defaultFetchTimeout.String(), "time a FetchTrigger download may take"},
+	{clamdAddressEnvVarName, "clamd-address", "", "clamd address, scanning is disabled without it"},
+	{dlpModeEnvVarName, "dlp-mode", dlpOff, "inspection of uploads for card numbers, keys and DLP_KEYWORDS, off, flag for admin review or block"},
+	{dlpKeywordsEnvVarName, "dlp-keywords", "", "words that content inspection looks for besides card numbers and keys, comma separated"},
+	{blockedFileTypesEnvVarName, "blocked-file-types", "", "uploads refused by name or sniffed type, comma separated ext:<extension> or type:<content type> such as ext:exe,type:application/x-msdownload,type:text/html"},
+	{allowedFileTypesEnvVarName, "allowed-file-types", "", "the only uploads accepted when set, comma separated ext:<extension> or type:<content type> such as type:image/*"},
+	{geoIPDatabaseEnvVarName, "geoip-database", "", "MaxMind GeoIP2 or GeoLite2 country database file, downloads cannot be restricted to countries without it"},
+	{adminAPIKeyEnvVarName, "admin-api-key", "", "key of the admin API, disabled without it"},
+	{uploadAPIKeysEnvVarName, "upload-api-keys", "", "keys required to upload, comma separated"},
+	{s3GatewayEnvVarName, "s3-gateway", "false", "serve an S3-compatible API signed with the upload API keys"},
+	{s3BucketEnvVarName, "s3-bucket", "filer", "bucket name of the S3-compatible API"},
+	{webdavEnvVarName, "webdav", webdavOff, "WebDAV folder of the files of each user and API key, off, read-only or read-write"},
+	{sftpPortEnvVarName, "sftp-port", "0", "port of the SFTP upload server, 0 disables it"},
+	{sftpHostKeyEnvVarName, "sftp-host-key", "", "private host key file of the SFTP server, a new key on every start when empty"},
+	{sftpAuthorizedKeysEnvVarName, "sftp-authorized-keys", "", "authorized_keys file of SFTP clients, which may also log in with an upload API key"},
+	{queueIngestionEnvVarName, "queue-ingestion", "false", "share the blobs named by messages of the ingestion queue"},
+	{ingestPrefixEnvVarName, "ingest-prefix", defaultIngestPrefix, "prefix of the blobs the ingestion queue may share, they are deleted once shared"},
+	{oidcIssuerEnvVarName, "oidc-issuer", "", "OIDC issuer of login tokens"},
+	{oidcAudienceEnvVarName, "oidc-audience", "", "OIDC audience of login tokens"},
+	{userQuotaEnvVarName, "quota-bytes-per-user", "0", "bytes a user or API key may store, 0 is unlimited"},
+	{globalQuotaEnvVarName, "quota-bytes-global", "0", "bytes all uploads may store, 0 is unlimited"},
+	{maxUploadBytesEnvVarName, "max-upload-bytes", "0", "maximum upload size, 0 is unlimited"},
+	{rateLimitEnvVarName, "rate-limit", "", "requests per client as <requests>/<period>"},
+	{trustedProxiesEnvVarName, "trusted-proxies", defaultTrustedProxies, "CIDR ranges or addresses of the proxies whose X-Forwarded-For is believed, comma separated, the Functions host runs on loopback"},
+	{emailProviderEnvVarName, "email-provider", "", "email provider, smtp or sendgrid"},
+	{emailFromEnvVarName, "email-from", "", "sender of share emails"},
+	{emailRateLimitEnvVarName, "email-rate-limit", defaultEmailRateLimit, "share emails per uploader as <emails>/<period>"},
+	{smtpHostEnvVarName, "smtp-host", "", "SMTP relay host"},
+	{smtpPortEnvVarName, "smtp-port", defaultSMTPPort, "SMTP relay port"},
+	{smtpUsernameEnvVarName, "smtp-username", "", "SMTP username"},
+	{smtpPasswordEnvVarName, "smtp-password", "", "SMTP password"},
+	{sendGridAPIKeyEnvVarName, "sendgrid-api-key", "", "SendGrid API key"},
+	{webhookURLsEnvVarName, "webhook-urls", "", "URLs receiving file events, comma separated"},
+	{webhookSecretEnvVarName, "webhook-secret", "", "key of the webhook signatures"},
+	{eventSinkEnvVarName, "event-sink", "", "store the file events are exported to, http, azure-table or bigquery, disabled when empty"},
+	{eventSinkURLEnvVarName, "event-sink-url", "", "URL the http event sink posts to, or endpoint replacing the default one of the other sinks"},
+	{eventSinkTableEnvVarName, "event-sink-table", "", "Azure Table name, or BigQuery <project>.<dataset>.<table> of the events"},
+	{eventSinkCredentialsEnvVarName, "event-sink-credentials", "", "service account key file of the bigquery event sink"},
+	{eventSinkBatchSizeEnvVarName, "event-sink-batch-size", strconv.Itoa(defaultEventSinkBatchSize), "events exported at once"},
+	{eventSinkIntervalEnvVarName, "event-sink-interval", defaultEventSinkInterval.String(), "longest time events wait before they are exported"},
+	{eventOutboxEnvVarName, "event-outbox", "false", "keep events in the database until webhooks and the event sink received them, so they survive restarts"},
+	{reportSigningKeyEnvVarName, "report-signing-key", "", "key of purge report signatures, purging is disabled without it"},
+	{logLevelEnvVarName, "log-level", "info", "minimum log level, debug, info, warn or error"},
+	{otlpEndpointEnvVarName, "otlp-endpoint", "", "OTLP/gRPC endpoint traces are exported to"},
+	{otelServiceNameEnvVarName, "service-name", defaultServiceName, "service name reported in traces"},
+}
+
+// routes with their own upload size and rate limits, overridden by <NAME>_<ROUTE>
+var configRoutes = []string{uploadRoute, downloadRoute, deleteRoute, metaRoute, fileInfoRoute, scanStatusRoute, previewRoute, pasteRoute, fetchRoute, tusRoute, uploadSessionRoute, downloadTokenRoute, s3Route, webdavRoute}
+
+// optional dotenv file, its variables never override the process environment
+const defaultEnvFile = ".env.local"
+
+// load ENV_FILE, or .env.local when it exists
+// deployments configured through the environment alone need neither
+func loadEnvFile() error {
+	path := os.Getenv(envFileEnvVarName)
+	if path == "" {
+		if _, err := os.Stat(defaultEnvFile); os.IsNotExist(err) {
+			return nil
+		}
+		path = defaultEnvFile
+	}
+	if err := godotenv.Load(path); err != nil {
+		return fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	return nil
+}
+
+// Configure loads ENV_FILE, then the configuration from the environment and
+// args. It fails fast on broken configuration instead of on the first request.
+func Configure(args []string) (*Config, error) {
+	if err := loadEnvFile(); err != nil {
+		return nil, err
+	}
+	c, err := loadConfig(args)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// StorageOptions configure the blob backend selected by STORAGE_BACKEND,
+// logging to logger.
+func (c *Config) StorageOptions(logger *zap.Logger) storage.Options {
+	return storage.Options{
+		Backend:  c.StorageBackend,
+		LocalDir: c.LocalStorageDir,
+		Azure: storage.AzureOptions{
+			Account:     c.AzureStorageAccount,
+			AccessKey:   c.AzureStorageAccessKey,
+			Endpoint:    c.AzureStorageEndpoint,
+			Container:   c.AzureStorageContainer,
+			AuthMode:    c.AzureAuthMode,
+			ClientID:    c.AzureClientID,
+			ServiceName: c.ServiceName,
+		},
+		Timeout:   c.StorageTimeout,
+		Logger:    logger,
+		RequestID: requestID,
+	}
+}
+
+// options of the backend replicas are kept in, ok is false without one
+// It is of the same kind as the primary backend, with the same containers.
+func (c *Config) secondaryStorageOptions(logger *zap.Logger) (opts storage.Options, ok bool) {
+	opts = c.StorageOptions(logger)
+	opts.LocalDir = c.SecondaryLocalStorageDir
+	opts.Azure.Account = c.SecondaryStorageAccount
+	opts.Azure.AccessKey = c.SecondaryStorageAccessKey
+	opts.Azure.Endpoint = c.SecondaryStorageEndpoint
+	if c.StorageBackend == storage.BackendLocal {
+		return opts, c.SecondaryLocalStorageDir != ""
+	}
+	return opts, c.SecondaryStorageAccount != ""
+}
+
+// StoreOptions configure the metadata store selected by METADATA_BACKEND,
+// whose secrets are hashed by secrets, logging to logger.
+func (c *Config) StoreOptions(secrets *secret.Hasher, logger *zap.Logger) store.Options {
+	return store.Options{
+		Backend: c.MetadataBackend,
+		DSN:     c.MetadataDSN,
+		Mongo: store.MongoOptions{
+			ConnectionString: c.MongoDBConnectionString,
+			Database:         c.MongoDBDatabase,
+			Collection:       c.MongoDBCollection,
+			MaxPoolSize:      c.MongoDBMaxPoolSize,
+			Monitor:          mongoMonitor(c.ServiceName),
+		},
+		RedisURL: c.RedisURL,
+		CacheTTL: c.CacheTTL,
+		Timeout:  c.MongoDBTimeout,
+		Secrets:  secrets,
+		Logger: func(ctx context.Context) *zap.Logger {
+			return tagLogger(logger, ctx)
+		},
+	}
+}
+
+// load the configuration from the environment and the command line
+func loadConfig(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("filer", flag.ContinueOnError)
+	values := map[string]*string{}
+	for _, s := range settings {
+		def := s.def
+		// empty variables are treated as unset, as app settings cannot be removed easily
+		if v := os.Getenv(s.env); v != "" {
+			def = v
+		}
+		values[s.env] = fs.String(s.flag, def, fmt.Sprintf("%s (%s)", s.usage, s.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	p := &configParser{values: values}
+	c := &Config{
+		ListenAddr: ":" + p.str("FUNCTIONS_CUSTOMHANDLER_PORT"),
+
+		MetadataBackend: p.oneOf(metadataBackendEnvVarName, store.BackendMongo, store.BackendSQLite, store.BackendPostgres),
+		MetadataDSN:     p.str(metadataDSNEnvVarName),
+
+		MongoDBConnectionString: p.str(mongoDBConnectionStringEnvVarName),
+		MongoDBDatabase:         p.str(mongoDBDatabaseEnvVarName),
+		MongoDBCollection:       p.str(mongoDBCollectionEnvVarName),
+		MongoDBTimeout:          p.duration(mongoDBTimeoutEnvVarName),
+		MigrateSecrets:          p.bool(migrateSecretsEnvVarName),
+
+		RedisURL: p.str(redisURLEnvVarName),
+		CacheTTL: p.duration(cacheTTLEnvVarName),
+
+		StorageBackend:        p.oneOf(storageBackendEnvVarName, "azure", "local"),
+		LocalStorageDir:       p.str(localStorageDirEnvVarName),
+		AzureStorageAccount:   p.str(azureStorageAccount),
+		AzureStorageAccessKey: p.str(azureStorageAccessKey),
+		AzureStorageEndpoint:  strings.TrimRight(p.baseURL(azureStorageEndpointEnvVarName), "/"),
+		AzureAuthMode:         p.oneOf(azureAuthModeEnvVarName, storage.AzureAuthSharedKey, storage.AzureAuthManagedIdentity, storage.AzureAuthDefault),
+		AzureClientID:         p.str(azureClientIDEnvVarName),
+		AzureStorageContainer: p.container(azureStorageContainerEnvVarName, p.str(azureStorageContainerEnvVarName)),
+		TenantContainers:      p.tenantContainers(tenantContainersEnvVarName),
+
+		SecondaryStorageAccount:   p.str(secondaryStorageAccount),
+		SecondaryStorageAccessKey: p.str(secondaryStorageAccessKey),
+		SecondaryStorageEndpoint:  strings.TrimRight(p.baseURL(secondaryEndpointEnvVarName), "/"),
+		SecondaryLocalStorageDir:  p.str(secondaryStorageDirEnvVarName),
+		RetentionRules:            p.retentionRules(retentionRulesEnvVarName),
+		StorageTimeout:            p.duration(storageTimeoutEnvVarName),
+
+		SecretHMACKey:      p.str(secretHMACKeyEnvVarName),
+		PublicBaseURL:      strings.TrimRight(p.baseURL(publicBaseURLEnvVarName), "/"),
+		CORSAllowedOrigins: p.list(corsAllowedOriginsEnvVarName),
+		CSRFProtection:     p.bool(csrfProtectionEnvVarName),
+		ShutdownTimeout:    p.duration(shutdownTimeoutEnvVarName),
+		AuditLog:           p.bool(auditLogEnvVarName),
+
+		DownloadRedirect:  p.bool(downloadRedirectEnvVarName),
+		SignedURLExpiry:   p.duration(signedURLExpiryEnvVarName),
+		CDNBaseURL:        strings.TrimRight(p.baseURL(cdnBaseURLEnvVarName), "/"),
+		VerifyDownloads:   p.bool(verifyDownloadsEnvVarName),
+		DownloadTokenKey:  p.str(downloadTokenKeyEnvVarName),
+		DownloadTokenTTL:  p.duration(downloadTokenTTLEnvVarName),
+		CompressDownloads: p.bool(compressDownloadsEnvVarName),
+		CompressAtRest:    p.bool(compressAtRestEnvVarName),
+		ClamdAddress:      p.str(clamdAddressEnvVarName),
+		GeoIPDatabase:     p.str(geoIPDatabaseEnvVarName),
+		DLPMode:           p.oneOf(dlpModeEnvVarName, dlpOff, dlpFlag, dlpBlock),
+		DLPKeywords:       p.list(dlpKeywordsEnvVarName),
+		BlockedFileTypes:  p.fileTypes(blockedFileTypesEnvVarName),
+		AllowedFileTypes:  p.fileTypes(allowedFileTypesEnvVarName),
+		FetchTimeout:      p.duration(fetchTimeoutEnvVarName),
+
+		AdminAPIKey:   p.str(adminAPIKeyEnvVarName),
+		UploadAPIKeys: p.list(uploadAPIKeysEnvVarName),
+		OIDCIssuer:    p.str(oidcIssuerEnvVarName),
+		OIDCAudience:  p.str(oidcAudienceEnvVarName),
+		S3Gateway:     p.bool(s3GatewayEnvVarName),
+		S3Bucket:      p.container(s3BucketEnvVarName, p.str(s3BucketEnvVarName)),
+		WebDAV:        p.oneOf(webdavEnvVarName, webdavOff, webdavReadOnly, webdavReadWrite),
+
+		SFTPHostKey:        p.str(sftpHostKeyEnvVarName),
+		SFTPAuthorizedKeys: p.str(sftpAuthorizedKeysEnvVarName),
+		QueueIngestion:     p.bool(queueIngestionEnvVarName),
+		IngestPrefix:       p.str(ingestPrefixEnvVarName),
+
+		UserQuotaBytes:      p.bytes(userQuotaEnvVarName),
+		GlobalQuotaBytes:    p.bytes(globalQuotaEnvVarName),
+		MaxUploadBytes:      p.bytes(maxUploadBytesEnvVarName),
+		RouteMaxUploadBytes: map[string]int64{},
+		RateLimit:           p.rateLimit(rateLimitEnvVarName),
+		RouteRateLimits:     map[string]string{},
+		TrustedProxies:      p.networks(trustedProxiesEnvVarName),
+
+		DownloadBytesPerSecond:       p.bytes(downloadBytesPerSecondEnvVarName),
+		GlobalDownloadBytesPerSecond: p.bytes(globalDownloadBytesEnvVarName),
+
+		EmailProvider:  p.oneOf(emailProviderEnvVarName, "", "smtp", "sendgrid"),
+		EmailFrom:      p.str(emailFromEnvVarName),
+		EmailRateLimit: p.rateLimit(emailRateLimitEnvVarName),
+		SMTPHost:       p.str(smtpHostEnvVarName),
+		SMTPPort:       p.str(smtpPortEnvVarName),
+		SMTPUsername:   p.str(smtpUsernameEnvVarName),
+		SMTPPassword:   p.str(smtpPasswordEnvVarName),
+		SendGridAPIKey: p.str(sendGridAPIKeyEnvVarName),
+
+		WebhookURLs:   p.list(webhookURLsEnvVarName),
+		WebhookSecret: p.str(webhookSecretEnvVarName),
+
+		EventSink:            p.oneOf(eventSinkEnvVarName, "", eventSinkHTTP, eventSinkAzureTable, eventSinkBigQuery),
+		EventSinkURL:         strings.TrimRight(p.baseURL(eventSinkURLEnvVarName), "/"),
+		EventSinkTable:       p.str(eventSinkTableEnvVarName),
+		EventSinkCredentials: p.str(eventSinkCredentialsEnvVarName),
+		EventSinkInterval:    p.duration(eventSinkIntervalEnvVarName),
+		EventOutbox:          p.bool(eventOutboxEnvVarName),
+
+		ReportSigningKey: p.str(reportSigningKeyEnvVarName),
+
+		OTLPEndpoint: p.str(otlpEndpointEnvVarName),
+		ServiceName:  p.str(otelServiceNameEnvVarName),
+	}
+	if v := p.str(mongoDBMaxPoolSizeEnvVarName); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		p.check(mongoDBMaxPoolSizeEnvVarName, v, err, "must be a number of connections")
+		c.MongoDBMaxPoolSize = n
+	}
+	if v := p.str(secretLengthEnvVarName); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err == nil && (n < minSecretLength || n > maxSecretLength) {
+			err = strconv.ErrRange
+		}
+		p.check(secretLengthEnvVarName, v, err, fmt.Sprintf("must be between %d and %d", minSecretLength, maxSecretLength))
+		c.SecretLength = uint32(n)
+	}
+	if v := p.str(downloadParallelismEnvVarName); v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil && (n < 1 || n > maxDownloadParallelism) {
+			err = strconv.ErrRange
+		}
+		p.check(downloadParallelismEnvVarName, v, err, fmt.Sprintf("must be between 1 and %d", maxDownloadParallelism))
+		c.DownloadParallelism = n
+	}
+	if v := p.str(eventSinkBatchSizeEnvVarName); v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil && n < 1 {
+			err = strconv.ErrRange
+		}
+		p.check(eventSinkBatchSizeEnvVarName, v, err, "must be a positive number of events")
+		c.EventSinkBatchSize = n
+	}
+	if v := p.str(maxConcurrentUploadsEnvVarName); v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil && n < 0 {
+			err = strconv.ErrRange
+		}
+		p.check(maxConcurrentUploadsEnvVarName, v, err, "must be a number of uploads, 0 is unlimited")
+		c.MaxConcurrentUploads = n
+	}
+	if c.DownloadChunkBytes = p.bytes(downloadChunkBytesEnvVarName); c.DownloadChunkBytes == 0 {
+		p.fail(downloadChunkBytesEnvVarName, "0", "must be a positive number of bytes")
+	}
+	if v := p.str(thumbnailSizeEnvVarName); v != "0" {
+		c.ThumbnailWidth, c.ThumbnailHeight = p.dimensions(thumbnailSizeEnvVarName)
+	}
+	if v := p.str(janitorIntervalEnvVarName); v != "0" {
+		c.JanitorInterval = p.duration(janitorIntervalEnvVarName)
+	}
+	if v := p.str(reconcileIntervalEnvVarName); v != "0" {
+		c.ReconcileInterval = p.duration(reconcileIntervalEnvVarName)
+	}
+	if v := p.str(trashRetentionEnvVarName); v != "0" {
+		c.TrashRetention = p.duration(trashRetentionEnvVarName)
+	}
+	if v := p.str(tierCoolAfterEnvVarName); v != "0" {
+		c.TierCoolAfter = p.duration(tierCoolAfterEnvVarName)
+	}
+	if v := p.str(tierArchiveAfterEnvVarName); v != "0" {
+		c.TierArchiveAfter = p.duration(tierArchiveAfterEnvVarName)
+	}
+	if v := p.str(idempotencyTTLEnvVarName); v != "0" {
+		c.IdempotencyTTL = p.duration(idempotencyTTLEnvVarName)
+	}
+	if v := p.str(auditRetentionEnvVarName); v != "0" {
+		c.AuditRetention = p.duration(auditRetentionEnvVarName)
+	}
+	if err := c.LogLevel.UnmarshalText([]byte(p.str(logLevelEnvVarName))); err != nil {
+		p.fail(logLevelEnvVarName, p.str(logLevelEnvVarName), "must be debug, info, warn or error")
+	}
+	for _, route := range configRoutes {
+		suffix := "_" + strings.ToUpper(route)
+		if v := os.Getenv(maxUploadBytesEnvVarName + suffix); v != "" {
+			c.RouteMaxUploadBytes[route] = p.parseBytes(maxUploadBytesEnvVarName+suffix, v)
+		}
+		if v := os.Getenv(rateLimitEnvVarName + suffix); v != "" {
+			c.RouteRateLimits[route] = p.parseRateLimit(rateLimitEnvVarName+suffix, v)
+		}
+	}
+
+	if c.MetadataBackend == store.BackendMongo {
+		p.required(mongoDBConnectionStringEnvVarName)
+		p.required(mongoDBDatabaseEnvVarName)
+		p.required(mongoDBCollectionEnvVarName)
+	} else {
+		p.required(metadataDSNEnvVarName)
+	}
+	// the url is left out of the error as it may hold a password
+	if _, err := redis.ParseURL(c.RedisURL); c.RedisURL != "" && err != nil {
+		p.errs = append(p.errs, fmt.Sprintf("invalid %s: must be a redis:// or rediss:// URL", redisURLEnvVarName))
+	}
+	// the key is not echoed, like the redis URL it is a credential
+	if k := c.DownloadTokenKey; k != "" && len(k) < minDownloadTokenKeyLength {
+		p.errs = append(p.errs, fmt.Sprintf("invalid %s: must be at least %d characters", downloadTokenKeyEnvVarName, minDownloadTokenKeyLength))
+	}
+	if c.StorageBackend == "azure" {
+		if c.AzureStorageAccount == "" {
+			p.errs = append(p.errs, fmt.Sprintf("%s is required by the azure storage backend", azureStorageAccount))
+		}
+		if c.AzureAuthMode == storage.AzureAuthSharedKey && c.AzureStorageAccessKey == "" {
+			p.errs = append(p.errs, fmt.Sprintf("%s is required with %s %s", azureStorageAccessKey, azureAuthModeEnvVarName, storage.AzureAuthSharedKey))
+		}
+		if c.SecondaryStorageAccount != "" && c.AzureAuthMode == storage.AzureAuthSharedKey && c.SecondaryStorageAccessKey == "" {
+			p.errs = append(p.errs, fmt.Sprintf("%s is required with %s %s", secondaryStorageAccessKey, azureAuthModeEnvVarName, storage.AzureAuthSharedKey))
+		}
+	}
+	if (c.TierCoolAfter > 0 || c.TierArchiveAfter > 0) && c.StorageBackend != storage.BackendAzure {
+		p.errs = append(p.errs, fmt.Sprintf("%s and %s require the azure storage backend", tierCoolAfterEnvVarName, tierArchiveAfterEnvVarName))
+	}
+	if c.TierCoolAfter > 0 && c.TierArchiveAfter > 0 && c.TierArchiveAfter <= c.TierCoolAfter {
+		p.fail(tierArchiveAfterEnvVarName, c.TierArchiveAfter.String(), fmt.Sprintf("must be longer than %s", tierCoolAfterEnvVarName))
+	}
+	// ingested blobs are deleted, the prefix must not hold those of files
+	if c.QueueIngestion && !validIngestPrefix(c.IngestPrefix) {
+		p.fail(ingestPrefixEnvVarName, c.IngestPrefix, "must be a folder ending with /, other than those of shared and trashed blobs")
+	}
+	// the CDN forwards the SAS of the blob to the storage account
+	if c.CDNBaseURL != "" && (c.StorageBackend != "azure" || c.AzureAuthMode != storage.AzureAuthSharedKey) {
+		p.errs = append(p.errs, fmt.Sprintf("%s requires the azure storage backend with %s %s", cdnBaseURLEnvVarName, azureAuthModeEnvVarName, storage.AzureAuthSharedKey))
+	}
+	if v := p.str(sftpPortEnvVarName); v != "0" {
+		port, err := strconv.ParseUint(v, 10, 16)
+		p.check(sftpPortEnvVarName, v, err, "must be a port number, 0 disables the SFTP server")
+		c.SFTPAddr = ":" + strconv.FormatUint(port, 10)
+		if len(c.UploadAPIKeys) == 0 && c.SFTPAuthorizedKeys == "" {
+			p.errs = append(p.errs, fmt.Sprintf("%s or %s is required by the SFTP server", uploadAPIKeysEnvVarName, sftpAuthorizedKeysEnvVarName))
+		}
+	}
+	if c.S3Gateway && len(c.UploadAPIKeys) == 0 {
+		p.errs = append(p.errs, fmt.Sprintf("%s is required by %s, its keys sign the requests", uploadAPIKeysEnvVarName, s3GatewayEnvVarName))
+	}
+	switch c.EventSink {
+	case eventSinkHTTP:
+		if c.EventSinkURL == "" {
+			p.errs = append(p.errs, fmt.Sprintf("%s is required by the http event sink", eventSinkURLEnvVarName))
+		}
+	case eventSinkAzureTable:
+		if c.AzureStorageAccount == "" || c.AzureStorageAccessKey == "" || c.EventSinkTable == "" {
+			p.errs = append(p.errs, fmt.Sprintf("%s, %s and %s are required by the azure-table event sink", azureStorageAccount, azureStorageAccessKey, eventSinkTableEnvVarName))
+		}
+		if c.EventSinkBatchSize > maxAzureTableBatch {
+			p.fail(eventSinkBatchSizeEnvVarName, strconv.Itoa(c.EventSinkBatchSize), fmt.Sprintf("must be at most %d with the azure-table event sink", maxAzureTableBatch))
+		}
+	case eventSinkBigQuery:
+		if c.EventSinkCredentials == "" {
+			p.errs = append(p.errs, fmt.Sprintf("%s is required by the bigquery event sink", eventSinkCredentialsEnvVarName))
+		}
+		if parts := strings.Split(c.EventSinkTable, "."); len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			p.fail(eventSinkTableEnvVarName, c.EventSinkTable, "must be <project>.<dataset>.<table> with the bigquery event sink")
+		}
+	}
+	switch c.EmailProvider {
+	case "smtp":
+		if c.SMTPHost == "" || c.EmailFrom == "" {
+			p.errs = append(p.errs, fmt.Sprintf("%s and %s are required by the smtp email provider", smtpHostEnvVarName, emailFromEnvVarName))
+		}
+	case "sendgrid":
+		if c.SendGridAPIKey == "" || c.EmailFrom == "" {
+			p.errs = append(p.errs, fmt.Sprintf("%s and %s are required by the sendgrid email provider", sendGridAPIKeyEnvVarName, emailFromEnvVarName))
+		}
+	}
+
+	if len(p.errs) > 0 {
+		return nil, errors.New("invalid configuration:\n  " + strings.Join(p.errs, "\n  "))
+	}
+	return c, nil
+}
+
+// upload size limit of a route, 0 means unlimited
+func (c *Config) maxUploadBytes(route string) int64 {
+	if n, ok := c.RouteMaxUploadBytes[route]; ok {
+		return n
+	}
+	return c.MaxUploadBytes
+}
+
+// rate limit of a route, empty when it is not limited
+func (c *Config) rateLimit(route string) string {
+	if v, ok := c.RouteRateLimits[route]; ok {
+		return v
+	}
+	return c.RateLimit
+}
+
+// configParser converts setting values, collecting every invalid one
+// so a broken configuration is reported in full instead of one value at a time
+type configParser struct {
+	values map[string]*string
+	errs   []string
+}
+
+func (p *configParser) fail(env, v, reason string) {
+	p.errs = append(p.errs, fmt.Sprintf("invalid %s %q: %s", env, v, reason))
+}
+
+func (p *configParser) check(env, v string, err error, reason string) {
+	if err != nil {
+		p.fail(env, v, reason)
+	}
+}
+
+func (p *configParser) str(env string) string {
+	return strings.TrimSpace(*p.values[env])
+}
+
+func (p *configParser) required(env string) string {
+	v := p.str(env)
+	if v == "" {
+		p.errs = append(p.errs, fmt.Sprintf("missing %s", env))
+	}
+	return v
+}
+
+func (p *configParser) oneOf(env string, allowed ...string) string {
+	v := p.str(env)
+	for _, a := range allowed {
+		if v == a {
+			return v
+		}
+	}
+	p.fail(env, v, "must be one of "+strings.Join(allowed, ", "))
+	return v
+}
+
+func (p *configParser) bool(env string) bool {
+	v := p.str(env)
+	b, err := strconv.ParseBool(v)
+	p.check(env, v, err, "must be true or false")
+	return b
+}
+
+func (p *configParser) duration(env string) time.Duration {
+	v := p.str(env)
+	d, err := parseTTL(v)
+	p.check(env, v, err, "must be a positive duration such as 30s or 10m")
+	return d
+}
+
+// comma separated values, blanks are dropped
+func (p *configParser) list(env string) []string {
+	var values []string
+	for _, v := range strings.Split(p.str(env), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func (p *configParser) bytes(env string) int64 {
+	return p.parseBytes(env, p.str(env))
+}
+
+func (p *configParser) parseBytes(env, v string) int64 {
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err == nil && n < 0 {
+		err = strconv.ErrRange
+	}
+	p.check(env, v, err, "must be a number of bytes, 0 for unlimited")
+	return n
+}
+
+// "<width>x<height>" in pixels
+func (p *configParser) dimensions(env string) (int, int) {
+	v := p.str(env)
+	var w, h int
+	err := strconv.ErrSyntax
+	if parts := strings.Split(v, "x"); len(parts) == 2 {
+		if w, err = strconv.Atoi(parts[0]); err == nil {
+			h, err = strconv.Atoi(parts[1])
+		}
+	}
+	if err == nil && (w <= 0 || h <= 0) {
+		err = strconv.ErrRange
+	}
+	p.check(env, v, err, "must be <width>x<height> such as 320x320, or 0")
+	return w, h
+}
+
+func (p *configParser) rateLimit(env string) string {
+	return p.parseRateLimit(env, p.str(env))
+}
+
+func (p *configParser) parseRateLimit(env, v string) string {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return ""
+	}
+	_, err := parseRateLimit(v)
+	p.check(env, v, err, "must be <requests>/<period> such as 100/1m, or 0")
+	return v
+}
+
+// Azure container names are 3 to 63 lowercase letters, digits and single hyphens
+func (p *configParser) container(env, v string) string {
+	valid := len(v) >= 3 && len(v) <= 63 && v[0] != '-' && v[len(v)-1] != '-' && !strings.Contains(v, "--")
+	for _, c := range v {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			valid = false
+		}
+	}
+	if !valid {
+		p.fail(env, v, "must be a container name of 3 to 63 lowercase letters, digits and hyphens")
+	}
+	return v
+}
+
+// "<uploader>=<container>" pairs, comma separated
+func (p *configParser) tenantContainers(env string) map[string]string {
+	containers := map[string]string{}
+	for _, pair := range p.list(env) {
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			p.fail(env, pair, "must be <uploader>=<container>")
+			continue
+		}
+		containers[strings.TrimSpace(pair[:i])] = p.container(env, strings.TrimSpace(pair[i+1:]))
+	}
+	return containers
+}
+
+// "<match>=<ttl>" rules, comma separated, matching size>N, type:<content type>
+// or ext:<extension>
+func (p *configParser) retentionRules(env string) []retentionRule {
+	var rules []retentionRule
+	for _, v := range p.list(env) {
+		i := strings.LastIndex(v, "=")
+		if i <= 0 {
+			p.fail(env, v, "must be <match>=<ttl>")
+			continue
+		}
+		match := strings.TrimSpace(v[:i])
+		ttl, err := parseTTL(strings.TrimSpace(v[i+1:]))
+		p.check(env, v, err, "must end with a positive duration such as 24h")
+		rule := retentionRule{ttl: ttl}
+		switch {
+		case strings.HasPrefix(match, "size>"):
+			n, err := strconv.ParseInt(strings.TrimPrefix(match, "size>"), 10, 64)
+			p.check(env, v, err, "size must be a number of bytes")
+			rule.minSize = n
+		default:
+			t, ok := parseFileType(match)
+			if !ok {
+				p.fail(env, v, "must match size>N, type:<content type> or ext:<extension>")
+				continue
+			}
+			rule.fileType = t
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// ext:<extension> and type:<content type> matches, comma separated
+func (p *configParser) fileTypes(env string) []fileType {
+	var types []fileType
+	for _, v := range p.list(env) {
+		t, ok := parseFileType(v)
+		if !ok {
+			p.fail(env, v, "must be ext:<extension> or type:<content type>")
+			continue
+		}
+		types = append(types, t)
+	}
+	return types
+}
+
+// CIDR ranges or single addresses, comma separated
+func (p *configParser) networks(env string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, v := range p.list(env) {
+		cidr := v
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			p.fail(env, v, "must be a CIDR range or an address")
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func (p *configParser) baseURL(env string) string {
+	v := p.str(env)
+	if v == "" {
+		return ""
+	}
+	u, err := url.Parse(v)
+	if err == nil && (u.Scheme != "http" && u.Scheme != "https" || u.Host == "") {
+		err = errors.New("not absolute")
+	}
+	p.check(env, v, err, "must be an absolute http or https URL")
+	return v
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const defaultContentType = "application/octet-stream"
+
+// types browsers may render inline, none of them can run scripts in the page
+// origin. SVG and HTML are deliberately missing.
+var inlineContentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"image/bmp":       true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+// whether a file of contentType may be served with an inline disposition
+func inlineSafe(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && inlineContentTypes[mediaType]
+}
+
+// signatures of executables among the binary files http.DetectContentType
+// leaves to application/octet-stream
+var executableSignatures = []struct {
+	prefix      string
+	contentType string
+}{
+	{"MZ", "application/x-msdownload"},
+	{"\x7fELF", "application/x-executable"},
+	{"\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xce\xfa\xed\xfe", "application/x-mach-binary"},
+}
+
+// content type of the first 512 bytes of a file
+func sniffContentType(head []byte) string {
+	sniffed := http.DetectContentType(head)
+	if sniffed != defaultContentType {
+		return sniffed
+	}
+	for _, sig := range executableSignatures {
+		if strings.HasPrefix(string(head), sig.prefix) {
+			return sig.contentType
+		}
+	}
+	return sniffed
+}
+
+// detect the content type of an upload
+// sniffing wins unless it is inconclusive, then the type declared by the
+// client and finally the one registered for the file extension are used.
+// The returned reader yields the whole content, including the sniffed bytes.
+func detectContentType(r io.Reader, name, declared string) (string, io.Reader, error) {
+	br := bufio.NewReaderSize(r, 512)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+
+	sniffed := sniffContentType(head)
+	if sniffed != defaultContentType && !strings.HasPrefix(sniffed, "text/plain") {
+		return sniffed, br, nil
+	}
+	if mediaType, _, err := mime.ParseMediaType(declared); err == nil && mediaType != defaultContentType {
+		return declared, br, nil
+	}
+	if byExt := mime.TypeByExtension(filepath.Ext(name)); byExt != "" {
+		return byExt, br, nil
+	}
+	return sniffed, br, nil
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// headers browser clients need to read from responses
+const corsExposedHeaders = "Content-Disposition, Content-Length, Location, Deprecation, Link, Upload-Offset, Upload-Length, Upload-Secret, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Chunk-Size, Retry-After"
+
+// allow cross-origin requests from CORS_ALLOWED_ORIGINS (comma separated or "*")
+func (s *Server) withCORS(next http.HandlerFunc) http.HandlerFunc {
+	allowed := s.config.CORSAllowedOrigins
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && originAllowed(origin, allowed) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+
+			// answer preflight requests, except the tus OPTIONS discovery request
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, HEAD, PATCH, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+				w.Header().Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func originAllowed(origin string, allowed []string) bool {
+	for _, a := range allowed {
+		a = strings.TrimSpace(a)
+		if a == "*" || strings.EqualFold(a, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted blobs are a random salt followed by AES-256-GCM sealed segments.
+// Each segment holds encSegmentSize bytes of plaintext except the last one,
+// which is shorter (possibly empty) and authenticated as final so that a
+// truncated blob fails to decrypt.
+const (
+	encSaltSize    = 16
+	encSegmentSize = 64 * 1024
+	encTagSize     = 16
+)
+
+var (
+	errCiphertextTruncated = errors.New("encrypted blob is truncated")
+	errSealedValue         = errors.New("sealed value cannot be opened")
+)
+
+// derive the file key from the share secret
+func deriveKey(secret string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(secret), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonces are the segment counter, keys are unique per blob thanks to the salt
+func segmentNonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+func segmentAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// size of the plaintext of an encrypted blob of the given size
+func plaintextSize(size int64) int64 {
+	body := size - encSaltSize
+	if body < encTagSize {
+		return 0
+	}
+	full := body / (encSegmentSize + encTagSize)
+	rem := body % (encSegmentSize + encTagSize)
+	if rem < encTagSize {
+		// a blob always ends with a final segment, so this one is corrupt
+		return full * encSegmentSize
+	}
+	return full*encSegmentSize + rem - encTagSize
+}
+
+type encryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	counter uint64
+	plain   []byte
+	out     bytes.Buffer
+	done    bool
+}
+
+// encrypt everything read from r with a key derived from secret
+func newEncryptReader(r io.Reader, secret string) (io.Reader, error) {
+	salt := make([]byte, encSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := deriveKey(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	e := &encryptReader{src: r, aead: aead, plain: make([]byte, encSegmentSize)}
+	e.out.Write(salt)
+	return e, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for e.out.Len() == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(e.src, e.plain)
+		final := false
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			final = true
+		default:
+			return 0, err
+		}
+		e.out.Write(e.aead.Seal(nil, segmentNonce(e.counter), e.plain[:n], segmentAAD(final)))
+		e.counter++
+		e.done = final
+	}
+	return e.out.Read(p)
+}
+
+type decryptReader struct {
+	src     io.ReadCloser
+	secret  string
+	aead    cipher.AEAD
+	counter uint64
+	sealed  []byte
+	out     bytes.Buffer
+	done    bool
+}
+
+// decrypt a blob written by newEncryptReader
+func newDecryptReader(r io.ReadCloser, secret string) io.ReadCloser {
+	return &decryptReader{src: r, secret: secret, sealed: make([]byte, encSegmentSize+encTagSize)}
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.aead == nil {
+		salt := make([]byte, encSaltSize)
+		if _, err := io.ReadFull(d.src, salt); err != nil {
+			return 0, errCiphertextTruncated
+		}
+		aead, err := deriveKey(d.secret, salt)
+		if err != nil {
+			return 0, err
+		}
+		d.aead = aead
+	}
+	for d.out.Len() == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.src, d.sealed)
+		final := false
+		switch err {
+		case nil:
+		case io.ErrUnexpectedEOF:
+			final = true
+		case io.EOF:
+			return 0, errCiphertextTruncated
+		default:
+			return 0, err
+		}
+		plain, err := d.aead.Open(nil, segmentNonce(d.counter), d.sealed[:n], segmentAAD(final))
+		if err != nil {
+			return 0, err
+		}
+		d.out.Write(plain)
+		d.counter++
+		d.done = final
+	}
+	return d.out.Read(p)
+}
+
+func (d *decryptReader) Close() error {
+	return d.src.Close()
+}
+
+// AES-256-GCM keyed with the hash of key, for small values sealed with
+// secrets the database only holds hashed. The keys are random secrets rather
+// than passphrases, a slow derivation would not make them harder to guess.
+func valueCipher(key string) (cipher.AEAD, error) {
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal value as base64 of a random nonce followed by the ciphertext
+func sealValue(key string, value []byte) (string, error) {
+	aead, err := valueCipher(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, value, nil)), nil
+}
+
+// open a value sealed with key, errSealedValue when it was sealed with another
+func openValue(key, sealed string) ([]byte, error) {
+	aead, err := valueCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return nil, errSealedValue
+	}
+	value, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errSealedValue
+	}
+	return value, nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"mime"
+	"net/http"
+
+	"filer/internal/secret"
+)
+
+const (
+	csrfRoute = "CsrfToken"
+	csrfPath  = "/api/" + csrfRoute
+
+	csrfCookie = "filer_csrf"
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrf_token"
+
+	csrfTokenLength = 32
+	csrfCookieAge   = 12 * 60 * 60
+)
+
+// whether the request was made over https, the Functions host terminates TLS
+func secureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// the CSRF token of the browser r came from, a new one is set in a cookie
+// when it has none. Tokens are double-submitted: POST forms and scripts send
+// the value back, which pages of other sites cannot read.
+func csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if c, err := r.Cookie(csrfCookie); err == nil && len(c.Value) == csrfTokenLength {
+		return c.Value, nil
+	}
+	token, err := secret.Random(csrfTokenLength)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   csrfCookieAge,
+		Secure:   secureRequest(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token, nil
+}
+
+// whether r carries the token of its CSRF cookie in X-CSRF-Token or the csrf_token field
+// Multipart bodies are streamed by the upload handlers rather than parsed
+// here, uploads send the token in the header.
+func csrfValid(r *http.Request) bool {
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	sent := r.Header.Get(csrfHeader)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); sent == "" && mediaType != "multipart/form-data" {
+		sent = r.PostFormValue(csrfField)
+	}
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(c.Value)) == 1
+}
+
+// whether the request is authenticated by something the browser attaches on
+// its own, requests with bearer tokens or API keys cannot be forged by other sites
+func ambientCredentials(r *http.Request) bool {
+	return r.Header.Get("Authorization") == "" && r.Header.Get("X-Api-Key") == ""
+}
+
+// with CSRF_PROTECTION, state-changing requests without a bearer token or API
+// key must send the token of the CsrfToken route
+// filer has no cookie or session auth of its own: a page of another site can
+// forge nothing its visitors could not send directly, so the check is off by
+// default. It is for deployments behind a proxy signing browsers in with a
+// cookie, such as App Service Authentication, until filer has cookie auth.
+func (s *Server) withCSRF(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next(w, r)
+			return
+		}
+		if s.config.CSRFProtection && ambientCredentials(r) && !csrfValid(r) {
+			writeError(w, r, http.StatusForbidden, "missing or invalid CSRF token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// CSRF token
+// issues the token browser scripts send in X-CSRF-Token with state-changing requests
+func csrfTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := csrfToken(w, r)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to generate token")
+		return
+	}
+	res, err := json.Marshal(csrfTokenResponse{token, csrfHeader})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
+
+// headers of HTML pages: no framing, no scripts, no referrer leaking the secret
+func withSecurityHeaders(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Content-Security-Policy", "default-src 'none'; img-src 'self'; style-src 'unsafe-inline'; form-action 'self'; frame-ancestors 'none'; base-uri 'none'")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "no-referrer")
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Cross-Origin-Opener-Policy", "same-origin")
+		next(w, r)
+	}
+}
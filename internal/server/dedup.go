@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"strings"
+)
+
+// deduplicated blobs are stored under their content hash and shared by
+// every file with the same contents, the blobs collection counts the references
+const contentBlobPrefix = "sha256/"
+
+// name of the shared blob holding contents with the given hash
+func contentBlobName(sum string) string {
+	return contentBlobPrefix + sum
+}
+
+// id of the reference count of a blob, blobs of tenant containers are
+// only shared within their container
+func blobRefID(container, name string) string {
+	if container == "" {
+		return name
+	}
+	return container + "/" + name
+}
+
+// add a reference to the shared blob name of a container
+// returns the blob url once it is stored, otherwise the caller uploads it
+func (s *Server) acquireBlob(ctx context.Context, container, name string) (string, error) {
+	// the url is only recorded once the upload completed
+	return s.store.AcquireBlob(ctx, blobRefID(container, name))
+}
+
+// record the url of a shared blob after uploading it
+func (s *Server) storedBlob(ctx context.Context, container, name, url string) error {
+	return s.store.StoredBlob(ctx, blobRefID(container, name), url)
+}
+
+// drop a reference to the blob name, deleting it with its last reference
+// blobs that are not shared are deleted right away
+func (s *Server) releaseBlob(ctx context.Context, container, name string) error {
+	if !strings.HasPrefix(name, contentBlobPrefix) {
+		return s.storageFor(container).Delete(ctx, name)
+	}
+
+	last, err := s.store.ReleaseBlob(ctx, blobRefID(container, name))
+	if err != nil || !last {
+		return err
+	}
+	return s.storageFor(container).Delete(ctx, name)
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// how long in-flight transfers may take after SIGTERM
+const defaultShutdownTimeout = 30 * time.Second
+
+// run f in the background, draining waits for it
+func (s *Server) goBackground(f func()) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		f()
+	}()
+}
+
+// stop accepting connections, then wait for in-flight requests and background
+// work (scans, emails, webhooks, exported events) until ctx is done. Requests still running at the
+// deadline have their connections closed.
+func (s *Server) drain(ctx context.Context, srv *http.Server) {
+	close(s.draining)
+	s.logger.Info("draining", zap.Duration("timeout", s.config.ShutdownTimeout))
+
+	if err := srv.Shutdown(ctx); err != nil {
+		s.logger.Error("in-flight requests did not finish, closing their connections", zap.Error(err))
+		srv.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		s.webhooks.wait()
+		s.events.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.logger.Warn("background work did not finish before the deadline")
+	}
+}
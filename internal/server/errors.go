@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"filer/internal/secret"
+
+	"go.uber.org/zap"
+)
+
+type requestIDKey struct{}
+
+// write a JSON error response with the given status code
+func writeError(w http.ResponseWriter, r *http.Request, code int, message string) {
+	res, _ := json.Marshal(errorResponse{code, message, requestID(r.Context())})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(res)
+}
+
+// request id of the request the context belongs to
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// tag every request with an id, reusing X-Request-Id when the caller sent one,
+// then trace it and log it once it is answered
+func (s *Server) withRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || len(id) > 128 {
+			var err error
+			if id, err = secret.Random(16); err != nil {
+				id = ""
+			}
+		}
+		w.Header().Set("X-Request-Id", id)
+		s.withTracing(s.withAccessLog(next))(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	}
+}
+
+// answer 500 to handlers that panic instead of dropping the connection
+func (s *Server) withRecovery(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			s.logFor(r.Context()).Error("handler panicked", zap.Any("panic", v), zap.Stack("stack"))
+			writeError(w, r, http.StatusInternalServerError, "internal error")
+		}()
+		next(w, r)
+	}
+}
@@ -0,0 +1,528 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// event sinks, EVENT_SINK
+const (
+	eventSinkHTTP       = "http"
+	eventSinkAzureTable = "azure-table"
+	eventSinkBigQuery   = "bigquery"
+)
+
+const (
+	defaultEventSinkBatchSize = 100
+	// entity group transactions of Azure Table take at most 100 entities
+	maxAzureTableBatch       = 100
+	defaultEventSinkInterval = 10 * time.Second
+	// events waiting for export, later ones are dropped until a batch is sent
+	eventSinkQueueSize = 10000
+	eventSinkTimeout   = 30 * time.Second
+	eventSinkAttempts  = 3
+	eventSinkBackoff   = 2 * time.Second
+
+	azureTableVersion = "2019-02-02"
+	// Edm.DateTime values have at most 7 fractional digits
+	azureTableTime   = "2006-01-02T15:04:05.0000000Z07:00"
+	bigQueryURL      = "https://bigquery.googleapis.com"
+	bigQueryAudience = "https://bigquery.googleapis.com/"
+	bigQueryTokenTTL = time.Hour
+)
+
+var exportedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "filer_exported_events_total",
+	Help: "File events sent to the event sink by result (exported, failed, dropped).",
+}, []string{"result"})
+
+// eventSink stores batches of file events in an analytics store
+// Batches may be sent again after a failure, sinks rely on the event ids to
+// not count them twice.
+type eventSink interface {
+	export(ctx context.Context, events []webhookEvent) error
+}
+
+// create the sink selected by EVENT_SINK, nil when events are not exported
+func newEventSink(config *Config) (eventSink, error) {
+	client := &http.Client{Timeout: eventSinkTimeout}
+	switch sink := config.EventSink; sink {
+	case "":
+		return nil, nil
+	case eventSinkHTTP:
+		return &httpEventSink{url: config.EventSinkURL, secret: []byte(config.WebhookSecret), client: client}, nil
+	case eventSinkAzureTable:
+		key, err := base64.StdEncoding.DecodeString(config.AzureStorageAccessKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid azure storage access key: %w", err)
+		}
+		endpoint := config.EventSinkURL
+		if endpoint == "" {
+			endpoint = "https://" + config.AzureStorageAccount + ".table.core.windows.net"
+		}
+		return &azureTableSink{endpoint: endpoint, account: config.AzureStorageAccount, key: key, table: config.EventSinkTable, client: client}, nil
+	case eventSinkBigQuery:
+		return newBigQuerySink(config, client)
+	default:
+		return nil, fmt.Errorf("unknown event sink %q", sink)
+	}
+}
+
+// eventExporter sends the emitted events to a sink in batches of
+// EVENT_SINK_BATCH_SIZE, at least every EVENT_SINK_INTERVAL
+type eventExporter struct {
+	sink      eventSink
+	logger    *zap.Logger
+	batchSize int
+	interval  time.Duration
+	queue     chan webhookEvent
+	// closed to send what is left and stop, done is closed once it is sent
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// exporter of EVENT_SINK, nil when events are not exported
+func newEventExporter(config *Config, logger *zap.Logger) (*eventExporter, error) {
+	sink, err := newEventSink(config)
+	if err != nil || sink == nil {
+		return nil, err
+	}
+	e := &eventExporter{
+		sink:      sink,
+		logger:    logger,
+		batchSize: config.EventSinkBatchSize,
+		interval:  config.EventSinkInterval,
+		queue:     make(chan webhookEvent, eventSinkQueueSize),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// queue an event for export, dropping it when the queue is full
+func (e *eventExporter) add(event webhookEvent) {
+	if e == nil {
+		return
+	}
+	select {
+	case e.queue <- event:
+	default:
+		exportedEvents.WithLabelValues("dropped").Inc()
+		e.logger.Warn("event sink: queue full, dropping event", zap.String("event", event.Type), zap.String("event_id", event.ID))
+	}
+}
+
+func (e *eventExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	var batch []webhookEvent
+	for {
+		select {
+		case event := <-e.queue:
+			if batch = append(batch, event); len(batch) >= e.batchSize {
+				e.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.flush(batch)
+			batch = nil
+		case <-e.stop:
+			// run is the only reader, the queued events cannot go meanwhile
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			for len(batch) > 0 {
+				n := len(batch)
+				if n > e.batchSize {
+					n = e.batchSize
+				}
+				e.flush(batch[:n])
+				batch = batch[n:]
+			}
+			return
+		}
+	}
+}
+
+// export a batch, retrying failures with a growing backoff
+func (e *eventExporter) flush(batch []webhookEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	backoff := eventSinkBackoff
+	for attempt := 1; ; attempt++ {
+		err := e.sink.export(context.Background(), batch)
+		if err == nil {
+			exportedEvents.WithLabelValues("exported").Add(float64(len(batch)))
+			return
+		}
+		if attempt == eventSinkAttempts {
+			exportedEvents.WithLabelValues("failed").Add(float64(len(batch)))
+			e.logger.Error("event sink: giving up on batch", zap.Int("events", len(batch)), zap.Error(err))
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// send the queued events and wait for them, events added later are not sent
+func (e *eventExporter) wait() {
+	if e == nil {
+		return
+	}
+	e.once.Do(func() { close(e.stop) })
+	<-e.done
+}
+
+// httpEventSink posts batches as a JSON array, signed like webhooks
+type httpEventSink struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func (h *httpEventSink) export(ctx context.Context, events []webhookEvent) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(h.secret) > 0 {
+		req.Header.Set("X-Filer-Signature", "sha256="+signWebhook(h.secret, body))
+	}
+	return doSinkRequest(h.client, req, nil)
+}
+
+// send req, failing on answers other than 2xx, and decode a JSON answer into
+// out unless it is nil
+func doSinkRequest(client *http.Client, req *http.Request, out interface{}) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// azureTableSink upserts events as entities of an Azure Table, partitioned
+// by day with the event id as row key, in entity group transactions
+type azureTableSink struct {
+	endpoint string
+	account  string
+	key      []byte
+	table    string
+	client   *http.Client
+	// the table is created before the first batch
+	created bool
+}
+
+func (a *azureTableSink) export(ctx context.Context, events []webhookEvent) error {
+	if !a.created {
+		if err := a.createTable(ctx); err != nil {
+			return fmt.Errorf("failed to create table: %w", err)
+		}
+		a.created = true
+	}
+	// a transaction only holds entities of one partition
+	var partitions []string
+	byPartition := map[string][]webhookEvent{}
+	for _, event := range events {
+		partition := event.Timestamp.Format("20060102")
+		if _, ok := byPartition[partition]; !ok {
+			partitions = append(partitions, partition)
+		}
+		byPartition[partition] = append(byPartition[partition], event)
+	}
+	for _, partition := range partitions {
+		if err := a.upsert(ctx, partition, byPartition[partition]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// create the table unless it exists
+func (a *azureTableSink) createTable(ctx context.Context) error {
+	body, _ := json.Marshal(map[string]string{"TableName": a.table})
+	req, err := a.request(ctx, http.MethodPost, "Tables", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json;odata=nometadata")
+	req.Header.Set("Prefer", "return-no-content")
+	res, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 && res.StatusCode != http.StatusConflict {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+// insert or replace the events of a partition in one transaction
+func (a *azureTableSink) upsert(ctx context.Context, partition string, events []webhookEvent) error {
+	batch, changeset := "batch_"+events[0].ID, "changeset_"+events[0].ID
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "--%s\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n", batch, changeset)
+	for i, event := range events {
+		entity, err := json.Marshal(azureTableEntity(partition, event))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&body, "--%s\r\nContent-Type: application/http\r\nContent-Transfer-Encoding: binary\r\n\r\n", changeset)
+		fmt.Fprintf(&body, "PUT %s/%s(PartitionKey='%s',RowKey='%s') HTTP/1.1\r\n", a.endpoint, a.table, partition, event.ID)
+		fmt.Fprintf(&body, "Content-ID: %d\r\nContent-Type: application/json\r\nAccept: application/json;odata=nometadata\r\nDataServiceVersion: 3.0\r\n\r\n", i+1)
+		body.Write(entity)
+		body.WriteString("\r\n")
+	}
+	fmt.Fprintf(&body, "--%s--\r\n--%s--\r\n", changeset, batch)
+
+	req, err := a.request(ctx, http.MethodPost, "$batch", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+batch)
+	res, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	answer, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	// the transaction fails as a whole, with the status of the failed entity
+	for _, line := range strings.Split(string(answer), "\n") {
+		if strings.HasPrefix(line, "HTTP/1.1 ") && !strings.HasPrefix(line, "HTTP/1.1 2") {
+			return fmt.Errorf("transaction failed: %s", strings.TrimSpace(line))
+		}
+	}
+	return nil
+}
+
+// properties of the entity of an event, the 64 bit size has to be typed
+func azureTableEntity(partition string, event webhookEvent) map[string]interface{} {
+	entity := map[string]interface{}{
+		"PartitionKey":    partition,
+		"RowKey":          event.ID,
+		"Type":            event.Type,
+		"FileID":          event.FileID,
+		"Time":            event.Timestamp.Format(azureTableTime),
+		"Time@odata.type": "Edm.DateTime",
+		"FileName":        event.Metadata.FileName,
+		"Size":            strconv.FormatInt(event.Metadata.Size, 10),
+		"Size@odata.type": "Edm.Int64",
+		"ContentType":     event.Metadata.ContentType,
+		"SHA256":          event.Metadata.SHA256,
+		"Uploader":        event.Metadata.Uploader,
+		"Owner":           event.Metadata.Owner,
+		"Downloads":       event.Metadata.Downloads,
+		"MaxDownloads":    event.Metadata.MaxDownloads,
+	}
+	if event.Metadata.ExpiresAt != nil {
+		entity["ExpiresAt"] = event.Metadata.ExpiresAt.UTC().Format(azureTableTime)
+		entity["ExpiresAt@odata.type"] = "Edm.DateTime"
+	}
+	return entity
+}
+
+// a request to the table service signed with the account key (SharedKeyLite)
+func (a *azureTableSink) request(ctx context.Context, method, resource string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, a.endpoint+"/"+resource, body)
+	if err != nil {
+		return nil, err
+	}
+	date := time.Now().UTC().Format(http.TimeFormat)
+	mac := hmac.New(sha256.New, a.key)
+	fmt.Fprintf(mac, "%s\n/%s/%s", date, a.account, resource)
+	req.Header.Set("x-ms-date", date)
+	req.Header.Set("x-ms-version", azureTableVersion)
+	req.Header.Set("DataServiceVersion", "3.0")
+	req.Header.Set("MaxDataServiceVersion", "3.0;NetFx")
+	req.Header.Set("Authorization", "SharedKeyLite "+a.account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return req, nil
+}
+
+// bigQuerySink streams events into a BigQuery table, authenticated as the
+// service account of EVENT_SINK_CREDENTIALS with self-signed tokens
+// The table has the columns of the JSON events: id, type, file_id,
+// timestamp and a metadata record.
+type bigQuerySink struct {
+	url    string
+	email  string
+	keyID  string
+	key    *rsa.PrivateKey
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// fields of a service account key file
+type serviceAccountKey struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+}
+
+func newBigQuerySink(config *Config, client *http.Client) (*bigQuerySink, error) {
+	data, err := ioutil.ReadFile(config.EventSinkCredentials)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event sink credentials: %w", err)
+	}
+	var account serviceAccountKey
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("invalid event sink credentials: %w", err)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil || account.ClientEmail == "" {
+		return nil, errors.New("invalid event sink credentials: missing client_email or private_key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid event sink credentials: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid event sink credentials: private_key is not an RSA key")
+	}
+
+	base := config.EventSinkURL
+	if base == "" {
+		base = bigQueryURL
+	}
+	// project.dataset.table, checked by the configuration
+	parts := strings.Split(config.EventSinkTable, ".")
+	return &bigQuerySink{
+		url: fmt.Sprintf("%s/bigquery/v2/projects/%s/datasets/%s/tables/%s/insertAll",
+			strings.TrimRight(base, "/"), url.PathEscape(parts[0]), url.PathEscape(parts[1]), url.PathEscape(parts[2])),
+		email:  account.ClientEmail,
+		keyID:  account.PrivateKeyID,
+		key:    key,
+		client: client,
+	}, nil
+}
+
+func (b *bigQuerySink) export(ctx context.Context, events []webhookEvent) error {
+	type row struct {
+		InsertID string       `json:"insertId"`
+		JSON     webhookEvent `json:"json"`
+	}
+	rows := make([]row, len(events))
+	for i, event := range events {
+		// insertId lets BigQuery drop rows of a batch sent again
+		rows[i] = row{InsertID: event.ID, JSON: event}
+	}
+	body, err := json.Marshal(struct {
+		Kind string `json:"kind"`
+		Rows []row  `json:"rows"`
+	}{"bigquery#tableDataInsertAllRequest", rows})
+	if err != nil {
+		return err
+	}
+	token, err := b.accessToken()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	var answer struct {
+		InsertErrors []struct {
+			Index  int `json:"index"`
+			Errors []struct {
+				Reason  string `json:"reason"`
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+	}
+	if err := doSinkRequest(b.client, req, &answer); err != nil {
+		return err
+	}
+	if len(answer.InsertErrors) > 0 {
+		first := answer.InsertErrors[0]
+		msg := "unknown error"
+		if len(first.Errors) > 0 {
+			msg = first.Errors[0].Reason + ": " + first.Errors[0].Message
+		}
+		return fmt.Errorf("%d rows rejected, row %d: %s", len(answer.InsertErrors), first.Index, msg)
+	}
+	return nil
+}
+
+// a JWT signed with the service account key, which Google APIs accept as
+// an access token, renewed a few minutes before it expires
+func (b *bigQuerySink) accessToken() (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.token != "" && now.Before(b.expires.Add(-5*time.Minute)) {
+		return b.token, nil
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": b.keyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss": b.email,
+		"sub": b.email,
+		"aud": bigQueryAudience,
+		"iat": now.Unix(),
+		"exp": now.Add(bigQueryTokenTTL).Unix(),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, b.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	b.token = signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+	b.expires = now.Add(bigQueryTokenTTL)
+	return b.token, nil
+}
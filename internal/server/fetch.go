@@ -0,0 +1,271 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+const (
+	fetchRoute = "FetchTrigger"
+	fetchPath  = "/api/" + fetchRoute
+
+	defaultFetchTimeout = 10 * time.Minute
+	maxFetchRedirects   = 5
+	defaultFetchName    = "download"
+)
+
+var (
+	errForbiddenAddress = errors.New("address is not public")
+	errFetchTooLarge    = errors.New("source exceeds the maximum upload size")
+)
+
+// ranges that are neither private nor loopback but still not the public internet
+var reservedNets = parseCIDRs(
+	"0.0.0.0/8",      // this network
+	"100.64.0.0/10",  // carrier-grade NAT
+	"192.0.0.0/24",   // IETF protocol assignments
+	"198.18.0.0/15",  // benchmarking
+	"240.0.0.0/4",    // reserved, including broadcast
+	"64:ff9b::/96",   // NAT64, reaches IPv4 addresses
+	"64:ff9b:1::/48", // local-use NAT64
+	"2002::/16",      // 6to4, reaches IPv4 addresses
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// whether ip is on the public internet
+// fetches must not reach the internal network or cloud metadata endpoints
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// the dialed address is checked rather than the URL host, so names
+// resolving, or rebinding, to internal addresses are refused too
+func fetchDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return errForbiddenAddress
+	}
+	return nil
+}
+
+// client of remote fetches, it ignores proxy settings as a proxy would dial on its behalf
+var fetchClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, Control: fetchDialControl}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxFetchRedirects {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return errors.New("redirect to an unsupported scheme")
+		}
+		return nil
+	},
+}
+
+func readFetchRequest(r *http.Request) (*fetchRequest, error) {
+	var req fetchRequest
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxClientMetadataBytes)).Decode(&req); err != nil {
+			return nil, errors.New("invalid JSON body")
+		}
+		return &req, nil
+	}
+	req = fetchRequest{URL: r.FormValue("url"), Name: r.FormValue("name"), TTL: r.FormValue("ttl")}
+	if v := r.FormValue("max_downloads"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.New("invalid max_downloads")
+		}
+		req.MaxDownloads = n
+	}
+	req.Encrypt, _ = strconv.ParseBool(r.FormValue("encrypt"))
+	return &req, nil
+}
+
+// a downloaded source, spooled to a temporary file
+type fetchedFile struct {
+	*os.File
+	size        int64
+	name        string
+	contentType string
+}
+
+func (f *fetchedFile) Close() error {
+	f.File.Close()
+	return os.Remove(f.File.Name())
+}
+
+// download the source at u into a temporary file of at most limit bytes, 0 for unlimited
+func (s *Server) fetchSource(ctx context.Context, u *url.URL, limit int64) (*fetchedFile, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", s.config.ServiceName)
+	res, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("source responded with status %d", res.StatusCode)
+	}
+	if limit > 0 && res.ContentLength > limit {
+		return nil, errFetchTooLarge
+	}
+
+	tmp, err := ioutil.TempFile("", "filer-fetch-")
+	if err != nil {
+		return nil, err
+	}
+	f := &fetchedFile{File: tmp, contentType: res.Header.Get("Content-Type"), name: path.Base(res.Request.URL.Path)}
+	if _, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		f.name = params["filename"]
+	}
+
+	body := io.Reader(res.Body)
+	if limit > 0 {
+		body = io.LimitReader(res.Body, limit+1)
+	}
+	if f.size, err = io.Copy(tmp, body); err == nil && limit > 0 && f.size > limit {
+		err = errFetchTooLarge
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Fetch
+// downloads a public http or https URL server-side and shares it like an
+// upload, so large files do not travel through the client. Sources are
+// limited by MAX_UPLOAD_BYTES and FETCH_TIMEOUT and must resolve to public
+// addresses.
+func (s *Server) fetchHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := readFetchRequest(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeError(w, r, http.StatusBadRequest, "invalid url")
+		return
+	}
+
+	file := store.File{Uploader: s.uploader(r), Owner: requestUser(r.Context()), Encrypted: req.Encrypt}
+	file.Container = s.tenantContainer(file.Uploader)
+	if err := applyLimits(&file, req.TTL, req.MaxDownloads); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.config.FetchTimeout)
+	defer cancel()
+	limit := s.config.maxUploadBytes(fetchRoute)
+	src, err := s.fetchSource(ctx, u, limit)
+	switch {
+	case errors.Is(err, errForbiddenAddress):
+		writeError(w, r, http.StatusForbidden, "url does not resolve to a public address")
+		return
+	case err == errFetchTooLarge:
+		writeTooLarge(w, r, limit)
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, r, http.StatusGatewayTimeout, "fetching the url timed out")
+		return
+	case err != nil:
+		s.logFor(r.Context()).Info("failed to fetch url", zap.String("host", u.Host), zap.Error(err))
+		writeError(w, r, http.StatusBadGateway, "failed to fetch url")
+		return
+	}
+	defer src.Close()
+
+	name := req.Name
+	if name == "" {
+		name = src.name
+	}
+	if name == "" || name == "." || name == "/" {
+		name = defaultFetchName
+	}
+	file.FileName = sanitizeFileName(name)
+	file.Size = src.size
+
+	secret, err := s.newSecret(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to generate secret")
+		return
+	}
+	if err := s.reserveQuota(r.Context(), file.Uploader, file.Size); err != nil {
+		s.writeQuotaError(w, r, err)
+		return
+	}
+	file.QuotaCharged = true
+	stored := false
+	defer func() {
+		if !stored {
+			s.releaseQuota(context.Background(), file.Uploader, file.Size)
+		}
+	}()
+
+	part, err := s.storeContent(r.Context(), file.Container, src, file.FileName, src.contentType, file.Size, secret, file.Encrypted, nil)
+	if s.writeRefused(w, r, err) {
+		return
+	}
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to store fetched file", zap.Error(err))
+		writeError(w, r, http.StatusBadGateway, "failed to store file")
+		return
+	}
+	setPart(&file, part)
+	stored = s.saveUpload(w, r, &file, part, secret, "fetch")
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// name used when nothing is left of a file name once sanitized
+	defaultFileName = "file"
+	// longest file name in bytes, the limit of most file systems
+	maxFileNameBytes = 255
+)
+
+// last path element of a client file name without control characters,
+// shortened to maxFileNameBytes
+// some clients send the full local path, with either separator
+func sanitizeFileName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." || name == "/" {
+		return defaultFileName
+	}
+	return truncateFileName(name, maxFileNameBytes)
+}
+
+// shorten name to limit bytes, keeping its extension and whole UTF-8 characters
+func truncateFileName(name string, limit int) string {
+	if len(name) <= limit {
+		return name
+	}
+	ext := path.Ext(name)
+	if len(ext) > limit/2 {
+		ext = ""
+	}
+	cut := limit - len(ext)
+	// never cut a character in half
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	return name[:cut] + ext
+}
+
+// name of a new blob that is not deduplicated, unique so uploads of files
+// with the same name never overwrite each other
+func newBlobName(fileName string) string {
+	return uuid.New().String() + "/" + sanitizeFileName(fileName)
+}
+
+// Content-Disposition of a download
+func attachmentDisposition(fileName string) string {
+	return disposition("attachment", fileName)
+}
+
+// Content-Disposition of a file rendered by the browser
+func inlineDisposition(fileName string) string {
+	return disposition("inline", fileName)
+}
+
+// the filename parameter is reduced to printable ASCII so it cannot break out
+// of the quoted string, names with other characters are also sent in full as
+// an RFC 5987 filename* parameter
+func disposition(kind, fileName string) string {
+	fileName = sanitizeFileName(fileName)
+	ascii := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, fileName)
+	value := kind + `; filename="` + ascii + `"`
+	if ascii != fileName {
+		value += "; filename*=UTF-8''" + encodeRFC5987(fileName)
+	}
+	return value
+}
+
+// percent-encode s as an RFC 5987 ext-value, keeping its attr-chars
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&15])
+	}
+	return b.String()
+}
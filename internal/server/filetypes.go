@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"filer/internal/store"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Uploads are refused with 415 when their name or content type matches
+// BLOCKED_FILE_TYPES, or when ALLOWED_FILE_TYPES is set and they do not
+// match it. The content type is the sniffed one whenever the contents are
+// recognized, so renaming an executable or declaring it an image does not
+// get it through. Files of bundles and archives are checked one by one, files
+// encrypted by their clients are application/octet-stream.
+
+var refusedFileTypes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "filer_refused_file_types_total",
+	Help: "Uploads refused by BLOCKED_FILE_TYPES or ALLOWED_FILE_TYPES by list (blocked, allowed).",
+}, []string{"list"})
+
+// fileType matches files by content type or by the extension of their name
+type fileType struct {
+	// type:<type>, a trailing /* matches every subtype
+	contentType string
+	// ext:<extension>, lowercase with its dot
+	extension string
+}
+
+// parse type:<content type> or ext:<extension>
+func parseFileType(match string) (fileType, bool) {
+	switch {
+	case strings.HasPrefix(match, "type:") && len(match) > len("type:"):
+		return fileType{contentType: strings.ToLower(strings.TrimPrefix(match, "type:"))}, true
+	case strings.HasPrefix(match, "ext:") && len(match) > len("ext:"):
+		return fileType{extension: "." + strings.TrimPrefix(strings.ToLower(strings.TrimPrefix(match, "ext:")), ".")}, true
+	}
+	return fileType{}, false
+}
+
+// whether a file named name of contentType matches, parameters of the
+// content type aside
+func (t fileType) matches(contentType, name string) bool {
+	if t.extension != "" {
+		return strings.ToLower(path.Ext(name)) == t.extension
+	}
+	if contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(contentType)
+	}
+	if strings.HasSuffix(t.contentType, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(t.contentType, "*"))
+	}
+	return mediaType == t.contentType
+}
+
+func (t fileType) String() string {
+	if t.extension != "" {
+		return "*" + t.extension
+	}
+	return t.contentType
+}
+
+// fileTypeError refuses an upload by its name or content type
+type fileTypeError struct {
+	reason string
+}
+
+func (e *fileTypeError) Error() string {
+	return "upload refused, " + e.reason
+}
+
+func (e *fileTypeError) statusCode() int {
+	return http.StatusUnsupportedMediaType
+}
+
+// check a file assembled in storage by the type sniffed from its blob, when
+// types are restricted
+func (s *Server) checkBlobType(ctx context.Context, container string, file *store.File) error {
+	if len(s.config.BlockedFileTypes) == 0 && len(s.config.AllowedFileTypes) == 0 {
+		return nil
+	}
+	blob, err := s.storageFor(container).GetRange(ctx, file.Blob, 0, 512)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	contentType, _, err := detectContentType(blob, file.FileName, file.ContentType)
+	if err != nil {
+		return err
+	}
+	return s.checkFileType(file.FileName, contentType)
+}
+
+// check a file named name of contentType against BLOCKED_FILE_TYPES and
+// ALLOWED_FILE_TYPES, an empty contentType only checks the name
+func (s *Server) checkFileType(name, contentType string) error {
+	for _, t := range s.config.BlockedFileTypes {
+		if t.matches(contentType, name) {
+			refusedFileTypes.WithLabelValues("blocked").Inc()
+			what := "files of type " + t.contentType
+			if t.extension != "" {
+				what = "files named " + t.String()
+			}
+			return &fileTypeError{reason: what + " are not accepted"}
+		}
+	}
+
+	// the name and the type must each match one of the rules for them
+	var extensions, types []string
+	extOK, typeOK := false, contentType == ""
+	for _, t := range s.config.AllowedFileTypes {
+		if t.extension != "" {
+			extensions = append(extensions, t.String())
+			extOK = extOK || t.matches(contentType, name)
+		} else {
+			types = append(types, t.String())
+			typeOK = typeOK || t.matches(contentType, name)
+		}
+	}
+	if len(extensions) > 0 && !extOK {
+		refusedFileTypes.WithLabelValues("allowed").Inc()
+		return &fileTypeError{reason: fmt.Sprintf("only files named %s are accepted", strings.Join(extensions, ", "))}
+	}
+	if len(types) > 0 && !typeOK {
+		refusedFileTypes.WithLabelValues("allowed").Inc()
+		return &fileTypeError{reason: fmt.Sprintf("only files of type %s are accepted", strings.Join(types, ", "))}
+	}
+	return nil
+}
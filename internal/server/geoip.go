@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Countries of client addresses are looked up in a MaxMind GeoIP2 or
+// GeoLite2 database file (.mmdb) named by GEOIP_DATABASE, read into memory at
+// startup.
+
+// geoIPDatabase is a MaxMind database read into memory
+type geoIPDatabase struct {
+	reader *maxminddb.Reader
+}
+
+// the fields of country records the lookups decode
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// read the database at path, nil when path is empty
+func openGeoIP(path string) (*geoIPDatabase, error) {
+	if path == "" {
+		return nil, nil
+	}
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GeoIP database %s: %w", path, err)
+	}
+	return &geoIPDatabase{reader: reader}, nil
+}
+
+// ISO 3166-1 code of the country of ip, empty when it is unknown
+// The registered country stands in for addresses without a country, such as
+// those of satellite providers.
+func (db *geoIPDatabase) country(ip net.IP) (string, error) {
+	// IPv4 databases know no IPv6 addresses, they are not an error here
+	if ip.To4() == nil && db.reader.Metadata.IPVersion == 4 {
+		return "", nil
+	}
+	var record geoIPRecord
+	if err := db.reader.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode, nil
+	}
+	return record.RegisteredCountry.ISOCode, nil
+}
@@ -0,0 +1,1788 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"filer/internal/secret"
+	"filer/internal/storage"
+	"filer/internal/store"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	// environment variables
+	metadataBackendEnvVarName         = "METADATA_BACKEND"
+	metadataDSNEnvVarName             = "METADATA_DSN"
+	mongoDBConnectionStringEnvVarName = "MONGODB_CONNECTION_STRING"
+	mongoDBDatabaseEnvVarName         = "MONGODB_DATABASE"
+	mongoDBCollectionEnvVarName       = "MONGODB_COLLECTION"
+	mongoDBMaxPoolSizeEnvVarName      = "MONGODB_MAX_POOL_SIZE"
+	mongoDBTimeoutEnvVarName          = "MONGODB_TIMEOUT"
+	redisURLEnvVarName                = "REDIS_URL"
+	thumbnailSizeEnvVarName           = "THUMBNAIL_SIZE"
+	fetchTimeoutEnvVarName            = "FETCH_TIMEOUT"
+	downloadParallelismEnvVarName     = "DOWNLOAD_PARALLELISM"
+	downloadChunkBytesEnvVarName      = "DOWNLOAD_CHUNK_BYTES"
+	downloadBytesPerSecondEnvVarName  = "DOWNLOAD_BYTES_PER_SECOND"
+	globalDownloadBytesEnvVarName     = "GLOBAL_DOWNLOAD_BYTES_PER_SECOND"
+	maxConcurrentUploadsEnvVarName    = "MAX_CONCURRENT_UPLOADS"
+	idempotencyTTLEnvVarName          = "IDEMPOTENCY_TTL"
+	cacheTTLEnvVarName                = "CACHE_TTL"
+	storageTimeoutEnvVarName          = "STORAGE_TIMEOUT"
+	azureStorageAccount               = "AZURE_STORAGE_ACCOUNT"
+	azureStorageAccessKey             = "AZURE_STORAGE_ACCESS_KEY"
+	azureStorageEndpointEnvVarName    = "AZURE_STORAGE_ENDPOINT"
+	azureAuthModeEnvVarName           = "AZURE_AUTH_MODE"
+	azureStorageContainerEnvVarName   = "AZURE_STORAGE_CONTAINER"
+	secondaryStorageAccount           = "SECONDARY_STORAGE_ACCOUNT"
+	secondaryStorageAccessKey         = "SECONDARY_STORAGE_ACCESS_KEY"
+	secondaryEndpointEnvVarName       = "SECONDARY_STORAGE_ENDPOINT"
+	secondaryStorageDirEnvVarName     = "SECONDARY_LOCAL_STORAGE_DIR"
+	tenantContainersEnvVarName        = "TENANT_CONTAINERS"
+	azureClientIDEnvVarName           = "AZURE_CLIENT_ID"
+	storageBackendEnvVarName          = "STORAGE_BACKEND"
+	localStorageDirEnvVarName         = "LOCAL_STORAGE_DIR"
+	janitorIntervalEnvVarName         = "JANITOR_INTERVAL"
+	reconcileIntervalEnvVarName       = "RECONCILE_INTERVAL"
+	trashRetentionEnvVarName          = "TRASH_RETENTION"
+	retentionRulesEnvVarName          = "RETENTION_RULES"
+	tierCoolAfterEnvVarName           = "TIER_COOL_AFTER"
+	tierArchiveAfterEnvVarName        = "TIER_ARCHIVE_AFTER"
+	auditLogEnvVarName                = "AUDIT_LOG"
+	auditRetentionEnvVarName          = "AUDIT_RETENTION"
+	shutdownTimeoutEnvVarName         = "SHUTDOWN_TIMEOUT"
+	secretHMACKeyEnvVarName           = "SECRET_HMAC_KEY"
+	migrateSecretsEnvVarName          = "MIGRATE_SECRETS"
+	corsAllowedOriginsEnvVarName      = "CORS_ALLOWED_ORIGINS"
+	maxUploadBytesEnvVarName          = "MAX_UPLOAD_BYTES"
+	downloadRedirectEnvVarName        = "DOWNLOAD_REDIRECT"
+	signedURLExpiryEnvVarName         = "SIGNED_URL_EXPIRY"
+	cdnBaseURLEnvVarName              = "CDN_BASE_URL"
+	clamdAddressEnvVarName            = "CLAMD_ADDRESS"
+	geoIPDatabaseEnvVarName           = "GEOIP_DATABASE"
+	dlpModeEnvVarName                 = "DLP_MODE"
+	dlpKeywordsEnvVarName             = "DLP_KEYWORDS"
+	blockedFileTypesEnvVarName        = "BLOCKED_FILE_TYPES"
+	allowedFileTypesEnvVarName        = "ALLOWED_FILE_TYPES"
+	verifyDownloadsEnvVarName         = "VERIFY_DOWNLOADS"
+	downloadTokenKeyEnvVarName        = "DOWNLOAD_TOKEN_KEY"
+	downloadTokenTTLEnvVarName        = "DOWNLOAD_TOKEN_TTL"
+	compressDownloadsEnvVarName       = "COMPRESS_DOWNLOADS"
+	compressAtRestEnvVarName          = "COMPRESS_AT_REST"
+	adminAPIKeyEnvVarName             = "ADMIN_API_KEY"
+	uploadAPIKeysEnvVarName           = "UPLOAD_API_KEYS"
+	s3GatewayEnvVarName               = "S3_GATEWAY"
+	s3BucketEnvVarName                = "S3_BUCKET"
+	webdavEnvVarName                  = "WEBDAV"
+	sftpPortEnvVarName                = "SFTP_PORT"
+	sftpHostKeyEnvVarName             = "SFTP_HOST_KEY"
+	sftpAuthorizedKeysEnvVarName      = "SFTP_AUTHORIZED_KEYS"
+	queueIngestionEnvVarName          = "QUEUE_INGESTION"
+	ingestPrefixEnvVarName            = "INGEST_PREFIX"
+	oidcIssuerEnvVarName              = "OIDC_ISSUER"
+	oidcAudienceEnvVarName            = "OIDC_AUDIENCE"
+	userQuotaEnvVarName               = "QUOTA_BYTES_PER_USER"
+	globalQuotaEnvVarName             = "QUOTA_BYTES_GLOBAL"
+	rateLimitEnvVarName               = "RATE_LIMIT"
+	trustedProxiesEnvVarName          = "TRUSTED_PROXIES"
+	secretLengthEnvVarName            = "SECRET_LENGTH"
+	publicBaseURLEnvVarName           = "PUBLIC_BASE_URL"
+	emailProviderEnvVarName           = "EMAIL_PROVIDER"
+	emailFromEnvVarName               = "EMAIL_FROM"
+	emailRateLimitEnvVarName          = "EMAIL_RATE_LIMIT"
+	smtpHostEnvVarName                = "SMTP_HOST"
+	smtpPortEnvVarName                = "SMTP_PORT"
+	smtpUsernameEnvVarName            = "SMTP_USERNAME"
+	smtpPasswordEnvVarName            = "SMTP_PASSWORD"
+	sendGridAPIKeyEnvVarName          = "SENDGRID_API_KEY"
+	webhookURLsEnvVarName             = "WEBHOOK_URLS"
+	webhookSecretEnvVarName           = "WEBHOOK_SECRET"
+	eventSinkEnvVarName               = "EVENT_SINK"
+	eventSinkURLEnvVarName            = "EVENT_SINK_URL"
+	eventSinkTableEnvVarName          = "EVENT_SINK_TABLE"
+	eventSinkCredentialsEnvVarName    = "EVENT_SINK_CREDENTIALS"
+	eventSinkBatchSizeEnvVarName      = "EVENT_SINK_BATCH_SIZE"
+	eventSinkIntervalEnvVarName       = "EVENT_SINK_INTERVAL"
+	eventOutboxEnvVarName             = "EVENT_OUTBOX"
+	csrfProtectionEnvVarName          = "CSRF_PROTECTION"
+	reportSigningKeyEnvVarName        = "REPORT_SIGNING_KEY"
+	logLevelEnvVarName                = "LOG_LEVEL"
+	otlpEndpointEnvVarName            = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	otelServiceNameEnvVarName         = "OTEL_SERVICE_NAME"
+	envFileEnvVarName                 = "ENV_FILE"
+
+	// route names, also used for per-route overrides
+	uploadRoute     = "UploadTrigger"
+	downloadRoute   = "DownloadTrigger"
+	deleteRoute     = "DeleteTrigger"
+	metaRoute       = "Meta"
+	fileInfoRoute   = "FileInfo"
+	scanStatusRoute = "ScanStatus"
+
+	maxClientMetadataBytes = 8 * 1024
+	// text fields of multipart uploads are held in memory up to this size
+	maxUploadFieldBytes = 64 * 1024
+
+	// secrets are 6 bits per character, the default gives 72 bits
+	defaultSecretLength = 12
+	minSecretLength     = 8
+	maxSecretLength     = 128
+	maxSecretAttempts   = 5
+	defaultBundleName   = "files.zip"
+
+	defaultMongoDBTimeout = 10 * time.Second
+	// time a storage call other than a transfer may take unless configured
+	defaultStorageTimeout = 30 * time.Second
+	// lifetime of signed download URLs unless configured
+	defaultSignedURLExpiry = 5 * time.Minute
+	// lifetime of cached files unless configured, files expiring sooner are cached until then
+	defaultCacheTTL = 5 * time.Minute
+)
+
+// create the token that deletes a share
+func newDeleteToken() (string, error) {
+	return secret.Random(32)
+}
+
+// create a share secret that is not in use yet
+func (s *Server) newSecret(ctx context.Context) (string, error) {
+	return s.unusedSecret(ctx, func() (string, error) {
+		return secret.Random(s.config.SecretLength)
+	})
+}
+
+// create a word code that is not in use yet
+func (s *Server) newWordCode(ctx context.Context) (string, error) {
+	return s.unusedSecret(ctx, makeWordCode)
+}
+
+// draw secrets until one matches no stored secret or word code
+func (s *Server) unusedSecret(ctx context.Context, generate func() (string, error)) (string, error) {
+	for i := 0; i < maxSecretAttempts; i++ {
+		secret, err := generate()
+		if err != nil {
+			return "", err
+		}
+		inUse, err := s.store.SecretInUse(ctx, secret)
+		if err != nil {
+			return "", err
+		}
+		if !inUse {
+			return secret, nil
+		}
+		s.logger.Info("secret collision, retrying")
+	}
+	return "", errors.New("failed to generate an unused secret")
+}
+
+// share link of a secret under PUBLIC_BASE_URL, empty when it is not configured
+// the base URL includes the route prefix of the Functions host, e.g. https://example.com/api
+func (s *Server) shareURL(secret string) string {
+	if s.config.PublicBaseURL == "" {
+		return ""
+	}
+	return s.config.PublicBaseURL + "/d/" + url.PathEscape(secret)
+}
+
+// share link of a secret, under the address r was sent to when
+// PUBLIC_BASE_URL is not configured
+func (s *Server) requestShareURL(r *http.Request, secret string) string {
+	return s.requestPageURL(r, landingRoute, secret)
+}
+
+// link to the page of route showing secret, like requestShareURL
+func (s *Server) requestPageURL(r *http.Request, route, secret string) string {
+	if s.config.PublicBaseURL != "" {
+		return s.config.PublicBaseURL + "/" + route + "/" + url.PathEscape(secret)
+	}
+	scheme := "http"
+	if secureRequest(r) {
+		scheme = "https"
+	}
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	return scheme + "://" + host + "/api/" + route + "/" + url.PathEscape(secret)
+}
+
+// answer to the upload of file, shared under secret
+func (s *Server) newUpload(r *http.Request, file *store.File, secret, deleteToken string) Upload {
+	return Upload{
+		Status:      http.StatusOK,
+		ID:          file.ID.Hex(),
+		Secret:      secret,
+		DeleteToken: deleteToken,
+		Size:        file.Size,
+		ContentType: downloadContentType(file),
+		SHA256:      file.SHA256,
+		MD5:         file.MD5,
+		URL:         s.requestShareURL(r, secret),
+		ExpiresAt:   file.ExpiresAt,
+	}
+}
+
+// the Functions host forwarding requests to the handler
+const defaultTrustedProxies = "127.0.0.0/8,::1"
+
+// address of the client, the Functions host forwards it in X-Forwarded-For
+// Clients may send the header themselves, so it is only read when the request
+// comes from one of TRUSTED_PROXIES, and then from the right, up to the first
+// hop that none of them added.
+func (s *Server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !s.trustedProxy(host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if net.ParseIP(hop) == nil {
+			// not an address a proxy would add, the header was forged
+			return host
+		}
+		if host = hop; !s.trustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// whether addr is one of TRUSTED_PROXIES
+func (s *Server) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.config.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// create a saved link for the secret, setting the id of file
+// The expiry of file is shortened by the retention rules it matches.
+func (s *Server) create(ctx context.Context, file *store.File, secret string) error {
+	file.SecretHash = s.secrets.Hash(secret)
+	file.CreatedAt = time.Now().UTC()
+	if len(file.Findings) > 0 {
+		file.Review = reviewPending
+	}
+	s.applyRetention(file, file.CreatedAt)
+	if s.replicas != nil {
+		file.Replication = replicationPending
+	}
+	if err := s.store.CreateFile(ctx, file); err != nil {
+		return fmt.Errorf("failed to add file link: %w", err)
+	}
+	s.logger.Debug("added file link", zap.String("id", file.ID.Hex()))
+	s.replicate(file)
+	return nil
+}
+
+// apply the ttl and max_downloads options of a new link
+func applyLimits(f *store.File, ttl string, maxDownloads int) error {
+	if ttl != "" {
+		d, err := parseTTL(ttl)
+		if err != nil {
+			return errors.New("invalid ttl")
+		}
+		expiresAt := time.Now().UTC().Add(d)
+		f.ExpiresAt = &expiresAt
+	}
+	if maxDownloads < 0 {
+		return errors.New("invalid max_downloads")
+	}
+	f.MaxDownloads = maxDownloads
+	return nil
+}
+
+// record the stored part as the contents of a single file
+func setPart(f *store.File, part *storedPart) {
+	f.LinkUrl = part.url
+	f.Blob = part.blob
+	f.SHA256 = part.sums.sha256
+	f.MD5 = part.sums.md5Base64()
+	f.ContentType = part.contentType
+	f.Compressed = part.compressed
+	addFindings(f, part.findings)
+}
+
+// save the link of a file stored as a single part and return its deletion token,
+// the part is released when the link cannot be saved
+func (s *Server) saveFile(r *http.Request, file *store.File, part *storedPart, secret, kind string) (string, error) {
+	parts := []*storedPart{part}
+	deleteToken, err := newDeleteToken()
+	if err != nil {
+		s.discardParts(file.Container, parts)
+		return "", errors.New("failed to generate deletion token")
+	}
+	scan := s.config.ClamdAddress != ""
+	if scan {
+		file.ScanStatus = scanPending
+	}
+
+	file.DeleteToken = s.secrets.Hash(deleteToken)
+	if err := s.create(r.Context(), file, secret); err != nil {
+		s.discardParts(file.Container, parts)
+		return "", errors.New("failed to save file link")
+	}
+	uploads.WithLabelValues(kind).Inc()
+	uploadedBytes.Add(float64(file.Size))
+	s.audit(r, auditUpload, file)
+	s.emit(eventFileUploaded, file)
+	if scan {
+		saved := *file
+		s.goBackground(func() { s.scan(saved, secret) })
+	}
+	return deleteToken, nil
+}
+
+// share content spooled by a protocol other than the upload API as file under
+// a new secret, the quota is released when it cannot be stored
+func (s *Server) shareSpooled(r *http.Request, file *store.File, content io.ReadSeeker, declaredType, kind string) (secret, deleteToken string, err error) {
+	if secret, err = s.newSecret(r.Context()); err != nil {
+		return "", "", err
+	}
+	if err := s.reserveQuota(r.Context(), file.Uploader, file.Size); err != nil {
+		return "", "", err
+	}
+	file.QuotaCharged = true
+	part, err := s.storeContent(r.Context(), file.Container, content, file.FileName, declaredType, file.Size, secret, file.Encrypted, nil)
+	if err == nil {
+		setPart(file, part)
+		deleteToken, err = s.saveFile(r, file, part, secret, kind)
+	}
+	if err != nil {
+		s.releaseQuota(context.Background(), file.Uploader, file.Size)
+		return "", "", err
+	}
+	return secret, deleteToken, nil
+}
+
+// save the link of a file stored as a single part and answer with its secret,
+// for the uploads that are not multipart forms. Reports whether it was saved,
+// the part is released otherwise.
+func (s *Server) saveUpload(w http.ResponseWriter, r *http.Request, file *store.File, part *storedPart, secret, kind string) bool {
+	deleteToken, err := s.saveFile(r, file, part, secret, kind)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return false
+	}
+
+	res, err := json.Marshal(s.newUpload(r, file, secret, deleteToken))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+	return true
+}
+
+// find save link and uuid
+func (s *Server) find(ctx context.Context, uuid string) (*store.File, error) {
+	file, err := s.store.FindFile(ctx, uuid)
+	if err != nil && err != store.ErrNotFound {
+		return nil, fmt.Errorf("failed to find file link: %w", err)
+	}
+	return file, err
+}
+
+// count a download of the file saved with uuid
+// fails with store.ErrNotFound once the download limit is reached
+func (s *Server) claimDownload(ctx context.Context, uuid string) (*store.File, error) {
+	return s.store.ClaimDownload(ctx, uuid)
+}
+
+// content type served on download
+func downloadContentType(f *store.File) string {
+	if len(f.Entries) > 0 {
+		return "application/zip"
+	}
+	if f.ContentType == "" {
+		return defaultContentType
+	}
+	return f.ContentType
+}
+
+// file upload to blob storage
+func (s *Server) upload(ctx context.Context, container string, fileData io.Reader, fileName string, opts storage.PutOptions) (string, error) {
+	return s.storageFor(container).Put(ctx, fileName, fileData, opts)
+}
+
+// open a ranged download stream from blob storage
+func (s *Server) downloadRange(ctx context.Context, container, fileName string, rng byteRange) (*storage.Blob, error) {
+	storage := s.storageFor(container)
+	blob, err := storage.GetRange(ctx, fileName, rng.start, rng.length)
+	if err != nil || !s.parallelWorthwhile(blob.Size) {
+		return blob, err
+	}
+	return s.newParallelBlob(ctx, storage, fileName, blob, rng.start), nil
+}
+
+// a stored file of a multipart form
+type storedPart struct {
+	url         string
+	blob        string
+	sums        checksums
+	contentType string
+	compressed  bool
+	// kinds of sensitive data found by content inspection
+	findings []string
+}
+
+// partReader remembers the error reading a part of the request failed with,
+// telling failures of the client from those of storage
+type partReader struct {
+	io.Reader
+	err error
+}
+
+func (p *partReader) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	if err != nil && err != io.EOF {
+		p.err = err
+	}
+	return n, err
+}
+
+// store one file of a multipart form as it is read from r, encrypted with
+// the secret if requested, and return it with its size
+// The contents are not buffered, so they are staged under a name of their
+// own and only moved to their content name once the checksums are known,
+// plain files whose contents are stored already drop the staged blob.
+func (s *Server) uploadPart(ctx context.Context, container string, r io.Reader, name, declaredType, secret string, encrypt bool, progress *uploadProgress) (*storedPart, int64, error) {
+	// the head decides the content type and whether the contents are worth compressing
+	br := bufio.NewReaderSize(r, minCompressBytes)
+	head, err := br.Peek(minCompressBytes)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	contentType, _, err := detectContentType(bytes.NewReader(head), name, declaredType)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := s.checkFileType(name, contentType); err != nil {
+		return nil, 0, err
+	}
+	staged := newBlobName(name)
+	// contents shorter than the head are all there is of them
+	part := &storedPart{blob: staged, contentType: contentType, compressed: s.compressAtRest(contentType, int64(len(head)))}
+
+	sha, md := sha256.New(), md5.New()
+	size := &countingWriter{Writer: ioutil.Discard}
+	var data io.Reader = io.TeeReader(br, io.MultiWriter(sha, md, size))
+	// the contents are inspected while they are uploaded, the inspector stops
+	// reading after maxInspectedBytes so the rest is drained for the upload
+	var inspected chan error
+	var inspectWriter *io.PipeWriter
+	if s.inspector != nil {
+		var pr *io.PipeReader
+		pr, inspectWriter = io.Pipe()
+		data = io.TeeReader(data, inspectWriter)
+		inspected = make(chan error, 1)
+		go func() {
+			var err error
+			part.findings, err = s.inspectContent(ctx, pr)
+			io.Copy(ioutil.Discard, pr)
+			inspected <- err
+		}()
+	}
+	if progress != nil {
+		data = io.TeeReader(data, progress)
+	}
+
+	// the blob of an encrypted file must not advertise the plaintext type
+	opts := storage.PutOptions{ContentType: contentType}
+	if part.compressed {
+		compressed := newCompressReader(data)
+		defer compressed.Close()
+		data = compressed
+		opts = storage.PutOptions{ContentType: gzipContentType}
+	}
+	if encrypt {
+		if data, err = newEncryptReader(data, secret); err != nil {
+			return nil, 0, err
+		}
+		opts.ContentType = defaultContentType
+	}
+	// not bound to the request, which may have failed because the client went away
+	discard := func() {
+		if err := s.storageFor(container).Delete(context.Background(), staged); err != nil && err != storage.ErrBlobNotFound {
+			s.logger.Error("failed to delete blob", zap.String("blob", staged), zap.Error(err))
+		}
+	}
+	part.url, err = s.upload(ctx, container, data, staged, opts)
+	if inspected != nil {
+		inspectWriter.CloseWithError(err)
+		if ierr := <-inspected; err == nil {
+			err = ierr
+		}
+	}
+	if err != nil {
+		discard()
+		return nil, 0, err
+	}
+	part.sums = checksums{sha256: hex.EncodeToString(sha.Sum(nil)), md5: md.Sum(nil)}
+	if encrypt {
+		// encrypted blobs never match and are authenticated by the cipher instead of checksums
+		return part, size.n, nil
+	}
+
+	// plain files are deduplicated by their SHA-256
+	part.blob = contentBlobName(part.sums.sha256)
+	if part.compressed {
+		part.blob += compressedBlobSuffix
+	}
+	url, err := s.acquireBlob(ctx, container, part.blob)
+	if err != nil {
+		discard()
+		return nil, 0, err
+	}
+	if url != "" {
+		discard()
+		part.url = url
+		return part, size.n, nil
+	}
+	if part.url, err = s.storageFor(container).Move(ctx, staged, part.blob); err != nil {
+		discard()
+		if err := s.releaseBlob(context.Background(), container, part.blob); err != nil && err != storage.ErrBlobNotFound {
+			s.logger.Error("failed to release blob", zap.String("blob", part.blob), zap.Error(err))
+		}
+		return nil, 0, err
+	}
+	if err := s.storedBlob(ctx, container, part.blob, part.url); err != nil {
+		s.logger.Error("failed to record blob", zap.String("blob", part.blob), zap.Error(err))
+	}
+	return part, size.n, nil
+}
+
+// store size bytes of content named name, encrypted with the secret if requested
+// plain files are deduplicated by their SHA-256, encrypted blobs never match
+// and are authenticated by the cipher instead of checksums
+func (s *Server) storeContent(ctx context.Context, container string, content io.ReadSeeker, name, declaredType string, size int64, secret string, encrypt bool, progress *uploadProgress) (*storedPart, error) {
+	var err error
+	part := &storedPart{blob: newBlobName(name)}
+	if !encrypt {
+		// the content is buffered locally, hashing it first avoids uploading duplicates
+		if part.sums, err = computeChecksums(content); err != nil {
+			return nil, err
+		}
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		part.blob = contentBlobName(part.sums.sha256)
+	}
+	if s.inspector != nil {
+		if part.findings, err = s.inspectContent(ctx, content); err != nil {
+			return nil, err
+		}
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	contentType, data, err := detectContentType(content, name, declaredType)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkFileType(name, contentType); err != nil {
+		return nil, err
+	}
+	part.contentType = contentType
+	part.compressed = s.compressAtRest(contentType, size)
+	if part.compressed && !encrypt {
+		part.blob += compressedBlobSuffix
+	}
+
+	if !encrypt {
+		if part.url, err = s.acquireBlob(ctx, container, part.blob); err != nil {
+			return nil, err
+		}
+		if part.url != "" {
+			if progress != nil {
+				progress.advance(size)
+			}
+			return part, nil
+		}
+	}
+
+	if progress != nil {
+		data = io.TeeReader(data, progress)
+	}
+
+	// the blob of an encrypted file must not advertise the plaintext type
+	opts := storage.PutOptions{ContentType: contentType, ContentMD5: part.sums.md5}
+	if part.compressed {
+		// the checksums are those of the contents rather than of the stored blob
+		compressed := newCompressReader(data)
+		defer compressed.Close()
+		data = compressed
+		opts = storage.PutOptions{ContentType: gzipContentType}
+	}
+	if encrypt {
+		if data, err = newEncryptReader(data, secret); err != nil {
+			return nil, err
+		}
+		opts.ContentType = defaultContentType
+	}
+	if part.url, err = s.upload(ctx, container, data, part.blob, opts); err != nil {
+		if !encrypt {
+			// the upload is cancelled when the client disconnects, the reference is released regardless
+			if err := s.releaseBlob(context.Background(), container, part.blob); err != nil {
+				s.logger.Error("failed to release blob", zap.String("blob", part.blob), zap.Error(err))
+			}
+		}
+		return nil, err
+	}
+	if !encrypt {
+		if err := s.storedBlob(ctx, container, part.blob, part.url); err != nil {
+			s.logger.Error("failed to record blob", zap.String("blob", part.blob), zap.Error(err))
+		}
+	}
+	return part, nil
+}
+
+// uploadRefusal refuses an upload for its contents rather than failing to
+// store it, with the status it is answered with
+type uploadRefusal interface {
+	error
+	statusCode() int
+}
+
+// answer the status of err when it refuses an upload, and report whether it did
+func (s *Server) writeRefused(w http.ResponseWriter, r *http.Request, err error) bool {
+	var refused uploadRefusal
+	if !errors.As(err, &refused) {
+		return false
+	}
+	s.logFor(r.Context()).Info("refused upload", zap.Error(refused))
+	writeError(w, r, refused.statusCode(), refused.Error())
+	return true
+}
+
+// release the blobs of parts stored for a failed upload
+// not bound to the request, which may have failed because the client went away
+func (s *Server) discardParts(container string, parts []*storedPart) {
+	ctx := context.Background()
+
+	for _, part := range parts {
+		if err := s.releaseBlob(ctx, container, part.blob); err != nil && err != storage.ErrBlobNotFound {
+			s.logger.Error("failed to release blob", zap.String("blob", part.blob), zap.Error(err))
+		}
+	}
+}
+
+// open a download stream from blob storage
+// large blobs are fetched in parallel chunks when DOWNLOAD_PARALLELISM is set
+func (s *Server) download(ctx context.Context, container, fileName string) (*storage.Blob, error) {
+	storage := s.storageFor(container)
+	blob, err := storage.Get(ctx, fileName)
+	if err != nil || !s.parallelWorthwhile(blob.Size) {
+		return blob, err
+	}
+	return s.newParallelBlob(ctx, storage, fileName, blob, 0), nil
+}
+
+func helloHandler(w http.ResponseWriter, r *http.Request) {
+	message := "This HTTP triggered function executed successfully. Pass a name in the query string for a personalized response.\n"
+	name := r.URL.Query().Get("name")
+	if name != "" {
+		message = fmt.Sprintf("Hello, %s. This HTTP triggered function executed successfully.\n", name)
+	}
+	fmt.Fprint(w, message)
+}
+
+// Upload to Azure storage
+// Generate uuid password
+// Azure storage link and password save to CosmosDB
+// return password
+func (s *Server) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	// Get file data
+	// the parts are streamed to storage as they arrive rather than spooled,
+	// so the fields deciding how files are stored must come before them
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "missing file field")
+		return
+	}
+	file := store.File{Uploader: s.uploader(r), Owner: requestUser(r.Context())}
+	file.Container = s.tenantContainer(file.Uploader)
+
+	secret, err := s.newSecret(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to generate secret")
+		return
+	}
+
+	// the sizes of the files are only known once they are stored, the quota
+	// is reserved for the whole body and settled afterwards
+	total := r.ContentLength
+	if total < 0 {
+		total = 0
+	}
+	if err := s.reserveQuota(r.Context(), file.Uploader, total); err != nil {
+		s.writeQuotaError(w, r, err)
+		return
+	}
+	file.QuotaCharged = true
+	stored := false
+	var parts []*storedPart
+	defer func() {
+		if !stored {
+			s.discardParts(file.Container, parts)
+			s.releaseQuota(context.Background(), file.Uploader, total)
+		}
+	}()
+
+	// report the staging progress when the client opened a progress session
+	progress := s.progress.get(r.URL.Query().Get("progress"))
+	if progress != nil {
+		progress.start(total)
+		defer func() { progress.finish(!stored) }()
+	}
+
+	// fields of the body, they win over those of the query as with FormValue
+	fields := url.Values{}
+	formValue := func(name string) string {
+		if v, ok := fields[name]; ok {
+			return v[0]
+		}
+		return r.URL.Query().Get(name)
+	}
+	// several "file" fields make a bundle, downloaded as a single zip
+	var names []string
+	var sizes []int64
+	// archive=preserve expands a zip or tar upload into its tree of files
+	var preserve bool
+	var archive *uploadedArchive
+	for {
+		p, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if isTooLarge(err) {
+			writeTooLarge(w, r, s.config.maxUploadBytes(uploadRoute))
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid multipart body")
+			return
+		}
+		name := p.FormName()
+		if p.FileName() == "" {
+			if name == "" {
+				continue
+			}
+			if len(names) > 0 && (name == "encrypt" || name == "archive") {
+				writeError(w, r, http.StatusBadRequest, name+" must come before the file fields")
+				return
+			}
+			value, err := ioutil.ReadAll(io.LimitReader(p, maxUploadFieldBytes+1))
+			if isTooLarge(err) {
+				writeTooLarge(w, r, s.config.maxUploadBytes(uploadRoute))
+				return
+			}
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "invalid multipart body")
+				return
+			}
+			if len(value) > maxUploadFieldBytes {
+				writeError(w, r, http.StatusBadRequest, "invalid "+name)
+				return
+			}
+			fields.Add(name, string(value))
+			if err := validateStreamedField(r, name, fields[name]); err != nil {
+				writeError(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			continue
+		}
+		if name != "file" {
+			continue
+		}
+
+		if len(names) == 0 {
+			// encrypt with a key derived from the secret, which is never stored
+			file.Encrypted, _ = strconv.ParseBool(formValue("encrypt"))
+			switch formValue("archive") {
+			case "":
+			case archivePreserve:
+				preserve = true
+			default:
+				writeError(w, r, http.StatusBadRequest, "invalid archive")
+				return
+			}
+		} else if preserve {
+			writeError(w, r, http.StatusBadRequest, "archive=preserve takes a single file")
+			return
+		}
+		names = append(names, p.FileName())
+
+		body := &partReader{Reader: p}
+		if preserve {
+			archive, err = s.openArchive(body)
+			if isTooLarge(body.err) {
+				writeTooLarge(w, r, s.config.maxUploadBytes(uploadRoute))
+				return
+			}
+			if body.err != nil {
+				writeError(w, r, http.StatusBadRequest, "invalid multipart body")
+				return
+			}
+			if err != nil {
+				s.writeArchiveError(w, r, err)
+				return
+			}
+			defer archive.Close()
+			continue
+		}
+		part, size, err := s.uploadPart(r.Context(), file.Container, body, p.FileName(), p.Header.Get("Content-Type"), secret, file.Encrypted, progress)
+		if isTooLarge(body.err) {
+			writeTooLarge(w, r, s.config.maxUploadBytes(uploadRoute))
+			return
+		}
+		if body.err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid multipart body")
+			return
+		}
+		if s.writeRefused(w, r, err) {
+			return
+		}
+		if err != nil {
+			s.logFor(r.Context()).Error("failed to store file", zap.String("filename", p.FileName()), zap.Error(err))
+			writeError(w, r, http.StatusBadGateway, "failed to store file")
+			return
+		}
+		parts = append(parts, part)
+		sizes = append(sizes, size)
+	}
+	if len(names) == 0 {
+		writeError(w, r, http.StatusBadRequest, "missing file field")
+		return
+	}
+	// the handling below reads the fields with FormValue
+	r.PostForm = fields
+	r.Form = url.Values{}
+	for name, values := range fields {
+		r.Form[name] = append(r.Form[name], values...)
+	}
+	for name, values := range r.URL.Query() {
+		r.Form[name] = append(r.Form[name], values...)
+	}
+
+	file.FileName = names[0]
+	if len(names) > 1 {
+		file.FileName = r.FormValue("name")
+		if file.FileName == "" {
+			file.FileName = defaultBundleName
+		}
+	}
+
+	if ttl := r.FormValue("ttl"); ttl != "" {
+		d, err := parseTTL(ttl)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid ttl")
+			return
+		}
+		expiresAt := time.Now().UTC().Add(d)
+		file.ExpiresAt = &expiresAt
+	}
+	if v := r.FormValue("max_downloads"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid max_downloads")
+			return
+		}
+		file.MaxDownloads = n
+	}
+
+	if passphrase := r.FormValue("passphrase"); passphrase != "" {
+		hashed, err := s.secrets.HashPassphrase(passphrase)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid passphrase")
+			return
+		}
+		file.PassphraseHash = hashed
+	}
+
+	if clientEncrypted, _ := strconv.ParseBool(r.FormValue("client_encrypted")); clientEncrypted {
+		metadata := r.FormValue("metadata")
+		if file.Encrypted || preserve || len(metadata) > maxClientMetadataBytes {
+			writeError(w, r, http.StatusBadRequest, "invalid client encryption parameters")
+			return
+		}
+		file.ClientEncrypted = true
+		file.ClientMetadata = metadata
+	}
+
+	// email the link to notify_email once stored, notify_include_secret=false leaves the link out
+	var notifyTo string
+	includeSecret := true
+	if v := r.FormValue("notify_email"); v != "" {
+		if s.mailer == nil {
+			writeError(w, r, http.StatusBadRequest, errEmailDisabled.Error())
+			return
+		}
+		if notifyTo, err = parseRecipient(v); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid notify_email")
+			return
+		}
+		if v := r.FormValue("notify_include_secret"); v != "" {
+			includeSecret, _ = strconv.ParseBool(v)
+		}
+		if s.emailLimiter != nil {
+			if ok, wait := s.emailLimiter.allow(file.Uploader); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeError(w, r, http.StatusTooManyRequests, "too many notification emails")
+				return
+			}
+		}
+	}
+
+	// the key of encrypted files is derived from the secret, so a word code cannot open them
+	var code string
+	if wordCode, _ := strconv.ParseBool(r.FormValue("word_code")); wordCode {
+		if file.Encrypted {
+			writeError(w, r, http.StatusBadRequest, "word codes cannot be used with encrypt")
+			return
+		}
+		if code, err = s.newWordCode(r.Context()); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to generate word code")
+			return
+		}
+		file.CodeHash = s.secrets.Hash(code)
+	}
+
+	if archive != nil {
+		if file.FileName = r.FormValue("name"); file.FileName == "" {
+			file.FileName = treeBundleName(names[0])
+		}
+	}
+	// download_as replaces the name the file is downloaded under
+	if name := r.FormValue("download_as"); name != "" {
+		file.FileName = name
+	}
+	file.FileName = sanitizeFileName(file.FileName)
+	// the types of the files are checked as they are stored, bundles are
+	// downloaded as zip whatever their name
+	if len(names) == 1 && archive == nil {
+		if err := s.checkFileType(file.FileName, ""); err != nil {
+			s.writeRefused(w, r, err)
+			return
+		}
+	}
+	if err := parseLabels(r, &file); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := parseRestrictions(r, &file, s.geoip); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if archive != nil {
+		// the quota is charged for the expanded files
+		if !s.settleQuota(w, r, file.Uploader, &total, archive.expanded) {
+			return
+		}
+		if progress != nil {
+			progress.start(archive.expanded)
+		}
+		parts, err = s.storeArchive(r.Context(), &file, archive, secret, progress)
+		if err == errArchiveSizeChange {
+			s.writeArchiveError(w, r, err)
+			return
+		}
+		if s.writeRefused(w, r, err) {
+			return
+		}
+		if err != nil {
+			s.logFor(r.Context()).Error("failed to store archive", zap.String("filename", names[0]), zap.Error(err))
+			writeError(w, r, http.StatusBadGateway, "failed to store file")
+			return
+		}
+	} else {
+		for i, part := range parts {
+			if file.ClientEncrypted {
+				part.contentType = defaultContentType
+			}
+			file.Size += sizes[i]
+			if len(parts) == 1 {
+				setPart(&file, part)
+			} else {
+				file.Entries = append(file.Entries, store.Entry{Name: names[i], Blob: part.blob, SHA256: part.sums.sha256, MD5: part.sums.md5Base64(), Size: sizes[i], ContentType: part.contentType, Compressed: part.compressed})
+				addFindings(&file, part.findings)
+			}
+		}
+		if !s.settleQuota(w, r, file.Uploader, &total, file.Size) {
+			return
+		}
+	}
+
+	deleteToken, err := newDeleteToken()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to generate deletion token")
+		return
+	}
+
+	// client side encrypted files are opaque, there is nothing to scan
+	scan := s.config.ClamdAddress != "" && !file.ClientEncrypted
+	if scan {
+		file.ScanStatus = scanPending
+	}
+
+	if s.wantsThumbnail(&file) {
+		s.storeThumbnail(r.Context(), &file)
+	}
+
+	file.DeleteToken = s.secrets.Hash(deleteToken)
+	err = s.create(r.Context(), &file, secret)
+	if err != nil {
+		if err := s.removeThumbnail(context.Background(), &file); err != nil {
+			s.logger.Error("failed to delete thumbnail", zap.String("blob", file.Thumbnail), zap.Error(err))
+		}
+		writeError(w, r, http.StatusInternalServerError, "failed to save file link")
+		return
+	}
+	stored = true
+	uploads.WithLabelValues("form").Inc()
+	uploadedBytes.Add(float64(file.Size))
+	s.audit(r, auditUpload, &file)
+	s.emit(eventFileUploaded, &file)
+	if scan {
+		s.goBackground(func() { s.scan(file, secret) })
+	}
+	if notifyTo != "" {
+		s.goBackground(func() { s.notifyEmail(notifyTo, file, secret, includeSecret) })
+	}
+
+	uploaded := s.newUpload(r, &file, secret, deleteToken)
+	uploaded.Code = code
+	if qr, _ := strconv.ParseBool(r.FormValue("qr")); qr && s.config.PublicBaseURL != "" {
+		png, err := s.shareQRCode(secret, defaultQRCodeSize)
+		if err != nil {
+			s.logFor(r.Context()).Error("failed to render QR code", zap.Error(err))
+		} else {
+			uploaded.QRCode = base64.StdEncoding.EncodeToString(png)
+		}
+	}
+
+	res, err := json.Marshal(uploaded)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+
+}
+
+// Validation password
+// Download data from azure storage
+func (s *Server) downloadHandler(w http.ResponseWriter, r *http.Request) {
+
+	secret := r.FormValue("secret")
+	// a download token stands in for the secret, see DownloadToken
+	var fileID string
+	var claims *downloadClaims
+	if token := r.FormValue("token"); secret == "" && token != "" && s.config.DownloadTokenKey != "" {
+		var err error
+		if fileID, claims, err = s.parseDownloadToken(token); err != nil {
+			writeError(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		secret = claims.Secret
+	}
+	if secret == "" {
+		writeError(w, r, http.StatusBadRequest, "missing secret")
+		return
+	}
+	// disposition=inline lets browsers render safe types instead of saving them
+	var inline bool
+	switch r.FormValue("disposition") {
+	case "", "attachment":
+	case "inline":
+		inline = true
+	default:
+		writeError(w, r, http.StatusBadRequest, "invalid disposition")
+		return
+	}
+
+	// check the passphrase before the download is counted
+	protected, err := s.find(r.Context(), secret)
+	if err == store.ErrNotFound {
+		failedGuess(r)
+		writeError(w, r, http.StatusNotFound, "file not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to look up file")
+		return
+	}
+	if claims != nil && protected.ID.Hex() != fileID {
+		writeError(w, r, http.StatusNotFound, "file not found")
+		return
+	}
+	if !s.allowedFrom(w, r, protected) {
+		return
+	}
+	// path selects a single file of a multi-file share or of a stored zip
+	entryPath := r.FormValue("path")
+	var zipEntry *zip.File
+	if entryPath != "" {
+		switch {
+		case len(protected.Entries) > 0:
+			if protected.Entry(entryPath) == nil {
+				writeError(w, r, http.StatusNotFound, "path not found")
+				return
+			}
+		case isZip(protected):
+			zipEntry, err = s.openZipEntry(r.Context(), protected, entryPath)
+			if err == errZipEntryNotFound {
+				writeError(w, r, http.StatusNotFound, "path not found")
+				return
+			}
+			if err == errNotArchive {
+				writeError(w, r, http.StatusBadRequest, "file is not a valid zip archive")
+				return
+			}
+			if err != nil {
+				s.logFor(r.Context()).Error("failed to read zip directory", zap.String("file_id", protected.ID.Hex()), zap.Error(err))
+				writeError(w, r, http.StatusBadGateway, "failed to read archive")
+				return
+			}
+		default:
+			writeError(w, r, http.StatusBadRequest, "path requires a multi-file share or an unencrypted zip")
+			return
+		}
+	}
+	if !scanPassed(protected) {
+		if protected.ScanStatus == scanPending {
+			writeError(w, r, http.StatusConflict, "file is being scanned")
+			return
+		}
+		writeError(w, r, http.StatusForbidden, "file failed the virus scan")
+		return
+	}
+	if protected.PassphraseHash != "" && (claims == nil || !claims.Passphrase) {
+		// passphrases are only accepted in a POST body, never in the URL
+		passphrase := r.PostFormValue("passphrase")
+		if passphrase == "" {
+			writeError(w, r, http.StatusUnauthorized, "passphrase required")
+			return
+		}
+		if !s.secrets.VerifyPassphrase(passphrase, protected.PassphraseHash) {
+			failedGuess(r)
+			writeError(w, r, http.StatusForbidden, "invalid passphrase")
+			return
+		}
+	}
+
+	// current copies are confirmed before the download is counted
+	v, cacheable := fileValidators(protected)
+	if entryPath != "" {
+		v, cacheable = validators{}, false
+		if e := protected.Entry(entryPath); e != nil {
+			v, cacheable = entryValidators(protected, e)
+		}
+	}
+	if cacheable && v.notModified(r) {
+		writeNotModified(w, v)
+		return
+	}
+	// archived files are brought back before the download is counted
+	if !s.online(w, r, protected) {
+		return
+	}
+
+	// HEAD answers with the headers of the download without counting it, link
+	// previews and scanners would use up one-time links otherwise
+	head := r.Method == http.MethodHead
+	file := protected
+	if !head {
+		file, err = s.claimDownload(r.Context(), secret)
+		if err == store.ErrNotFound {
+			writeError(w, r, http.StatusNotFound, "file not found")
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to look up file")
+			return
+		}
+	}
+
+	s.logFor(r.Context()).Debug("serving file", zap.String("file_id", file.ID.Hex()), zap.String("filename", file.FileName))
+
+	if zipEntry != nil {
+		s.writeZipEntry(w, r, file, zipEntry, inline)
+		if !head {
+			s.audit(r, auditDownload, file)
+			s.emit(eventFileDownloaded, file)
+			s.burn(file)
+		}
+		return
+	}
+	if entryPath != "" {
+		if e := file.Entry(entryPath); e != nil {
+			s.writeEntry(w, r, file, e, secret, inline)
+			if !head {
+				s.audit(r, auditDownload, file)
+				s.emit(eventFileDownloaded, file)
+				s.burn(file)
+			}
+			return
+		}
+	}
+	if len(file.Entries) > 0 {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Disposition", attachmentDisposition(file.FileName))
+		w.Header().Set("Content-Type", "application/zip")
+		if head {
+			return
+		}
+		cw := &countingWriter{Writer: w}
+		err := s.writeBundle(r.Context(), cw, file, secret)
+		downloadedBytes.Add(float64(cw.n))
+		if err != nil {
+			s.logFor(r.Context()).Error("failed to stream bundle", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+		} else {
+			downloads.WithLabelValues("bundle").Inc()
+		}
+		s.audit(r, auditDownload, file)
+		s.emit(eventFileDownloaded, file)
+		s.burn(file)
+		return
+	}
+
+	// force_download serves a generic type so browsers never try to handle the file
+	contentType := downloadContentType(file)
+	if force, _ := strconv.ParseBool(r.FormValue("force_download")); force {
+		contentType = defaultContentType
+	}
+	// pastes are shown as text unless disposition=attachment is requested
+	if file.Paste && r.FormValue("disposition") == "" {
+		inline = true
+	}
+	disposition := attachmentDisposition(file.FileName)
+	if inline && inlineSafe(contentType) {
+		disposition = inlineDisposition(file.FileName)
+	}
+
+	// hand out a short-lived signed URL instead of proxying the bytes
+	// encrypted files must be decrypted here and one-time files burnt after the transfer,
+	// S3 clients do not follow redirects
+	if (s.config.DownloadRedirect || s.config.CDNBaseURL != "") && !file.Encrypted && !file.Compressed && file.MaxDownloads == 0 && r.Context().Value(streamDownloadKey{}) == nil {
+		signed, err := s.storageFor(file.Container).SignedURL(r.Context(), file.BlobName(), s.config.SignedURLExpiry, storage.SignedURLOptions{
+			ContentType:        contentType,
+			ContentDisposition: disposition,
+		})
+		kind := "redirect"
+		if err == nil && s.config.CDNBaseURL != "" {
+			signed, err = s.cdnURL(signed)
+			kind = "cdn"
+		}
+		if err == nil {
+			w.Header().Set("Cache-Control", "no-store")
+			http.Redirect(w, r, signed, http.StatusFound)
+			if !head {
+				downloads.WithLabelValues(kind).Inc()
+				s.audit(r, auditDownload, file)
+				s.emit(eventFileDownloaded, file)
+			}
+			return
+		}
+		if err != storage.ErrSignedURLNotSupported {
+			s.logFor(r.Context()).Error("failed to sign url", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+		}
+	}
+
+	// ranges are served for plain files whose size is known
+	// one-time files are always sent whole, so a partial read cannot burn them
+	rangeable := !file.Encrypted && !file.Compressed && file.MaxDownloads == 0 && file.Size > 0
+	status := http.StatusOK
+	var rng byteRange
+	if rangeable {
+		w.Header().Set("Accept-Ranges", "bytes")
+		var ranged bool
+		rng, ranged, err = parseRange(r.Header.Get("Range"), file.Size)
+		if err == errRangeNotSatisfiable {
+			w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(file.Size, 10))
+			writeError(w, r, http.StatusRequestedRangeNotSatisfiable, "range not satisfiable")
+			return
+		}
+		if ranged && (!cacheable || v.rangeCurrent(r)) {
+			status = http.StatusPartialContent
+		}
+	}
+
+	var blob *storage.Blob
+	if status == http.StatusPartialContent {
+		blob, err = s.downloadRange(r.Context(), file.Container, file.BlobName(), rng)
+	} else {
+		blob, err = s.download(r.Context(), file.Container, file.BlobName())
+	}
+	if err == storage.ErrBlobNotFound {
+		writeError(w, r, http.StatusNotFound, "file not found")
+		return
+	}
+	// the blob was archived after the file was looked up
+	if err == storage.ErrBlobArchived {
+		if _, err := s.rehydrate(r.Context(), file); err != nil {
+			s.logFor(r.Context()).Error("failed to rehydrate file", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+		}
+		writePreparing(w)
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, "failed to read file")
+		return
+	}
+	defer blob.Close()
+
+	var body io.Reader = blob
+	size := blob.Size
+	if file.Encrypted {
+		body = newDecryptReader(blob, secret)
+		size = plaintextSize(blob.Size)
+	}
+	// blobs compressed at rest go out as they are to clients accepting gzip
+	encoded := file.Compressed && s.config.CompressDownloads && !s.config.VerifyDownloads && negotiateEncoding(r) == "gzip"
+	if encoded {
+		w.Header().Set("Content-Encoding", "gzip")
+	} else if file.Compressed {
+		if body, err = newDecompressReader(body); err != nil {
+			s.logFor(r.Context()).Error("failed to decompress file", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+			writeError(w, r, http.StatusBadGateway, "failed to read file")
+			return
+		}
+		size = file.Size
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if cacheable {
+		v.write(w.Header())
+	}
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if status == http.StatusPartialContent {
+		w.Header().Set("Content-Range", rng.contentRange(file.Size))
+	} else if file.SHA256 != "" && encoded {
+		// the digests describe the contents rather than the gzip stream
+		w.Header().Set("ETag", "W/"+strconv.Quote(file.SHA256))
+	} else if file.SHA256 != "" {
+		w.Header().Set("ETag", strconv.Quote(file.SHA256))
+		if file.MD5 != "" {
+			w.Header().Set("Content-MD5", file.MD5)
+		}
+		if s.config.VerifyDownloads {
+			body = newVerifyReader(body, file.SHA256)
+		}
+	}
+	w.WriteHeader(status)
+	if head {
+		return
+	}
+
+	// copy the blob straight to the client instead of buffering it
+	n, err := io.Copy(w, body)
+	downloadedBytes.Add(float64(n))
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to stream file", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+		if err == errChecksumMismatch {
+			// the body was cut short, the recipient sees a failed transfer
+			return
+		}
+	}
+	downloads.WithLabelValues("file").Inc()
+
+	blob.Close()
+	// the audit log records every read, ranges included
+	s.audit(r, auditDownload, file)
+	// resumed ranges are part of a download that was already reported
+	if status == http.StatusOK {
+		s.emit(eventFileDownloaded, file)
+	}
+	s.burn(file)
+}
+
+// remove the file once its last allowed download went out
+// not bound to the request, the client may be gone once the download ends
+func (s *Server) burn(file *store.File) {
+	if !file.Exhausted() {
+		return
+	}
+	if err := s.remove(context.Background(), file); err != nil {
+		s.logger.Error("failed to remove file", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+		return
+	}
+	s.emit(eventFileDeleted, file)
+}
+
+// Metadata of a file
+// lets E2E encrypted clients fetch their opaque metadata (iv, encrypted name...)
+func (s *Server) metaHandler(w http.ResponseWriter, r *http.Request) {
+	secret := r.URL.Query().Get("secret")
+	if secret == "" {
+		writeError(w, r, http.StatusBadRequest, "missing secret")
+		return
+	}
+
+	file, err := s.find(r.Context(), secret)
+	if err == store.ErrNotFound {
+		failedGuess(r)
+		writeError(w, r, http.StatusNotFound, "file not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to look up file")
+		return
+	}
+
+	res, err := json.Marshal(Meta{file.FileName, file.ClientEncrypted, file.ClientMetadata})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
+
+// File details
+// lets a front-end confirm the download without transferring the file
+func (s *Server) fileInfoHandler(w http.ResponseWriter, r *http.Request) {
+	secret := r.URL.Query().Get("secret")
+	if secret == "" {
+		writeError(w, r, http.StatusBadRequest, "missing secret")
+		return
+	}
+
+	file, err := s.find(r.Context(), secret)
+	if err == store.ErrNotFound {
+		failedGuess(r)
+		writeError(w, r, http.StatusNotFound, "file not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to look up file")
+		return
+	}
+
+	info := FileInfo{
+		FileName:           file.FileName,
+		Size:               file.Size,
+		ContentType:        downloadContentType(file),
+		UploadedAt:         file.CreatedAt,
+		ExpiresAt:          file.ExpiresAt,
+		PassphraseRequired: file.PassphraseHash != "",
+		Encrypted:          file.Encrypted || file.ClientEncrypted,
+		Files:              file.Entries,
+		ScanStatus:         file.ScanStatus,
+		Replication:        file.Replication,
+		Tier:               file.Tier,
+		SHA256:             file.SHA256,
+		MD5:                file.MD5,
+		Preview:            file.Thumbnail != "",
+		Paste:              file.Paste,
+		Syntax:             file.Syntax,
+		Description:        file.Description,
+		Tags:               file.Tags,
+		Meta:               file.Meta,
+	}
+	if file.MaxDownloads > 0 {
+		remaining := file.MaxDownloads - file.Downloads
+		info.RemainingDownloads = &remaining
+	}
+
+	res, err := json.Marshal(info)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
+
+// Delete an uploaded file
+// requires the deletion token returned at upload time
+func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	secret, token := r.FormValue("secret"), r.FormValue("token")
+	if secret == "" || token == "" {
+		writeError(w, r, http.StatusBadRequest, "missing secret or token")
+		return
+	}
+
+	file, err := s.find(r.Context(), secret)
+	if err == store.ErrNotFound {
+		failedGuess(r)
+		writeError(w, r, http.StatusNotFound, "file not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to look up file")
+		return
+	}
+	if !s.secrets.Verify(token, file.DeleteToken) {
+		failedGuess(r)
+		writeError(w, r, http.StatusForbidden, "invalid deletion token")
+		return
+	}
+
+	if err := s.remove(r.Context(), file); err != nil {
+		s.logFor(r.Context()).Error("failed to remove file", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to delete file")
+		return
+	}
+	s.audit(r, auditDelete, file)
+	s.emit(eventFileDeleted, file)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// routes of the API, the probes and the metrics
+func (s *Server) routes() http.Handler {
+	rt := newRouter()
+	for _, prefix := range []string{"", "/api"} {
+		rt.get(prefix+healthPath, healthHandler)
+		rt.get(prefix+readyPath, s.readyHandler)
+		rt.get(prefix+metricsPath, promhttp.Handler().ServeHTTP)
+	}
+
+	rt.group("", func(rt *router) {
+		rt.use(s.withRequestID, s.withRecovery)
+		for _, path := range []string{"/api/HttpExample", "/api/HttpTrigger"} {
+			rt.get(path, helloHandler)
+			rt.post(path, helloHandler)
+		}
+		// share links are pages, they are not called cross-origin
+		landing := withSecurityHeaders(s.withRateLimit(downloadRoute, s.withCSRF(s.withLockout(s.landingHandler))))
+		for _, path := range []string{landingPath, "/" + landingRoute} {
+			rt.get(path+"/{secret}", landing)
+			rt.post(path+"/{secret}", landing)
+		}
+		collectionPage := withSecurityHeaders(s.withRateLimit(downloadRoute, s.withLockout(s.collectionPageHandler)))
+		for _, path := range []string{collectionPagePath, "/" + collectionPageRoute} {
+			rt.get(path+"/{secret}", collectionPage)
+		}
+		if s.config.S3Gateway {
+			rt.handle("", s3Path+"/*", withS3Errors(s.withRateLimit(s3Route, s.withUploadSlot(s.withMaxUploadBytes(s3Route, s.withLockout(s.s3Handler))))))
+		}
+		if s.config.QueueIngestion {
+			rt.post(ingestPath, s.ingestHandler)
+		}
+		if s.config.WebDAV != webdavOff {
+			rt.handle("", webdavPath+"/*", s.withUser(s.withRateLimit(webdavRoute, s.withUploadSlot(s.withMaxUploadBytes(webdavRoute, s.webdavHandler)))))
+		}
+
+		rt.use(s.withCORS)
+		upload := withMultipart(s.withUser(s.withUploadAPIKey(s.withRateLimit(uploadRoute, s.withIdempotency(uploadRoute, s.withUploadSlot(s.withMaxUploadBytes(uploadRoute, s.withValidation(uploadRoute, s.withCSRF(s.uploadHandler)))))))))
+		download := s.withRateLimit(downloadRoute, s.withValidation(downloadRoute, s.withCSRF(s.withLockout(s.withThrottle(s.withCompression(s.downloadHandler))))))
+		downloadToken := s.withRateLimit(downloadTokenRoute, s.withValidation(downloadTokenRoute, s.withCSRF(s.withLockout(s.downloadTokenHandler))))
+		remove := s.withRateLimit(deleteRoute, s.withValidation(deleteRoute, s.withCSRF(s.withLockout(s.deleteHandler))))
+		rotate := s.withUser(s.withRateLimit(deleteRoute, s.withValidation(deleteRoute, s.withCSRF(s.withLockout(s.rotateHandler)))))
+		meta := s.withRateLimit(metaRoute, s.withValidation(metaRoute, s.withLockout(s.metaHandler)))
+		fileInfo := s.withRateLimit(fileInfoRoute, s.withValidation(fileInfoRoute, s.withLockout(s.fileInfoHandler)))
+		scanStatus := s.withRateLimit(scanStatusRoute, s.withValidation(scanStatusRoute, s.withLockout(s.scanStatusHandler)))
+		preview := s.withRateLimit(previewRoute, s.withValidation(previewRoute, s.withLockout(s.previewHandler)))
+		qrCode := s.withValidation(qrCodeRoute, s.qrCodeHandler)
+
+		rt.group(v1FilesPath, func(rt *router) {
+			rt.post("", upload)
+			rt.group("/{secret}", func(rt *router) {
+				rt.use(withQueryParams("secret"))
+				rt.get("", download)
+				rt.post("", download)
+				rt.handle(http.MethodDelete, "", remove)
+				rt.get("/meta", meta)
+				rt.get("/info", fileInfo)
+				rt.get("/scan", scanStatus)
+				rt.get("/preview", preview)
+				rt.get("/qrcode", qrCode)
+				rt.post("/tokens", downloadToken)
+				rt.post("/rotate", rotate)
+			})
+		})
+		rt.group(v1DownloadsPath, func(rt *router) {
+			rt.use(withQueryParams("token"))
+			rt.get("/{token}", download)
+		})
+		rt.group("", func(rt *router) {
+			rt.use(withDeprecation)
+			rt.post("/api/"+uploadRoute, upload)
+			rt.get("/api/"+downloadRoute, download)
+			rt.post("/api/"+downloadRoute, download)
+			rt.post(downloadTokenPath, downloadToken)
+			rt.post("/api/"+deleteRoute, remove)
+			rt.handle(http.MethodDelete, "/api/"+deleteRoute, remove)
+			rt.get("/api/"+metaRoute, meta)
+			rt.post("/api/"+metaRoute, meta)
+			rt.get("/api/"+fileInfoRoute, fileInfo)
+			rt.post("/api/"+fileInfoRoute, fileInfo)
+			rt.get("/api/"+scanStatusRoute, scanStatus)
+			rt.get(previewPath, preview)
+			rt.get(qrCodePath, qrCode)
+		})
+		rt.post(pastePath, s.withUser(s.withUploadAPIKey(s.withRateLimit(pasteRoute, s.withIdempotency(pasteRoute, s.withUploadSlot(s.withMaxUploadBytes(pasteRoute, s.withValidation(pasteRoute, s.withCSRF(s.pasteHandler)))))))))
+		rt.post(fetchPath, s.withUser(s.withUploadAPIKey(s.withRateLimit(fetchRoute, s.withIdempotency(fetchRoute, s.withUploadSlot(s.withValidation(fetchRoute, s.withCSRF(s.fetchHandler))))))))
+		rt.get(csrfPath, csrfTokenHandler)
+		rt.get(openAPIPath, openAPIHandler)
+		rt.post(progressPath, s.uploadProgressHandler)
+		rt.get(progressPath+"/{session}", s.uploadProgressHandler)
+
+		// the tus OPTIONS discovery request is answered by the handler
+		resumable := s.withUser(s.withUploadAPIKey(s.withRateLimit(tusRoute, s.withUploadSlot(s.withMaxUploadBytes(tusRoute, s.withCSRF(s.uploadResumableHandler))))))
+		rt.handle(http.MethodOptions, tusPath, resumable)
+		rt.post(tusPath, resumable)
+		for _, method := range []string{http.MethodOptions, http.MethodHead, http.MethodPatch} {
+			rt.handle(method, tusPath+"/{id}", resumable)
+		}
+
+		uploadSession := func(h http.HandlerFunc) http.HandlerFunc {
+			return s.withUser(s.withUploadAPIKey(s.withRateLimit(uploadSessionRoute, s.withUploadSlot(s.withMaxUploadBytes(uploadSessionRoute, s.withValidation(uploadSessionRoute, s.withCSRF(h)))))))
+		}
+		rt.post(precheckPath, s.withUser(s.withUploadAPIKey(s.withRateLimit(precheckRoute, s.withValidation(precheckRoute, s.withCSRF(s.precheckHandler))))))
+		rt.post(v1UploadsPath, uploadSession(s.createUploadSessionHandler))
+		rt.get(v1UploadsPath+"/{id}", uploadSession(s.uploadSessionHandler))
+		rt.handle(http.MethodPatch, v1UploadsPath+"/{id}", uploadSession(s.uploadSessionHandler))
+		rt.post(v1UploadsPath+"/{id}/complete", uploadSession(s.completeUploadSessionHandler))
+
+		rt.get(myFilesPath, s.withUser(s.withCSRF(s.myFilesHandler)))
+		myFile := s.withUser(s.withValidation(myFilesRoute, s.withCSRF(s.myFilesHandler)))
+		rt.handle(http.MethodDelete, myFilesPath+"/{id}", myFile)
+		rt.handle(http.MethodPatch, myFilesPath+"/{id}", myFile)
+
+		collections := s.withUser(s.withValidation(collectionsRoute, s.withCSRF(s.collectionsHandler)))
+		rt.get(collectionsPath, collections)
+		rt.post(collectionsPath, collections)
+		rt.get(collectionsPath+"/{secret}", s.withRateLimit(downloadRoute, s.withValidation(collectionsRoute, s.withLockout(s.collectionHandler))))
+		rt.handle(http.MethodDelete, collectionsPath+"/{secret}", s.withUser(s.withValidation(collectionsRoute, s.withCSRF(s.collectionHandler))))
+		collectionFiles := s.withUser(s.withValidation(collectionsRoute, s.withCSRF(s.collectionFilesHandler)))
+		rt.post(collectionsPath+"/{secret}/files", collectionFiles)
+		rt.handle(http.MethodDelete, collectionsPath+"/{secret}/files/{id}", collectionFiles)
+
+		rt.group("", func(rt *router) {
+			rt.use(s.withAdmin)
+			for _, path := range []string{adminPath, adminFunctionPath} {
+				rt.get(path, s.adminListFiles)
+				rt.handle(http.MethodDelete, path+"/{id}", s.adminDeleteFile)
+			}
+			for _, path := range []string{adminQuotasPath, adminQuotasFnPath} {
+				rt.get(path, s.adminListQuotas)
+				rt.handle(http.MethodPut, path+"/{principal}", s.adminSetQuota)
+			}
+			for _, path := range []string{adminAuditPath, adminAuditFn} {
+				rt.get(path, s.adminAuditHandler)
+			}
+			for _, path := range []string{adminPurgePath, adminPurgeFn} {
+				rt.post(path, s.adminPurgeHandler)
+			}
+			for _, path := range []string{adminSearchPath, adminSearchFn} {
+				rt.get(path, s.adminSearchHandler)
+			}
+			for _, path := range []string{adminOrphansPath, adminOrphansFn} {
+				rt.get(path, s.adminOrphansHandler)
+			}
+			for _, path := range []string{adminTrashPath, adminTrashFn} {
+				rt.get(path, s.adminTrashHandler)
+				rt.post(path+"/{id}/restore", s.adminRestoreHandler)
+			}
+			for _, path := range []string{adminReviewPath, adminReviewFn} {
+				rt.get(path, s.adminListReview)
+				rt.post(path+"/{id}", s.adminReviewFile)
+			}
+		})
+	})
+	return rt
+}
+
+// Run serves the API, and SFTP when enabled, until SIGINT or SIGTERM, then
+// lets running transfers finish.
+func (s *Server) Run() {
+	listenAddr := s.config.ListenAddr
+	if s.config.MigrateSecrets {
+		n, err := s.store.MigrateSecrets(context.Background())
+		if err != nil {
+			s.logger.Fatal("failed to migrate secrets", zap.Error(err))
+		}
+		s.logger.Info("hashed plaintext secrets", zap.Int("count", n))
+	}
+	go s.runJanitor(s.config.JanitorInterval)
+	go s.runReconciler(s.config.ReconcileInterval)
+	if s.replicas != nil {
+		for i := 0; i < replicationWorkers; i++ {
+			go s.runReplication()
+		}
+	}
+	if s.config.EventOutbox && (s.webhooks != nil || s.events != nil) {
+		go s.runOutbox()
+	}
+
+	srv := &http.Server{Addr: listenAddr, Handler: s.routes()}
+	go func() {
+		s.logger.Info("listening", zap.String("addr", listenAddr))
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			s.logger.Fatal("failed to listen", zap.Error(err))
+		}
+	}()
+	var sftp *sftpServer
+	if s.config.SFTPAddr != "" {
+		var err error
+		if sftp, err = newSFTPServer(s); err == nil {
+			err = sftp.listen(s.config.SFTPAddr)
+		}
+		if err != nil {
+			s.logger.Fatal("failed to start the SFTP server", zap.Error(err))
+		}
+	}
+
+	// let running transfers finish on redeploys, then release the database connections
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	if sftp != nil {
+		sftp.close()
+	}
+
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancelDrain()
+	s.drain(drainCtx, srv)
+}
@@ -0,0 +1,821 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"filer/internal/secret"
+	"filer/internal/storage"
+	"filer/internal/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+var errInjected = errors.New("injected failure")
+
+// memStorage keeps blobs in memory, failing the operations named in fail
+type memStorage struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+	// staged chunks of the blobs of resumable uploads, by index
+	chunks map[string]map[int][]byte
+	fail   map[string]error
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{blobs: map[string][]byte{}, chunks: map[string]map[int][]byte{}, fail: map[string]error{}}
+}
+
+func (m *memStorage) failing(operation string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fail[operation]
+}
+
+// names of the stored blobs, sorted
+func (m *memStorage) names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.blobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *memStorage) Put(ctx context.Context, name string, r io.Reader, opts storage.PutOptions) (string, error) {
+	if err := m.failing("put"); err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[name] = data
+	return "mem://" + name, nil
+}
+
+func (m *memStorage) Get(ctx context.Context, name string) (*storage.Blob, error) {
+	return m.GetRange(ctx, name, 0, -1)
+}
+
+func (m *memStorage) GetRange(ctx context.Context, name string, offset, count int64) (*storage.Blob, error) {
+	if err := m.failing("get"); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.blobs[name]
+	if !ok {
+		return nil, storage.ErrBlobNotFound
+	}
+	data = data[offset:]
+	if count >= 0 && count < int64(len(data)) {
+		data = data[:count]
+	}
+	return &storage.Blob{ReadCloser: ioutil.NopCloser(bytes.NewReader(data)), Size: int64(len(data))}, nil
+}
+
+func (m *memStorage) Delete(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.blobs[name]; !ok {
+		return storage.ErrBlobNotFound
+	}
+	delete(m.blobs, name)
+	return nil
+}
+
+func (m *memStorage) Move(ctx context.Context, from, to string) (string, error) {
+	if err := m.failing("move"); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.blobs[from]
+	if !ok {
+		return "", storage.ErrBlobNotFound
+	}
+	delete(m.blobs, from)
+	m.blobs[to] = data
+	return "mem://" + to, nil
+}
+
+func (m *memStorage) Exists(ctx context.Context, name string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.blobs[name]
+	return ok, nil
+}
+
+func (m *memStorage) SignedURL(ctx context.Context, name string, expiry time.Duration, opts storage.SignedURLOptions) (string, error) {
+	return "", storage.ErrSignedURLNotSupported
+}
+
+func (m *memStorage) SetTier(ctx context.Context, name, tier string) error {
+	return storage.ErrTiersNotSupported
+}
+
+func (m *memStorage) Tier(ctx context.Context, name string) (string, error) {
+	return storage.TierHot, nil
+}
+
+func (m *memStorage) List(ctx context.Context, fn func(storage.BlobInfo) error) error {
+	for _, name := range m.names() {
+		if err := fn(storage.BlobInfo{Name: name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memStorage) StageChunk(ctx context.Context, name string, index int, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.chunks[name] == nil {
+		m.chunks[name] = map[int][]byte{}
+	}
+	m.chunks[name][index] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *memStorage) CommitChunks(ctx context.Context, name string, count int, opts storage.PutOptions) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var data []byte
+	for i := 0; i < count; i++ {
+		chunk, ok := m.chunks[name][i]
+		if !ok {
+			return "", fmt.Errorf("chunk %d of %s not staged", i, name)
+		}
+		data = append(data, chunk...)
+	}
+	delete(m.chunks, name)
+	m.blobs[name] = data
+	return "mem://" + name, nil
+}
+
+func (m *memStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+// memStore keeps the file links, blob references and quotas the upload and
+// download handlers use in memory. The other methods of store.Store are left
+// to the embedded nil interface and panic when called.
+type memStore struct {
+	store.Store
+	secrets *secret.Hasher
+
+	mu     sync.Mutex
+	files  []*store.File
+	blobs  map[string]int
+	urls   map[string]string
+	quotas map[string]int64
+	// resumable upload sessions by id
+	sessions map[string]*store.UploadSession
+	// CreateFile fails with it when set
+	createErr error
+}
+
+func newMemStore(secrets *secret.Hasher) *memStore {
+	return &memStore{
+		secrets:  secrets,
+		blobs:    map[string]int{},
+		urls:     map[string]string{},
+		quotas:   map[string]int64{},
+		sessions: map[string]*store.UploadSession{},
+	}
+}
+
+// the unexpired file of a secret or word code
+func (m *memStore) find(secret string) *store.File {
+	hash, code := m.secrets.Hash(secret), m.secrets.HashWordCode(secret)
+	for _, f := range m.files {
+		if (f.SecretHash == hash || f.CodeHash != "" && f.CodeHash == code) && (f.ExpiresAt == nil || f.ExpiresAt.After(time.Now())) {
+			return f
+		}
+	}
+	return nil
+}
+
+func (m *memStore) SecretInUse(ctx context.Context, secret string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.find(secret) != nil, nil
+}
+
+func (m *memStore) CreateFile(ctx context.Context, file *store.File) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.createErr != nil {
+		return m.createErr
+	}
+	file.ID = primitive.NewObjectID()
+	saved := *file
+	m.files = append(m.files, &saved)
+	return nil
+}
+
+func (m *memStore) FindFile(ctx context.Context, secret string) (*store.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.find(secret)
+	if f == nil {
+		return nil, store.ErrNotFound
+	}
+	found := *f
+	return &found, nil
+}
+
+func (m *memStore) ClaimDownload(ctx context.Context, secret string) (*store.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.find(secret)
+	if f == nil || f.Exhausted() {
+		return nil, store.ErrNotFound
+	}
+	f.Downloads++
+	claimed := *f
+	return &claimed, nil
+}
+
+func (m *memStore) DeleteFile(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, f := range m.files {
+		if f.ID == id {
+			m.files = append(m.files[:i], m.files[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memStore) AcquireBlob(ctx context.Context, id string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[id]++
+	return m.urls[id], nil
+}
+
+func (m *memStore) StoredBlob(ctx context.Context, id, url string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.urls[id] = url
+	return nil
+}
+
+func (m *memStore) ReleaseBlob(ctx context.Context, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[id]--
+	if m.blobs[id] > 0 {
+		return false, nil
+	}
+	delete(m.blobs, id)
+	delete(m.urls, id)
+	return true, nil
+}
+
+func (m *memStore) ChargeQuota(ctx context.Context, id string, size, def int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if def > 0 && m.quotas[id]+size > def {
+		return false, nil
+	}
+	m.quotas[id] += size
+	return true, nil
+}
+
+func (m *memStore) UnchargeQuota(ctx context.Context, id string, size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.quotas[id] -= size
+	return nil
+}
+
+func (m *memStore) CreateUploadSession(ctx context.Context, session *store.UploadSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	saved := *session
+	m.sessions[session.ID] = &saved
+	return nil
+}
+
+func (m *memStore) FindUploadSession(ctx context.Context, id string) (*store.UploadSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	found := *session
+	return &found, nil
+}
+
+func (m *memStore) AdvanceUploadSession(ctx context.Context, session *store.UploadSession, written int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	saved, ok := m.sessions[session.ID]
+	if !ok || saved.Offset != session.Offset || saved.Chunks != session.Chunks {
+		return store.ErrUploadSessionConflict
+	}
+	saved.Offset += written
+	saved.Chunks++
+	return nil
+}
+
+func (m *memStore) CompleteUploadSession(ctx context.Context, id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if session, ok := m.sessions[id]; ok {
+		session.CompletedAt = &at
+	}
+	return nil
+}
+
+// the configuration of args, on top of the sqlite metadata and local storage
+// settings the fakes stand in for
+func testConfig(t *testing.T, args ...string) *Config {
+	t.Helper()
+	c, err := loadConfig(append([]string{"-metadata-backend=sqlite", "-metadata-dsn=unused", "-storage-backend=local", "-secret-hmac-key=test"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// a server of the in-memory backends, with the configuration of args
+func newTestServer(t *testing.T, args ...string) (http.Handler, *memStorage, *memStore) {
+	t.Helper()
+	config := testConfig(t, args...)
+	secrets := secret.NewHasher(config.SecretHMACKey)
+	blobs, metadata := newMemStorage(), newMemStore(secrets)
+	s, err := New(config, zap.NewNop(), blobs, metadata, secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.routes(), blobs, metadata
+}
+
+// a field of a multipart body, a file when filename is set
+type formPart struct {
+	name, filename, body string
+}
+
+func multipartBody(t *testing.T, parts []formPart) (*bytes.Buffer, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		header := textproto.MIMEHeader{}
+		disposition := fmt.Sprintf(`form-data; name=%q`, p.name)
+		if p.filename != "" {
+			disposition += fmt.Sprintf(`; filename=%q`, p.filename)
+		}
+		header.Set("Content-Disposition", disposition)
+		w, err := form.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, p.body)
+	}
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf, form.FormDataContentType()
+}
+
+// upload parts and return the answer
+func upload(t *testing.T, h http.Handler, parts []formPart) *httptest.ResponseRecorder {
+	t.Helper()
+	body, contentType := multipartBody(t, parts)
+	r := httptest.NewRequest(http.MethodPost, "/api/UploadTrigger", body)
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestUploadHandler(t *testing.T) {
+	large := strings.Repeat("0123456789abcdef", 1<<20)
+
+	tests := []struct {
+		name string
+		args []string
+		// parts of the body, or raw with contentType
+		parts       []formPart
+		raw         string
+		contentType string
+		// fail the storage operation or the metadata store
+		failStorage string
+		failCreate  bool
+
+		status int
+		size   int64
+	}{
+		{
+			name:   "single file",
+			parts:  []formPart{{"file", "a.txt", "hello"}},
+			status: http.StatusOK, size: 5,
+		},
+		{
+			name:   "bundle",
+			parts:  []formPart{{"name", "", "both.zip"}, {"file", "a.txt", "hello"}, {"file", "b.txt", "world!"}},
+			status: http.StatusOK, size: 11,
+		},
+		{
+			name:   "large file",
+			parts:  []formPart{{"file", "large.txt", large}},
+			status: http.StatusOK, size: int64(len(large)),
+		},
+		{
+			name:   "large file compressed at rest",
+			args:   []string{"-compress-at-rest=true"},
+			parts:  []formPart{{"file", "large.txt", large}},
+			status: http.StatusOK, size: int64(len(large)),
+		},
+		{
+			name:   "encrypted file",
+			parts:  []formPart{{"encrypt", "", "true"}, {"file", "a.txt", "hello"}},
+			status: http.StatusOK, size: 5,
+		},
+		{
+			name:   "missing file field",
+			parts:  []formPart{{"name", "", "a.txt"}},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "file field without a file",
+			parts:  []formPart{{"file", "", "hello"}},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:        "not multipart",
+			raw:         `{"file": "hello"}`,
+			contentType: "application/json",
+			status:      http.StatusUnsupportedMediaType,
+		},
+		{
+			name:        "truncated multipart body",
+			raw:         "--b\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.txt\"\r\n\r\nhello",
+			contentType: "multipart/form-data; boundary=b",
+			status:      http.StatusBadRequest,
+		},
+		{
+			name:        "multipart body without parts",
+			raw:         "garbage",
+			contentType: "multipart/form-data; boundary=b",
+			status:      http.StatusBadRequest,
+		},
+		{
+			name:   "invalid ttl",
+			parts:  []formPart{{"ttl", "", "soon"}, {"file", "a.txt", "hello"}},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "invalid max_downloads after the file",
+			parts:  []formPart{{"file", "a.txt", "hello"}, {"max_downloads", "", "0"}},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "encrypt after the file",
+			parts:  []formPart{{"file", "a.txt", "hello"}, {"encrypt", "", "true"}},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "several files with archive=preserve",
+			parts:  []formPart{{"archive", "", "preserve"}, {"file", "a.zip", "x"}, {"file", "b.zip", "y"}},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "archive=preserve of a file that is no archive",
+			parts:  []formPart{{"archive", "", "preserve"}, {"file", "a.zip", "hello"}},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "too large",
+			args:   []string{"-max-upload-bytes=1024"},
+			parts:  []formPart{{"file", "large.txt", large}},
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "over the global quota",
+			args:   []string{"-quota-bytes-global=1024"},
+			parts:  []formPart{{"file", "large.txt", large}},
+			status: http.StatusInsufficientStorage,
+		},
+		{
+			name:        "storage failure",
+			parts:       []formPart{{"file", "a.txt", "hello"}},
+			failStorage: "put",
+			status:      http.StatusBadGateway,
+		},
+		{
+			name:        "failure to move the staged blob",
+			parts:       []formPart{{"file", "a.txt", "hello"}},
+			failStorage: "move",
+			status:      http.StatusBadGateway,
+		},
+		{
+			name:       "metadata failure",
+			parts:      []formPart{{"file", "a.txt", "hello"}},
+			failCreate: true,
+			status:     http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, blobs, metadata := newTestServer(t, tt.args...)
+			if tt.failStorage != "" {
+				blobs.fail[tt.failStorage] = errInjected
+			}
+			if tt.failCreate {
+				metadata.createErr = errInjected
+			}
+
+			var w *httptest.ResponseRecorder
+			if tt.parts != nil {
+				w = upload(t, h, tt.parts)
+			} else {
+				r := httptest.NewRequest(http.MethodPost, "/api/UploadTrigger", strings.NewReader(tt.raw))
+				r.Header.Set("Content-Type", tt.contentType)
+				w = httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+			}
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			if tt.status != http.StatusOK {
+				// failed uploads leave neither blobs nor quota behind
+				if names := blobs.names(); len(names) > 0 {
+					t.Errorf("blobs left behind: %v", names)
+				}
+				if used := metadata.quotas[globalQuotaID]; used != 0 {
+					t.Errorf("%d bytes of quota left charged", used)
+				}
+				return
+			}
+			var uploaded Upload
+			if err := json.Unmarshal(w.Body.Bytes(), &uploaded); err != nil {
+				t.Fatal(err)
+			}
+			if uploaded.Secret == "" {
+				t.Error("no secret")
+			}
+			if len(metadata.files) != 1 {
+				t.Fatalf("%d files saved, want 1", len(metadata.files))
+			}
+			file := metadata.files[0]
+			if file.Size != tt.size {
+				t.Errorf("size %d, want %d", file.Size, tt.size)
+			}
+			if used := metadata.quotas[globalQuotaID]; used != tt.size {
+				t.Errorf("%d bytes of quota charged, want %d", used, tt.size)
+			}
+			// staged blobs of plain files are moved to their content name
+			if !metadata.files[0].Encrypted {
+				for _, name := range blobs.names() {
+					if !strings.HasPrefix(name, contentBlobPrefix) {
+						t.Errorf("staged blob %s left behind", name)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestUploadHandlerDeduplicates(t *testing.T) {
+	h, blobs, metadata := newTestServer(t)
+	for i := 0; i < 2; i++ {
+		if w := upload(t, h, []formPart{{"file", "a.txt", "hello"}}); w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	}
+	if names := blobs.names(); len(names) != 1 || !strings.HasPrefix(names[0], contentBlobPrefix) {
+		t.Errorf("blobs %v, want a single content blob", names)
+	}
+	if len(metadata.files) != 2 {
+		t.Errorf("%d files, want 2", len(metadata.files))
+	}
+}
+
+func TestDownloadHandler(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		parts []formPart
+		// change the stored file before it is downloaded
+		prepare func(blobs *memStorage, metadata *memStore)
+		// method of the download, GET when empty
+		method string
+		// query of the download, with the secret of the upload in %s
+		query  string
+		header http.Header
+		// methods of the requests made before the one checked
+		before []string
+
+		status int
+		body   string
+		// headers the answer has to carry
+		wantHeader http.Header
+		// names of the entries of a bundle
+		entries []string
+	}{
+		{
+			name:   "file",
+			parts:  []formPart{{"file", "a.txt", "hello"}},
+			query:  "secret=%s",
+			status: http.StatusOK, body: "hello",
+		},
+		{
+			name:   "encrypted file",
+			parts:  []formPart{{"encrypt", "", "true"}, {"file", "a.txt", "hello"}},
+			query:  "secret=%s",
+			status: http.StatusOK, body: "hello",
+		},
+		{
+			name:   "file compressed at rest",
+			args:   []string{"-compress-at-rest=true"},
+			parts:  []formPart{{"file", "a.txt", strings.Repeat("hello ", 1000)}},
+			query:  "secret=%s",
+			status: http.StatusOK, body: strings.Repeat("hello ", 1000),
+		},
+		{
+			name:   "range",
+			parts:  []formPart{{"file", "a.txt", "hello"}},
+			query:  "secret=%s",
+			header: http.Header{"Range": {"bytes=1-3"}},
+			status: http.StatusPartialContent, body: "ell",
+		},
+		{
+			name:   "bundle",
+			parts:  []formPart{{"file", "a.txt", "hello"}, {"file", "b.txt", "world"}},
+			query:  "secret=%s",
+			status: http.StatusOK, entries: []string{"a.txt", "b.txt"},
+		},
+		{
+			name:   "entry of a bundle",
+			parts:  []formPart{{"file", "a.txt", "hello"}, {"file", "b.txt", "world"}},
+			query:  "secret=%s&path=b.txt",
+			status: http.StatusOK, body: "world",
+		},
+		{
+			name:   "missing entry of a bundle",
+			parts:  []formPart{{"file", "a.txt", "hello"}, {"file", "b.txt", "world"}},
+			query:  "secret=%s&path=c.txt",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "missing secret",
+			parts:  []formPart{{"file", "a.txt", "hello"}},
+			query:  "",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "unknown secret",
+			parts:  []formPart{{"file", "a.txt", "hello"}},
+			query:  "secret=unknown%.0s",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "invalid disposition",
+			parts:  []formPart{{"file", "a.txt", "hello"}},
+			query:  "secret=%s&disposition=download",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "passphrase required",
+			parts:  []formPart{{"passphrase", "", "open sesame"}, {"file", "a.txt", "hello"}},
+			query:  "secret=%s",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "download limit reached",
+			parts:  []formPart{{"max_downloads", "", "1"}, {"file", "a.txt", "hello"}},
+			query:  "secret=%s",
+			before: []string{http.MethodGet},
+			status: http.StatusNotFound,
+		},
+		{
+			name:       "HEAD",
+			parts:      []formPart{{"file", "a.txt", "hello"}},
+			method:     http.MethodHead,
+			query:      "secret=%s",
+			status:     http.StatusOK,
+			wantHeader: http.Header{"Content-Length": {"5"}, "Content-Disposition": {`attachment; filename="a.txt"`}},
+		},
+		{
+			name:   "HEAD of an entry of a bundle",
+			parts:  []formPart{{"file", "a.txt", "hello"}, {"file", "b.txt", "world"}},
+			method: http.MethodHead,
+			query:  "secret=%s&path=b.txt",
+			status: http.StatusOK, wantHeader: http.Header{"Content-Length": {"5"}},
+		},
+		{
+			// link previews must not use up one-time links
+			name:   "download of a one-time file after HEAD",
+			parts:  []formPart{{"max_downloads", "", "1"}, {"file", "a.txt", "hello"}},
+			query:  "secret=%s",
+			before: []string{http.MethodHead, http.MethodHead},
+			status: http.StatusOK, body: "hello",
+		},
+		{
+			name:  "missing blob",
+			parts: []formPart{{"file", "a.txt", "hello"}},
+			prepare: func(blobs *memStorage, metadata *memStore) {
+				for _, name := range blobs.names() {
+					blobs.Delete(context.Background(), name)
+				}
+			},
+			query:  "secret=%s",
+			status: http.StatusNotFound,
+		},
+		{
+			name:  "storage failure",
+			parts: []formPart{{"file", "a.txt", "hello"}},
+			prepare: func(blobs *memStorage, metadata *memStore) {
+				blobs.fail["get"] = errInjected
+			},
+			query:  "secret=%s",
+			status: http.StatusBadGateway,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, blobs, metadata := newTestServer(t, tt.args...)
+			w := upload(t, h, tt.parts)
+			if w.Code != http.StatusOK {
+				t.Fatalf("upload status %d: %s", w.Code, w.Body)
+			}
+			var uploaded Upload
+			if err := json.Unmarshal(w.Body.Bytes(), &uploaded); err != nil {
+				t.Fatal(err)
+			}
+			if tt.prepare != nil {
+				tt.prepare(blobs, metadata)
+			}
+
+			target := "/api/DownloadTrigger"
+			if tt.query != "" {
+				target += "?" + fmt.Sprintf(tt.query, uploaded.Secret)
+			}
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			for _, method := range append(tt.before, method) {
+				r := httptest.NewRequest(method, target, nil)
+				for name, values := range tt.header {
+					r.Header[name] = values
+				}
+				w = httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+			}
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body %q, want %q", w.Body.String(), tt.body)
+			}
+			for name := range tt.wantHeader {
+				if got, want := w.Header().Get(name), tt.wantHeader.Get(name); got != want {
+					t.Errorf("%s %q, want %q", name, got, want)
+				}
+			}
+			if tt.entries != nil {
+				zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var names []string
+				for _, f := range zr.File {
+					names = append(names, f.Name)
+				}
+				if strings.Join(names, ",") != strings.Join(tt.entries, ",") {
+					t.Errorf("entries %v, want %v", names, tt.entries)
+				}
+			}
+		})
+	}
+}
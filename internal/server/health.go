@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// probes answer below the route prefix too, the Functions host only forwards /api
+const (
+	healthPath = "/healthz"
+	readyPath  = "/readyz"
+	// a dependency that does not answer within this is reported as down
+	readyTimeout = 3 * time.Second
+)
+
+// health report of the instance
+type healthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Liveness
+// answers as long as the process serves requests, dependencies are not checked
+// so a database outage does not get every instance restarted
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthReport{Status: "ok"})
+}
+
+// Readiness
+// pings the metadata store and the storage container, 503 when either does not answer in time
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	checks := map[string]func(context.Context) error{
+		"metadata": s.store.Ping,
+		"storage":  s.storage.Ping,
+	}
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(checks))
+	for name, check := range checks {
+		go func(name string, check func(context.Context) error) {
+			results <- result{name, check(ctx)}
+		}(name, check)
+	}
+
+	report := healthReport{Status: "ok", Checks: map[string]string{}}
+	code := http.StatusOK
+	for range checks {
+		res := <-results
+		if res.err != nil {
+			s.logFor(r.Context()).Warn("readiness check failed", zap.String("check", res.name), zap.Error(res.err))
+			report.Status = "unavailable"
+			report.Checks[res.name] = "error"
+			code = http.StatusServiceUnavailable
+			continue
+		}
+		report.Checks[res.name] = "ok"
+	}
+	writeHealth(w, code, report)
+}
+
+func writeHealth(w http.ResponseWriter, code int, report healthReport) {
+	res, _ := json.Marshal(report)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(res)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"filer/internal/store"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// Clients retrying an upload whose answer they did not get send the same
+// Idempotency-Key header as the first attempt. The answer of the first upload
+// is kept for IDEMPOTENCY_TTL and replayed to its retries, which get the same
+// secret instead of storing the file once more. Keys are scoped to the
+// principal and the route, and the answers are sealed with the key, so the
+// secrets they hold cannot be read from the database alone.
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// longest key, clients usually send a UUID
+	maxIdempotencyKeyLength = 255
+	// answers larger than this are not kept, uploads answer a few hundred bytes
+	maxIdempotentResponseBytes = 64 * 1024
+	defaultIdempotencyTTL      = 24 * time.Hour
+	// uploads still in progress after this long are deemed abandoned by a
+	// crashed instance, and a retry uploads the file again
+	idempotencyLease = time.Hour
+	// how long retries sent while the first upload is in progress are asked to wait
+	idempotencyRetryAfter = 5 * time.Second
+	// prefix of the keys the answers are sealed with
+	idempotencyScope = "idempotency-response\x00"
+)
+
+var idempotentUploads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "filer_idempotent_uploads_total",
+	Help: "Uploads sent with an Idempotency-Key by result (stored, replayed, conflict).",
+}, []string{"result"})
+
+// whether key may be used as an Idempotency-Key
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// idempotencyRecorder keeps the answer of an upload while it is written
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (r *idempotencyRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *idempotencyRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.body.Len()+len(p) > maxIdempotentResponseBytes {
+		r.truncated = true
+	} else if !r.truncated {
+		r.body.Write(p)
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// keep streaming responses working through the recorder
+func (r *idempotencyRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// answer retries of an upload sent with an Idempotency-Key like the upload,
+// see above. Retries sent while it is in progress are answered 409, failed
+// uploads are forgotten so that they can be retried.
+func (s *Server) withIdempotency(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || s.config.IdempotencyTTL <= 0 || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			writeError(w, r, http.StatusBadRequest, "Idempotency-Key must be 1 to 255 printable ASCII characters")
+			return
+		}
+
+		scope := s.uploader(r) + "\x00" + route + "\x00" + key
+		now := time.Now().UTC()
+		record := &store.IdempotencyKey{ID: s.secrets.Hash("idempotency\x00" + scope), CreatedAt: now}
+		existing, err := s.store.ReserveIdempotencyKey(r.Context(), record, now.Add(-idempotencyLease))
+		if err != nil {
+			s.logFor(r.Context()).Error("failed to reserve idempotency key", zap.Error(err))
+			writeError(w, r, http.StatusInternalServerError, "failed to read idempotency key")
+			return
+		}
+		if existing != nil {
+			s.replayUpload(w, r, existing, scope)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		// the request may be over, the answer is saved regardless
+		ctx := context.Background()
+		if rec.status != http.StatusOK || rec.truncated {
+			if err := s.store.ReleaseIdempotencyKey(ctx, record.ID); err != nil {
+				s.logFor(r.Context()).Error("failed to release idempotency key", zap.Error(err))
+			}
+			return
+		}
+		sealed, err := sealValue(idempotencyScope+scope, rec.body.Bytes())
+		if err == nil {
+			err = s.store.CompleteIdempotencyKey(ctx, record.ID, sealed, w.Header().Get("Content-Type"))
+		}
+		if err != nil {
+			// retries are answered 409 until the lease is over, then stored again
+			s.logFor(r.Context()).Error("failed to save the answer of an idempotent upload", zap.Error(err))
+			return
+		}
+		idempotentUploads.WithLabelValues("stored").Inc()
+	}
+}
+
+// answer a retry with the stored answer of its upload, or 409 while the
+// upload is in progress
+func (s *Server) replayUpload(w http.ResponseWriter, r *http.Request, record *store.IdempotencyKey, scope string) {
+	if record.Response == "" {
+		idempotentUploads.WithLabelValues("conflict").Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(idempotencyRetryAfter.Seconds()))))
+		writeError(w, r, http.StatusConflict, "an upload with this Idempotency-Key is in progress")
+		return
+	}
+	body, err := openValue(idempotencyScope+scope, record.Response)
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to open the answer of an idempotent upload", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to read idempotency key")
+		return
+	}
+	idempotentUploads.WithLabelValues("replayed").Inc()
+	if record.ContentType != "" {
+		w.Header().Set("Content-Type", record.ContentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.Write(body)
+}
+
+// drop the answers older than IDEMPOTENCY_TTL, run by the janitor
+func (s *Server) pruneIdempotencyKeys(ctx context.Context) {
+	if s.config.IdempotencyTTL <= 0 {
+		return
+	}
+	n, err := s.store.PruneIdempotencyKeys(ctx, time.Now().UTC().Add(-s.config.IdempotencyTTL))
+	if err != nil {
+		s.logger.Error("janitor: failed to prune idempotency keys", zap.Error(err))
+		return
+	}
+	if n > 0 {
+		s.logger.Info("janitor: pruned idempotency keys", zap.Int64("count", n))
+	}
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"filer/internal/storage"
+	"filer/internal/store"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// Queue ingestion shares blobs other systems wrote to the storage account,
+// so they can hand out artifacts without uploading them through the API. A
+// message on the filer-ingest queue names a blob under INGEST_PREFIX:
+//
+//	{"blob": "ingest/builds/app-1.4.2.zip", "ttl": "72h", "id": "build-1842"}
+//
+// The Functions host invokes the IngestQueue function with every message.
+// The blob is stored like an upload, deduplicated, compressed, encrypted and
+// scanned alike, and deleted once its link is saved. The secret is posted to
+// the filer-ingest-results queue with the id of the message:
+//
+//	{"id": "build-1842", "blob": "ingest/builds/app-1.4.2.zip", "secret": "3kXlq9ZmP0aB", ...}
+//
+// Messages that cannot be shared get a result with an error instead. Failures
+// of the storage or the database fail the invocation, the host retries the
+// message and moves it to filer-ingest-poison after five attempts.
+const (
+	ingestRoute = "IngestQueue"
+	// functions without an HTTP trigger are invoked at the path of their name
+	ingestPath = "/" + ingestRoute
+
+	defaultIngestPrefix = "ingest/"
+	// principal of the ingested files when the message names none
+	defaultIngestUploader = "queue"
+	// bindings of function.json
+	ingestMessageBinding = "message"
+	ingestResultBinding  = "result"
+	// invocations carry the message, of at most 64 KiB, and its metadata
+	maxInvocationBytes = 1 << 20
+)
+
+var ingestions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "filer_ingestions_total",
+	Help: "Messages of the ingestion queue by result (shared, rejected, failed).",
+}, []string{"result"})
+
+// message of the ingestion queue
+type ingestMessage struct {
+	// blob to share, under INGEST_PREFIX of the container of Uploader
+	Blob string `json:"blob"`
+	// name of the shared file, the last element of Blob by default
+	Name string `json:"name"`
+	// type of the contents, that of the blob by default
+	ContentType  string `json:"content_type"`
+	TTL          string `json:"ttl"`
+	MaxDownloads int    `json:"max_downloads"`
+	Encrypt      bool   `json:"encrypt"`
+	// principal charged for the file, whose tenant container holds the blob
+	Uploader string `json:"uploader"`
+	// returned with the result so senders can tell them apart
+	ID string `json:"id"`
+}
+
+// result posted for every message, with Error when it was rejected
+type ingestResult struct {
+	ID          string     `json:"id,omitempty"`
+	Blob        string     `json:"blob"`
+	Secret      string     `json:"secret,omitempty"`
+	DeleteToken string     `json:"delete_token,omitempty"`
+	URL         string     `json:"url,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// invocation of a function by the Functions host, Data holds the values of
+// the input bindings by name
+type functionInvocation struct {
+	Data     map[string]json.RawMessage
+	Metadata map[string]json.RawMessage
+}
+
+// answer to the Functions host, Outputs holds the values of the output
+// bindings by name and Logs lines for the function logs
+type functionResponse struct {
+	Outputs     map[string]interface{}
+	Logs        []string
+	ReturnValue interface{}
+}
+
+// whether blobs under prefix may be ingested, which deletes them
+func validIngestPrefix(prefix string) bool {
+	if prefix == "" || !strings.HasSuffix(prefix, "/") || path.Clean(prefix)+"/" != prefix || strings.HasPrefix(prefix, "/") {
+		return false
+	}
+	for _, reserved := range []string{contentBlobPrefix, trashBlobPrefix} {
+		if strings.HasPrefix(prefix, reserved) || strings.HasPrefix(reserved, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// whether name is a blob dropped for ingestion
+func (s *Server) ingestBlob(name string) bool {
+	return s.config.QueueIngestion && strings.HasPrefix(name, s.config.IngestPrefix) && path.Clean(name) == name &&
+		len(name) > len(s.config.IngestPrefix)
+}
+
+// the Functions host runs next to the handler, other clients must not share
+// blobs of the account
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// queue messages are passed as JSON strings, or as objects when the host
+// parsed them already
+func decodeIngestMessage(raw json.RawMessage) (*ingestMessage, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		raw = json.RawMessage(text)
+	}
+	var msg ingestMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return nil, errors.New("invalid message")
+	}
+	return &msg, nil
+}
+
+// IngestQueue
+// shares the blob named by a message of the ingestion queue, see above
+func (s *Server) ingestHandler(w http.ResponseWriter, r *http.Request) {
+	if !fromLoopback(r) {
+		writeError(w, r, http.StatusForbidden, "only the Functions host may invoke IngestQueue")
+		return
+	}
+	var inv functionInvocation
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxInvocationBytes)).Decode(&inv); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid invocation")
+		return
+	}
+
+	var res ingestResult
+	msg, err := decodeIngestMessage(inv.Data[ingestMessageBinding])
+	if err != nil {
+		res.Error = err.Error()
+	} else if res, err = s.ingest(r, msg); err != nil {
+		ingestions.WithLabelValues("failed").Inc()
+		s.logFor(r.Context()).Error("failed to ingest blob", zap.String("blob", msg.Blob), zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to ingest blob")
+		return
+	}
+
+	var line string
+	if res.Error != "" {
+		ingestions.WithLabelValues("rejected").Inc()
+		s.logFor(r.Context()).Info("rejected ingestion message", zap.String("blob", res.Blob), zap.String("reason", res.Error))
+		line = "rejected " + res.Blob + ": " + res.Error
+	} else {
+		ingestions.WithLabelValues("shared").Inc()
+		line = "shared " + res.Blob
+	}
+	body, err := json.Marshal(functionResponse{Outputs: map[string]interface{}{ingestResultBinding: res}, Logs: []string{line}})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// share the blob of msg and delete it, rejections are reported in the
+// result and only failures worth retrying are returned
+func (s *Server) ingest(r *http.Request, msg *ingestMessage) (ingestResult, error) {
+	res := ingestResult{ID: msg.ID, Blob: msg.Blob}
+	reject := func(reason string) (ingestResult, error) {
+		res.Error = reason
+		return res, nil
+	}
+	if !s.ingestBlob(msg.Blob) {
+		return reject("blob is not under " + s.config.IngestPrefix)
+	}
+
+	uploader := msg.Uploader
+	if uploader == "" {
+		uploader = defaultIngestUploader
+	}
+	file := store.File{Uploader: uploader, Encrypted: msg.Encrypt}
+	file.Container = s.tenantContainer(file.Uploader)
+	if err := applyLimits(&file, msg.TTL, msg.MaxDownloads); err != nil {
+		return reject(err.Error())
+	}
+
+	src, err := s.spoolBlob(r.Context(), file.Container, msg.Blob, s.config.maxUploadBytes(ingestRoute))
+	switch {
+	case err == storage.ErrBlobNotFound:
+		return reject("blob not found")
+	case err == errFetchTooLarge:
+		return reject(err.Error())
+	case err != nil:
+		return res, err
+	}
+	defer src.Close()
+
+	name := msg.Name
+	if name == "" {
+		name = path.Base(msg.Blob)
+	}
+	file.FileName = sanitizeFileName(name)
+	file.Size = src.size
+	contentType := msg.ContentType
+	if contentType == "" {
+		contentType = src.contentType
+	}
+	secret, deleteToken, err := s.shareSpooled(r, &file, src, contentType, "queue")
+	var refused uploadRefusal
+	switch {
+	case err == nil:
+	case err == errUserQuotaExceeded, err == errGlobalQuotaExceeded, errors.As(err, &refused):
+		return reject(err.Error())
+	default:
+		return res, err
+	}
+
+	// a message retried after this point shares the blob once more
+	if err := s.storageFor(file.Container).Delete(r.Context(), msg.Blob); err != nil && err != storage.ErrBlobNotFound {
+		s.logFor(r.Context()).Warn("failed to delete ingested blob", zap.String("blob", msg.Blob), zap.Error(err))
+	}
+	res.Secret, res.DeleteToken, res.URL, res.ExpiresAt = secret, deleteToken, s.shareURL(secret), file.ExpiresAt
+	return res, nil
+}
+
+// copy a blob into a temporary file of at most limit bytes, 0 for unlimited
+func (s *Server) spoolBlob(ctx context.Context, container, name string, limit int64) (*fetchedFile, error) {
+	blob, err := s.storageFor(container).Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	if limit > 0 && blob.Size > limit {
+		return nil, errFetchTooLarge
+	}
+
+	tmp, err := ioutil.TempFile("", "filer-ingest-")
+	if err != nil {
+		return nil, err
+	}
+	f := &fetchedFile{File: tmp, name: path.Base(name), contentType: blob.ContentType}
+	if f.size, err = io.Copy(tmp, blob); err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
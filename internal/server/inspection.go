@@ -0,0 +1,303 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"filer/internal/store"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// Uploads are inspected for sensitive data before they are shared when
+// DLP_MODE is set. In flag mode the files holding any are shared as usual and
+// queued for the review of admins, who approve or remove them, in block mode
+// they are refused with 422 and nothing is kept. Files encrypted by their
+// clients are inspected too, their ciphertext just never matches.
+const (
+	adminReviewRoute = "AdminReview"
+	adminReviewPath  = "/api/admin/review"
+	adminReviewFn    = "/api/" + adminReviewRoute
+
+	dlpOff   = "off"
+	dlpFlag  = "flag"
+	dlpBlock = "block"
+
+	// review states of flagged files
+	reviewPending  = "pending"
+	reviewApproved = "approved"
+
+	// only the head of larger files is inspected
+	maxInspectedBytes = 64 << 20
+	inspectChunkBytes = 64 << 10
+	// tail of a chunk inspected again with the next, so that matches across
+	// chunks are found
+	inspectOverlapBytes = 512
+)
+
+// kinds of findings
+const (
+	findingCreditCard = "credit_card"
+	findingAWSKey     = "aws_access_key"
+	findingPrivateKey = "private_key"
+	findingGitHub     = "github_token"
+	findingSlack      = "slack_token"
+	findingKeyword    = "keyword"
+)
+
+var (
+	inspections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "filer_inspected_uploads_total",
+		Help: "Uploads inspected for sensitive data by result (clean, flagged, blocked).",
+	}, []string{"result"})
+
+	errReviewDecision = errors.New("decision must be approve or reject")
+)
+
+// contentInspector looks for sensitive data in the contents of uploads
+type contentInspector interface {
+	// kinds of sensitive data found in r, sorted, none when it is clean
+	inspect(ctx context.Context, r io.Reader) ([]string, error)
+}
+
+// contentBlockedError refuses an upload holding sensitive data in block mode
+type contentBlockedError struct {
+	findings []string
+}
+
+func (e *contentBlockedError) Error() string {
+	return "upload refused, it holds sensitive data: " + strings.Join(e.findings, ", ")
+}
+
+func (e *contentBlockedError) statusCode() int {
+	return http.StatusUnprocessableEntity
+}
+
+// the inspector of DLP_MODE, nil when it is off
+func newContentInspector(mode string, keywords []string) contentInspector {
+	if mode == "" || mode == dlpOff {
+		return nil
+	}
+	return newPatternInspector(keywords)
+}
+
+// patternInspector finds secrets by their well-known formats, card numbers
+// passing the Luhn check and whole-word, case-insensitive keywords
+type patternInspector struct {
+	patterns map[string]*regexp.Regexp
+}
+
+var (
+	cardNumberPattern = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+	secretPatterns    = map[string]*regexp.Regexp{
+		findingAWSKey:     regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+		findingPrivateKey: regexp.MustCompile(`-----BEGIN (?:[A-Z]+ )*PRIVATE KEY-----`),
+		findingGitHub:     regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36}\b`),
+		findingSlack:      regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`),
+	}
+)
+
+func newPatternInspector(keywords []string) *patternInspector {
+	p := &patternInspector{patterns: map[string]*regexp.Regexp{}}
+	for kind, re := range secretPatterns {
+		p.patterns[kind] = re
+	}
+	var quoted []string
+	for _, k := range keywords {
+		if k = strings.TrimSpace(k); k != "" {
+			quoted = append(quoted, regexp.QuoteMeta(k))
+		}
+	}
+	if len(quoted) > 0 {
+		p.patterns[findingKeyword] = regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+	}
+	return p
+}
+
+func (p *patternInspector) inspect(ctx context.Context, r io.Reader) ([]string, error) {
+	found := map[string]bool{}
+	buf := make([]byte, inspectOverlapBytes+inspectChunkBytes)
+	kept, read := 0, 0
+	for read < maxInspectedBytes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n, err := io.ReadFull(r, buf[kept:])
+		read += n
+		if n > 0 {
+			p.match(buf[:kept+n], found)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		kept = copy(buf, buf[kept+n-inspectOverlapBytes:kept+n])
+	}
+	findings := make([]string, 0, len(found))
+	for kind := range found {
+		findings = append(findings, kind)
+	}
+	sort.Strings(findings)
+	return findings, nil
+}
+
+func (p *patternInspector) match(b []byte, found map[string]bool) {
+	for kind, re := range p.patterns {
+		if !found[kind] && re.Match(b) {
+			found[kind] = true
+		}
+	}
+	if !found[findingCreditCard] {
+		for _, m := range cardNumberPattern.FindAll(b, -1) {
+			if isCardNumber(m) {
+				found[findingCreditCard] = true
+				break
+			}
+		}
+	}
+}
+
+// whether the digits of b, separators aside, make the number of a payment card
+// of a major network passing the Luhn check
+func isCardNumber(b []byte) bool {
+	digits := make([]byte, 0, len(b))
+	for _, c := range b {
+		if c >= '0' && c <= '9' {
+			digits = append(digits, c-'0')
+		}
+	}
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+	switch prefix := int(digits[0])*10 + int(digits[1]); {
+	case digits[0] == 4, prefix >= 51 && prefix <= 55, prefix >= 22 && prefix <= 27,
+		prefix == 34, prefix == 37, digits[0] == 6, prefix == 35, prefix == 36:
+	default:
+		return false
+	}
+	sum := 0
+	for i := range digits {
+		d := int(digits[len(digits)-1-i])
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// inspect the contents of an upload when DLP_MODE is set, failing with a
+// contentBlockedError in block mode when they hold sensitive data
+func (s *Server) inspectContent(ctx context.Context, r io.Reader) ([]string, error) {
+	if s.inspector == nil {
+		return nil, nil
+	}
+	findings, err := s.inspector.inspect(ctx, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect contents: %w", err)
+	}
+	switch {
+	case len(findings) == 0:
+		inspections.WithLabelValues("clean").Inc()
+	case s.config.DLPMode == dlpBlock:
+		inspections.WithLabelValues("blocked").Inc()
+		return nil, &contentBlockedError{findings: findings}
+	default:
+		inspections.WithLabelValues("flagged").Inc()
+	}
+	return findings, nil
+}
+
+// inspect a stored blob, for uploads assembled in storage
+func (s *Server) inspectBlob(ctx context.Context, container, name string) ([]string, error) {
+	blob, err := s.storageFor(container).Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	return s.inspectContent(ctx, blob)
+}
+
+// add the findings of a part of a file to those of the file
+func addFindings(f *store.File, findings []string) {
+	for _, kind := range findings {
+		if !containsString(f.Findings, kind) {
+			f.Findings = append(f.Findings, kind)
+		}
+	}
+	sort.Strings(f.Findings)
+}
+
+// Admin review
+// GET lists the files flagged by content inspection awaiting review.
+func (s *Server) adminListReview(w http.ResponseWriter, r *http.Request) {
+	page, perPage, err := pageParams(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	list, err := s.listFiles(r.Context(), store.FileFilter{Review: reviewPending}, page, perPage)
+	if err != nil {
+		s.logFor(r.Context()).Error("admin: failed to list files awaiting review", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to list files")
+		return
+	}
+	writeFileList(w, r, list)
+}
+
+// POST /api/admin/review/<id> decides on a flagged file, approve keeps it
+// shared and out of the queue, reject removes it like an admin deletion.
+func (s *Server) adminReviewFile(w http.ResponseWriter, r *http.Request) {
+	decision := r.FormValue("decision")
+	if decision != "approve" && decision != "reject" {
+		writeError(w, r, http.StatusBadRequest, errReviewDecision.Error())
+		return
+	}
+	id := urlParam(r, "id")
+	file, err := s.findByID(r.Context(), id)
+	if err == store.ErrNotFound {
+		writeError(w, r, http.StatusNotFound, "file not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to look up file")
+		return
+	}
+	if file.Review != reviewPending {
+		writeError(w, r, http.StatusConflict, "file is not awaiting review")
+		return
+	}
+
+	if decision == "approve" {
+		if err := s.store.SetReview(r.Context(), file.ID, reviewApproved); err != nil {
+			s.logFor(r.Context()).Error("admin: failed to approve file", zap.String("file_id", id), zap.Error(err))
+			writeError(w, r, http.StatusInternalServerError, "failed to approve file")
+			return
+		}
+		s.logFor(r.Context()).Info("admin: approved file", zap.String("file_id", id), zap.Strings("findings", file.Findings))
+		s.audit(r, auditApprove, file)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := s.remove(r.Context(), file); err != nil {
+		s.logFor(r.Context()).Error("admin: failed to remove file", zap.String("file_id", id), zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to delete file")
+		return
+	}
+	s.logFor(r.Context()).Info("admin: rejected file", zap.String("file_id", id), zap.Strings("findings", file.Findings))
+	s.audit(r, auditDelete, file)
+	s.emit(eventFileDeleted, file)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,233 @@
+//go:build integration
+
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"filer/internal/secret"
+	"filer/internal/storage"
+	"filer/internal/store"
+	"filer/internal/testenv"
+
+	"go.uber.org/zap"
+)
+
+// a server wired like main, storing blobs in Azurite and links in MongoDB
+func newIntegrationServer(t *testing.T) (*httptest.Server, storage.Storage) {
+	t.Helper()
+	config := testConfig(t,
+		"-storage-backend=azure",
+		"-azure-storage-endpoint="+testenv.Azurite(t),
+		"-azure-storage-account="+testenv.AzuriteAccount,
+		"-azure-storage-access-key="+testenv.AzuriteAccessKey,
+		"-azure-storage-container=filer",
+		"-metadata-backend=mongo",
+		"-mongodb-connection-string="+testenv.Mongo(t),
+		"-mongodb-database=filer",
+		"-mongodb-collection=files",
+	)
+	blobs, err := storage.New(config.StorageOptions(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets := secret.NewHasher(config.SecretHMACKey)
+	metadata, err := store.New(config.StoreOptions(secrets, zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { metadata.Close(context.Background()) })
+	s, err := New(config, zap.NewNop(), blobs, metadata, secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+	return ts, blobs
+}
+
+// upload parts to ts and decode the answer
+func uploadTo(t *testing.T, ts *httptest.Server, parts []formPart) Upload {
+	t.Helper()
+	body, contentType := multipartBody(t, parts)
+	res, err := http.Post(ts.URL+v1FilesPath, contentType, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("upload status %d: %s", res.StatusCode, msg)
+	}
+	var uploaded Upload
+	if err := json.NewDecoder(res.Body).Decode(&uploaded); err != nil {
+		t.Fatal(err)
+	}
+	return uploaded
+}
+
+// download the file of secret from ts, returning the status and the body
+func downloadFrom(t *testing.T, ts *httptest.Server, secret string, header http.Header) (int, []byte) {
+	t.Helper()
+	r, err := http.NewRequest(http.MethodGet, ts.URL+v1FilesPath+"/"+url.PathEscape(secret), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, body
+}
+
+// names of the blobs of the container
+func blobNames(t *testing.T, blobs storage.Storage) []string {
+	t.Helper()
+	var names []string
+	err := blobs.List(context.Background(), func(info storage.BlobInfo) error {
+		names = append(names, info.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestEndToEnd(t *testing.T) {
+	ts, blobs := newIntegrationServer(t)
+
+	// several blocks of the block blob, incompressible
+	large := make([]byte, 10*1024*1024+1)
+	rand.New(rand.NewSource(1)).Read(large)
+
+	t.Run("upload and download", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			parts []formPart
+			// header of the download
+			header http.Header
+
+			status int
+			body   string
+			// entries of bundles, which are downloaded as zip files
+			entries []string
+		}{
+			{
+				name:   "file",
+				parts:  []formPart{{"file", "a.txt", "hello"}},
+				status: http.StatusOK,
+				body:   "hello",
+			},
+			{
+				name:   "large file",
+				parts:  []formPart{{"file", "large.bin", string(large)}},
+				status: http.StatusOK,
+				body:   string(large),
+			},
+			{
+				name:   "encrypted",
+				parts:  []formPart{{"encrypt", "", "true"}, {"file", "a.txt", "secret"}},
+				status: http.StatusOK,
+				body:   "secret",
+			},
+			{
+				name:   "range",
+				parts:  []formPart{{"file", "a.txt", "hello"}},
+				header: http.Header{"Range": {"bytes=1-3"}},
+				status: http.StatusPartialContent,
+				body:   "ell",
+			},
+			{
+				name:    "bundle",
+				parts:   []formPart{{"name", "", "both.zip"}, {"file", "a.txt", "hello"}, {"file", "b.txt", "world!"}},
+				status:  http.StatusOK,
+				entries: []string{"a.txt", "b.txt"},
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				uploaded := uploadTo(t, ts, tt.parts)
+				status, body := downloadFrom(t, ts, uploaded.Secret, tt.header)
+				if status != tt.status {
+					t.Fatalf("status %d, want %d: %s", status, tt.status, body)
+				}
+				if tt.entries == nil {
+					if !bytes.Equal(body, []byte(tt.body)) {
+						t.Errorf("downloaded %d bytes, not the %d uploaded", len(body), len(tt.body))
+					}
+					return
+				}
+				zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var names []string
+				for _, f := range zr.File {
+					names = append(names, f.Name)
+				}
+				if strings.Join(names, ",") != strings.Join(tt.entries, ",") {
+					t.Errorf("entries %v, want %v", names, tt.entries)
+				}
+			})
+		}
+	})
+
+	t.Run("deduplicate and delete", func(t *testing.T) {
+		content := []formPart{{"file", "same.txt", "stored once"}}
+		first, second := uploadTo(t, ts, content), uploadTo(t, ts, content)
+		name := contentBlobName(first.SHA256)
+		count := func() int {
+			n := 0
+			for _, blob := range blobNames(t, blobs) {
+				if strings.HasPrefix(blob, name) {
+					n++
+				}
+			}
+			return n
+		}
+		if n := count(); n != 1 {
+			t.Fatalf("%d blobs of the content, want 1", n)
+		}
+
+		for i, uploaded := range []Upload{first, second} {
+			r, err := http.NewRequest(http.MethodDelete, ts.URL+v1FilesPath+"/"+url.PathEscape(uploaded.Secret)+"?token="+url.QueryEscape(uploaded.DeleteToken), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusNoContent {
+				t.Fatalf("delete status %d", res.StatusCode)
+			}
+			if status, _ := downloadFrom(t, ts, uploaded.Secret, nil); status != http.StatusNotFound {
+				t.Errorf("download of a deleted file: status %d", status)
+			}
+			// the blob goes with the last file referencing it
+			if n, want := count(), 1-i; n != want {
+				t.Errorf("%d blobs of the content after %d deletions, want %d", n, i+1, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultJanitorInterval = 10 * time.Minute
+
+// parse a ttl given either in seconds or as a Go duration ("90m", "24h")
+func parseTTL(s string) (time.Duration, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		s = strconv.FormatInt(secs, 10) + "s"
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, strconv.ErrRange
+	}
+	return d, nil
+}
+
+// periodically remove expired files, erase the files trashed for longer
+// than TRASH_RETENTION, retry the copies to the secondary storage and move
+// untouched files to colder access tiers
+func (s *Server) runJanitor(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.draining:
+			return
+		case <-ticker.C:
+		}
+		n, err := s.purgeExpired(context.Background())
+		if err != nil {
+			s.logger.Error("janitor: failed to purge expired files", zap.Error(err))
+		}
+		if n > 0 {
+			s.logger.Info("janitor: removed expired files", zap.Int("count", n))
+		}
+		n, err = s.purgeTrash(context.Background())
+		if err != nil {
+			s.logger.Error("janitor: failed to empty the trash", zap.Error(err))
+		}
+		if n > 0 {
+			s.logger.Info("janitor: erased trashed files", zap.Int("count", n))
+		}
+		if err := s.retryReplication(context.Background()); err != nil {
+			s.logger.Error("janitor: failed to look for unreplicated files", zap.Error(err))
+		}
+		n, err = s.applyTiers(context.Background())
+		if err != nil {
+			s.logger.Error("janitor: failed to look for untouched files", zap.Error(err))
+		}
+		if n > 0 {
+			s.logger.Info("janitor: moved untouched files to colder tiers", zap.Int("count", n))
+		}
+		s.pruneAudit(context.Background())
+		s.pruneIdempotencyKeys(context.Background())
+		s.pruneUploadSessions(context.Background())
+	}
+}
+
+// delete expired blobs and their documents
+func (s *Server) purgeExpired(ctx context.Context) (int, error) {
+	files, err := s.store.ExpiredFiles(ctx, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for i := range files {
+		file := &files[i]
+		if err := s.remove(ctx, file); err != nil {
+			s.logger.Error("janitor: failed to remove file", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+			continue
+		}
+		s.emit(eventFileExpired, file)
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"filer/internal/store"
+)
+
+// limits of the description, tags and meta key/values of an upload
+const (
+	maxDescriptionLength = 1024
+	maxTags              = 20
+	maxTagLength         = 64
+	maxMetaKeys          = 20
+	maxMetaKeyLength     = 64
+	maxMetaValueLength   = 512
+)
+
+// read the description, tags[] and meta[<key>] fields of an upload into file
+// Tags are also accepted comma separated, and lower cased so searching them
+// ignores case.
+func parseLabels(r *http.Request, file *store.File) error {
+	description := strings.TrimSpace(r.FormValue("description"))
+	if utf8.RuneCountInString(description) > maxDescriptionLength {
+		return fmt.Errorf("description exceeds %d characters", maxDescriptionLength)
+	}
+	file.Description = description
+
+	seen := map[string]bool{}
+	for _, field := range []string{"tags[]", "tags"} {
+		for _, value := range r.Form[field] {
+			for _, tag := range strings.Split(value, ",") {
+				tag = strings.ToLower(strings.TrimSpace(tag))
+				if tag == "" || seen[tag] {
+					continue
+				}
+				if !validLabel(tag, maxTagLength) {
+					return fmt.Errorf("invalid tag %q", tag)
+				}
+				seen[tag] = true
+				file.Tags = append(file.Tags, tag)
+			}
+		}
+	}
+	if len(file.Tags) > maxTags {
+		return fmt.Errorf("more than %d tags", maxTags)
+	}
+	sort.Strings(file.Tags)
+
+	for field, values := range r.Form {
+		if !strings.HasPrefix(field, "meta[") || !strings.HasSuffix(field, "]") {
+			continue
+		}
+		key := field[len("meta[") : len(field)-1]
+		if !validLabel(key, maxMetaKeyLength) {
+			return fmt.Errorf("invalid meta key %q", key)
+		}
+		value := values[0]
+		if utf8.RuneCountInString(value) > maxMetaValueLength || strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			return fmt.Errorf("invalid value of meta[%s]", key)
+		}
+		if file.Meta == nil {
+			file.Meta = map[string]string{}
+		}
+		file.Meta[key] = value
+	}
+	if len(file.Meta) > maxMetaKeys {
+		return fmt.Errorf("more than %d meta keys", maxMetaKeys)
+	}
+	return nil
+}
+
+// tags and meta keys are short and printable, without brackets or commas
+func validLabel(s string, maxLength int) bool {
+	if s == "" || utf8.RuneCountInString(s) > maxLength {
+		return false
+	}
+	return strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsPrint(r) || strings.ContainsRune("[],", r)
+	}) < 0
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+// share links point at /d/<secret>, under the route prefix of the Functions host
+const (
+	landingRoute = "d"
+	landingPath  = "/api/" + landingRoute
+)
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{if .FileName}}{{.FileName}}{{else}}store.File not found{{end}}</title>
+{{if .PreviewURL}}<meta property="og:image" content="{{.PreviewURL}}">{{end}}
+<style>
+body { font-family: system-ui, sans-serif; max-width: 32rem; margin: 4rem auto; padding: 0 1rem; color: #222; }
+.size { color: #666; }
+img { max-width: 100%; }
+input, button { font-size: 1rem; padding: .5rem; margin-top: .5rem; }
+</style>
+</head>
+<body>
+{{if .FileName}}
+<h1>{{.FileName}}</h1>
+{{if .PreviewURL}}<img src="{{.PreviewURL}}" alt="">{{end}}
+<p class="size">{{.Size}}{{if .Remaining}} &middot; {{.Remaining}}{{end}}</p>
+{{if .ClientEncrypted}}<p>This file is end-to-end encrypted and must be opened with the client it was shared from.</p>{{end}}
+<form method="post">
+{{if .CSRFToken}}<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">{{end}}
+{{if .PassphraseRequired}}<label>Passphrase <input type="password" name="passphrase" required autofocus></label><br>{{end}}
+<button type="submit">Download</button>
+</form>
+{{else}}
+<h1>store.File not found</h1>
+<p>The link is wrong, has expired or the file was already downloaded.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// values shown on the landing page
+type landingPage struct {
+	FileName           string
+	Size               string
+	Remaining          string
+	PassphraseRequired bool
+	ClientEncrypted    bool
+	// thumbnail of images, absolute under PUBLIC_BASE_URL so link previews can fetch it
+	PreviewURL string
+	// sent back with the form when CSRF_PROTECTION is set
+	CSRFToken string
+}
+
+// format a size for people
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Share link
+// GET /d/<secret> shows a landing page with the file name, size and a download button,
+// so link previews never count as downloads. POST, or GET with dl=1, downloads the file.
+func (s *Server) landingHandler(w http.ResponseWriter, r *http.Request) {
+	secret := urlParam(r, "secret")
+
+	if r.Method == http.MethodPost || (r.Method == http.MethodGet && r.URL.Query().Get("dl") == "1") {
+		// hand over to the download handler, which reads the secret from the query
+		q := r.URL.Query()
+		q.Set("secret", secret)
+		r.URL.RawQuery = q.Encode()
+		// the form is already parsed when the CSRF token was checked
+		if r.Form != nil {
+			r.Form.Set("secret", secret)
+		}
+		s.downloadHandler(w, r)
+		return
+	}
+
+	file, err := s.find(r.Context(), secret)
+	if err == store.ErrNotFound {
+		failedGuess(r)
+		s.writeLanding(w, http.StatusNotFound, landingPage{})
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to look up file")
+		return
+	}
+
+	page := landingPage{
+		FileName:           file.FileName,
+		Size:               humanSize(file.Size),
+		PassphraseRequired: file.PassphraseHash != "",
+		ClientEncrypted:    file.ClientEncrypted,
+	}
+	if file.Thumbnail != "" && scanPassed(file) {
+		page.PreviewURL = s.previewURL(secret)
+	}
+	if s.config.CSRFProtection {
+		if page.CSRFToken, err = csrfToken(w, r); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to generate token")
+			return
+		}
+	}
+	if file.MaxDownloads > 0 {
+		remaining := file.MaxDownloads - file.Downloads
+		if remaining == 1 {
+			page.Remaining = "1 download left"
+		} else {
+			page.Remaining = fmt.Sprintf("%d downloads left", remaining)
+		}
+	}
+	s.writeLanding(w, http.StatusOK, page)
+}
+
+// preview of a secret, relative to the landing page when PUBLIC_BASE_URL is not configured
+func (s *Server) previewURL(secret string) string {
+	base := s.config.PublicBaseURL
+	if base == "" {
+		base = ".."
+	}
+	return base + "/" + previewRoute + "?secret=" + url.QueryEscape(secret)
+}
+
+func (s *Server) writeLanding(w http.ResponseWriter, code int, page landingPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := landingTemplate.Execute(w, page); err != nil {
+		s.logger.Error("failed to render landing page", zap.Error(err))
+	}
+}
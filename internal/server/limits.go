@@ -0,0 +1,45 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+)
+
+func writeTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("upload exceeds the maximum size of %d bytes", limit))
+}
+
+// whether err was caused by reading past the http.MaxBytesReader limit
+func isTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// limit the request body of a route to its maximum upload size
+func (s *Server) withMaxUploadBytes(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := s.config.maxUploadBytes(route)
+		if limit > 0 {
+			if r.ContentLength > limit {
+				writeTooLarge(w, r, limit)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next(w, r)
+	}
+}
+
+// answer 415 to request bodies that are not multipart/form-data
+func withMultipart(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+			writeError(w, r, http.StatusUnsupportedMediaType, "expected a multipart/form-data body")
+			return
+		}
+		next(w, r)
+	}
+}
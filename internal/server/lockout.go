@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Secrets are looked up by their hash, so response times reveal nothing about
+// how close a guess was; guessing is slowed down by locking out addresses instead.
+const (
+	lockoutThreshold = 5
+	lockoutBase      = time.Second
+	lockoutMax       = time.Hour
+	// failures are forgotten after this long without a new one
+	lockoutWindow = 15 * time.Minute
+	lockoutSweep  = 10000
+)
+
+// failed secret guesses of one address
+type failures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// lockout tracks failed secret guesses per address, per instance
+type lockout struct {
+	mu    sync.Mutex
+	peers map[string]*failures
+}
+
+func newLockout() *lockout {
+	return &lockout{peers: map[string]*failures{}}
+}
+
+// time left until the address may try again
+func (l *lockout) locked(addr string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.peers[addr]
+	if !ok {
+		return 0
+	}
+	if wait := time.Until(f.lockedUntil); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// record a failed guess, locking the address out for exponentially longer
+// once it made lockoutThreshold of them
+func (l *lockout) fail(addr string) (int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.peers) >= lockoutSweep {
+		for a, f := range l.peers {
+			if now.Sub(f.last) > lockoutWindow && now.After(f.lockedUntil) {
+				delete(l.peers, a)
+			}
+		}
+	}
+	f, ok := l.peers[addr]
+	if !ok || now.Sub(f.last) > lockoutWindow {
+		f = &failures{}
+		l.peers[addr] = f
+	}
+	f.count++
+	f.last = now
+	if f.count < lockoutThreshold {
+		return f.count, 0
+	}
+	d := lockoutMax
+	if n := f.count - lockoutThreshold; n < 16 && lockoutBase<<uint(n) < lockoutMax {
+		d = lockoutBase << uint(n)
+	}
+	f.lockedUntil = now.Add(d)
+	return f.count, d
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// keep streaming responses working through the recorder
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type guessKey struct{}
+
+// guess is set by handlers behind withLockout when the secret of a request
+// is unknown, or its passphrase or deletion token wrong
+type guess struct {
+	failed bool
+}
+
+// failedGuess reports that r guessed a secret, passphrase or deletion token
+// wrong. Other failures, such as missing blobs or restricted files, are not
+// guesses and must not lock out the people the file was shared with.
+func failedGuess(r *http.Request) {
+	if g, ok := r.Context().Value(guessKey{}).(*guess); ok {
+		g.failed = true
+	}
+}
+
+// count the failed guesses reported by next and turn away clients that are
+// locked out, IPv6 clients by their /64 like the rate limits
+func (s *Server) withLockout(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		addr := s.rateLimitKey(r)
+		if wait := s.lockout.locked(addr); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, http.StatusTooManyRequests, "too many failed attempts")
+			return
+		}
+
+		g := &guess{}
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r.WithContext(context.WithValue(r.Context(), guessKey{}, g)))
+		if !g.failed {
+			return
+		}
+		s.auditFailure(r, rec.status)
+		count, d := s.lockout.fail(addr)
+		s.logFor(r.Context()).Warn("audit: failed attempt", zap.Int("count", count), zap.String("client", addr), zap.String("path", loggedPath(r)), zap.Int("status", rec.status))
+		if d > 0 {
+			s.logFor(r.Context()).Warn("audit: locked out", zap.String("client", addr), zap.Duration("duration", d))
+		}
+	}
+}
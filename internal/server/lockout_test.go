@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestWithLockout(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts []formPart
+		// change the stored file before it is downloaded
+		prepare func(blobs *memStorage)
+		// query of the attempts, with the secret of the upload in %s
+		query string
+		// body of the attempts, sent as a form when set
+		form string
+		// address of the nth attempt
+		addr func(n int) string
+
+		// status of the attempts and of the one made after them
+		status, after int
+	}{
+		{
+			name:   "unknown secrets",
+			parts:  []formPart{{"file", "a.txt", "hello"}},
+			query:  "secret=unknown%.0s",
+			addr:   func(n int) string { return "192.0.2.1" },
+			status: http.StatusNotFound, after: http.StatusTooManyRequests,
+		},
+		{
+			name:   "unknown secrets from addresses of one IPv6 network",
+			parts:  []formPart{{"file", "a.txt", "hello"}},
+			query:  "secret=unknown%.0s",
+			addr:   func(n int) string { return fmt.Sprintf("2001:db8::%x", n+1) },
+			status: http.StatusNotFound, after: http.StatusTooManyRequests,
+		},
+		{
+			name:   "unknown secrets from different IPv6 networks",
+			parts:  []formPart{{"file", "a.txt", "hello"}},
+			query:  "secret=unknown%.0s",
+			addr:   func(n int) string { return fmt.Sprintf("2001:db8:%x::1", n+1) },
+			status: http.StatusNotFound, after: http.StatusNotFound,
+		},
+		{
+			name:   "wrong passphrases",
+			parts:  []formPart{{"passphrase", "", "open sesame"}, {"file", "a.txt", "hello"}},
+			query:  "secret=%s",
+			form:   "passphrase=guess",
+			addr:   func(n int) string { return "192.0.2.1" },
+			status: http.StatusForbidden, after: http.StatusTooManyRequests,
+		},
+		{
+			// the secret is right, the file is broken
+			name:  "missing blob",
+			parts: []formPart{{"file", "a.txt", "hello"}},
+			prepare: func(blobs *memStorage) {
+				for _, name := range blobs.names() {
+					blobs.Delete(context.Background(), name)
+				}
+			},
+			query:  "secret=%s",
+			addr:   func(n int) string { return "192.0.2.1" },
+			status: http.StatusNotFound, after: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, blobs, _ := newTestServer(t)
+			w := upload(t, h, tt.parts)
+			if w.Code != http.StatusOK {
+				t.Fatalf("upload status %d: %s", w.Code, w.Body)
+			}
+			var uploaded Upload
+			if err := json.Unmarshal(w.Body.Bytes(), &uploaded); err != nil {
+				t.Fatal(err)
+			}
+			if tt.prepare != nil {
+				tt.prepare(blobs)
+			}
+
+			target := "/api/DownloadTrigger?" + fmt.Sprintf(tt.query, url.QueryEscape(uploaded.Secret))
+			for n := 0; n <= lockoutThreshold; n++ {
+				r := httptest.NewRequest(http.MethodGet, target, nil)
+				if tt.form != "" {
+					r = httptest.NewRequest(http.MethodPost, target, strings.NewReader(tt.form))
+					r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				}
+				r.RemoteAddr = "[" + tt.addr(n) + "]:1234"
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+
+				want := tt.status
+				if n == lockoutThreshold {
+					want = tt.after
+				}
+				if w.Code != want {
+					t.Fatalf("attempt %d: status %d, want %d: %s", n+1, w.Code, want, w.Body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// NewLogger returns a logger of the entries at level and above, written as
+// JSON lines to stderr where the Functions host collects them.
+func NewLogger(level zapcore.Level) *zap.Logger {
+	c := zap.NewProductionConfig()
+	c.Level = zap.NewAtomicLevelAt(level)
+	c.EncoderConfig.TimeKey = "time"
+	c.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	l, err := c.Build()
+	if err != nil {
+		return zap.NewNop()
+	}
+	return l
+}
+
+// logger of the server tagged with the id of the request and the trace ctx
+// belongs to
+func (s *Server) logFor(ctx context.Context) *zap.Logger {
+	return tagLogger(s.logger, ctx)
+}
+
+// l tagged with the id of the request and the trace ctx belongs to
+func tagLogger(l *zap.Logger, ctx context.Context) *zap.Logger {
+	if id := requestID(ctx); id != "" {
+		l = l.With(zap.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		l = l.With(zap.String("trace_id", sc.TraceID().String()))
+	}
+	return l
+}
+
+// log every request once it is answered
+func (s *Server) withAccessLog(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		d := time.Since(start)
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		observeRequest(r, status, d)
+		s.logFor(r.Context()).Info("request",
+			zap.String("method", r.Method),
+			zap.String("path", loggedPath(r)),
+			zap.Int("status", status),
+			zap.Duration("duration", d),
+			zap.String("client", s.clientIP(r)),
+		)
+	}
+}
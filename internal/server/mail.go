@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+const (
+	sendGridURL           = "https://api.sendgrid.com/v3/mail/send"
+	defaultSMTPPort       = "587"
+	defaultEmailRateLimit = "10/1h"
+	emailTimeout          = 30 * time.Second
+)
+
+var errEmailDisabled = errors.New("email notifications are not configured")
+
+// Mailer sends plain text emails
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// create the mailer selected by EMAIL_PROVIDER, nil when emails are disabled
+func newMailer(config *Config) (Mailer, error) {
+	switch provider := config.EmailProvider; provider {
+	case "":
+		return nil, nil
+	case "smtp":
+		return &smtpMailer{
+			addr:     net.JoinHostPort(config.SMTPHost, config.SMTPPort),
+			host:     config.SMTPHost,
+			username: config.SMTPUsername,
+			password: config.SMTPPassword,
+			from:     config.EmailFrom,
+		}, nil
+	case "sendgrid":
+		return &sendGridMailer{apiKey: config.SendGridAPIKey, from: config.EmailFrom}, nil
+	default:
+		return nil, fmt.Errorf("unknown email provider %q", provider)
+	}
+}
+
+// smtpMailer sends through an SMTP relay, with STARTTLS when offered
+type smtpMailer struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+func (m *smtpMailer) Send(ctx context.Context, to, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	from, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, auth, from.Address, []string{to}, msg.Bytes())
+}
+
+// sendGridMailer sends through the SendGrid v3 API
+type sendGridMailer struct {
+	apiKey string
+	from   string
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+func (m *sendGridMailer) Send(ctx context.Context, to, subject, body string) error {
+	from, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return err
+	}
+	type content struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	type personalization struct {
+		To []sendGridAddress `json:"to"`
+	}
+	payload, err := json.Marshal(struct {
+		Personalizations []personalization `json:"personalizations"`
+		From             sendGridAddress   `json:"from"`
+		Subject          string            `json:"subject"`
+		Content          []content         `json:"content"`
+	}{
+		Personalizations: []personalization{{To: []sendGridAddress{{Email: to}}}},
+		From:             sendGridAddress{Email: from.Address, Name: from.Name},
+		Subject:          subject,
+		Content:          []content{{Type: "text/plain", Value: body}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sendGridURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("sendgrid: unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+var shareEmailTemplate = template.Must(template.New("share").Parse(`Someone shared "{{.FileName}}" ({{.Size}}) with you.
+
+{{if .URL}}Download it here:
+{{.URL}}
+{{else if .Secret}}Download it with this secret:
+{{.Secret}}
+{{else}}The sender will give you the download link separately.
+{{end}}{{if .ExpiresAt}}
+The file is available until {{.ExpiresAt}}.
+{{end}}{{if .Passphrase}}
+You will need the passphrase the sender gave you.
+{{end}}`))
+
+// values of the share email
+type shareEmail struct {
+	FileName   string
+	Size       string
+	URL        string
+	Secret     string
+	ExpiresAt  string
+	Passphrase bool
+}
+
+// limit of share emails per uploader, nil when unlimited
+func emailRateLimiter(config *Config) *rateLimiter {
+	if config.EmailRateLimit == "" {
+		return nil
+	}
+	// validated when the configuration was loaded
+	limiter, _ := parseRateLimit(config.EmailRateLimit)
+	return limiter
+}
+
+// parse a recipient address, rejecting anything but a single plain address
+func parseRecipient(addr string) (string, error) {
+	a, err := mail.ParseAddress(addr)
+	if err != nil {
+		return "", err
+	}
+	return a.Address, nil
+}
+
+// email the share link of a stored file, the secret is left out unless includeSecret
+func (s *Server) notifyEmail(to string, file store.File, secret string, includeSecret bool) {
+	if s.mailer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), emailTimeout)
+	defer cancel()
+
+	data := shareEmail{
+		FileName:   file.FileName,
+		Size:       humanSize(file.Size),
+		Passphrase: file.PassphraseHash != "",
+	}
+	if includeSecret {
+		data.URL = s.shareURL(secret)
+		if data.URL == "" {
+			data.Secret = secret
+		}
+	}
+	if file.ExpiresAt != nil {
+		data.ExpiresAt = file.ExpiresAt.Format(time.RFC1123)
+	}
+	var body bytes.Buffer
+	if err := shareEmailTemplate.Execute(&body, data); err != nil {
+		s.logger.Error("failed to render share email", zap.Error(err))
+		return
+	}
+
+	// file names come from the uploader and must not break the headers
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace("A file was shared with you: " + file.FileName)
+	if err := s.mailer.Send(ctx, to, subject, body.String()); err != nil {
+		s.logger.Error("failed to email share link", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"filer/internal/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
+)
+
+// Prometheus scrapes /metrics, the Functions host forwards it as /api/metrics
+const metricsPath = "/metrics"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "filer_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "filer_http_request_duration_seconds",
+		Help:    "Time to answer HTTP requests, including the transfer of the body.",
+		Buckets: []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"route", "method"})
+	uploads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "filer_uploads_total",
+		Help: "Stored uploads by kind (form, resumable, paste).",
+	}, []string{"kind"})
+	downloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "filer_downloads_total",
+		Help: "Served downloads by kind (file, bundle, redirect, cdn, not_modified).",
+	}, []string{"kind"})
+	uploadedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "filer_uploaded_bytes_total",
+		Help: "Bytes of stored uploads.",
+	})
+	downloadedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "filer_downloaded_bytes_total",
+		Help: "Bytes sent to downloading clients, redirected downloads are not counted.",
+	})
+	storageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "filer_storage_operation_duration_seconds",
+		Help:    "Latency of blob storage operations by operation and result.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+	mongoDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "filer_mongo_command_duration_seconds",
+		Help:    "Latency of MongoDB commands by command and result.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"command", "result"})
+)
+
+// route label of a request path, the first segment below /api, or below
+// /api/v1 for the versioned API
+// secrets and ids further down the path are left out to bound the label values
+func metricsRoute(path string) string {
+	segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 4)
+	if segments[0] == "api" && len(segments) > 2 && "/api/"+segments[1] == v1Path {
+		return v1Path + "/" + segments[2]
+	}
+	if segments[0] == "api" && len(segments) > 1 {
+		return "/api/" + segments[1]
+	}
+	return "/" + segments[0]
+}
+
+// count a request and its duration
+func observeRequest(r *http.Request, status int, d time.Duration) {
+	route := metricsRoute(r.URL.Path)
+	httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+	httpDuration.WithLabelValues(route, r.Method).Observe(d.Seconds())
+}
+
+// result label of an operation
+func metricsResult(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// record the duration of MongoDB commands and trace them
+func mongoMonitor(serviceName string) *event.CommandMonitor {
+	traced := otelmongo.NewMonitor(serviceName)
+	return &event.CommandMonitor{
+		Started: traced.Started,
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			traced.Succeeded(ctx, e)
+			mongoDuration.WithLabelValues(e.CommandName, "ok").Observe(time.Duration(e.DurationNanos).Seconds())
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			traced.Failed(ctx, e)
+			mongoDuration.WithLabelValues(e.CommandName, "error").Observe(time.Duration(e.DurationNanos).Seconds())
+		},
+	}
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// instrumentedStorage records the latency of every storage operation and traces it
+type instrumentedStorage struct {
+	storage.Storage
+}
+
+// wrap a backend with metrics, keeping resumable upload support visible
+func instrumentStorage(backend storage.Storage) storage.Storage {
+	s := instrumentedStorage{backend}
+	if chunked, ok := backend.(storage.ChunkedStorage); ok {
+		return instrumentedChunkedStorage{s, chunked}
+	}
+	return s
+}
+
+// time and trace a storage operation, the returned function records its outcome
+func observeStorage(ctx context.Context, operation string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, end := startSpan(ctx, "storage."+operation)
+	return ctx, func(err error) {
+		// missing and archived blobs are answers, not failures of the backend
+		if err == storage.ErrBlobNotFound || err == storage.ErrBlobArchived {
+			err = nil
+		}
+		end(err)
+		storageDuration.WithLabelValues(operation, metricsResult(err)).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (s instrumentedStorage) Put(ctx context.Context, name string, r io.Reader, opts storage.PutOptions) (string, error) {
+	ctx, done := observeStorage(ctx, "put")
+	url, err := s.Storage.Put(ctx, name, r, opts)
+	done(err)
+	return url, err
+}
+
+// Get and GetRange are timed until the stream is open, not until it is read
+func (s instrumentedStorage) Get(ctx context.Context, name string) (*storage.Blob, error) {
+	ctx, done := observeStorage(ctx, "get")
+	blob, err := s.Storage.Get(ctx, name)
+	done(err)
+	return blob, err
+}
+
+func (s instrumentedStorage) GetRange(ctx context.Context, name string, offset, count int64) (*storage.Blob, error) {
+	ctx, done := observeStorage(ctx, "get_range")
+	blob, err := s.Storage.GetRange(ctx, name, offset, count)
+	done(err)
+	return blob, err
+}
+
+func (s instrumentedStorage) Delete(ctx context.Context, name string) error {
+	ctx, done := observeStorage(ctx, "delete")
+	err := s.Storage.Delete(ctx, name)
+	done(err)
+	return err
+}
+
+func (s instrumentedStorage) Move(ctx context.Context, from, to string) (string, error) {
+	ctx, done := observeStorage(ctx, "move")
+	url, err := s.Storage.Move(ctx, from, to)
+	done(err)
+	return url, err
+}
+
+func (s instrumentedStorage) Exists(ctx context.Context, name string) (bool, error) {
+	ctx, done := observeStorage(ctx, "exists")
+	ok, err := s.Storage.Exists(ctx, name)
+	done(err)
+	return ok, err
+}
+
+func (s instrumentedStorage) SetTier(ctx context.Context, name, tier string) error {
+	ctx, done := observeStorage(ctx, "set_tier")
+	err := s.Storage.SetTier(ctx, name, tier)
+	done(err)
+	return err
+}
+
+func (s instrumentedStorage) Tier(ctx context.Context, name string) (string, error) {
+	ctx, done := observeStorage(ctx, "tier")
+	tier, err := s.Storage.Tier(ctx, name)
+	done(err)
+	return tier, err
+}
+
+func (s instrumentedStorage) List(ctx context.Context, fn func(storage.BlobInfo) error) error {
+	ctx, done := observeStorage(ctx, "list")
+	err := s.Storage.List(ctx, fn)
+	done(err)
+	return err
+}
+
+func (s instrumentedStorage) Ping(ctx context.Context) error {
+	ctx, done := observeStorage(ctx, "ping")
+	err := s.Storage.Ping(ctx)
+	done(err)
+	return err
+}
+
+// instrumentedChunkedStorage also times resumable upload operations
+type instrumentedChunkedStorage struct {
+	instrumentedStorage
+	chunked storage.ChunkedStorage
+}
+
+func (s instrumentedChunkedStorage) StageChunk(ctx context.Context, name string, index int, data []byte) error {
+	ctx, done := observeStorage(ctx, "stage_chunk")
+	err := s.chunked.StageChunk(ctx, name, index, data)
+	done(err)
+	return err
+}
+
+func (s instrumentedChunkedStorage) CommitChunks(ctx context.Context, name string, count int, opts storage.PutOptions) (string, error) {
+	ctx, done := observeStorage(ctx, "commit_chunks")
+	url, err := s.chunked.CommitChunks(ctx, name, count, opts)
+	done(err)
+	return url, err
+}
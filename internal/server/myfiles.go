@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+const (
+	myFilesRoute = "MyFiles"
+	myFilesPath  = "/api/" + myFilesRoute
+)
+
+// My files
+// GET lists the files uploaded by the signed-in user.
+// DELETE /api/MyFiles/<id> removes one of them, PATCH /api/MyFiles/<id> with ttl extends it.
+func (s *Server) myFilesHandler(w http.ResponseWriter, r *http.Request) {
+	owner := requestUser(r.Context())
+	if owner == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, r, http.StatusUnauthorized, "login required")
+		return
+	}
+
+	id := urlParam(r, "id")
+	if id == "" {
+		filter, err := searchFilter(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		filter.Owner = owner
+		page, perPage, err := pageParams(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		list, err := s.listFiles(r.Context(), filter, page, perPage)
+		if err != nil {
+			s.logFor(r.Context()).Error("failed to list files", zap.String("owner", owner), zap.Error(err))
+			writeError(w, r, http.StatusInternalServerError, "failed to list files")
+			return
+		}
+		writeFileList(w, r, list)
+		return
+	}
+
+	// files of other users and trashed files are reported as missing
+	file, err := s.findByID(r.Context(), id)
+	if err == nil && (file.Owner != owner || file.DeletedAt != nil) {
+		err = store.ErrNotFound
+	}
+	if err == store.ErrNotFound {
+		writeError(w, r, http.StatusNotFound, "file not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to look up file")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		if err := s.remove(r.Context(), file); err != nil {
+			s.logFor(r.Context()).Error("failed to remove file", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+			writeError(w, r, http.StatusInternalServerError, "failed to delete file")
+			return
+		}
+		s.audit(r, auditDelete, file)
+		s.emit(eventFileDeleted, file)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		d, err := parseTTL(r.FormValue("ttl"))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid ttl")
+			return
+		}
+		now := time.Now().UTC()
+		expiresAt := s.retainedExpiry(file, now.Add(d))
+		if !expiresAt.After(now) {
+			writeError(w, r, http.StatusConflict, "the retention rules do not let this file live any longer")
+			return
+		}
+		if err := s.store.SetExpiry(r.Context(), file.ID, expiresAt); err != nil {
+			s.logFor(r.Context()).Error("failed to extend file", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+			writeError(w, r, http.StatusInternalServerError, "failed to extend file")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
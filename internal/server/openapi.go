@@ -0,0 +1,497 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	openAPIPath = "/api/openapi.json"
+
+	// as http.Request.ParseMultipartForm, for multipart bodies without files
+	maxFormMemory = 32 << 20
+	// larger JSON bodies are left to the handlers, which reject them
+	maxValidatedJSONBytes = maxPasteBytes + 1
+)
+
+// the parts of an OpenAPI schema requests are checked against
+type apiSchema struct {
+	Ref        string                `json:"$ref"`
+	Type       string                `json:"type"`
+	Format     string                `json:"format"`
+	Enum       []interface{}         `json:"enum"`
+	Pattern    string                `json:"pattern"`
+	MaxLength  *int                  `json:"maxLength"`
+	Minimum    *float64              `json:"minimum"`
+	Maximum    *float64              `json:"maximum"`
+	Required   []string              `json:"required"`
+	Properties map[string]*apiSchema `json:"properties"`
+	Items      *apiSchema            `json:"items"`
+
+	pattern *regexp.Regexp
+}
+
+type apiParameter struct {
+	Ref      string     `json:"$ref"`
+	Name     string     `json:"name"`
+	In       string     `json:"in"`
+	Required bool       `json:"required"`
+	Schema   *apiSchema `json:"schema"`
+}
+
+type apiOperation struct {
+	Parameters  []*apiParameter `json:"parameters"`
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema *apiSchema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+type apiPathItem struct {
+	Get    *apiOperation `json:"get"`
+	Put    *apiOperation `json:"put"`
+	Post   *apiOperation `json:"post"`
+	Delete *apiOperation `json:"delete"`
+	Patch  *apiOperation `json:"patch"`
+}
+
+type apiDocument struct {
+	Paths      map[string]*apiPathItem `json:"paths"`
+	Components struct {
+		Schemas    map[string]*apiSchema    `json:"schemas"`
+		Parameters map[string]*apiParameter `json:"parameters"`
+	} `json:"components"`
+}
+
+// the document of openapi.json, compiled into the binary by go generate
+var apiSpec = mustLoadAPISpec(openAPIDocument)
+
+func mustLoadAPISpec(doc string) *apiDocument {
+	var d apiDocument
+	if err := json.Unmarshal([]byte(doc), &d); err != nil {
+		panic("openapi: " + err.Error())
+	}
+	if err := d.compile(); err != nil {
+		panic("openapi: " + err.Error())
+	}
+	return &d
+}
+
+// resolve the references of parameters and compile the patterns of every schema
+func (d *apiDocument) compile() error {
+	var walk func(s *apiSchema) error
+	walk = func(s *apiSchema) error {
+		if s == nil {
+			return nil
+		}
+		if s.Ref != "" && d.schema(s) == nil {
+			return fmt.Errorf("unknown schema %s", s.Ref)
+		}
+		if s.Pattern != "" {
+			re, err := regexp.Compile(s.Pattern)
+			if err != nil {
+				return err
+			}
+			s.pattern = re
+		}
+		for _, p := range s.Properties {
+			if err := walk(p); err != nil {
+				return err
+			}
+		}
+		return walk(s.Items)
+	}
+	for _, s := range d.Components.Schemas {
+		if err := walk(s); err != nil {
+			return err
+		}
+	}
+	for path, item := range d.Paths {
+		for _, op := range []*apiOperation{item.Get, item.Put, item.Post, item.Delete, item.Patch} {
+			if op == nil {
+				continue
+			}
+			for i, p := range op.Parameters {
+				if p.Ref != "" {
+					if op.Parameters[i] = d.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]; op.Parameters[i] == nil {
+						return fmt.Errorf("%s: unknown parameter %s", path, p.Ref)
+					}
+				}
+				if err := walk(op.Parameters[i].Schema); err != nil {
+					return err
+				}
+			}
+			if op.RequestBody != nil {
+				for _, media := range op.RequestBody.Content {
+					if err := walk(media.Schema); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// the schema s refers to, s itself when it is not a reference
+func (d *apiDocument) schema(s *apiSchema) *apiSchema {
+	if s == nil || s.Ref == "" {
+		return s
+	}
+	return d.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+}
+
+// the operation of method on path, nil when the document does not describe it
+// Path templates such as /api/MyFiles/{id} match a single segment.
+func (d *apiDocument) operation(path, method string) *apiOperation {
+	item := d.Paths[path]
+	if item == nil {
+		segments := strings.Split(path, "/")
+		for template, candidate := range d.Paths {
+			if matchPathTemplate(strings.Split(template, "/"), segments) {
+				item = candidate
+				break
+			}
+		}
+	}
+	if item == nil {
+		return nil
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return item.Get
+	case http.MethodPut:
+		return item.Put
+	case http.MethodPost:
+		return item.Post
+	case http.MethodDelete:
+		return item.Delete
+	case http.MethodPatch:
+		return item.Patch
+	}
+	return nil
+}
+
+func matchPathTemplate(template, segments []string) bool {
+	if len(template) != len(segments) {
+		return false
+	}
+	for i, t := range template {
+		if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+			if segments[i] == "" {
+				return false
+			}
+		} else if t != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// a request that does not match its operation
+type validationError string
+
+func (e validationError) Error() string {
+	return string(e)
+}
+
+// check the parameters and the body of r against op
+// Form and multipart bodies are parsed, JSON bodies are read and put back for
+// the handler. Parameters may be sent in the query or in a form body alike,
+// as the handlers read them with FormValue. Multipart bodies carrying files
+// are streamed by their handlers instead, which check the fields with
+// validateStreamedField as they arrive, only the query is checked here.
+func (d *apiDocument) validate(op *apiOperation, r *http.Request) error {
+	values := r.URL.Query()
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var body *apiSchema
+	if op.RequestBody != nil {
+		if media, ok := op.RequestBody.Content[mediaType]; ok {
+			body = d.schema(media.Schema)
+		}
+	}
+	streamed := mediaType == "multipart/form-data" && body != nil && d.hasFiles(body)
+
+	switch {
+	case body == nil, streamed:
+	case mediaType == "multipart/form-data":
+		if err := r.ParseMultipartForm(maxFormMemory); err != nil {
+			if isTooLarge(err) {
+				return err
+			}
+			return validationError("invalid multipart body")
+		}
+		values = r.Form
+	case mediaType == "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			if isTooLarge(err) {
+				return err
+			}
+			return validationError("invalid form body")
+		}
+		values = r.Form
+	case mediaType == "application/json":
+		if err := d.validateJSON(body, r); err != nil {
+			return err
+		}
+		body = nil
+	}
+
+	for _, p := range op.Parameters {
+		var present []string
+		switch p.In {
+		case "query":
+			present = values[p.Name]
+		case "header":
+			present = r.Header.Values(p.Name)
+		default:
+			continue
+		}
+		if err := d.validateValues(p.Name, present, d.schema(p.Schema), p.Required); err != nil {
+			return err
+		}
+	}
+	if body == nil {
+		return nil
+	}
+	required := map[string]bool{}
+	for _, name := range body.Required {
+		required[name] = true
+	}
+	for _, name := range sortedProperties(body) {
+		prop := d.schema(body.Properties[name])
+		// files only come in streamed bodies, whose handlers check what they hold
+		if binarySchema(prop) {
+			continue
+		}
+		if err := d.validateValues(name, values[name], prop, required[name] && !streamed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// whether the body s has file properties
+func (d *apiDocument) hasFiles(s *apiSchema) bool {
+	for _, prop := range s.Properties {
+		if binarySchema(d.schema(prop)) {
+			return true
+		}
+	}
+	return false
+}
+
+// check the values received so far of a field of a multipart body streamed
+// by the handler of r, as validate does for the bodies it parses
+func validateStreamedField(r *http.Request, name string, values []string) error {
+	op := apiSpec.operation(r.URL.Path, r.Method)
+	if op == nil || op.RequestBody == nil {
+		return nil
+	}
+	media, ok := op.RequestBody.Content["multipart/form-data"]
+	if !ok {
+		return nil
+	}
+	body := apiSpec.schema(media.Schema)
+	if body == nil {
+		return nil
+	}
+	prop := apiSpec.schema(body.Properties[name])
+	if prop == nil || binarySchema(prop) {
+		return nil
+	}
+	return apiSpec.validateValues(name, values, prop, false)
+}
+
+// names of the properties of s, in a stable order so errors name the same field every time
+func sortedProperties(s *apiSchema) []string {
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// whether s describes file contents, or a list of files
+func binarySchema(s *apiSchema) bool {
+	if s.Type == "array" && s.Items != nil {
+		s = s.Items
+	}
+	return s.Type == "string" && s.Format == "binary"
+}
+
+// check the first value of a parameter, which FormValue returns
+// Empty values count as missing, as they do in the handlers.
+func (d *apiDocument) validateValues(name string, values []string, s *apiSchema, required bool) error {
+	if len(values) == 0 || values[0] == "" {
+		if required {
+			return validationError("missing " + name)
+		}
+		return nil
+	}
+	if s == nil {
+		return nil
+	}
+	if s.Type == "array" {
+		for _, v := range values {
+			if err := d.validateValue(name, v, d.schema(s.Items)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return d.validateValue(name, values[0], s)
+}
+
+func (d *apiDocument) validateValue(name, v string, s *apiSchema) error {
+	invalid := validationError("invalid " + name)
+	if s == nil {
+		return nil
+	}
+	switch s.Type {
+	case "integer", "number":
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || s.Type == "integer" && strings.ContainsAny(v, ".eE") {
+			return invalid
+		}
+		if s.Minimum != nil && n < *s.Minimum || s.Maximum != nil && n > *s.Maximum {
+			return invalid
+		}
+	case "boolean":
+		if _, err := strconv.ParseBool(v); err != nil {
+			return invalid
+		}
+	case "string":
+		if s.MaxLength != nil && len(v) > *s.MaxLength {
+			return invalid
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return invalid
+		}
+		if s.Format == "duration" {
+			if _, err := parseTTL(v); err != nil {
+				return invalid
+			}
+		}
+	}
+	if len(s.Enum) > 0 {
+		for _, e := range s.Enum {
+			if fmt.Sprint(e) == v {
+				return nil
+			}
+		}
+		return invalid
+	}
+	return nil
+}
+
+// check a JSON object body against s, then let the handler read it again
+func (d *apiDocument) validateJSON(s *apiSchema, r *http.Request) error {
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, maxValidatedJSONBytes))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+	if err != nil {
+		if isTooLarge(err) {
+			return err
+		}
+		return validationError("failed to read body")
+	}
+	if len(buf) == maxValidatedJSONBytes {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil || fields == nil {
+		return validationError("invalid JSON body")
+	}
+	for _, name := range s.Required {
+		if v, ok := fields[name]; !ok || v == nil || v == "" {
+			return validationError("missing " + name)
+		}
+	}
+	for _, name := range sortedProperties(s) {
+		v, ok := fields[name]
+		if !ok || v == nil {
+			continue
+		}
+		prop := d.schema(s.Properties[name])
+		var text string
+		switch v := v.(type) {
+		case string:
+			if prop.Type != "string" {
+				return validationError("invalid " + name)
+			}
+			text = v
+		case json.Number:
+			if prop.Type != "integer" && prop.Type != "number" {
+				return validationError("invalid " + name)
+			}
+			text = v.String()
+		case bool:
+			if prop.Type != "boolean" {
+				return validationError("invalid " + name)
+			}
+			text = strconv.FormatBool(v)
+		default:
+			return validationError("invalid " + name)
+		}
+		if text == "" {
+			continue
+		}
+		if err := d.validateValue(name, text, prop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check requests to route against the OpenAPI document before the handler
+// sees them, answering 400 with the offending field otherwise
+func (s *Server) withValidation(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op := apiSpec.operation(r.URL.Path, r.Method)
+		if op == nil {
+			next(w, r)
+			return
+		}
+		err := apiSpec.validate(op, r)
+		if isTooLarge(err) {
+			writeTooLarge(w, r, s.config.maxUploadBytes(route))
+			return
+		}
+		var invalid validationError
+		if errors.As(err, &invalid) {
+			writeError(w, r, http.StatusBadRequest, invalid.Error())
+			return
+		}
+		next(w, r)
+	}
+}
+
+// OpenAPI document
+// describes every route with its parameters and answers, for clients and
+// generators in other languages
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(openAPIDocument)))
+	if r.Method == http.MethodGet {
+		io.WriteString(w, openAPIDocument)
+	}
+}
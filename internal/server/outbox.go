@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"filer/internal/store"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// With EVENT_OUTBOX, events are saved in the database for every webhook and
+// the event sink before the request emitting them is answered, and a
+// dispatcher on every instance delivers them from there. An event is kept
+// until its destination received it, so a crash or a redeploy right after an
+// upload delays its webhooks rather than losing them. Events may be delivered
+// more than once, receivers tell them apart by their id.
+const (
+	// destination of the entries of the event sink, the others are webhook URLs
+	outboxEventSink = "event-sink"
+	// how often every instance looks for due entries
+	outboxInterval = 5 * time.Second
+	// entries claimed at once
+	outboxBatch = 100
+	// time an instance has to deliver the entries it claimed, other
+	// instances deliver them once it is over
+	outboxLease = 5 * time.Minute
+	// failed deliveries are retried after a backoff doubling from
+	// outboxBackoff up to outboxMaxBackoff, for about nine hours
+	outboxBackoff    = 30 * time.Second
+	outboxMaxBackoff = time.Hour
+	outboxAttempts   = 16
+)
+
+var outboxDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "filer_outbox_deliveries_total",
+	Help: "Deliveries of events from the outbox by destination (webhook, event_sink) and result (delivered, failed, dropped).",
+}, []string{"destination", "result"})
+
+// save event in the outbox for every webhook and the event sink, reporting
+// whether it was, events that could not be saved are sent right away
+func (s *Server) saveToOutbox(event webhookEvent) bool {
+	body, err := json.Marshal(event)
+	if err != nil {
+		s.logger.Error("outbox: failed to encode event", zap.String("event", event.Type), zap.Error(err))
+		return false
+	}
+	var destinations []string
+	if s.webhooks != nil {
+		destinations = append(destinations, s.webhooks.urls...)
+	}
+	if s.events != nil {
+		destinations = append(destinations, outboxEventSink)
+	}
+	now := time.Now().UTC()
+	entries := make([]store.OutboxEntry, len(destinations))
+	for i, destination := range destinations {
+		entries[i] = store.OutboxEntry{Destination: destination, Event: body, CreatedAt: now, NextAttempt: now}
+	}
+	if err := s.store.AddOutbox(context.Background(), entries); err != nil {
+		s.logger.Error("outbox: failed to save event, sending it right away", zap.String("event", event.Type),
+			zap.String("event_id", event.ID), zap.Error(err))
+		return false
+	}
+	return true
+}
+
+// deliver the due entries of the outbox until the instance drains
+func (s *Server) runOutbox() {
+	ticker := time.NewTicker(outboxInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.draining:
+			return
+		case <-ticker.C:
+		}
+		// a full batch leaves more entries due
+		for {
+			n, err := s.dispatchOutbox(context.Background())
+			if err != nil {
+				s.logger.Error("outbox: failed to claim events", zap.Error(err))
+			}
+			if n < outboxBatch || s.isDraining() {
+				break
+			}
+		}
+	}
+}
+
+// whether the instance is shutting down
+func (s *Server) isDraining() bool {
+	select {
+	case <-s.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver a batch of due entries, returning how many were claimed
+// Webhooks are posted concurrently, the entries of the event sink are
+// exported in batches of EVENT_SINK_BATCH_SIZE.
+func (s *Server) dispatchOutbox(ctx context.Context) (int, error) {
+	entries, err := s.store.ClaimOutbox(ctx, time.Now().UTC(), outboxLease, outboxBatch)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		wg   sync.WaitGroup
+		sink []store.OutboxEntry
+	)
+	for i := range entries {
+		if entries[i].Destination == outboxEventSink {
+			sink = append(sink, entries[i])
+			continue
+		}
+		wg.Add(1)
+		go func(e store.OutboxEntry) {
+			defer wg.Done()
+			s.postOutbox(ctx, e)
+		}(entries[i])
+	}
+	s.exportOutbox(ctx, sink)
+	wg.Wait()
+	return len(entries), nil
+}
+
+// post the entry of a webhook, once
+func (s *Server) postOutbox(ctx context.Context, e store.OutboxEntry) {
+	if !s.webhooks.has(e.Destination) {
+		s.dropOutbox(ctx, "webhook", e, errors.New("webhook is no longer configured"))
+		return
+	}
+	var event webhookEvent
+	if err := json.Unmarshal(e.Event, &event); err != nil {
+		s.dropOutbox(ctx, "webhook", e, err)
+		return
+	}
+	s.settleOutbox(ctx, "webhook", e, s.webhooks.post(e.Destination, event, e.Event))
+}
+
+// export the entries of the event sink, once
+func (s *Server) exportOutbox(ctx context.Context, entries []store.OutboxEntry) {
+	if s.events == nil {
+		for _, e := range entries {
+			s.dropOutbox(ctx, "event_sink", e, errors.New("event sink is no longer configured"))
+		}
+		return
+	}
+	var (
+		batch  []store.OutboxEntry
+		events []webhookEvent
+	)
+	for _, e := range entries {
+		var event webhookEvent
+		if err := json.Unmarshal(e.Event, &event); err != nil {
+			s.dropOutbox(ctx, "event_sink", e, err)
+			continue
+		}
+		batch = append(batch, e)
+		events = append(events, event)
+	}
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > s.events.batchSize {
+			n = s.events.batchSize
+		}
+		err := s.events.sink.export(ctx, events[:n])
+		for _, e := range batch[:n] {
+			s.settleOutbox(ctx, "event_sink", e, err)
+		}
+		batch, events = batch[n:], events[n:]
+	}
+}
+
+// remove a delivered entry, or schedule the next attempt of a failed one
+func (s *Server) settleOutbox(ctx context.Context, destination string, e store.OutboxEntry, err error) {
+	if err == nil {
+		outboxDeliveries.WithLabelValues(destination, "delivered").Inc()
+		if err := s.store.DeleteOutbox(ctx, e.ID); err != nil {
+			s.logger.Error("outbox: failed to remove delivered event", zap.String("entry_id", e.ID.Hex()), zap.Error(err))
+		}
+		return
+	}
+	attempts := e.Attempts + 1
+	if attempts >= outboxAttempts {
+		s.dropOutbox(ctx, destination, e, err)
+		return
+	}
+	outboxDeliveries.WithLabelValues(destination, "failed").Inc()
+	backoff := outboxBackoff << uint(attempts-1)
+	if backoff > outboxMaxBackoff || backoff <= 0 {
+		backoff = outboxMaxBackoff
+	}
+	if err := s.store.RetryOutbox(ctx, e.ID, attempts, time.Now().UTC().Add(backoff)); err != nil {
+		s.logger.Error("outbox: failed to schedule delivery", zap.String("entry_id", e.ID.Hex()), zap.Error(err))
+	}
+}
+
+// give up on an entry
+func (s *Server) dropOutbox(ctx context.Context, destination string, e store.OutboxEntry, reason error) {
+	outboxDeliveries.WithLabelValues(destination, "dropped").Inc()
+	s.logger.Error("outbox: giving up on delivery", zap.String("entry_id", e.ID.Hex()), zap.String("destination", e.Destination),
+		zap.Int("attempts", e.Attempts+1), zap.Error(reason))
+	if err := s.store.DeleteOutbox(ctx, e.ID); err != nil {
+		s.logger.Error("outbox: failed to remove event", zap.String("entry_id", e.ID.Hex()), zap.Error(err))
+	}
+}
+
+// whether url is one of the webhooks
+func (wh *webhooks) has(url string) bool {
+	if wh == nil {
+		return false
+	}
+	for _, u := range wh.urls {
+		if u == url {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"io"
+
+	"filer/internal/storage"
+)
+
+const (
+	defaultDownloadChunkBytes = 8 << 20
+	maxDownloadParallelism    = 64
+	// a failed chunk is cheap to fetch again, unlike a failed stream
+	chunkAttempts = 3
+)
+
+// whether a blob of size bytes is streamed in parallel chunks
+func (s *Server) parallelWorthwhile(size int64) bool {
+	return s.config.DownloadParallelism > 1 && size > s.config.DownloadChunkBytes
+}
+
+// a fetched chunk of a parallel download
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+// parallelBlob streams a blob as ranged chunks fetched concurrently and read
+// in order. At most DOWNLOAD_PARALLELISM chunks are buffered ahead of the reader.
+type parallelBlob struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// pending chunks in blob order
+	order chan chan chunkResult
+	// size of the chunks, but the last
+	chunk int64
+	buf   []byte
+	err   error
+}
+
+// read the count bytes of name starting at offset in parallel chunks
+// first is the already opened stream of the range, its first chunk is read from it
+func (s *Server) newParallelBlob(ctx context.Context, backend storage.Storage, name string, first *storage.Blob, offset int64) *storage.Blob {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &parallelBlob{
+		ctx:    ctx,
+		cancel: cancel,
+		order:  make(chan chan chunkResult, s.config.DownloadParallelism-1),
+		chunk:  s.config.DownloadChunkBytes,
+	}
+	go p.produce(backend, name, first, offset)
+	return &storage.Blob{ReadCloser: p, Size: first.Size, ContentType: first.ContentType}
+}
+
+func (p *parallelBlob) produce(backend storage.Storage, name string, first *storage.Blob, offset int64) {
+	defer close(p.order)
+	chunk := p.chunk
+	for start := int64(0); start < first.Size; start += chunk {
+		n := chunk
+		if start+n > first.Size {
+			n = first.Size - start
+		}
+		res := make(chan chunkResult, 1)
+		select {
+		case p.order <- res:
+		case <-p.ctx.Done():
+			if start == 0 {
+				first.Close()
+			}
+			return
+		}
+		if start == 0 {
+			go func() {
+				res <- readChunk(first, n)
+				first.Close()
+			}()
+		} else {
+			go func(off, n int64) { res <- fetchChunk(p.ctx, backend, name, off, n) }(offset+start, n)
+		}
+	}
+}
+
+func readChunk(r io.Reader, n int64) chunkResult {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return chunkResult{err: err}
+	}
+	return chunkResult{data: data}
+}
+
+func fetchChunk(ctx context.Context, backend storage.Storage, name string, off, n int64) chunkResult {
+	var res chunkResult
+	for attempt := 0; attempt < chunkAttempts; attempt++ {
+		blob, err := backend.GetRange(ctx, name, off, n)
+		if err != nil {
+			res = chunkResult{err: err}
+		} else {
+			res = readChunk(blob, n)
+			blob.Close()
+		}
+		if res.err == nil || res.err == storage.ErrBlobNotFound || ctx.Err() != nil {
+			break
+		}
+	}
+	return res
+}
+
+func (p *parallelBlob) Read(b []byte) (int, error) {
+	for len(p.buf) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		res, ok := <-p.order
+		if !ok {
+			// the producer also stops early when the download is cancelled
+			if err := p.ctx.Err(); err != nil {
+				p.err = err
+				continue
+			}
+			return 0, io.EOF
+		}
+		chunk := <-res
+		p.buf, p.err = chunk.data, chunk.err
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+// stop fetching, chunks in flight are dropped
+func (p *parallelBlob) Close() error {
+	p.cancel()
+	return nil
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+const (
+	pasteRoute = "PasteTrigger"
+	pastePath  = "/api/" + pasteRoute
+
+	// snippets larger than this belong in a file upload
+	maxPasteBytes    = 1 << 20
+	defaultPasteName = "paste.txt"
+	pasteContentType = "text/plain; charset=utf-8"
+)
+
+// syntax hints are language names such as go, c++ or objective-c
+var pasteSyntax = regexp.MustCompile(`^[a-z0-9+#._-]{1,32}$`)
+
+// read the paste of a JSON or raw text body
+func readPaste(r *http.Request) (*pasteRequest, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPasteBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxPasteBytes {
+		return nil, &http.MaxBytesError{Limit: maxPasteBytes}
+	}
+
+	var req pasteRequest
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, pasteError("invalid JSON body")
+		}
+		return &req, nil
+	}
+
+	q := r.URL.Query()
+	req = pasteRequest{Text: string(body), Name: q.Get("name"), Syntax: q.Get("syntax"), TTL: q.Get("ttl")}
+	if v := q.Get("max_downloads"); v != "" {
+		if req.MaxDownloads, err = strconv.Atoi(v); err != nil {
+			return nil, pasteError("invalid max_downloads")
+		}
+	}
+	req.Encrypt, _ = strconv.ParseBool(q.Get("encrypt"))
+	return &req, nil
+}
+
+// a paste rejected for the given reason
+type pasteError string
+
+func (e pasteError) Error() string {
+	return string(e)
+}
+
+// Paste
+// shares a text snippet sent as the raw body, or as JSON with its options.
+// Options of raw bodies are the query parameters name, syntax, ttl,
+// max_downloads and encrypt. Pastes are downloaded as text/plain and shown
+// inline unless disposition=attachment is requested.
+func (s *Server) pasteHandler(w http.ResponseWriter, r *http.Request) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		writeError(w, r, http.StatusUnsupportedMediaType, "files are uploaded to "+uploadRoute)
+		return
+	}
+
+	req, err := readPaste(r)
+	if isTooLarge(err) {
+		limit := s.config.maxUploadBytes(pasteRoute)
+		if limit <= 0 || limit > maxPasteBytes {
+			limit = maxPasteBytes
+		}
+		writeTooLarge(w, r, limit)
+		return
+	}
+	if invalid, ok := err.(pasteError); ok {
+		writeError(w, r, http.StatusBadRequest, invalid.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "failed to read paste")
+		return
+	}
+	if req.Text == "" {
+		writeError(w, r, http.StatusBadRequest, "missing text")
+		return
+	}
+	if !utf8.ValidString(req.Text) {
+		writeError(w, r, http.StatusBadRequest, "text must be UTF-8")
+		return
+	}
+	if req.Syntax != "" && !pasteSyntax.MatchString(req.Syntax) {
+		writeError(w, r, http.StatusBadRequest, "invalid syntax")
+		return
+	}
+
+	file := store.File{
+		FileName:  sanitizeFileName(req.Name),
+		Uploader:  s.uploader(r),
+		Owner:     requestUser(r.Context()),
+		Encrypted: req.Encrypt,
+		Paste:     true,
+		Syntax:    req.Syntax,
+	}
+	if req.Name == "" {
+		file.FileName = defaultPasteName
+	}
+	file.Container = s.tenantContainer(file.Uploader)
+	if err := applyLimits(&file, req.TTL, req.MaxDownloads); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	secret, err := s.newSecret(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to generate secret")
+		return
+	}
+
+	size := int64(len(req.Text))
+	if err := s.reserveQuota(r.Context(), file.Uploader, size); err != nil {
+		s.writeQuotaError(w, r, err)
+		return
+	}
+	file.QuotaCharged = true
+	stored := false
+	defer func() {
+		if !stored {
+			s.releaseQuota(context.Background(), file.Uploader, size)
+		}
+	}()
+
+	part, err := s.storeContent(r.Context(), file.Container, bytes.NewReader([]byte(req.Text)), file.FileName, pasteContentType, size, secret, file.Encrypted, nil)
+	if s.writeRefused(w, r, err) {
+		return
+	}
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to store paste", zap.Error(err))
+		writeError(w, r, http.StatusBadGateway, "failed to store paste")
+		return
+	}
+	file.Size = size
+	setPart(&file, part)
+	// snippets looking like markup are still served as text
+	file.ContentType = pasteContentType
+	stored = s.saveUpload(w, r, &file, part, secret, "paste")
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"filer/internal/store"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// CI jobs share the same artifacts over and over. A precheck names the
+// contents by their SHA-256 and size, and when the uploader already stored
+// them the new file references the deduplicated blob instead of being sent
+// again. Only files of the same principal match, so knowing the hash of
+// contents others uploaded is not enough to share them.
+const (
+	precheckRoute = "UploadPrecheck"
+	precheckPath  = v1UploadsPath + "/precheck"
+)
+
+var errNoContent = errors.New("no file holds these contents, upload them")
+
+var prechecks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "filer_upload_prechecks_total",
+	Help: "Upload prechecks by result (shared, missing).",
+}, []string{"result"})
+
+func readPrecheckRequest(r *http.Request) (*precheckRequest, error) {
+	var req precheckRequest
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxClientMetadataBytes)).Decode(&req); err != nil {
+			return nil, errors.New("invalid JSON body")
+		}
+	} else {
+		req = precheckRequest{SHA256: r.FormValue("sha256"), Name: r.FormValue("name"), TTL: r.FormValue("ttl")}
+		size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid size")
+		}
+		req.Size = size
+		if v := r.FormValue("max_downloads"); v != "" {
+			if req.MaxDownloads, err = strconv.Atoi(v); err != nil {
+				return nil, errors.New("invalid max_downloads")
+			}
+		}
+	}
+	req.SHA256 = strings.ToLower(req.SHA256)
+	if len(req.SHA256) != 64 || strings.Trim(req.SHA256, "0123456789abcdef") != "" {
+		return nil, errors.New("invalid sha256")
+	}
+	if req.Size <= 0 {
+		return nil, errors.New("invalid size")
+	}
+	return &req, nil
+}
+
+// Upload precheck
+// shares contents the uploader already stored under a new secret, see
+// above. 404 means the contents have to be uploaded.
+func (s *Server) precheckHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := readPrecheckRequest(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	file := store.File{Uploader: s.uploader(r), Owner: requestUser(r.Context()), Size: req.Size}
+	file.Container = s.tenantContainer(file.Uploader)
+	if err := applyLimits(&file, req.TTL, req.MaxDownloads); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	existing, err := s.store.FindFileByContent(r.Context(), file.Uploader, req.SHA256, req.Size)
+	if err == store.ErrNotFound || err == nil && !reusable(existing, file.Container) {
+		prechecks.WithLabelValues("missing").Inc()
+		writeError(w, r, http.StatusNotFound, errNoContent.Error())
+		return
+	}
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to look for stored contents", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to look for stored contents")
+		return
+	}
+
+	name := req.Name
+	if name == "" {
+		name = existing.FileName
+	}
+	file.FileName = sanitizeFileName(name)
+	file.Blob, file.SHA256, file.MD5 = existing.Blob, existing.SHA256, existing.MD5
+	file.ContentType, file.Compressed, file.Tier = existing.ContentType, existing.Compressed, existing.Tier
+	if err := s.checkFileType(file.FileName, file.ContentType); err != nil {
+		s.writeRefused(w, r, err)
+		return
+	}
+	// the contents were inspected when first uploaded
+	addFindings(&file, existing.Findings)
+	if len(file.Findings) > 0 && s.config.DLPMode == dlpBlock {
+		s.writeRefused(w, r, &contentBlockedError{findings: file.Findings})
+		return
+	}
+
+	secret, err := s.newSecret(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to generate secret")
+		return
+	}
+	if err := s.reserveQuota(r.Context(), file.Uploader, file.Size); err != nil {
+		s.writeQuotaError(w, r, err)
+		return
+	}
+	file.QuotaCharged = true
+	stored := false
+	defer func() {
+		if !stored {
+			s.releaseQuota(context.Background(), file.Uploader, file.Size)
+		}
+	}()
+
+	// the blob is deleted with its last reference, which may just have gone
+	if file.LinkUrl, err = s.acquireBlob(r.Context(), file.Container, file.Blob); err != nil {
+		s.logFor(r.Context()).Error("failed to reference stored contents", zap.String("blob", file.Blob), zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to reference stored contents")
+		return
+	}
+	part := &storedPart{url: file.LinkUrl, blob: file.Blob}
+	if file.LinkUrl == "" {
+		s.discardParts(file.Container, []*storedPart{part})
+		prechecks.WithLabelValues("missing").Inc()
+		writeError(w, r, http.StatusNotFound, errNoContent.Error())
+		return
+	}
+	if stored = s.saveUpload(w, r, &file, part, secret, "precheck"); stored {
+		prechecks.WithLabelValues("shared").Inc()
+	}
+}
+
+// whether a new file of container may reference the blob of existing
+// Infected blobs are deleted, files stored before deduplication own theirs.
+func reusable(existing *store.File, container string) bool {
+	return existing.Container == container && existing.ScanStatus != scanInfected &&
+		strings.HasPrefix(existing.Blob, contentBlobPrefix) && len(existing.Entries) == 0
+}
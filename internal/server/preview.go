@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+
+	"filer/internal/storage"
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+const (
+	previewRoute = "Preview"
+	previewPath  = "/api/" + previewRoute
+
+	defaultThumbnailSize = "320x320"
+	// larger images are not decoded, a small compressed file can hold a huge bitmap
+	maxThumbnailSourcePixels = 40 * 1000 * 1000
+	thumbnailJPEGQuality     = 80
+)
+
+var errImageTooLarge = errors.New("image too large for a thumbnail")
+
+// image types thumbnails are generated for, the standard library decodes them
+var thumbnailSourceTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// whether a thumbnail is generated for the uploaded file
+// encrypted and passphrase protected files must not leak their contents
+func (s *Server) wantsThumbnail(f *store.File) bool {
+	return s.config.ThumbnailWidth > 0 && len(f.Entries) == 0 && thumbnailSourceTypes[f.ContentType] &&
+		!f.Encrypted && !f.ClientEncrypted && f.PassphraseHash == ""
+}
+
+// scale the image read from r down to fit THUMBNAIL_SIZE and return it with its content type
+// JPEG photos stay JPEG, PNG and GIF images become PNG to keep their transparency
+func (s *Server) makeThumbnail(r io.Reader, contentType string) ([]byte, string, error) {
+	// the header read to check the dimensions is replayed to decode the image
+	var header bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxThumbnailSourcePixels {
+		return nil, "", errImageTooLarge
+	}
+	img, _, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return nil, "", err
+	}
+
+	small := scaleDown(img, s.config.ThumbnailWidth, s.config.ThumbnailHeight)
+	var buf bytes.Buffer
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, small, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	} else {
+		contentType = "image/png"
+		err = png.Encode(&buf, small)
+	}
+	return buf.Bytes(), contentType, err
+}
+
+// shrink src to fit within maxWidth x maxHeight keeping its aspect ratio,
+// averaging the source pixels covered by each thumbnail pixel
+func scaleDown(src image.Image, maxWidth, maxHeight int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > maxWidth {
+		h = h * maxWidth / w
+		w = maxWidth
+	}
+	if h > maxHeight {
+		w = w * maxHeight / h
+		h = maxHeight
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			if n > 0 {
+				dst.SetRGBA64(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+			}
+		}
+	}
+	return dst
+}
+
+// generate and store the thumbnail of an uploaded image, recording it on file
+// The image is read back from storage, uploads are not kept locally. A
+// missing preview does not fail the upload, errors are only logged.
+func (s *Server) storeThumbnail(ctx context.Context, file *store.File) {
+	blob, err := s.download(ctx, file.Container, file.BlobName())
+	if err != nil {
+		s.logFor(ctx).Error("failed to open image for a thumbnail", zap.Error(err))
+		return
+	}
+	defer blob.Close()
+
+	var src io.Reader = blob
+	if file.Compressed {
+		decompressed, err := newDecompressReader(blob)
+		if err != nil {
+			s.logFor(ctx).Error("failed to open image for a thumbnail", zap.Error(err))
+			return
+		}
+		defer decompressed.Close()
+		src = decompressed
+	}
+	data, contentType, err := s.makeThumbnail(src, file.ContentType)
+	if err != nil {
+		s.logFor(ctx).Info("no thumbnail generated", zap.String("filename", file.FileName), zap.Error(err))
+		return
+	}
+	name := newBlobName("thumbnail")
+	if _, err := s.upload(ctx, file.Container, bytes.NewReader(data), name, storage.PutOptions{ContentType: contentType}); err != nil {
+		s.logFor(ctx).Error("failed to store thumbnail", zap.String("filename", file.FileName), zap.Error(err))
+		return
+	}
+	file.Thumbnail = name
+	file.ThumbnailType = contentType
+}
+
+// delete the thumbnail blob of a file, if it has one
+func (s *Server) removeThumbnail(ctx context.Context, file *store.File) error {
+	if file.Thumbnail == "" {
+		return nil
+	}
+	if err := s.storageFor(file.Container).Delete(ctx, storedBlobName(file, file.Thumbnail)); err != nil && err != storage.ErrBlobNotFound {
+		return err
+	}
+	return nil
+}
+
+// Preview
+// serves the thumbnail of an image so UIs and link previews do not need the
+// full file. Previews are not counted as downloads.
+func (s *Server) previewHandler(w http.ResponseWriter, r *http.Request) {
+	secret := r.URL.Query().Get("secret")
+	if secret == "" {
+		writeError(w, r, http.StatusBadRequest, "missing secret")
+		return
+	}
+
+	file, err := s.find(r.Context(), secret)
+	if err == store.ErrNotFound {
+		failedGuess(r)
+		writeError(w, r, http.StatusNotFound, "file not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to look up file")
+		return
+	}
+	if !s.allowedFrom(w, r, file) {
+		return
+	}
+	if !scanPassed(file) {
+		if file.ScanStatus == scanPending {
+			writeError(w, r, http.StatusConflict, "file is being scanned")
+			return
+		}
+		writeError(w, r, http.StatusForbidden, "file failed the virus scan")
+		return
+	}
+	if file.Thumbnail == "" {
+		writeError(w, r, http.StatusNotFound, "no preview available")
+		return
+	}
+
+	blob, err := s.download(r.Context(), file.Container, file.Thumbnail)
+	if err == storage.ErrBlobNotFound {
+		writeError(w, r, http.StatusNotFound, "no preview available")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, "failed to read preview")
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", file.ThumbnailType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.FormatInt(blob.Size, 10))
+	if _, err := io.Copy(w, blob); err != nil {
+		s.logFor(r.Context()).Error("failed to stream preview", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"filer/internal/secret"
+)
+
+// Upload progress is tracked in memory, so the progress stream must be
+// opened on the instance receiving the upload.
+const (
+	progressRoute        = "UploadProgress"
+	progressPath         = "/api/" + progressRoute
+	progressSessionTTL   = time.Hour
+	progressPollInterval = 500 * time.Millisecond
+)
+
+// progress of the blob staging of one upload
+type uploadProgress struct {
+	mu      sync.Mutex
+	written int64
+	total   int64
+	done    bool
+	failed  bool
+}
+
+// progress event sent to subscribers
+type progressEvent struct {
+	Written int64 `json:"written"`
+	Total   int64 `json:"total"`
+	Done    bool  `json:"done"`
+	Failed  bool  `json:"failed,omitempty"`
+}
+
+// count bytes as they are staged
+func (p *uploadProgress) Write(b []byte) (int, error) {
+	p.advance(int64(len(b)))
+	return len(b), nil
+}
+
+// count bytes that did not need to be staged
+func (p *uploadProgress) advance(n int64) {
+	p.mu.Lock()
+	p.written += n
+	p.mu.Unlock()
+}
+
+// set the number of bytes the upload is going to stage
+func (p *uploadProgress) start(total int64) {
+	p.mu.Lock()
+	p.total = total
+	p.mu.Unlock()
+}
+
+// mark the upload as finished
+func (p *uploadProgress) finish(failed bool) {
+	p.mu.Lock()
+	p.done = true
+	p.failed = failed
+	p.mu.Unlock()
+}
+
+func (p *uploadProgress) snapshot() progressEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return progressEvent{Written: p.written, Total: p.total, Done: p.done, Failed: p.failed}
+}
+
+// progressTracker holds the progress of uploads by session id
+type progressTracker struct {
+	mu       sync.Mutex
+	sessions map[string]*uploadProgress
+}
+
+func newProgressTracker() *progressTracker {
+	return &progressTracker{sessions: map[string]*uploadProgress{}}
+}
+
+// create a progress session, forgotten after progressSessionTTL
+func (t *progressTracker) create() (string, error) {
+	id, err := secret.Random(32)
+	if err != nil {
+		return "", err
+	}
+	t.mu.Lock()
+	t.sessions[id] = &uploadProgress{}
+	t.mu.Unlock()
+	time.AfterFunc(progressSessionTTL, func() {
+		t.mu.Lock()
+		delete(t.sessions, id)
+		t.mu.Unlock()
+	})
+	return id, nil
+}
+
+// progress of session id, nil if unknown
+func (t *progressTracker) get(id string) *uploadProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessions[id]
+}
+
+// Upload progress
+// POST creates a progress session to pass to UploadTrigger as ?progress=<session>.
+// GET /api/UploadProgress/<session> streams its progress as server-sent events.
+func (s *Server) uploadProgressHandler(w http.ResponseWriter, r *http.Request) {
+	id := urlParam(r, "session")
+	if id != "" {
+		s.streamProgress(w, r, id)
+		return
+	}
+	id, err := s.progress.create()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to create progress session")
+		return
+	}
+	res, _ := json.Marshal(progressSession{id})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(res)
+}
+
+// send a progress event whenever the progress changes until the upload is done
+func (s *Server) streamProgress(w http.ResponseWriter, r *http.Request, id string) {
+	p := s.progress.get(id)
+	if p == nil {
+		writeError(w, r, http.StatusNotFound, "progress session not found")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(progressPollInterval)
+	defer ticker.Stop()
+	var last progressEvent
+	first := true
+	for {
+		event := p.snapshot()
+		if first || event != last {
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+			flusher.Flush()
+			first, last = false, event
+		}
+		if event.Done {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		// progress streams would hold up draining until the deadline
+		case <-s.draining:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+const (
+	adminPurgeRoute = "AdminPurge"
+	adminPurgePath  = "/api/admin/purge"
+	adminPurgeFn    = "/api/" + adminPurgeRoute
+)
+
+// hex HMAC-SHA256 of a report with REPORT_SIGNING_KEY
+func (s *Server) signReport(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(s.config.ReportSigningKey))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Admin purge
+// POST with uploader, or api_key for the files uploaded with a key, deletes
+// every file of that uploader with its blobs and answers with a deletion
+// report signed with REPORT_SIGNING_KEY.
+func (s *Server) adminPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if s.config.ReportSigningKey == "" {
+		writeError(w, r, http.StatusNotFound, "purging requires REPORT_SIGNING_KEY")
+		return
+	}
+	id := r.PostFormValue("uploader")
+	if key := r.PostFormValue("api_key"); key != "" {
+		id = apiKeyID(key)
+	}
+	if id == "" {
+		writeError(w, r, http.StatusBadRequest, "missing uploader or api_key")
+		return
+	}
+
+	report := purgeReport{Uploader: id, RequestID: requestID(r.Context()), StartedAt: time.Now().UTC(), Deleted: []purgedFile{}}
+	// list everything first, removing files while paging would skip some,
+	// trashed files included
+	var files []store.File
+	for _, trashed := range []bool{false, true} {
+		for page := 1; ; page++ {
+			list, _, err := s.store.ListFiles(r.Context(), store.FileFilter{Uploader: id, Trashed: trashed}, page, maxAdminPerPage)
+			if err != nil {
+				s.logFor(r.Context()).Error("admin: failed to list files to purge", zap.Error(err))
+				writeError(w, r, http.StatusInternalServerError, "failed to list files")
+				return
+			}
+			files = append(files, list...)
+			if len(list) < maxAdminPerPage {
+				break
+			}
+		}
+	}
+
+	for i := range files {
+		file := &files[i]
+		entry := purgedFile{
+			ID:         file.ID.Hex(),
+			FileName:   file.FileName,
+			Size:       file.Size,
+			SHA256:     file.SHA256,
+			UploadedAt: file.CreatedAt,
+		}
+		for _, name := range file.BlobNames() {
+			entry.Blobs = append(entry.Blobs, storedBlobName(file, name))
+		}
+		if file.Thumbnail != "" {
+			entry.Blobs = append(entry.Blobs, storedBlobName(file, file.Thumbnail))
+		}
+		if err := s.erase(r.Context(), file); err != nil {
+			s.logFor(r.Context()).Error("admin: failed to purge file", zap.String("file_id", entry.ID), zap.Error(err))
+			entry.Error = "failed to delete file"
+			report.Failed = append(report.Failed, entry)
+			continue
+		}
+		s.audit(r, auditDelete, file)
+		s.emit(eventFileDeleted, file)
+		report.Deleted = append(report.Deleted, entry)
+		report.DeletedBytes += file.Size
+	}
+	report.CompletedAt = time.Now().UTC()
+	s.logFor(r.Context()).Info("admin: purged uploader", zap.String("uploader", id),
+		zap.Int("deleted", len(report.Deleted)), zap.Int("failed", len(report.Failed)))
+
+	res, err := json.Marshal(report)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Filer-Signature", "sha256="+s.signReport(res))
+	// the report is still sent when some files could not be deleted, a retry picks them up
+	if len(report.Failed) > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write(res)
+}
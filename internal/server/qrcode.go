@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	qrCodeRoute = "QrCode"
+	qrCodePath  = "/api/" + qrCodeRoute
+
+	defaultQRCodeSize = 256
+	maxQRCodeSize     = 1024
+)
+
+// PNG QR code of the share link of a secret
+func (s *Server) shareQRCode(secret string, size int) ([]byte, error) {
+	return qrcode.Encode(s.shareURL(secret), qrcode.Medium, size)
+}
+
+// QR code
+// renders the share link of a secret as a PNG, for handing a link over to a phone.
+// The secret is not looked up, the image only encodes the link.
+func (s *Server) qrCodeHandler(w http.ResponseWriter, r *http.Request) {
+	secret := r.URL.Query().Get("secret")
+	if secret == "" {
+		writeError(w, r, http.StatusBadRequest, "missing secret")
+		return
+	}
+	if s.shareURL(secret) == "" {
+		writeError(w, r, http.StatusNotImplemented, "share links are not configured")
+		return
+	}
+	size := defaultQRCodeSize
+	if v := r.URL.Query().Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 64 || n > maxQRCodeSize {
+			writeError(w, r, http.StatusBadRequest, "invalid size")
+			return
+		}
+		size = n
+	}
+
+	png, err := s.shareQRCode(secret, size)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to render QR code")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(png)))
+	w.Write(png)
+}
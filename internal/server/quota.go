@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// the global quota is tracked next to the per-principal ones,
+// principals are always prefixed ("user:", "key:") so the ids cannot clash
+const (
+	globalQuotaID     = "global"
+	adminQuotasRoute  = "AdminQuotas"
+	adminQuotasPath   = "/api/admin/quotas"
+	adminQuotasFnPath = "/api/" + adminQuotasRoute
+)
+
+var (
+	errUserQuotaExceeded   = errors.New("user quota exceeded")
+	errGlobalQuotaExceeded = errors.New("global quota exceeded")
+)
+
+// whether uploads of the principal count towards a quota
+// anonymous uploads are identified by address and only count globally
+func quotaPrincipal(uploader string) bool {
+	return strings.HasPrefix(uploader, "user:") || strings.HasPrefix(uploader, "key:")
+}
+
+// add size to the usage of id if it stays within its limit, or def when it has none
+func (s *Server) chargeQuota(ctx context.Context, id string, size, def int64) (bool, error) {
+	return s.store.ChargeQuota(ctx, id, size, def)
+}
+
+// reserve size bytes for an upload by uploader
+// returns errUserQuotaExceeded or errGlobalQuotaExceeded when there is no room left
+func (s *Server) reserveQuota(ctx context.Context, uploader string, size int64) error {
+	ok, err := s.chargeQuota(ctx, globalQuotaID, size, s.config.GlobalQuotaBytes)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errGlobalQuotaExceeded
+	}
+	if !quotaPrincipal(uploader) {
+		return nil
+	}
+	ok, err = s.chargeQuota(ctx, uploader, size, s.config.UserQuotaBytes)
+	if err == nil && !ok {
+		err = errUserQuotaExceeded
+	}
+	if err != nil {
+		s.unchargeQuota(ctx, globalQuotaID, size)
+	}
+	return err
+}
+
+// give back size bytes reserved by uploader
+func (s *Server) releaseQuota(ctx context.Context, uploader string, size int64) {
+	s.unchargeQuota(ctx, globalQuotaID, size)
+	if quotaPrincipal(uploader) {
+		s.unchargeQuota(ctx, uploader, size)
+	}
+}
+
+func (s *Server) unchargeQuota(ctx context.Context, id string, size int64) {
+	if err := s.store.UnchargeQuota(ctx, id, size); err != nil {
+		s.logger.Error("failed to release quota", zap.String("principal", id), zap.Int64("bytes", size), zap.Error(err))
+	}
+}
+
+// settle the reservation of *reserved bytes of uploader to size, once the
+// size of an upload reserved ahead of storing it is known. Answers the
+// quota error and reports false when the remainder cannot be reserved.
+func (s *Server) settleQuota(w http.ResponseWriter, r *http.Request, uploader string, reserved *int64, size int64) bool {
+	if size > *reserved {
+		if err := s.reserveQuota(r.Context(), uploader, size-*reserved); err != nil {
+			s.writeQuotaError(w, r, err)
+			return false
+		}
+	} else if size < *reserved {
+		s.releaseQuota(r.Context(), uploader, *reserved-size)
+	}
+	*reserved = size
+	return true
+}
+
+// respond to a failed quota reservation
+func (s *Server) writeQuotaError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errUserQuotaExceeded:
+		writeError(w, r, http.StatusTooManyRequests, "upload quota exceeded")
+	case errGlobalQuotaExceeded:
+		writeError(w, r, http.StatusInsufficientStorage, "storage quota exceeded")
+	default:
+		s.logger.Error("failed to reserve quota", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to reserve quota")
+	}
+}
+
+// Admin quotas
+// GET lists the usage and limits of every principal.
+func (s *Server) adminListQuotas(w http.ResponseWriter, r *http.Request) {
+	quotas, err := s.store.ListQuotas(r.Context())
+	if err != nil {
+		s.logFor(r.Context()).Error("admin: failed to list quotas", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to list quotas")
+		return
+	}
+
+	res, err := json.Marshal(quotaList{s.config.UserQuotaBytes, s.config.GlobalQuotaBytes, quotas})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
+
+// PUT /api/admin/quotas/<principal> with limit sets its quota (0 lifts it), "default" removes the override.
+func (s *Server) adminSetQuota(w http.ResponseWriter, r *http.Request) {
+	id := urlParam(r, "principal")
+	var limit *int64
+	if v := r.FormValue("limit"); v != "default" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = &n
+	}
+
+	if err := s.store.SetQuotaLimit(r.Context(), id, limit); err != nil {
+		s.logFor(r.Context()).Error("admin: failed to set quota", zap.String("principal", id), zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to set quota")
+		return
+	}
+	s.logFor(r.Context()).Info("admin: set quota", zap.String("principal", id), zap.String("limit", r.FormValue("limit")))
+	w.WriteHeader(http.StatusNoContent)
+}
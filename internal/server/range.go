@@ -0,0 +1,65 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// a byte range of a file
+type byteRange struct {
+	start, length int64
+}
+
+// value of the Content-Range header for the range
+func (r byteRange) contentRange(size int64) string {
+	return "bytes " + strconv.FormatInt(r.start, 10) + "-" + strconv.FormatInt(r.start+r.length-1, 10) + "/" + strconv.FormatInt(size, 10)
+}
+
+// parse a Range header for a file of the given size
+// only single ranges are honored, ok is false when the whole file should be served
+func parseRange(header string, size int64) (r byteRange, ok bool, err error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return byteRange{}, false, nil
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	if strings.Contains(spec, ",") {
+		// multipart/byteranges is not worth it, serve everything
+		return byteRange{}, false, nil
+	}
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return byteRange{}, false, nil
+	}
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+	if first == "" {
+		// suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return byteRange{}, false, errRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return byteRange{size - n, n}, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return byteRange{}, false, errRangeNotSatisfiable
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return byteRange{}, false, errRangeNotSatisfiable
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return byteRange{start, end - start + 1}, true, nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buckets are swept once the limiter tracks this many clients
+const rateLimitSweepSize = 10000
+
+// a token bucket refilled at rate tokens per second up to burst
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client
+// limits are per instance, each scaled out instance allows the full rate
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(n int, per time.Duration) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(n) / per.Seconds(),
+		burst:   float64(n),
+		buckets: map[string]*bucket{},
+	}
+}
+
+// take a token for client, returns how long to wait when there is none
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.buckets) >= rateLimitSweepSize {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// forget clients whose bucket has refilled, they are indistinguishable from new ones
+func (l *rateLimiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// rate limiter of a route, RATE_LIMIT_<ROUTE> overrides RATE_LIMIT
+// returns nil when the route is not limited
+func (s *Server) routeRateLimiter(route string) *rateLimiter {
+	v := s.config.rateLimit(route)
+	if v == "" {
+		return nil
+	}
+	// validated when the configuration was loaded
+	limiter, _ := parseRateLimit(v)
+	return limiter
+}
+
+// parse a rate limit "<requests>/<period>", "0" disables the limit and returns nil
+func parseRateLimit(v string) (*rateLimiter, error) {
+	if v == "0" {
+		return nil, nil
+	}
+	parts := strings.SplitN(v, "/", 2)
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n <= 0 || len(parts) != 2 {
+		return nil, strconv.ErrSyntax
+	}
+	per, err := parseTTL(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return newRateLimiter(n, per), nil
+}
+
+// reject requests beyond the rate limit of the route with 429 and Retry-After
+// callers are limited per user, API key or address, like uploads are attributed,
+// the address being the one clientIP trusts
+func (s *Server) withRateLimit(route string, next http.HandlerFunc) http.HandlerFunc {
+	limiter := s.routeRateLimiter(route)
+	if limiter == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		if ok, wait := limiter.allow(s.rateLimitKey(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// bucket of a request, IPv6 clients are handed whole /64 networks and share
+// the bucket of theirs
+func (s *Server) rateLimitKey(r *http.Request) string {
+	key := s.uploader(r)
+	if ip := net.ParseIP(key); ip != nil && ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return key
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"filer/internal/storage"
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+const (
+	adminOrphansRoute = "AdminOrphans"
+	adminOrphansPath  = "/api/admin/orphans"
+	adminOrphansFn    = "/api/" + adminOrphansRoute
+
+	defaultReconcileInterval = 24 * time.Hour
+	// blobs and links younger than this may belong to an upload in progress,
+	// which writes the blob before saving the link
+	orphanMinAge = 24 * time.Hour
+)
+
+// periodically remove blobs without links and links without blobs, left
+// behind by uploads that failed halfway
+func (s *Server) runReconciler(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.draining:
+			return
+		case <-ticker.C:
+		}
+		report, err := s.reconcile(context.Background(), false)
+		if err != nil {
+			s.logger.Error("reconciler: failed to look for orphans", zap.Error(err))
+			continue
+		}
+		if len(report.Blobs) > 0 || len(report.Files) > 0 {
+			s.logger.Info("reconciler: removed orphans", zap.Int("blobs", len(report.Blobs)),
+				zap.Int("files", len(report.Files)), zap.Int("failed", report.Failed))
+		}
+	}
+}
+
+// find the orphans older than orphanMinAge, and remove them unless dryRun
+// Shared blobs are left to their reference counts, and a link is only an
+// orphan when none of its blobs exist.
+func (s *Server) reconcile(ctx context.Context, dryRun bool) (*orphanReport, error) {
+	report := &orphanReport{DryRun: dryRun, StartedAt: time.Now().UTC(), Blobs: []orphanBlob{}, Files: []orphanFile{}}
+	cutoff := report.StartedAt.Add(-orphanMinAge)
+
+	// read every link before listing the blobs, a blob written since is too
+	// young to be an orphan
+	files, err := s.store.AllFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	linked := map[string]bool{}
+	for i := range files {
+		// trashed files hold their blobs under trashBlobPrefix
+		for _, name := range files[i].BlobNames() {
+			linked[blobRefID(files[i].Container, storedBlobName(&files[i], name))] = true
+		}
+		if files[i].Thumbnail != "" {
+			linked[blobRefID(files[i].Container, storedBlobName(&files[i], files[i].Thumbnail))] = true
+		}
+	}
+
+	containers := []string{""}
+	for name := range s.tenants {
+		containers = append(containers, name)
+	}
+	sort.Strings(containers[1:])
+	for _, container := range containers {
+		var orphans []orphanBlob
+		err := s.storageFor(container).List(ctx, func(blob storage.BlobInfo) error {
+			// blobs dropped for ingestion are not filer's until they are shared
+			if !linked[blobRefID(container, blob.Name)] && !strings.HasPrefix(blob.Name, contentBlobPrefix) && !s.ingestBlob(blob.Name) && blob.Modified.Before(cutoff) {
+				orphans = append(orphans, orphanBlob{Container: container, Name: blob.Name, Size: blob.Size, Modified: blob.Modified})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, orphan := range orphans {
+			if !dryRun {
+				if err := s.storageFor(container).Delete(ctx, orphan.Name); err != nil && err != storage.ErrBlobNotFound {
+					s.logger.Error("reconciler: failed to delete blob", zap.String("container", container), zap.String("blob", orphan.Name), zap.Error(err))
+					report.Failed++
+					continue
+				}
+			}
+			report.Blobs = append(report.Blobs, orphan)
+		}
+	}
+
+	for i := range files {
+		file := &files[i]
+		if !file.CreatedAt.Before(cutoff) || !s.blobsMissing(ctx, file) {
+			continue
+		}
+		if !dryRun {
+			if err := s.erase(ctx, file); err != nil {
+				s.logger.Error("reconciler: failed to delete file link", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+				report.Failed++
+				continue
+			}
+			s.emit(eventFileDeleted, file)
+		}
+		report.Files = append(report.Files, orphanFile{ID: file.ID.Hex(), FileName: file.FileName, UploadedAt: file.CreatedAt, Container: file.Container, Blobs: file.BlobNames()})
+	}
+	report.CompletedAt = time.Now().UTC()
+	return report, nil
+}
+
+// whether none of the blobs of file exist, false when that is not known
+func (s *Server) blobsMissing(ctx context.Context, file *store.File) bool {
+	for _, name := range file.BlobNames() {
+		exists, err := s.storageFor(file.Container).Exists(ctx, storedBlobName(file, name))
+		if err != nil {
+			s.logger.Warn("reconciler: failed to check blob", zap.String("file_id", file.ID.Hex()), zap.String("blob", name), zap.Error(err))
+			return false
+		}
+		if exists {
+			return false
+		}
+	}
+	return true
+}
+
+// Admin orphans
+// GET reports what the reconciler would remove, without removing anything
+func (s *Server) adminOrphansHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := s.reconcile(r.Context(), true)
+	if err != nil {
+		s.logFor(r.Context()).Error("admin: failed to look for orphans", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to look for orphans")
+		return
+	}
+	res, err := json.Marshal(report)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
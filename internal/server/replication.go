@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"filer/internal/storage"
+	"filer/internal/store"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	// copy states of the blobs of a file in the secondary storage
+	replicationPending    = "pending"
+	replicationReplicated = "replicated"
+
+	// files copied at once
+	replicationWorkers = 4
+	// files waiting for a worker, later ones are left to the janitor
+	replicationQueueSize = 1000
+	// pending files older than this were missed by the workers, by a
+	// failure or a restart, and are queued again by the janitor
+	replicationRetryAfter = 10 * time.Minute
+)
+
+var (
+	replications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "filer_replications_total",
+		Help: "Files copied to the secondary storage by result (replicated, failed, dropped).",
+	}, []string{"result"})
+	storageFailovers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "filer_storage_failovers_total",
+		Help: "Storage calls that failed on one backend and were tried on the other, by backend and operation.",
+	}, []string{"backend", "operation"})
+)
+
+// open the secondary storage with the tenant containers, nil without one
+func openReplicas(config *Config, logger *zap.Logger) (map[string]storage.Storage, error) {
+	opts, ok := config.secondaryStorageOptions(logger)
+	if !ok {
+		return nil, nil
+	}
+	secondary, err := storage.New(opts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secondary storage configuration: %w", err)
+	}
+	replicas := map[string]storage.Storage{"": storage.WithTimeout(secondary, config.StorageTimeout)}
+	for _, name := range config.TenantContainers {
+		if _, ok := replicas[name]; ok {
+			continue
+		}
+		container, err := secondary.(storage.ContainerStorage).Container(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open secondary tenant container: %w", err)
+		}
+		replicas[name] = storage.WithTimeout(container, config.StorageTimeout)
+	}
+	return replicas, nil
+}
+
+// backend of a container reading from its replica when it fails, logging the
+// failures to logger
+func withReplica(logger *zap.Logger, backend storage.Storage, replicas map[string]storage.Storage, container string) storage.Storage {
+	replica, ok := replicas[container]
+	if !ok {
+		return backend
+	}
+	return storage.WithFailover(backend, replica, func(operation string, secondary bool, err error) {
+		name := "primary"
+		if secondary {
+			name = "secondary"
+		}
+		storageFailovers.WithLabelValues(name, operation).Inc()
+		logger.Warn("storage call failed, trying the other backend", zap.String("backend", name),
+			zap.String("container", container), zap.String("operation", operation), zap.Error(err))
+	})
+}
+
+// the blobs of file kept in the secondary storage, with its thumbnail
+func replicatedBlobs(file *store.File) []string {
+	names := file.BlobNames()
+	if file.Thumbnail != "" {
+		names = append(names, file.Thumbnail)
+	}
+	return names
+}
+
+// copy the blobs of a new or restored file to the secondary storage in the
+// background, its link must be saved with Replication set
+func (s *Server) replicate(file *store.File) {
+	if s.replicas == nil {
+		return
+	}
+	select {
+	case s.replication <- *file:
+	default:
+		replications.WithLabelValues("dropped").Inc()
+		s.logger.Warn("replication: queue full, leaving file to the janitor", zap.String("file_id", file.ID.Hex()))
+	}
+}
+
+func (s *Server) runReplication() {
+	for {
+		select {
+		case <-s.draining:
+			return
+		case file := <-s.replication:
+			if err := s.copyToReplica(context.Background(), &file); err != nil {
+				replications.WithLabelValues("failed").Inc()
+				s.logger.Error("replication: failed to copy file", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+				continue
+			}
+			replications.WithLabelValues("replicated").Inc()
+		}
+	}
+}
+
+// copy the blobs of file and record it replicated
+// Blobs gone meanwhile are skipped, the file was deleted or trashed.
+func (s *Server) copyToReplica(ctx context.Context, file *store.File) error {
+	replica := s.replicas[file.Container]
+	for _, name := range replicatedBlobs(file) {
+		blob, err := s.storageFor(file.Container).Get(ctx, name)
+		if err == storage.ErrBlobNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = replica.Put(ctx, name, blob, storage.PutOptions{ContentType: blob.ContentType})
+		blob.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return s.store.SetReplication(ctx, file.ID, replicationReplicated)
+}
+
+// queue the files still pending after replicationRetryAfter again
+func (s *Server) retryReplication(ctx context.Context) error {
+	if s.replicas == nil {
+		return nil
+	}
+	files, err := s.store.FilesReplicating(ctx, replicationPending)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-replicationRetryAfter)
+	for i := range files {
+		if files[i].CreatedAt.Before(cutoff) {
+			s.replicate(&files[i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"time"
+
+	"filer/internal/store"
+)
+
+// a rule of RETENTION_RULES, the files it matches expire after ttl at the latest
+// A rule matches one of the size of a file, its content type or the
+// extension of its name, for bundles also the content type or extension of
+// any of their files.
+type retentionRule struct {
+	// size>N, files larger than N bytes
+	minSize int64
+	// type:<type> or ext:<extension>
+	fileType
+	ttl time.Duration
+}
+
+func (rule retentionRule) matches(file *store.File) bool {
+	if rule.contentType == "" && rule.extension == "" {
+		return file.Size > rule.minSize
+	}
+	if rule.fileType.matches(file.ContentType, file.FileName) {
+		return true
+	}
+	for _, entry := range file.Entries {
+		if rule.fileType.matches(entry.ContentType, entry.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// move the expiry of a new file to the earliest one of the rules it matches,
+// when it would expire later or never
+func (s *Server) applyRetention(file *store.File, now time.Time) {
+	for _, rule := range s.config.RetentionRules {
+		if !rule.matches(file) {
+			continue
+		}
+		if expiresAt := now.Add(rule.ttl); file.ExpiresAt == nil || expiresAt.Before(*file.ExpiresAt) {
+			file.ExpiresAt = &expiresAt
+		}
+	}
+}
+
+// expiresAt moved to the earliest expiry the rules matching file allow,
+// counted from its upload, for files given a new lifetime
+func (s *Server) retainedExpiry(file *store.File, expiresAt time.Time) time.Time {
+	extended := *file
+	extended.ExpiresAt = &expiresAt
+	s.applyRetention(&extended, file.CreatedAt)
+	return *extended.ExpiresAt
+}
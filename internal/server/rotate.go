@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+// Links pasted to the wrong channel are revoked by giving the file a new
+// secret. The file is not uploaded again and keeps its limits and deletion
+// token, while the former secret, its word code and the download tokens and
+// collections holding it stop leading to the file.
+
+// Rotate a secret
+// requires the deletion token returned at upload time, or the signed-in owner
+func (s *Server) rotateHandler(w http.ResponseWriter, r *http.Request) {
+	secret, token := r.FormValue("secret"), r.FormValue("token")
+	owner := requestUser(r.Context())
+	if secret == "" || token == "" && owner == "" {
+		writeError(w, r, http.StatusBadRequest, "missing secret or token")
+		return
+	}
+
+	file, err := s.find(r.Context(), secret)
+	if err == store.ErrNotFound {
+		failedGuess(r)
+		writeError(w, r, http.StatusNotFound, "file not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to look up file")
+		return
+	}
+	if !(owner != "" && file.Owner == owner) && !s.secrets.Verify(token, file.DeleteToken) {
+		failedGuess(r)
+		writeError(w, r, http.StatusForbidden, "invalid deletion token")
+		return
+	}
+	// the key of encrypted files is derived from the secret, and scans
+	// record their outcome under the secret they started with
+	if file.Encrypted {
+		writeError(w, r, http.StatusConflict, "encrypted files cannot be given a new secret")
+		return
+	}
+	if file.ScanStatus == scanPending {
+		writeError(w, r, http.StatusConflict, "the file is still being scanned, retry later")
+		return
+	}
+
+	newSecret, err := s.newSecret(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to generate secret")
+		return
+	}
+	var code, codeHash string
+	if file.CodeHash != "" {
+		if code, err = s.newWordCode(r.Context()); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "failed to generate word code")
+			return
+		}
+		codeHash = s.secrets.Hash(code)
+	}
+	rotated, err := s.store.RotateSecret(r.Context(), file.ID, s.secrets.Hash(newSecret), codeHash)
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to rotate secret", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to rotate secret")
+		return
+	}
+	if !rotated {
+		writeError(w, r, http.StatusNotFound, "file not found")
+		return
+	}
+	s.audit(r, auditRotate, file)
+
+	rotation := s.newUpload(r, file, newSecret, "")
+	rotation.Code = code
+	res, err := json.Marshal(rotation)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
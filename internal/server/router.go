@@ -0,0 +1,241 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// middleware wraps a handler, like withCORS and the other with functions
+type middleware func(http.HandlerFunc) http.HandlerFunc
+
+// router dispatches requests on their path and method
+// Patterns are matched segment by segment: {name} matches any one segment,
+// read back with urlParam, and a trailing * matches the rest of the path.
+// Static segments win over parameters and parameters over *. A trailing
+// slash is ignored.
+type router struct {
+	routes *[]*route
+	prefix string
+	// run for every request to a route of the group, before its method is checked
+	stack []middleware
+}
+
+type route struct {
+	pattern  string
+	segments []string
+	methods  []string
+	handlers map[string]http.HandlerFunc
+	serve    http.HandlerFunc
+}
+
+// the route a request matched, with the values of its parameters
+type routeMatch struct {
+	route  *route
+	params map[string]string
+}
+
+type routeMatchKey struct{}
+
+func newRouter() *router {
+	return &router{routes: &[]*route{}}
+}
+
+// add middleware to the routes registered afterwards on rt and its groups
+func (rt *router) use(mw ...middleware) {
+	rt.stack = append(rt.stack, mw...)
+}
+
+// register the routes of fn under prefix, with their own middleware
+func (rt *router) group(prefix string, fn func(*router)) {
+	fn(&router{
+		routes: rt.routes,
+		prefix: rt.prefix + prefix,
+		stack:  append([]middleware(nil), rt.stack...),
+	})
+}
+
+// serve method on pattern with h, any method the route has no handler for
+// when method is empty
+// The middleware of the first registration of a pattern is used for all of
+// its methods.
+func (rt *router) handle(method, pattern string, h http.HandlerFunc) {
+	pattern = rt.prefix + pattern
+	var rte *route
+	for _, r := range *rt.routes {
+		if r.pattern == pattern {
+			rte = r
+			break
+		}
+	}
+	if rte == nil {
+		rte = &route{
+			pattern:  pattern,
+			segments: splitPath(pattern),
+			handlers: make(map[string]http.HandlerFunc),
+		}
+		rte.serve = chain(rt.stack, rte.dispatch)
+		*rt.routes = append(*rt.routes, rte)
+	}
+	if _, ok := rte.handlers[method]; !ok && method != "" {
+		rte.methods = append(rte.methods, method)
+	}
+	rte.handlers[method] = h
+}
+
+func (rt *router) get(pattern string, h http.HandlerFunc) {
+	rt.handle(http.MethodGet, pattern, h)
+}
+
+func (rt *router) post(pattern string, h http.HandlerFunc) {
+	rt.handle(http.MethodPost, pattern, h)
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rte, params := rt.match(r.URL.Path)
+	if rte == nil {
+		writeError(w, r, http.StatusNotFound, "not found")
+		return
+	}
+	rte.serve(w, r.WithContext(context.WithValue(r.Context(), routeMatchKey{}, &routeMatch{rte, params})))
+}
+
+// the most specific route matching path, with its parameters
+func (rt *router) match(path string) (*route, map[string]string) {
+	segments := splitPath(path)
+	var best *route
+	var bestRank []int
+	for _, rte := range *rt.routes {
+		rank, ok := rte.rank(segments)
+		if ok && (best == nil || lessRank(rank, bestRank)) {
+			best, bestRank = rte, rank
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	return best, best.params(segments)
+}
+
+// how specific the match of rte is for each segment, ok false if it does not match
+func (rte *route) rank(segments []string) ([]int, bool) {
+	rank := make([]int, 0, len(rte.segments))
+	for i, p := range rte.segments {
+		switch {
+		case p == "*" && i == len(rte.segments)-1:
+			return append(rank, 2), true
+		case i >= len(segments):
+			return nil, false
+		case strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") && segments[i] != "":
+			rank = append(rank, 1)
+		case p == segments[i]:
+			rank = append(rank, 0)
+		default:
+			return nil, false
+		}
+	}
+	return rank, len(segments) == len(rte.segments)
+}
+
+func (rte *route) params(segments []string) map[string]string {
+	var params map[string]string
+	for i, p := range rte.segments {
+		name := ""
+		value := ""
+		switch {
+		case p == "*" && i == len(rte.segments)-1:
+			name, value = "*", strings.Join(segments[i:], "/")
+		case strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}"):
+			name, value = p[1:len(p)-1], segments[i]
+		default:
+			continue
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[name] = value
+	}
+	return params
+}
+
+// call the handler of the method, answering 405 with the allowed methods
+// otherwise and a plain OPTIONS request with them
+func (rte *route) dispatch(w http.ResponseWriter, r *http.Request) {
+	h, ok := rte.handlers[r.Method]
+	if !ok && r.Method == http.MethodHead {
+		h, ok = rte.handlers[http.MethodGet]
+	}
+	if !ok {
+		h, ok = rte.handlers[""]
+	}
+	if ok {
+		h(w, r)
+		return
+	}
+
+	allow := append([]string(nil), rte.methods...)
+	if rte.handlers[http.MethodGet] != nil && rte.handlers[http.MethodHead] == nil {
+		allow = append(allow, http.MethodHead)
+	}
+	if rte.handlers[http.MethodOptions] == nil {
+		allow = append(allow, http.MethodOptions)
+	}
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// value of the path parameter name of the route r matched, * for the rest
+// of the path
+func urlParam(r *http.Request, name string) string {
+	m, _ := r.Context().Value(routeMatchKey{}).(*routeMatch)
+	if m == nil {
+		return ""
+	}
+	return m.params[name]
+}
+
+// path of r for logs, with the secrets and tokens of path parameters
+// replaced by their parameter
+func loggedPath(r *http.Request) string {
+	m, _ := r.Context().Value(routeMatchKey{}).(*routeMatch)
+	if m == nil || (m.params["secret"] == "" && m.params["token"] == "") {
+		return r.URL.Path
+	}
+	segments := splitPath(r.URL.Path)
+	for i, p := range m.route.segments {
+		if (p == "{secret}" || p == "{token}") && i < len(segments) {
+			segments[i] = p
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// wrap h in mw, the first one outermost
+func chain(mw []middleware, h http.HandlerFunc) http.HandlerFunc {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// whether rank a is more specific than b, comparing from the first segment
+func lessRank(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) > len(b)
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	// handlers answer with their name, the method and the path parameters
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			m, _ := r.Context().Value(routeMatchKey{}).(*routeMatch)
+			fmt.Fprintf(w, "%s %s %v", name, r.Method, m.params)
+		}
+	}
+	// middleware lists itself in X-Middleware
+	mark := func(name string) middleware {
+		return func(next http.HandlerFunc) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Middleware", name)
+				next(w, r)
+			}
+		}
+	}
+
+	rt := newRouter()
+	rt.use(mark("root"))
+	rt.get("/api/files", handler("list"))
+	rt.post("/api/files", handler("create"))
+	rt.get("/api/files/{secret}", handler("get"))
+	rt.handle(http.MethodDelete, "/api/files/{secret}", handler("delete"))
+	rt.get("/api/files/latest", handler("latest"))
+	rt.get("/api/files/{secret}/entries/{entry}", handler("entry"))
+	rt.get("/head", handler("get"))
+	rt.handle(http.MethodHead, "/head", handler("head"))
+	rt.get("/static/*", handler("static"))
+	rt.handle("", "/webdav/*", handler("webdav"))
+	rt.group("/admin", func(rt *router) {
+		rt.use(mark("admin"))
+		rt.get("/files/{id}", handler("admin"))
+		rt.group("/keys", func(rt *router) {
+			rt.use(mark("keys"))
+			rt.post("", handler("keys"))
+		})
+	})
+	rt.get("/after", handler("after"))
+
+	tests := []struct {
+		name, method, path string
+
+		status     int
+		body       string
+		allow      string
+		middleware string
+	}{
+		{
+			name: "static route", method: http.MethodGet, path: "/api/files",
+			status: http.StatusOK, body: "list GET map[]", middleware: "root",
+		},
+		{
+			name: "second method of a route", method: http.MethodPost, path: "/api/files",
+			status: http.StatusOK, body: "create POST map[]", middleware: "root",
+		},
+		{
+			name: "path parameter", method: http.MethodGet, path: "/api/files/abc",
+			status: http.StatusOK, body: "get GET map[secret:abc]", middleware: "root",
+		},
+		{
+			name: "trailing slash", method: http.MethodGet, path: "/api/files/abc/",
+			status: http.StatusOK, body: "get GET map[secret:abc]", middleware: "root",
+		},
+		{
+			name: "several path parameters", method: http.MethodGet, path: "/api/files/abc/entries/3",
+			status: http.StatusOK, body: "entry GET map[entry:3 secret:abc]", middleware: "root",
+		},
+		{
+			name: "static segment over a parameter", method: http.MethodGet, path: "/api/files/latest",
+			status: http.StatusOK, body: "latest GET map[]", middleware: "root",
+		},
+		{
+			name: "other method of the static segment", method: http.MethodDelete, path: "/api/files/latest",
+			status: http.StatusMethodNotAllowed, allow: "GET, HEAD, OPTIONS", middleware: "root",
+		},
+		{
+			name: "parameter route", method: http.MethodDelete, path: "/api/files/abc",
+			status: http.StatusOK, body: "delete DELETE map[secret:abc]", middleware: "root",
+		},
+		{
+			name: "method not allowed", method: http.MethodPut, path: "/api/files/abc",
+			status: http.StatusMethodNotAllowed, allow: "GET, DELETE, HEAD, OPTIONS", middleware: "root",
+		},
+		{
+			name: "method not allowed on a static route", method: http.MethodDelete, path: "/api/files",
+			status: http.StatusMethodNotAllowed, allow: "GET, POST, HEAD, OPTIONS", middleware: "root",
+		},
+		{
+			name: "options", method: http.MethodOptions, path: "/api/files/abc",
+			status: http.StatusNoContent, allow: "GET, DELETE, HEAD, OPTIONS", middleware: "root",
+		},
+		{
+			name: "HEAD falls back to GET", method: http.MethodHead, path: "/api/files/abc",
+			status: http.StatusOK, body: "get HEAD map[secret:abc]", middleware: "root",
+		},
+		{
+			name: "HEAD handler", method: http.MethodHead, path: "/head",
+			status: http.StatusOK, body: "head HEAD map[]", middleware: "root",
+		},
+		{
+			name: "GET next to a HEAD handler", method: http.MethodGet, path: "/head",
+			status: http.StatusOK, body: "get GET map[]", middleware: "root",
+		},
+		{
+			name: "allowed methods with a HEAD handler", method: http.MethodPost, path: "/head",
+			status: http.StatusMethodNotAllowed, allow: "GET, HEAD, OPTIONS", middleware: "root",
+		},
+		{
+			name: "rest of the path", method: http.MethodGet, path: "/static/css/app.css",
+			status: http.StatusOK, body: "static GET map[*:css/app.css]", middleware: "root",
+		},
+		{
+			name: "rest of the path empty", method: http.MethodGet, path: "/static",
+			status: http.StatusOK, body: "static GET map[*:]", middleware: "root",
+		},
+		{
+			name: "any method", method: "PROPFIND", path: "/webdav/a/b",
+			status: http.StatusOK, body: "webdav PROPFIND map[*:a/b]", middleware: "root",
+		},
+		{
+			name: "group", method: http.MethodGet, path: "/admin/files/1",
+			status: http.StatusOK, body: "admin GET map[id:1]", middleware: "root, admin",
+		},
+		{
+			name: "nested group", method: http.MethodPost, path: "/admin/keys",
+			status: http.StatusOK, body: "keys POST map[]", middleware: "root, admin, keys",
+		},
+		{
+			// the middleware of a group runs before the method is checked
+			name: "method not allowed in a group", method: http.MethodGet, path: "/admin/keys",
+			status: http.StatusMethodNotAllowed, allow: "POST, OPTIONS", middleware: "root, admin, keys",
+		},
+		{
+			name: "route registered after a group", method: http.MethodGet, path: "/after",
+			status: http.StatusOK, body: "after GET map[]", middleware: "root",
+		},
+		{
+			name: "group prefix alone", method: http.MethodGet, path: "/admin",
+			status: http.StatusNotFound,
+		},
+		{
+			name: "not found", method: http.MethodGet, path: "/missing",
+			status: http.StatusNotFound,
+		},
+		{
+			name: "extra segment", method: http.MethodGet, path: "/api/files/abc/extra",
+			status: http.StatusNotFound,
+		},
+		{
+			name: "empty parameter", method: http.MethodGet, path: "/api/files//entries/3",
+			status: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body %q, want %q", w.Body, tt.body)
+			}
+			if got := w.Header().Get("Allow"); got != tt.allow {
+				t.Errorf("Allow %q, want %q", got, tt.allow)
+			}
+			if got := strings.Join(w.Header().Values("X-Middleware"), ", "); got != tt.middleware {
+				t.Errorf("middleware %q, want %q", got, tt.middleware)
+			}
+		})
+	}
+}
+
+func TestLoggedPath(t *testing.T) {
+	rt := newRouter()
+	var logged string
+	record := func(w http.ResponseWriter, r *http.Request) { logged = loggedPath(r) }
+	rt.get("/api/v1/files/{secret}", record)
+	rt.get("/api/v1/tokens/{token}/download", record)
+	rt.get("/api/v1/collections/{id}", record)
+
+	tests := []struct {
+		path, logged string
+	}{
+		{"/api/v1/files/s3cr3t", "/api/v1/files/{secret}"},
+		{"/api/v1/tokens/t0k3n/download", "/api/v1/tokens/{token}/download"},
+		{"/api/v1/collections/42", "/api/v1/collections/42"},
+	}
+	for _, tt := range tests {
+		rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if logged != tt.logged {
+			t.Errorf("%s logged as %s, want %s", tt.path, logged, tt.logged)
+		}
+	}
+}
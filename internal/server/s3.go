@@ -0,0 +1,538 @@
+package server
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+// S3-compatible gateway, a minimal path-style S3 API over a single bucket so
+// S3 tools can push and pull files with an upload API key:
+//
+//	aws --endpoint-url https://filer.example.com/api/S3 s3 cp file.bin s3://filer/<secret>
+//
+// Object keys are the secrets of the files. PutObject shares the body under
+// the key chosen by the client, which should be as random as a generated
+// secret, GetObject and HeadObject read files back. Secrets are stored
+// hashed, so listings are always empty. Multipart uploads are not supported,
+// clients have to send files in one request.
+const (
+	s3Route     = "S3"
+	s3Path      = "/api/" + s3Route
+	s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+	// metadata of PutObject, e.g. aws s3 cp --metadata ttl=24h,max-downloads=1
+	s3FileNameHeader     = "X-Amz-Meta-Filename"
+	s3TTLHeader          = "X-Amz-Meta-Ttl"
+	s3MaxDownloadsHeader = "X-Amz-Meta-Max-Downloads"
+)
+
+// error of the S3 API, answered as an XML <Error> document
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string {
+	return e.message
+}
+
+var (
+	s3AccessDenied           = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	s3AuthorizationMalformed = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "the request is not signed with AWS Signature Version 4"}
+	s3InvalidAccessKeyID     = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "the access key id is not the id of an upload API key"}
+	s3SignatureDoesNotMatch  = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "the request signature does not match"}
+	s3RequestTimeTooSkewed   = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "the request time is too far from the server time"}
+	s3RequestExpired         = &s3Error{http.StatusForbidden, "AccessDenied", "the presigned URL has expired"}
+	s3MissingContentSHA256   = &s3Error{http.StatusBadRequest, "InvalidRequest", "missing x-amz-content-sha256"}
+	s3ContentSHA256Mismatch  = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "the body does not match x-amz-content-sha256"}
+	s3BadDigest              = &s3Error{http.StatusBadRequest, "BadDigest", "the body does not match Content-MD5"}
+	s3IncompleteBody         = &s3Error{http.StatusBadRequest, "IncompleteBody", "the body is shorter than its declared length"}
+	s3NoSuchBucket           = &s3Error{http.StatusNotFound, "NoSuchBucket", "the bucket does not exist"}
+	s3NoSuchKey              = &s3Error{http.StatusNotFound, "NoSuchKey", "file not found"}
+	s3KeyInUse               = &s3Error{http.StatusConflict, "KeyAlreadyExists", "a file is already shared under this key"}
+	s3PassphraseProtected    = &s3Error{http.StatusForbidden, "AccessDenied", "passphrase protected files cannot be read through the S3 gateway"}
+	s3MethodNotAllowed       = &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed"}
+	s3MultipartNotSupported  = &s3Error{http.StatusNotImplemented, "NotImplemented", "multipart uploads are not supported, raise the multipart threshold of the client"}
+	s3CopyNotSupported       = &s3Error{http.StatusNotImplemented, "NotImplemented", "copying objects is not supported"}
+	s3ChunkedNotSupported    = &s3Error{http.StatusNotImplemented, "NotImplemented", "signed trailers are not supported"}
+	s3InternalError          = &s3Error{http.StatusInternalServerError, "InternalError", "internal error"}
+)
+
+// the S3 code of an error answered with status by the rest of the API
+func s3ErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "InvalidRequest"
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "AccessDenied"
+	case http.StatusNotFound:
+		return "NoSuchKey"
+	case http.StatusMethodNotAllowed:
+		return "MethodNotAllowed"
+	case http.StatusConflict:
+		return "OperationAborted"
+	case http.StatusRequestEntityTooLarge:
+		return "EntityTooLarge"
+	case http.StatusRequestedRangeNotSatisfiable:
+		return "InvalidRange"
+	case http.StatusTooManyRequests:
+		return "SlowDown"
+	case http.StatusServiceUnavailable:
+		return "ServiceUnavailable"
+	}
+	return "InternalError"
+}
+
+type s3ErrorDocument struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestID string `xml:"RequestId"`
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, e *s3Error) {
+	status := e.status
+	// S3 clients only know 403 for refused credentials
+	if status == http.StatusUnauthorized {
+		status = http.StatusForbidden
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeS3XML(w, status, s3ErrorDocument{Code: e.code, Message: e.message, Resource: r.URL.Path, RequestID: requestID(r.Context())})
+}
+
+func writeS3XML(w http.ResponseWriter, status int, v interface{}) {
+	res, err := xml.Marshal(v)
+	if err != nil {
+		status, res = http.StatusInternalServerError, nil
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	w.Write(res)
+}
+
+// answers the S3 API gives with the handlers of the rest of the API, their
+// JSON errors are turned into S3 errors and digests into S3 ETags
+type s3ResponseWriter struct {
+	http.ResponseWriter
+	r *http.Request
+	// status of a JSON error that is being rewritten
+	failed int
+}
+
+func (w *s3ResponseWriter) WriteHeader(code int) {
+	if code >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		w.failed = code
+		return
+	}
+	// S3 clients compare ETags of single part objects to the MD5 of the contents
+	if etag := s3ETag(w.Header().Get("Content-MD5")); etag != "" && code < 300 {
+		w.Header().Set("ETag", etag)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *s3ResponseWriter) Write(b []byte) (int, error) {
+	if w.failed == 0 {
+		return w.ResponseWriter.Write(b)
+	}
+	var e errorResponse
+	json.Unmarshal(b, &e)
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	writeS3Error(w.ResponseWriter, w.r, &s3Error{w.failed, s3ErrorCode(w.failed), e.Message})
+	w.failed = 0
+	return len(b), nil
+}
+
+func (w *s3ResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// answer errors of next, including those of the middlewares it is wrapped in, as S3 errors
+func withS3Errors(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Request-Id", requestID(r.Context()))
+		next(&s3ResponseWriter{ResponseWriter: w, r: r}, r)
+	}
+}
+
+// quoted hex MD5 of a base64 Content-MD5, empty when it is unknown
+func s3ETag(contentMD5 string) string {
+	sum, err := base64.StdEncoding.DecodeString(contentMD5)
+	if err != nil || len(sum) != md5.Size {
+		return ""
+	}
+	return strconv.Quote(hex.EncodeToString(sum))
+}
+
+// creation date reported for the bucket
+var s3BucketCreated = time.Now()
+
+// marks downloads of S3 clients, which are streamed as they do not follow redirects
+type streamDownloadKey struct{}
+
+// S3 gateway
+// serves the ListBuckets, HeadBucket, ListObjects, GetBucketLocation,
+// PutObject, GetObject and HeadObject operations of S3 on /api/S3/<bucket>/<key>.
+func (s *Server) s3Handler(w http.ResponseWriter, r *http.Request) {
+	sig, serr := s.verifySigV4(r)
+	if serr != nil {
+		writeS3Error(w, r, serr)
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), apiKeyIDKey{}, sig.keyID))
+
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, s3Path), "/")
+	bucket, key := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+	if bucket == "" {
+		if r.Method != http.MethodGet {
+			writeS3Error(w, r, s3MethodNotAllowed)
+			return
+		}
+		writeS3XML(w, http.StatusOK, s3BucketList{
+			Xmlns:   s3Namespace,
+			Owner:   s3Owner{ID: s.config.S3Bucket, DisplayName: s.config.S3Bucket},
+			Buckets: []s3Bucket{{Name: s.config.S3Bucket, CreationDate: s3BucketCreated.UTC().Format(time.RFC3339)}},
+		})
+		return
+	}
+	if bucket != s.config.S3Bucket {
+		writeS3Error(w, r, s3NoSuchBucket)
+		return
+	}
+
+	query := r.URL.Query()
+	if key == "" {
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case r.Method != http.MethodGet:
+			writeS3Error(w, r, s3MethodNotAllowed)
+		case query["location"] != nil:
+			writeS3XML(w, http.StatusOK, s3Location{Xmlns: s3Namespace})
+		default:
+			writeS3XML(w, http.StatusOK, s3ObjectList{Xmlns: s3Namespace, Name: bucket, Prefix: query.Get("prefix"), MaxKeys: 1000})
+		}
+		return
+	}
+	if query["uploads"] != nil || query.Get("uploadId") != "" {
+		writeS3Error(w, r, s3MultipartNotSupported)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			writeS3Error(w, r, s3CopyNotSupported)
+			return
+		}
+		s.s3PutObject(w, r, sig, key)
+	case http.MethodGet:
+		s.s3GetObject(w, r, key)
+	case http.MethodHead:
+		s.s3HeadObject(w, r, key)
+	default:
+		writeS3Error(w, r, s3MethodNotAllowed)
+	}
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type s3BucketList struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3ObjectList struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Xmlns       string   `xml:"xmlns,attr"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	MaxKeys     int
+	IsTruncated bool
+}
+
+type s3Location struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+// whether key can be a secret, URL-safe and at least as long as generated secrets
+func (s *Server) validS3Key(key string) bool {
+	if len(key) < int(s.config.SecretLength) || len(key) > maxSecretLength {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~') {
+			return false
+		}
+	}
+	return true
+}
+
+// share the body under key, encrypted at rest when server-side encryption is requested
+func (s *Server) s3PutObject(w http.ResponseWriter, r *http.Request, sig *sigV4, key string) {
+	if !s.validS3Key(key) {
+		writeS3Error(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument",
+			fmt.Sprintf("keys are the secrets of the files, %d to %d letters, digits, -, _, . and ~", s.config.SecretLength, maxSecretLength)})
+		return
+	}
+	file := store.File{Uploader: s.uploader(r), Encrypted: r.Header.Get("X-Amz-Server-Side-Encryption") != ""}
+	file.Container = s.tenantContainer(file.Uploader)
+	maxDownloads := 0
+	if v := r.Header.Get(s3MaxDownloadsHeader); v != "" {
+		var err error
+		if maxDownloads, err = strconv.Atoi(v); err != nil {
+			maxDownloads = -1
+		}
+	}
+	if err := applyLimits(&file, r.Header.Get(s3TTLHeader), maxDownloads); err != nil {
+		writeS3Error(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", err.Error()})
+		return
+	}
+	inUse, err := s.store.SecretInUse(r.Context(), key)
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to look up secret", zap.Error(err))
+		writeS3Error(w, r, s3InternalError)
+		return
+	}
+	if inUse {
+		writeS3Error(w, r, s3KeyInUse)
+		return
+	}
+
+	body, serr := s3Body(r, sig)
+	if serr != nil {
+		writeS3Error(w, r, serr)
+		return
+	}
+	src, serr := s.spoolS3Body(r, sig, body)
+	if serr != nil {
+		writeS3Error(w, r, serr)
+		return
+	}
+	defer src.Close()
+
+	name := key
+	if v := r.Header.Get(s3FileNameHeader); v != "" {
+		// non-ASCII names arrive as RFC 2047 encoded words
+		if decoded, err := new(mime.WordDecoder).DecodeHeader(v); err == nil {
+			name = decoded
+		}
+	}
+	file.FileName = sanitizeFileName(name)
+	file.Size = src.size
+
+	switch err := s.reserveQuota(r.Context(), file.Uploader, file.Size); err {
+	case nil:
+	case errUserQuotaExceeded:
+		writeS3Error(w, r, &s3Error{http.StatusForbidden, "QuotaExceeded", "upload quota exceeded"})
+		return
+	case errGlobalQuotaExceeded:
+		writeS3Error(w, r, &s3Error{http.StatusInsufficientStorage, "InsufficientStorage", "storage quota exceeded"})
+		return
+	default:
+		s.writeQuotaError(w, r, err)
+		return
+	}
+	file.QuotaCharged = true
+	stored := false
+	defer func() {
+		if !stored {
+			s.releaseQuota(context.Background(), file.Uploader, file.Size)
+		}
+	}()
+
+	part, err := s.storeContent(r.Context(), file.Container, src, file.FileName, r.Header.Get("Content-Type"), file.Size, key, file.Encrypted, nil)
+	var refused uploadRefusal
+	if errors.As(err, &refused) {
+		writeS3Error(w, r, &s3Error{http.StatusForbidden, "AccessDenied", refused.Error()})
+		return
+	}
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to store S3 object", zap.Error(err))
+		writeS3Error(w, r, s3InternalError)
+		return
+	}
+	setPart(&file, part)
+	deleteToken, err := s.saveFile(r, &file, part, key, "s3")
+	if err != nil {
+		writeS3Error(w, r, &s3Error{http.StatusInternalServerError, "InternalError", err.Error()})
+		return
+	}
+	stored = true
+
+	// S3 clients only read the ETag, the other headers are for scripts
+	w.Header().Set("ETag", strconv.Quote(hex.EncodeToString(src.md5)))
+	w.Header().Set("X-Filer-Delete-Token", deleteToken)
+	if u := s.shareURL(key); u != "" {
+		w.Header().Set("X-Filer-Url", u)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// the object in the body of a PutObject, decoded from aws-chunked when it is streamed
+func s3Body(r *http.Request, sig *sigV4) (io.Reader, *s3Error) {
+	switch sig.payload {
+	case streamingSignedPayload, streamingUnsignedTrailer:
+		return newAWSChunkedReader(r.Body, sig), nil
+	case unsignedPayload:
+		return r.Body, nil
+	}
+	if strings.HasPrefix(sig.payload, "STREAMING-") {
+		return nil, s3ChunkedNotSupported
+	}
+	if _, err := hex.DecodeString(sig.payload); err != nil || len(sig.payload) != 2*sha256.Size {
+		return nil, s3ContentSHA256Mismatch
+	}
+	return r.Body, nil
+}
+
+// an object spooled to a temporary file
+type s3Object struct {
+	*os.File
+	size int64
+	md5  []byte
+}
+
+func (o *s3Object) Close() error {
+	o.File.Close()
+	return os.Remove(o.File.Name())
+}
+
+// spool body into a temporary file, checking it against the signed payload
+// hash, Content-MD5 and the declared length on the way
+func (s *Server) spoolS3Body(r *http.Request, sig *sigV4, body io.Reader) (*s3Object, *s3Error) {
+	tmp, err := ioutil.TempFile("", "filer-s3-")
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to spool S3 object", zap.Error(err))
+		return nil, s3InternalError
+	}
+	o := &s3Object{File: tmp}
+	md5Sum, sha256Sum := md5.New(), sha256.New()
+	o.size, err = io.Copy(io.MultiWriter(tmp, md5Sum, sha256Sum), body)
+	o.md5 = md5Sum.Sum(nil)
+
+	serr := (*s3Error)(nil)
+	switch {
+	case isTooLarge(err):
+		limit := s.config.maxUploadBytes(s3Route)
+		serr = &s3Error{http.StatusRequestEntityTooLarge, "EntityTooLarge", fmt.Sprintf("upload exceeds the maximum size of %d bytes", limit)}
+	case err == s3SignatureDoesNotMatch:
+		serr = s3SignatureDoesNotMatch
+	case err == errMalformedChunk:
+		serr = &s3Error{http.StatusBadRequest, "InvalidRequest", err.Error()}
+	case err == io.ErrUnexpectedEOF:
+		serr = s3IncompleteBody
+	case err != nil:
+		s.logFor(r.Context()).Info("failed to read S3 object", zap.Error(err))
+		serr = s3IncompleteBody
+	case len(sig.payload) == 2*sha256.Size && hex.EncodeToString(sha256Sum.Sum(nil)) != sig.payload:
+		serr = s3ContentSHA256Mismatch
+	case r.Header.Get("Content-MD5") != "" && r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(o.md5):
+		serr = s3BadDigest
+	}
+	if serr == nil {
+		if v := r.Header.Get("X-Amz-Decoded-Content-Length"); v != "" && v != strconv.FormatInt(o.size, 10) {
+			serr = s3IncompleteBody
+		}
+	}
+	if serr == nil {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			serr = s3InternalError
+		}
+	}
+	if serr != nil {
+		o.Close()
+		return nil, serr
+	}
+	return o, nil
+}
+
+// stream the file shared under key through the download handler, so downloads
+// are counted, burnt and audited like any other
+func (s *Server) s3GetObject(w http.ResponseWriter, r *http.Request, key string) {
+	get := r.Clone(context.WithValue(r.Context(), streamDownloadKey{}, true))
+	get.URL.RawQuery = "secret=" + s3URIEncode(key, true)
+	get.Form, get.PostForm = nil, nil
+	s.downloadHandler(w, get)
+}
+
+// the headers of the file shared under key, without counting a download
+func (s *Server) s3HeadObject(w http.ResponseWriter, r *http.Request, key string) {
+	file, err := s.find(r.Context(), key)
+	if err == store.ErrNotFound || err == nil && file.Exhausted() {
+		if err != nil {
+			failedGuess(r)
+		}
+		writeS3Error(w, r, s3NoSuchKey)
+		return
+	}
+	if err != nil {
+		writeS3Error(w, r, s3InternalError)
+		return
+	}
+	if file.PassphraseHash != "" {
+		writeS3Error(w, r, s3PassphraseProtected)
+		return
+	}
+	if !scanPassed(file) {
+		writeS3Error(w, r, &s3Error{http.StatusForbidden, "AccessDenied", "file is being scanned or failed the virus scan"})
+		return
+	}
+
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", downloadContentType(file))
+	h.Set("Last-Modified", file.CreatedAt.UTC().Format(http.TimeFormat))
+	h.Set(s3FileNameHeader, mime.QEncoding.Encode("utf-8", file.FileName))
+	// bundles are zipped on the fly, their size is not known up front
+	if len(file.Entries) == 0 {
+		h.Set("Content-Length", strconv.FormatInt(file.Size, 10))
+	}
+	if etag := s3ETag(file.MD5); etag != "" {
+		h.Set("ETag", etag)
+	}
+	if file.ExpiresAt != nil {
+		h.Set("X-Amz-Expiration", fmt.Sprintf(`expiry-date="%s", rule-id="ttl"`, file.ExpiresAt.UTC().Format(http.TimeFormat)))
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"filer/internal/storage"
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+// scan states of a file, files without a state were never scanned
+const (
+	scanPending  = "pending"
+	scanClean    = "clean"
+	scanInfected = "infected"
+	scanFailed   = "error"
+)
+
+const (
+	clamdTimeout   = 10 * time.Minute
+	clamdChunkSize = 64 * 1024
+)
+
+var errInfected = errors.New("file is infected")
+
+// whether the file may be downloaded given its scan state
+func scanPassed(f *store.File) bool {
+	return f.ScanStatus == "" || f.ScanStatus == scanClean
+}
+
+// send r to clamd with the INSTREAM command
+// returns errInfected with the signature name when a virus is found
+func clamdScan(ctx context.Context, addr string, r io.Reader) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(clamdTimeout))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return err
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// a zero length chunk ends the stream
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return err
+	}
+
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	result := strings.TrimRight(string(reply), "\x00\n")
+	switch {
+	case strings.HasSuffix(result, " OK"):
+		return nil
+	case strings.HasSuffix(result, " FOUND"):
+		return fmt.Errorf("%w: %s", errInfected, strings.TrimSuffix(strings.TrimPrefix(result, "stream: "), " FOUND"))
+	default:
+		return fmt.Errorf("clamd: %s", result)
+	}
+}
+
+// scan every blob of the file saved with secret and record the result
+// infected blobs are deleted right away, the link is kept to report the state
+func (s *Server) scan(file store.File, secret string) {
+	ctx := context.Background()
+
+	status := scanClean
+	for _, name := range file.BlobNames() {
+		err := s.scanBlob(ctx, file.Container, name, file.Encrypted, secret)
+		if errors.Is(err, errInfected) {
+			s.logger.Warn("scan: infected file", zap.String("file_id", file.ID.Hex()), zap.String("blob", name), zap.Error(err))
+			status = scanInfected
+			break
+		}
+		if err != nil {
+			s.logger.Error("scan: failed to scan", zap.String("file_id", file.ID.Hex()), zap.String("blob", name), zap.Error(err))
+			status = scanFailed
+		}
+	}
+
+	if status == scanInfected {
+		for _, name := range file.BlobNames() {
+			if err := s.storageFor(file.Container).Delete(ctx, name); err != nil && err != storage.ErrBlobNotFound {
+				s.logger.Error("scan: failed to delete blob", zap.String("blob", name), zap.Error(err))
+			}
+		}
+	}
+
+	if err := s.store.SetScanStatus(ctx, secret, status); err != nil {
+		s.logger.Error("scan: failed to record result", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+	}
+}
+
+// blobs compressed at rest are sent as gzip streams, which clamd unpacks
+func (s *Server) scanBlob(ctx context.Context, container, name string, encrypted bool, secret string) error {
+	blob, err := s.storageFor(container).Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	var data io.ReadCloser = blob
+	if encrypted {
+		data = newDecryptReader(blob, secret)
+	}
+	defer data.Close()
+	return clamdScan(ctx, s.config.ClamdAddress, data)
+}
+
+// Scan status
+// reports whether a file has been scanned and may be downloaded
+func (s *Server) scanStatusHandler(w http.ResponseWriter, r *http.Request) {
+	secret := r.URL.Query().Get("secret")
+	if secret == "" {
+		writeError(w, r, http.StatusBadRequest, "missing secret")
+		return
+	}
+
+	file, err := s.find(r.Context(), secret)
+	if err == store.ErrNotFound {
+		failedGuess(r)
+		writeError(w, r, http.StatusNotFound, "file not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to look up file")
+		return
+	}
+
+	status := file.ScanStatus
+	if status == "" {
+		status = "not_scanned"
+	}
+	res, err := json.Marshal(scanState{status, scanPassed(file)})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+const (
+	adminSearchRoute = "AdminSearch"
+	adminSearchPath  = "/api/admin/search"
+	adminSearchFn    = "/api/" + adminSearchRoute
+)
+
+// filter of the filename, tag, after and before query parameters
+// filename matches the start of file names, after and before are RFC 3339
+// times bounding the upload time.
+func searchFilter(r *http.Request) (store.FileFilter, error) {
+	q := r.URL.Query()
+	filter := store.FileFilter{
+		FileNamePrefix: q.Get("filename"),
+		Tag:            strings.ToLower(strings.TrimSpace(q.Get("tag"))),
+	}
+	for _, p := range []struct {
+		param string
+		bound *time.Time
+	}{{"after", &filter.CreatedAfter}, {"before", &filter.CreatedBefore}} {
+		if v := q.Get(p.param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, validationError("invalid " + p.param)
+			}
+			*p.bound = t.UTC()
+		}
+	}
+	return filter, nil
+}
+
+// Admin search
+// GET finds files by the start of their name, a tag and their upload time,
+// newest first.
+func (s *Server) adminSearchHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := searchFilter(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.Uploader = r.URL.Query().Get("uploader")
+	page, perPage, err := pageParams(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	list, err := s.listFiles(r.Context(), filter, page, perPage)
+	if err != nil {
+		s.logFor(r.Context()).Error("admin: failed to search files", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to search files")
+		return
+	}
+	writeFileList(w, r, list)
+}
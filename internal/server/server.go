@@ -0,0 +1,110 @@
+// Package server implements the handlers of the API and the SFTP server on
+// top of the storage and metadata backends.
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"filer/internal/secret"
+	"filer/internal/storage"
+	"filer/internal/store"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"go.uber.org/zap"
+)
+
+// Server holds the clients shared by all requests.
+// The metadata store keeps a connection pool, so it is created once at startup.
+type Server struct {
+	config *Config
+	logger *zap.Logger
+
+	storage storage.Storage
+	// storages of the tenant containers by container name
+	tenants map[string]storage.Storage
+	store   store.Store
+	secrets *secret.Hasher
+	// progress of uploads in flight on this instance
+	progress *progressTracker
+	// failed secret guesses per address
+	lockout *lockout
+	// sends share emails, nil when emails are disabled
+	mailer       Mailer
+	emailLimiter *rateLimiter
+	// verifies login tokens, nil when OIDC is not configured
+	verifier *oidc.IDTokenVerifier
+	// posts file events, nil when no webhooks are configured
+	webhooks *webhooks
+	// exports file events in batches, nil without an event sink
+	events *eventExporter
+	// countries of client addresses, nil without GEOIP_DATABASE
+	geoip *geoIPDatabase
+	// inspects uploads for sensitive data, nil when DLP_MODE is off
+	inspector contentInspector
+	// egress shared by all downloads, nil when it is unlimited
+	egress *byteBucket
+	// slots of the uploads in progress, nil when they are unlimited
+	uploadSlots chan struct{}
+	// secondary storage of each container, nil without one, and the files
+	// waiting to be copied to it
+	replicas    map[string]storage.Storage
+	replication chan store.File
+	// closed once the instance starts draining on shutdown
+	draining chan struct{}
+	// scans and emails started by requests, waited for when draining
+	background sync.WaitGroup
+}
+
+// New creates the server of the blobs of storage and the links of store, whose
+// secrets are hashed by secrets, configured by config and logging to logger.
+// The caller closes store once Run returns.
+func New(config *Config, logger *zap.Logger, blobs storage.Storage, metadata store.Store, secrets *secret.Hasher) (*Server, error) {
+	verifier, err := newOIDCVerifier(context.Background(), config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC provider: %w", err)
+	}
+	mailer, err := newMailer(config)
+	if err != nil {
+		return nil, err
+	}
+	replicas, err := openReplicas(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	tenants, err := openTenantContainers(config, logger, blobs, replicas)
+	if err != nil {
+		return nil, err
+	}
+	events, err := newEventExporter(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	geoip, err := openGeoIP(config.GeoIPDatabase)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		config:       config,
+		logger:       logger,
+		storage:      instrumentStorage(withReplica(logger, storage.WithTimeout(blobs, config.StorageTimeout), replicas, "")),
+		tenants:      tenants,
+		store:        metadata,
+		secrets:      secrets,
+		progress:     newProgressTracker(),
+		lockout:      newLockout(),
+		verifier:     verifier,
+		mailer:       mailer,
+		emailLimiter: emailRateLimiter(config),
+		webhooks:     newWebhooks(config, logger),
+		events:       events,
+		geoip:        geoip,
+		inspector:    newContentInspector(config.DLPMode, config.DLPKeywords),
+		egress:       newByteBucket(config.GlobalDownloadBytesPerSecond),
+		uploadSlots:  newUploadSlots(config.MaxConcurrentUploads),
+		replicas:     replicas,
+		replication:  make(chan store.File, replicationQueueSize),
+		draining:     make(chan struct{}),
+	}, nil
+}
@@ -0,0 +1,527 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"filer/internal/secret"
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP ingestion for systems that can only push files over SFTP. Clients log
+// in with an upload API key as password, or with a key of
+// SFTP_AUTHORIZED_KEYS, and every file they write is shared like an upload.
+// The secret is printed to the session log, which sftp shows on the terminal:
+//
+//	sftp -P 2022 anyone@filer.example.com
+//	sftp> put report.pdf
+//	report.pdf: secret 3kXlq9ZmP0aB, delete token ...
+//
+// The folder is write-only, it always looks empty. Only the subset of SFTP
+// version 3 needed to upload is spoken, see
+// https://datatracker.ietf.org/doc/html/draft-ietf-secsh-filexfer-02
+const (
+	sftpVersion = 3
+	// largest packet accepted, clients write 32 KiB to 256 KiB at a time
+	maxSFTPPacket = 1 << 20
+	// suffix of the temporary names of resumable transfers, e.g. of WinSCP
+	sftpPartSuffix = ".filepart"
+	// how long a client may take to log in
+	sftpHandshakeTimeout = 30 * time.Second
+)
+
+// SFTP packet types
+const (
+	sshFxpInit     = 1
+	sshFxpVersion  = 2
+	sshFxpOpen     = 3
+	sshFxpClose    = 4
+	sshFxpWrite    = 6
+	sshFxpLstat    = 7
+	sshFxpFstat    = 8
+	sshFxpSetstat  = 9
+	sshFxpFsetstat = 10
+	sshFxpOpendir  = 11
+	sshFxpReaddir  = 12
+	sshFxpRealpath = 16
+	sshFxpStat     = 17
+	sshFxpRename   = 18
+	sshFxpStatus   = 101
+	sshFxpHandle   = 102
+	sshFxpName     = 104
+	sshFxpAttrs    = 105
+)
+
+// SFTP status codes
+const (
+	sshFxOK               = 0
+	sshFxEOF              = 1
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+	sshFxFailure          = 4
+	sshFxOpUnsupported    = 8
+)
+
+const (
+	sshFxfWrite = 0x02
+
+	sshFileXferAttrSize        = 0x01
+	sshFileXferAttrPermissions = 0x04
+)
+
+// embedded SFTP server, see serveSFTP
+type sftpServer struct {
+	s        *Server
+	config   *ssh.ServerConfig
+	listener net.Listener
+}
+
+// an SFTP server of s with the host key and authorized keys of the configuration
+func newSFTPServer(s *Server) (*sftpServer, error) {
+	authorized := map[string]string{}
+	if s.config.SFTPAuthorizedKeys != "" {
+		data, err := ioutil.ReadFile(s.config.SFTPAuthorizedKeys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", sftpAuthorizedKeysEnvVarName, err)
+		}
+		for len(strings.TrimSpace(string(data))) > 0 {
+			key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", sftpAuthorizedKeysEnvVarName, err)
+			}
+			authorized[string(key.Marshal())] = sshKeyID(key)
+			data = rest
+		}
+	}
+
+	c := &ssh.ServerConfig{
+		ServerVersion: "SSH-2.0-filer",
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			got := sha256.Sum256(password)
+			for _, key := range s.config.UploadAPIKeys {
+				want := sha256.Sum256([]byte(key))
+				if subtle.ConstantTimeCompare(want[:], got[:]) == 1 {
+					return &ssh.Permissions{Extensions: map[string]string{"principal": apiKeyID(key)}}, nil
+				}
+			}
+			return nil, errors.New("invalid API key")
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if id, ok := authorized[string(key.Marshal())]; ok {
+				return &ssh.Permissions{Extensions: map[string]string{"principal": id}}, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	hostKey, err := sftpHostKey(s.config, s.logger)
+	if err != nil {
+		return nil, err
+	}
+	c.AddHostKey(hostKey)
+	return &sftpServer{s: s, config: c}, nil
+}
+
+// the host key of SFTP_HOST_KEY, or a new one that changes with every start
+func sftpHostKey(config *Config, logger *zap.Logger) (ssh.Signer, error) {
+	if config.SFTPHostKey == "" {
+		logger.Warn("no SFTP host key configured, clients will see a new one after every restart", zap.String("setting", sftpHostKeyEnvVarName))
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return ssh.NewSignerFromKey(key)
+	}
+	data, err := ioutil.ReadFile(config.SFTPHostKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", sftpHostKeyEnvVarName, err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", sftpHostKeyEnvVarName, err)
+	}
+	return signer, nil
+}
+
+// uploader recorded for files sent with an authorized SSH key, like the ids of API keys
+func sshKeyID(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "ssh:" + hex.EncodeToString(sum[:4])
+}
+
+// accept SFTP connections on addr until close is called
+func (srv *sftpServer) listen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv.listener = ln
+	srv.s.logger.Info("listening for SFTP", zap.String("addr", addr))
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					srv.s.logger.Error("failed to accept SFTP connection", zap.Error(err))
+				}
+				return
+			}
+			go srv.serveConn(conn)
+		}
+	}()
+	return nil
+}
+
+// stop accepting connections, sessions are cut when the process exits
+func (srv *sftpServer) close() {
+	if srv.listener != nil {
+		srv.listener.Close()
+	}
+}
+
+func (srv *sftpServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(sftpHandshakeTimeout))
+	sconn, channels, requests, err := ssh.NewServerConn(conn, srv.config)
+	if err != nil {
+		srv.s.logger.Debug("SFTP handshake failed", zap.String("client", conn.RemoteAddr().String()), zap.Error(err))
+		return
+	}
+	defer sconn.Close()
+	conn.SetDeadline(time.Time{})
+	go ssh.DiscardRequests(requests)
+
+	id, _ := secret.Random(16)
+	ctx := context.WithValue(context.Background(), requestIDKey{}, id)
+	ctx = context.WithValue(ctx, apiKeyIDKey{}, sconn.Permissions.Extensions["principal"])
+	srv.s.logFor(ctx).Info("SFTP session", zap.String("client", conn.RemoteAddr().String()), zap.String("principal", requestAPIKeyID(ctx)))
+
+	for ch := range channels {
+		if ch.ChannelType() != "session" {
+			ch.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := ch.Accept()
+		if err != nil {
+			continue
+		}
+		go srv.serveSession(ctx, sconn, channel, requests)
+	}
+}
+
+// run the sftp subsystem of a session, shells and commands are refused
+func (srv *sftpServer) serveSession(ctx context.Context, conn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		ok := req.Type == "subsystem" && len(req.Payload) >= 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+		// uploads are audited and logged like requests of the API
+		r, _ := http.NewRequestWithContext(ctx, http.MethodPut, "/", nil)
+		r.RemoteAddr = conn.RemoteAddr().String()
+		r.Header.Set("User-Agent", string(conn.ClientVersion()))
+		session := &sftpSession{s: srv.s, r: r, channel: channel, handles: map[string]*sftpHandle{}, shared: map[string]bool{}}
+		if err := session.serve(); err != nil && err != io.EOF {
+			srv.s.logFor(ctx).Info("SFTP session failed", zap.Error(err))
+		}
+		session.discard()
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		return
+	}
+}
+
+// an open file or directory of a session
+type sftpHandle struct {
+	name string
+	// nil for the directory
+	tmp  *os.File
+	size int64
+}
+
+type sftpSession struct {
+	s       *Server
+	r       *http.Request
+	channel ssh.Channel
+	mu      sync.Mutex
+	handles map[string]*sftpHandle
+	next    int
+	// names shared in this session, renames of them are accepted
+	shared map[string]bool
+}
+
+// answer packets until the client closes the channel
+func (ss *sftpSession) serve() error {
+	var header [5]byte
+	for {
+		if _, err := io.ReadFull(ss.channel, header[:]); err != nil {
+			return err
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		if length < 1 || length > maxSFTPPacket {
+			return errors.New("invalid SFTP packet length")
+		}
+		payload := make([]byte, length-1)
+		if _, err := io.ReadFull(ss.channel, payload); err != nil {
+			return err
+		}
+		if err := ss.handle(header[4], &sftpReader{b: payload}); err != nil {
+			return err
+		}
+	}
+}
+
+func (ss *sftpSession) handle(kind byte, p *sftpReader) error {
+	if kind == sshFxpInit {
+		return ss.send(sshFxpVersion, uint32(sftpVersion))
+	}
+	id := p.uint32()
+	if p.err != nil {
+		return p.err
+	}
+	switch kind {
+	case sshFxpRealpath:
+		name := sftpPath(p.string())
+		return ss.send(sshFxpName, id, uint32(1), name, name, uint32(0))
+	case sshFxpStat, sshFxpLstat:
+		// the folder looks empty, so clients never try to overwrite or resume a file
+		if sftpPath(p.string()) == "/" {
+			return ss.sendDirAttrs(id)
+		}
+		return ss.status(id, sshFxNoSuchFile, "no such file")
+	case sshFxpOpendir:
+		if sftpPath(p.string()) != "/" {
+			return ss.status(id, sshFxNoSuchFile, "no such directory")
+		}
+		return ss.send(sshFxpHandle, id, ss.open(&sftpHandle{name: "/"}))
+	case sshFxpReaddir:
+		h := ss.handleOf(p.string())
+		if h == nil || h.tmp != nil {
+			return ss.status(id, sshFxFailure, "invalid handle")
+		}
+		return ss.status(id, sshFxEOF, "")
+	case sshFxpOpen:
+		name := sftpPath(p.string())
+		flags := p.uint32()
+		if flags&sshFxfWrite == 0 {
+			return ss.status(id, sshFxPermissionDenied, "files can only be uploaded")
+		}
+		if name == "/" || path.Dir(name) != "/" {
+			return ss.status(id, sshFxPermissionDenied, "files can only be uploaded to the root folder")
+		}
+		tmp, err := ioutil.TempFile("", "filer-sftp-")
+		if err != nil {
+			ss.s.logFor(ss.r.Context()).Error("failed to spool SFTP upload", zap.Error(err))
+			return ss.status(id, sshFxFailure, "failed to open file")
+		}
+		return ss.send(sshFxpHandle, id, ss.open(&sftpHandle{name: name, tmp: tmp}))
+	case sshFxpWrite:
+		h := ss.handleOf(p.string())
+		offset := p.uint64()
+		data := p.bytes()
+		if p.err != nil || h == nil || h.tmp == nil {
+			return ss.status(id, sshFxFailure, "invalid handle")
+		}
+		end := int64(offset) + int64(len(data))
+		if limit := ss.s.config.MaxUploadBytes; limit > 0 && end > limit {
+			return ss.status(id, sshFxFailure, fmt.Sprintf("upload exceeds the maximum size of %d bytes", limit))
+		}
+		if _, err := h.tmp.WriteAt(data, int64(offset)); err != nil {
+			return ss.status(id, sshFxFailure, "failed to write file")
+		}
+		if end > h.size {
+			h.size = end
+		}
+		return ss.status(id, sshFxOK, "")
+	case sshFxpFstat:
+		h := ss.handleOf(p.string())
+		if h == nil {
+			return ss.status(id, sshFxFailure, "invalid handle")
+		}
+		if h.tmp == nil {
+			return ss.sendDirAttrs(id)
+		}
+		return ss.send(sshFxpAttrs, id, uint32(sshFileXferAttrSize|sshFileXferAttrPermissions), uint64(h.size), uint32(0100644))
+	case sshFxpSetstat, sshFxpFsetstat:
+		// times and modes of uploads are not kept
+		return ss.status(id, sshFxOK, "")
+	case sshFxpClose:
+		handle := p.string()
+		h := ss.handleOf(handle)
+		if h == nil {
+			return ss.status(id, sshFxFailure, "invalid handle")
+		}
+		ss.mu.Lock()
+		delete(ss.handles, handle)
+		ss.mu.Unlock()
+		if h.tmp == nil {
+			return ss.status(id, sshFxOK, "")
+		}
+		if err := ss.share(h); err != nil {
+			return ss.status(id, sshFxFailure, err.Error())
+		}
+		return ss.status(id, sshFxOK, "")
+	case sshFxpRename:
+		from, to := sftpPath(p.string()), sftpPath(p.string())
+		// transfers to a temporary name were shared under the final one
+		if ss.shared[from] && strings.TrimSuffix(from, sftpPartSuffix) == to {
+			return ss.status(id, sshFxOK, "")
+		}
+		return ss.status(id, sshFxPermissionDenied, "files cannot be renamed")
+	}
+	return ss.status(id, sshFxOpUnsupported, "operation not supported")
+}
+
+// share an uploaded file and print its secret to the session log
+func (ss *sftpSession) share(h *sftpHandle) error {
+	defer func() {
+		h.tmp.Close()
+		os.Remove(h.tmp.Name())
+	}()
+	if _, err := h.tmp.Seek(0, io.SeekStart); err != nil {
+		return errors.New("failed to read file")
+	}
+	name := strings.TrimSuffix(path.Base(h.name), sftpPartSuffix)
+	file := store.File{Uploader: ss.s.uploader(ss.r), FileName: sanitizeFileName(name), Size: h.size}
+	file.Container = ss.s.tenantContainer(file.Uploader)
+	secret, deleteToken, err := ss.s.shareSpooled(ss.r, &file, h.tmp, "", "sftp")
+	var refused uploadRefusal
+	switch {
+	case err == errUserQuotaExceeded:
+		return errors.New("upload quota exceeded")
+	case err == errGlobalQuotaExceeded:
+		return errors.New("storage quota exceeded")
+	case errors.As(err, &refused):
+		return refused
+	case err != nil:
+		ss.s.logFor(ss.r.Context()).Error("failed to share SFTP upload", zap.Error(err))
+		return errors.New("failed to store file")
+	}
+	ss.shared[h.name] = true
+
+	line := fmt.Sprintf("%s: secret %s, delete token %s", name, secret, deleteToken)
+	if u := ss.s.shareURL(secret); u != "" {
+		line += ", " + u
+	}
+	fmt.Fprintln(ss.channel.Stderr(), line)
+	ss.s.logFor(ss.r.Context()).Info("shared SFTP upload", zap.String("file_id", file.ID.Hex()), zap.Int64("size", file.Size))
+	return nil
+}
+
+// remove the spooled files of transfers left open
+func (ss *sftpSession) discard() {
+	for _, h := range ss.handles {
+		if h.tmp != nil {
+			h.tmp.Close()
+			os.Remove(h.tmp.Name())
+		}
+	}
+}
+
+func (ss *sftpSession) open(h *sftpHandle) string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.next++
+	handle := fmt.Sprint(ss.next)
+	ss.handles[handle] = h
+	return handle
+}
+
+func (ss *sftpSession) handleOf(handle string) *sftpHandle {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.handles[handle]
+}
+
+func (ss *sftpSession) sendDirAttrs(id uint32) error {
+	return ss.send(sshFxpAttrs, id, uint32(sshFileXferAttrPermissions), uint32(040755))
+}
+
+func (ss *sftpSession) status(id, code uint32, message string) error {
+	return ss.send(sshFxpStatus, id, code, message, "")
+}
+
+// write a packet of kind made of uint32, uint64 and string fields
+func (ss *sftpSession) send(kind byte, fields ...interface{}) error {
+	b := []byte{0, 0, 0, 0, kind}
+	for _, f := range fields {
+		switch v := f.(type) {
+		case uint32:
+			b = binary.BigEndian.AppendUint32(b, v)
+		case uint64:
+			b = binary.BigEndian.AppendUint64(b, v)
+		case string:
+			b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+			b = append(b, v...)
+		}
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	_, err := ss.channel.Write(b)
+	return err
+}
+
+// the absolute, cleaned form of a client path, relative paths start at the root
+func sftpPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// fields of a request packet, the first error sticks
+type sftpReader struct {
+	b   []byte
+	err error
+}
+
+func (p *sftpReader) uint32() uint32 {
+	if len(p.b) < 4 {
+		p.err = errors.New("short SFTP packet")
+		return 0
+	}
+	v := binary.BigEndian.Uint32(p.b)
+	p.b = p.b[4:]
+	return v
+}
+
+func (p *sftpReader) uint64() uint64 {
+	if len(p.b) < 8 {
+		p.err = errors.New("short SFTP packet")
+		return 0
+	}
+	v := binary.BigEndian.Uint64(p.b)
+	p.b = p.b[8:]
+	return v
+}
+
+func (p *sftpReader) bytes() []byte {
+	n := p.uint32()
+	if p.err != nil || uint32(len(p.b)) < n {
+		p.err = errors.New("short SFTP packet")
+		return nil
+	}
+	v := p.b[:n]
+	p.b = p.b[n:]
+	return v
+}
+
+func (p *sftpReader) string() string {
+	return string(p.bytes())
+}
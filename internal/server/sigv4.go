@@ -0,0 +1,376 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4 of the S3 gateway, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+// The access key id of an upload API key is its id without the "key:" prefix,
+// the secret access key is the API key itself.
+const (
+	sigV4Algorithm      = "AWS4-HMAC-SHA256"
+	sigV4ChunkAlgorithm = "AWS4-HMAC-SHA256-PAYLOAD"
+	sigV4TimeFormat     = "20060102T150405Z"
+	// allowed clock difference of signed requests
+	sigV4MaxSkew = 15 * time.Minute
+	// longest lifetime of presigned URLs
+	sigV4MaxExpires = 7 * 24 * time.Hour
+
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingSignedPayload   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptySHA256              = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// largest chunk of an aws-chunked body, clients send 64 KiB to a few MiB
+	maxAWSChunkBytes = 16 << 20
+)
+
+// a request signature that matched, the chunks of streaming uploads are chained to it
+type sigV4 struct {
+	// id of the API key the request was signed with
+	keyID      string
+	signingKey []byte
+	amzDate    string
+	scope      string
+	signature  string
+	// x-amz-content-sha256 of the request
+	payload string
+}
+
+// check the SigV4 signature of r, in the Authorization header or in the
+// query of a presigned URL, against the upload API keys
+func (s *Server) verifySigV4(r *http.Request) (*sigV4, *s3Error) {
+	query := r.URL.Query()
+	var credential, signedHeaders, signature, amzDate, payload string
+	presigned := query.Get("X-Amz-Algorithm") != ""
+	if presigned {
+		if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+			return nil, s3AuthorizationMalformed
+		}
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payload = unsignedPayload
+	} else {
+		auth := r.Header.Get("Authorization")
+		if auth == "" {
+			return nil, s3AccessDenied
+		}
+		if !strings.HasPrefix(auth, sigV4Algorithm+" ") {
+			return nil, s3AuthorizationMalformed
+		}
+		for _, field := range strings.Split(strings.TrimPrefix(auth, sigV4Algorithm+" "), ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				return nil, s3AuthorizationMalformed
+			}
+			switch kv[0] {
+			case "Credential":
+				credential = kv[1]
+			case "SignedHeaders":
+				signedHeaders = kv[1]
+			case "Signature":
+				signature = kv[1]
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		payload = r.Header.Get("X-Amz-Content-Sha256")
+		if payload == "" {
+			return nil, s3MissingContentSHA256
+		}
+	}
+
+	signedAt, err := time.Parse(sigV4TimeFormat, amzDate)
+	if err != nil {
+		return nil, s3AuthorizationMalformed
+	}
+	// <access key id>/<date>/<region>/s3/aws4_request, any region is accepted
+	scope := strings.Split(credential, "/")
+	if len(scope) != 5 || scope[1] != amzDate[:8] || scope[3] != "s3" || scope[4] != "aws4_request" {
+		return nil, s3AuthorizationMalformed
+	}
+	headers := strings.Split(signedHeaders, ";")
+	if signature == "" || !sort.StringsAreSorted(headers) || !containsString(headers, "host") {
+		return nil, s3AuthorizationMalformed
+	}
+	key := s.s3SecretKey(scope[0])
+	if key == "" {
+		return nil, s3InvalidAccessKeyID
+	}
+
+	now := time.Now()
+	if presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 || time.Duration(expires)*time.Second > sigV4MaxExpires {
+			return nil, s3AuthorizationMalformed
+		}
+		if signedAt.After(now.Add(sigV4MaxSkew)) {
+			return nil, s3RequestTimeTooSkewed
+		}
+		if now.After(signedAt.Add(time.Duration(expires) * time.Second)) {
+			return nil, s3RequestExpired
+		}
+	} else if d := now.Sub(signedAt); d > sigV4MaxSkew || d < -sigV4MaxSkew {
+		return nil, s3RequestTimeTooSkewed
+	}
+
+	canonical := strings.Join([]string{
+		r.Method,
+		s3URIEncode(r.URL.Path, false),
+		canonicalQuery(query, presigned),
+		canonicalHeaders(r, headers),
+		signedHeaders,
+		payload,
+	}, "\n")
+	sig := &sigV4{
+		keyID:      apiKeyID(key),
+		signingKey: sigV4SigningKey(key, scope[1], scope[2]),
+		amzDate:    amzDate,
+		scope:      strings.Join(scope[1:], "/"),
+		payload:    payload,
+	}
+	sig.signature = sig.sign(sigV4Algorithm, hexSHA256([]byte(canonical)))
+	if subtle.ConstantTimeCompare([]byte(sig.signature), []byte(signature)) != 1 {
+		return nil, s3SignatureDoesNotMatch
+	}
+	return sig, nil
+}
+
+// the upload API key whose access key id is id, empty when there is none
+func (s *Server) s3SecretKey(id string) string {
+	for _, key := range s.config.UploadAPIKeys {
+		if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(apiKeyID(key), "key:")), []byte(id)) == 1 {
+			return key
+		}
+	}
+	return ""
+}
+
+func sigV4SigningKey(key, date, region string) []byte {
+	k := hmacSHA256([]byte("AWS4"+key), date)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, "s3")
+	return hmacSHA256(k, "aws4_request")
+}
+
+// hex signature of the string to sign made of algorithm, the date and scope of
+// the request and the lines of rest
+func (s *sigV4) sign(algorithm string, rest ...string) string {
+	stringToSign := strings.Join(append([]string{algorithm, s.amzDate, s.scope}, rest...), "\n")
+	return hex.EncodeToString(hmacSHA256(s.signingKey, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// query parameters sorted by name and value, without the signature of presigned URLs
+func canonicalQuery(query url.Values, presigned bool) string {
+	var pairs []string
+	for name, values := range query {
+		if presigned && name == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range values {
+			pairs = append(pairs, s3URIEncode(name, true)+"="+s3URIEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// the signed headers as lowercase name:value lines, values trimmed and their
+// inner spaces collapsed
+func canonicalHeaders(r *http.Request, names []string) string {
+	var b strings.Builder
+	for _, name := range names {
+		var values []string
+		switch name {
+		case "host":
+			values = []string{r.Host}
+		case "content-length":
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		default:
+			values = r.Header.Values(name)
+		}
+		for i, v := range values {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		b.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	return b.String()
+}
+
+// percent-encode everything but unreserved characters, and slashes unless encodeSlash is set
+func s3URIEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+var errMalformedChunk = errors.New("malformed aws-chunked body")
+
+// decoded body of an aws-chunked upload, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-streaming.html
+// Signed chunks are checked against the signature of the previous one, the
+// first against the seed signature of the request. Trailing checksums are
+// skipped, the contents are hashed on their own once stored.
+type awsChunkedReader struct {
+	r *bufio.Reader
+	// nil for unsigned chunks
+	sig      *sigV4
+	previous string
+	chunkSig string
+	hash     hash.Hash
+	started  bool
+	left     int64
+	err      error
+}
+
+func newAWSChunkedReader(r io.Reader, sig *sigV4) *awsChunkedReader {
+	c := &awsChunkedReader{r: bufio.NewReader(r), hash: sha256.New()}
+	if sig.payload == streamingSignedPayload {
+		c.sig = sig
+		c.previous = sig.signature
+	}
+	return c
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	for c.err == nil && c.left == 0 {
+		c.err = c.nextChunk()
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	c.hash.Write(p[:n])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	c.err = err
+	return n, err
+}
+
+// finish the current chunk and start the next one, io.EOF after the last
+func (c *awsChunkedReader) nextChunk() error {
+	if c.started {
+		if line, err := c.readLine(); err != nil || line != "" {
+			return errMalformedChunk
+		}
+		if err := c.verify(); err != nil {
+			return err
+		}
+	}
+	c.started = true
+	c.hash.Reset()
+
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	size, params := line, ""
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		size, params = line[:i], line[i+1:]
+	}
+	if c.left, err = strconv.ParseInt(size, 16, 64); err != nil || c.left < 0 || c.left > maxAWSChunkBytes {
+		return errMalformedChunk
+	}
+	if c.sig != nil {
+		if !strings.HasPrefix(params, "chunk-signature=") {
+			return errMalformedChunk
+		}
+		c.chunkSig = strings.TrimPrefix(params, "chunk-signature=")
+	}
+	if c.left > 0 {
+		return nil
+	}
+
+	// the last chunk is empty, trailers up to a blank line may follow it
+	if err := c.verify(); err != nil {
+		return err
+	}
+	for i := 0; ; i++ {
+		line, err := c.readLine()
+		if err != nil || i > 16 {
+			return errMalformedChunk
+		}
+		if line == "" {
+			return io.EOF
+		}
+	}
+}
+
+func (c *awsChunkedReader) verify() error {
+	if c.sig == nil {
+		return nil
+	}
+	want := c.sig.sign(sigV4ChunkAlgorithm, c.previous, emptySHA256, hex.EncodeToString(c.hash.Sum(nil)))
+	if subtle.ConstantTimeCompare([]byte(want), []byte(c.chunkSig)) != 1 {
+		return s3SignatureDoesNotMatch
+	}
+	c.previous = c.chunkSig
+	return nil
+}
+
+func (c *awsChunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errMalformedChunk
+	}
+	if err == io.EOF {
+		return "", io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"filer/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+// container of the files of an uploader, TENANT_CONTAINERS maps uploaders
+// (as recorded with their files, e.g. key:1a2b3c4d or user:<subject>) to containers
+// empty for uploaders that share the default container
+func (s *Server) tenantContainer(uploader string) string {
+	return s.config.TenantContainers[uploader]
+}
+
+// open the tenant containers, creating the missing ones, with their replicas
+func openTenantContainers(config *Config, logger *zap.Logger, blobs storage.Storage, replicas map[string]storage.Storage) (map[string]storage.Storage, error) {
+	tenants := map[string]storage.Storage{}
+	for _, name := range config.TenantContainers {
+		if _, ok := tenants[name]; ok {
+			continue
+		}
+		backend, ok := blobs.(storage.ContainerStorage)
+		if !ok {
+			return nil, errors.New("the storage backend does not support tenant containers")
+		}
+		container, err := backend.Container(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open tenant container: %w", err)
+		}
+		tenants[name] = instrumentStorage(withReplica(logger, storage.WithTimeout(container, config.StorageTimeout), replicas, name))
+	}
+	return tenants, nil
+}
+
+// storage holding the blobs of a container, the default one when empty
+func (s *Server) storageFor(container string) storage.Storage {
+	if storage, ok := s.tenants[container]; ok {
+		return storage
+	}
+	return s.storage
+}
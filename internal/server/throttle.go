@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// bytes written between two waits of a throttled download
+const throttleChunkBytes = 32 << 10
+
+// byteBucket is a token bucket of bytes refilled at rate bytes per second,
+// holding at most one second of them
+type byteBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// bucket of rate bytes per second, nil when rate is 0 (unlimited)
+func newByteBucket(rate int64) *byteBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &byteBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// take n bytes, returns how long to wait before sending them
+// The balance goes negative so concurrent writers queue up behind each other.
+func (b *byteBucket) reserve(n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// throttledWriter paces the body of a response by its own bucket and the
+// bucket shared by every download of the instance
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	own    *byteBucket
+	global *byteBucket
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > throttleChunkBytes {
+			n = throttleChunkBytes
+		}
+		wait := t.own.reserve(n)
+		if d := t.global.reserve(n); d > wait {
+			wait = d
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-t.ctx.Done():
+				timer.Stop()
+				return written, t.ctx.Err()
+			}
+		}
+		m, err := t.ResponseWriter.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (t *throttledWriter) Flush() {
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// limit the egress of each download to DOWNLOAD_BYTES_PER_SECOND and of all
+// of them to GLOBAL_DOWNLOAD_BYTES_PER_SECOND, so a single hot link cannot
+// take the bandwidth of the instance
+func (s *Server) withThrottle(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.DownloadBytesPerSecond == 0 && s.egress == nil {
+			next(w, r)
+			return
+		}
+		next(&throttledWriter{ResponseWriter: w, ctx: r.Context(), own: newByteBucket(s.config.DownloadBytesPerSecond), global: s.egress}, r)
+	}
+}
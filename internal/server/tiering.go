@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"filer/internal/storage"
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+// how long recipients of an archived file are asked to wait, high priority
+// rehydrations take up to an hour
+const rehydrationRetryAfter = 15 * time.Minute
+
+// move the files untouched for TIER_ARCHIVE_AFTER to the archive tier and
+// those untouched for TIER_COOL_AFTER to the cool tier
+// Files only ever move to colder tiers here, archived ones come back when
+// they are downloaded.
+func (s *Server) applyTiers(ctx context.Context) (int, error) {
+	moved := 0
+	if s.config.TierArchiveAfter > 0 {
+		n, err := s.moveUntouched(ctx, s.config.TierArchiveAfter, storage.TierArchive, "", storage.TierCool)
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+	}
+	if s.config.TierCoolAfter > 0 {
+		n, err := s.moveUntouched(ctx, s.config.TierCoolAfter, storage.TierCool, "")
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// move the files of the from tiers untouched for after to tier
+func (s *Server) moveUntouched(ctx context.Context, after time.Duration, tier string, from ...string) (int, error) {
+	files, err := s.store.UntouchedFiles(ctx, time.Now().UTC().Add(-after), from)
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for i := range files {
+		file := &files[i]
+		if err := s.setTier(ctx, file, tier); err != nil {
+			s.logger.Error("janitor: failed to move file to another tier", zap.String("file_id", file.ID.Hex()),
+				zap.String("tier", tier), zap.Error(err))
+			continue
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// move the blobs of a file to tier, thumbnails stay hot for previews
+func (s *Server) setTier(ctx context.Context, file *store.File, tier string) error {
+	for _, name := range file.BlobNames() {
+		if err := s.storageFor(file.Container).SetTier(ctx, name, tier); err != nil && err != storage.ErrBlobNotFound {
+			return err
+		}
+	}
+	return s.store.SetTier(ctx, file.ID, tier)
+}
+
+// bring the archived blobs of a file back to the hot tier, reporting whether
+// all of them can be read. The tier of the file is recorded as hot once they
+// are, and as rehydrating until then.
+func (s *Server) rehydrate(ctx context.Context, file *store.File) (bool, error) {
+	backend := s.storageFor(file.Container)
+	ready := true
+	for _, name := range file.BlobNames() {
+		tier, err := backend.Tier(ctx, name)
+		if err == storage.ErrBlobNotFound {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		switch tier {
+		case storage.TierArchive:
+			if err := backend.SetTier(ctx, name, storage.TierHot); err != nil {
+				return false, err
+			}
+			ready = false
+		case storage.TierRehydrating:
+			ready = false
+		}
+	}
+
+	tier := storage.TierRehydrating
+	if ready {
+		tier = ""
+	}
+	if tier != file.Tier {
+		if err := s.store.SetTier(ctx, file.ID, tier); err != nil {
+			return false, err
+		}
+		file.Tier = tier
+	}
+	return ready, nil
+}
+
+// whether the blobs of file can be downloaded, starting the rehydration of
+// archived files and answering 202 until it is done
+func (s *Server) online(w http.ResponseWriter, r *http.Request, file *store.File) bool {
+	if file.Tier != storage.TierArchive && file.Tier != storage.TierRehydrating {
+		return true
+	}
+	ready, err := s.rehydrate(r.Context(), file)
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to rehydrate file", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+		writeError(w, r, http.StatusBadGateway, "failed to read file")
+		return false
+	}
+	if ready {
+		return true
+	}
+	writePreparing(w)
+	return false
+}
+
+// answer that the file is being brought back from the archive tier
+func writePreparing(w http.ResponseWriter) {
+	res, _ := json.Marshal(preparingState{Status: "preparing"})
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rehydrationRetryAfter.Seconds()))))
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(res)
+}
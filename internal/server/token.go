@@ -0,0 +1,171 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	downloadTokenRoute = "DownloadToken"
+	downloadTokenPath  = "/api/" + downloadTokenRoute
+
+	defaultDownloadTokenTTL   = 5 * time.Minute
+	minDownloadTokenKeyLength = 32
+)
+
+var errInvalidToken = errors.New("invalid or expired download token")
+
+// private claims of a download token
+type downloadClaims struct {
+	// the token is encrypted, so the secret stays hidden from whoever sees the URL
+	Secret string `json:"sec"`
+	// the passphrase was checked when the token was issued
+	Passphrase bool `json:"pph,omitempty"`
+}
+
+// separate keys for signing and encrypting tokens, derived from DOWNLOAD_TOKEN_KEY
+func (s *Server) downloadTokenKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(s.config.DownloadTokenKey))
+	mac.Write([]byte("download token " + purpose))
+	return mac.Sum(nil)
+}
+
+// issue a token granting the download of file through its secret until expiry
+// Tokens are signed, then encrypted JWTs (HS256 in A256GCM).
+func (s *Server) newDownloadToken(file *store.File, secret string, passphrase bool, expiry time.Time) (string, error) {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: s.downloadTokenKey("signing")},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: jose.DIRECT, Key: s.downloadTokenKey("encryption")},
+		(&jose.EncrypterOptions{}).WithType("JWT").WithContentType("JWT"))
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := jwt.Claims{
+		Issuer:    s.config.ServiceName,
+		Audience:  jwt.Audience{downloadRoute},
+		Subject:   file.ID.Hex(),
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(expiry),
+	}
+	return jwt.SignedAndEncrypted(signer, encrypter).
+		Claims(claims).
+		Claims(downloadClaims{Secret: secret, Passphrase: passphrase}).
+		CompactSerialize()
+}
+
+// the id of the file and the claims of a valid token, errInvalidToken otherwise
+func (s *Server) parseDownloadToken(raw string) (string, *downloadClaims, error) {
+	nested, err := jwt.ParseSignedAndEncrypted(raw)
+	if err != nil {
+		return "", nil, errInvalidToken
+	}
+	signed, err := nested.Decrypt(s.downloadTokenKey("encryption"))
+	if err != nil {
+		return "", nil, errInvalidToken
+	}
+	var (
+		claims  jwt.Claims
+		private downloadClaims
+	)
+	if err := signed.Claims(s.downloadTokenKey("signing"), &claims, &private); err != nil {
+		return "", nil, errInvalidToken
+	}
+	err = claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:   s.config.ServiceName,
+		Audience: jwt.Audience{downloadRoute},
+		Time:     time.Now(),
+	}, 0)
+	if err != nil || private.Secret == "" {
+		return "", nil, errInvalidToken
+	}
+	return claims.Subject, &private, nil
+}
+
+// Download token
+// exchanges a secret, sent in a POST body, for a short-lived download token
+// so the secret itself never shows up in browser history, proxies or access
+// logs. DownloadTrigger accepts the token in place of the secret, as does
+// /api/v1/downloads/{token}.
+func (s *Server) downloadTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if s.config.DownloadTokenKey == "" {
+		writeError(w, r, http.StatusNotFound, "download tokens are disabled")
+		return
+	}
+	secret := r.PostFormValue("secret")
+	if secret == "" {
+		// the secret is in the path of /api/v1/files/{secret}/tokens
+		secret = urlParam(r, "secret")
+	}
+	if secret == "" {
+		writeError(w, r, http.StatusBadRequest, "missing secret")
+		return
+	}
+
+	file, err := s.find(r.Context(), secret)
+	if err == store.ErrNotFound {
+		failedGuess(r)
+		writeError(w, r, http.StatusNotFound, "file not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to look up file")
+		return
+	}
+	if file.PassphraseHash != "" {
+		passphrase := r.PostFormValue("passphrase")
+		if passphrase == "" {
+			writeError(w, r, http.StatusUnauthorized, "passphrase required")
+			return
+		}
+		if !s.secrets.VerifyPassphrase(passphrase, file.PassphraseHash) {
+			failedGuess(r)
+			writeError(w, r, http.StatusForbidden, "invalid passphrase")
+			return
+		}
+	}
+
+	// a token never outlives the file it grants
+	expiry := time.Now().Add(s.config.DownloadTokenTTL).Truncate(time.Second)
+	if file.ExpiresAt != nil && file.ExpiresAt.Before(expiry) {
+		expiry = file.ExpiresAt.Truncate(time.Second)
+	}
+	token, err := s.newDownloadToken(file, secret, file.PassphraseHash != "", expiry)
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to issue download token", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to issue token")
+		return
+	}
+	res, err := json.Marshal(downloadToken{Token: token, ExpiresAt: expiry.UTC(), URL: s.tokenURL(token)})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
+
+// download link of a token under PUBLIC_BASE_URL, empty when it is not configured
+func (s *Server) tokenURL(token string) string {
+	if s.config.PublicBaseURL == "" {
+		return ""
+	}
+	return s.config.PublicBaseURL + "/v1/downloads/" + url.PathEscape(token)
+}
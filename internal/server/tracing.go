@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const defaultServiceName = "filer"
+
+// tracer of the handlers and the storage layer, a no-op until tracing is set up
+var tracer = otel.Tracer("filer")
+
+// InitTracing exports spans over OTLP/gRPC when OTEL_EXPORTER_OTLP_ENDPOINT is set.
+// The exporter reads the other OTEL_EXPORTER_OTLP_* variables (headers, insecure...) itself.
+// The returned function flushes pending spans on shutdown.
+func InitTracing(ctx context.Context, config *Config) (func(context.Context) error, error) {
+	// continue traces started by the caller, e.g. the Functions host or a client
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if config.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	endpoint := strings.TrimPrefix(strings.TrimPrefix(config.OTLPEndpoint, "http://"), "https://")
+	exporter, err := otlp.NewExporter(ctx, otlpgrpc.NewDriver(otlpgrpc.WithEndpoint(endpoint)))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx, resource.WithAttributes(semconv.ServiceNameKey.String(config.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// trace requests, named after their method and route
+// otelhttp records the request URI as http.target and the first
+// X-Forwarded-For hop as http.client_ip, which are replaced by the route, as
+// paths and queries carry secrets and tokens, and by the trusted client address.
+func (s *Server) withTracing(next http.HandlerFunc) http.HandlerFunc {
+	tagged := func(w http.ResponseWriter, r *http.Request) {
+		trace.SpanFromContext(r.Context()).SetAttributes(
+			attribute.String("request_id", requestID(r.Context())),
+			semconv.HTTPTargetKey.String(metricsRoute(r.URL.Path)),
+			semconv.HTTPClientIPKey.String(s.clientIP(r)),
+		)
+		next(w, r)
+	}
+	h := otelhttp.NewHandler(http.HandlerFunc(tagged), "http", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return r.Method + " " + metricsRoute(r.URL.Path)
+	}))
+	return h.ServeHTTP
+}
+
+// start a client span, the returned function ends it with the outcome of the call
+func startSpan(ctx context.Context, name string) (context.Context, func(error)) {
+	ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
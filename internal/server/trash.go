@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"filer/internal/storage"
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+const (
+	adminTrashRoute = "AdminTrash"
+	adminTrashPath  = "/api/admin/trash"
+	adminTrashFn    = "/api/" + adminTrashRoute
+
+	// trashed files keep their blobs under this prefix until they are purged
+	trashBlobPrefix = "trash/"
+)
+
+// name the blob name of file is stored under, shared blobs stay in place
+// with their reference held while the file is in the trash
+func storedBlobName(file *store.File, name string) string {
+	if file.DeletedAt == nil || strings.HasPrefix(name, contentBlobPrefix) {
+		return name
+	}
+	return trashBlobPrefix + name
+}
+
+// the blobs of file moved in and out of the trash, with its thumbnail
+func trashableBlobs(file *store.File) []string {
+	var names []string
+	for _, name := range file.BlobNames() {
+		if !strings.HasPrefix(name, contentBlobPrefix) {
+			names = append(names, name)
+		}
+	}
+	if file.Thumbnail != "" {
+		names = append(names, file.Thumbnail)
+	}
+	return names
+}
+
+// copy the blobs of a container to the names rename gives them
+// blobs that are already gone are skipped
+func (s *Server) copyBlobs(ctx context.Context, container string, names []string, rename func(string) string) error {
+	backend := s.storageFor(container)
+	for _, name := range names {
+		blob, err := backend.Get(ctx, name)
+		if err == storage.ErrBlobNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = backend.Put(ctx, rename(name), blob, storage.PutOptions{ContentType: blob.ContentType})
+		blob.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delete the blobs of a container once they were copied, failures are
+// logged and left to the reconciler
+func (s *Server) deleteMovedBlobs(ctx context.Context, container string, names []string) {
+	for _, name := range names {
+		if err := s.storageFor(container).Delete(ctx, name); err != nil && err != storage.ErrBlobNotFound {
+			s.logFor(ctx).Warn("failed to delete moved blob", zap.String("container", container), zap.String("blob", name), zap.Error(err))
+		}
+	}
+}
+
+func trashName(name string) string {
+	return trashBlobPrefix + name
+}
+
+func untrashName(name string) string {
+	return strings.TrimPrefix(name, trashBlobPrefix)
+}
+
+// delete a file, into the trash while TRASH_RETENTION is set
+// Files already in the trash are erased.
+func (s *Server) remove(ctx context.Context, file *store.File) error {
+	if s.config.TrashRetention <= 0 || file.DeletedAt != nil {
+		return s.erase(ctx, file)
+	}
+	// archived blobs cannot be copied to the trash
+	if file.Tier == storage.TierArchive || file.Tier == storage.TierRehydrating {
+		return s.erase(ctx, file)
+	}
+
+	// the blobs are copied before the link is marked, so a failure leaves
+	// the file as it was and the copies to the reconciler
+	names := trashableBlobs(file)
+	if err := s.copyBlobs(ctx, file.Container, names, trashName); err != nil {
+		return err
+	}
+	at := time.Now().UTC()
+	trashed, err := s.store.TrashFile(ctx, file.ID, at)
+	if err != nil || !trashed {
+		// a concurrent deletion moved the blobs already
+		return err
+	}
+	file.DeletedAt = &at
+	s.deleteMovedBlobs(ctx, file.Container, names)
+	return nil
+}
+
+// take a file out of the trash, moving its blobs back
+func (s *Server) restore(ctx context.Context, file *store.File) error {
+	var names []string
+	for _, name := range trashableBlobs(file) {
+		names = append(names, trashName(name))
+	}
+	if err := s.copyBlobs(ctx, file.Container, names, untrashName); err != nil {
+		return err
+	}
+	restored, err := s.store.RestoreFile(ctx, file.ID)
+	if err != nil || !restored {
+		return err
+	}
+	file.DeletedAt = nil
+	s.deleteMovedBlobs(ctx, file.Container, names)
+	// the replicas were deleted with the blobs when the file was trashed
+	if s.replicas != nil {
+		if err := s.store.SetReplication(ctx, file.ID, replicationPending); err != nil {
+			s.logFor(ctx).Warn("failed to mark restored file unreplicated", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+		}
+		file.Replication = replicationPending
+		s.replicate(file)
+	}
+	// copies of cool blobs land in the hot tier
+	if file.Tier != "" {
+		if err := s.store.SetTier(ctx, file.ID, ""); err != nil {
+			s.logFor(ctx).Warn("failed to mark restored file hot", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+		}
+		file.Tier = ""
+	}
+	return nil
+}
+
+// delete the blobs and the saved link of a file, trashed or not
+// shared blobs are only deleted with their last reference
+func (s *Server) erase(ctx context.Context, file *store.File) error {
+	for _, name := range file.BlobNames() {
+		if err := s.releaseBlob(ctx, file.Container, storedBlobName(file, name)); err != nil && err != storage.ErrBlobNotFound {
+			return err
+		}
+	}
+	if err := s.removeThumbnail(ctx, file); err != nil {
+		return err
+	}
+
+	deleted, err := s.store.DeleteFile(ctx, file.ID)
+	if err != nil {
+		return err
+	}
+	if deleted && file.QuotaCharged {
+		s.releaseQuota(ctx, file.Uploader, file.Size)
+	}
+	return nil
+}
+
+// erase the files trashed for longer than TRASH_RETENTION, all of them once
+// the trash is disabled
+func (s *Server) purgeTrash(ctx context.Context) (int, error) {
+	files, err := s.store.TrashedFiles(ctx, time.Now().UTC().Add(-s.config.TrashRetention))
+	if err != nil {
+		return 0, err
+	}
+
+	erased := 0
+	for i := range files {
+		file := &files[i]
+		if err := s.erase(ctx, file); err != nil {
+			s.logger.Error("janitor: failed to erase trashed file", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+			continue
+		}
+		erased++
+	}
+	return erased, nil
+}
+
+// Admin trash
+// GET lists the deleted files that can still be restored, newest first.
+func (s *Server) adminTrashHandler(w http.ResponseWriter, r *http.Request) {
+	page, perPage, err := pageParams(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	list, err := s.listFiles(r.Context(), store.FileFilter{Trashed: true, Uploader: r.URL.Query().Get("uploader")}, page, perPage)
+	if err != nil {
+		s.logFor(r.Context()).Error("admin: failed to list trashed files", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to list files")
+		return
+	}
+	writeFileList(w, r, list)
+}
+
+// Admin restore
+// POST takes a file out of the trash. Files that expired meanwhile need a
+// new ttl.
+func (s *Server) adminRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	id := urlParam(r, "id")
+	file, err := s.findByID(r.Context(), id)
+	if err == nil && file.DeletedAt == nil {
+		err = store.ErrNotFound
+	}
+	if err == store.ErrNotFound {
+		writeError(w, r, http.StatusNotFound, "file not in the trash")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to look up file")
+		return
+	}
+
+	var expiresAt time.Time
+	if v := r.FormValue("ttl"); v != "" {
+		d, err := parseTTL(v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid ttl")
+			return
+		}
+		now := time.Now().UTC()
+		if expiresAt = s.retainedExpiry(file, now.Add(d)); !expiresAt.After(now) {
+			writeError(w, r, http.StatusConflict, "the retention rules do not let this file live any longer")
+			return
+		}
+	} else if file.ExpiresAt != nil && !file.ExpiresAt.After(time.Now()) {
+		writeError(w, r, http.StatusConflict, "file has expired, restoring it requires a ttl")
+		return
+	}
+
+	// extended first, the janitor would trash it again otherwise
+	if !expiresAt.IsZero() {
+		if err := s.store.SetExpiry(r.Context(), file.ID, expiresAt); err != nil {
+			s.logFor(r.Context()).Error("admin: failed to extend trashed file", zap.String("file_id", id), zap.Error(err))
+			writeError(w, r, http.StatusInternalServerError, "failed to extend file")
+			return
+		}
+	}
+	if err := s.restore(r.Context(), file); err != nil {
+		s.logFor(r.Context()).Error("admin: failed to restore file", zap.String("file_id", id), zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to restore file")
+		return
+	}
+	s.logFor(r.Context()).Info("admin: restored file", zap.String("file_id", id), zap.String("filename", file.FileName))
+	s.audit(r, auditRestore, file)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"filer/internal/secret"
+	"filer/internal/storage"
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+// tus.io resumable upload protocol, see https://tus.io/protocols/resumable-upload.html
+const (
+	tusVersion       = "1.0.0"
+	tusExtensions    = "creation"
+	tusRoute         = "UploadResumable"
+	tusPath          = "/api/" + tusRoute
+	tusMaxChunkBytes = 8 * 1024 * 1024
+	// every chunk but the last is at least this large, so that the largest
+	// uploads fit in tusMaxChunks
+	tusMinChunkBytes = 1024 * 1024
+	// Azure commits at most 50,000 blocks into a blob
+	tusMaxChunks = 50000
+	// completed sessions answer retries with 409 rather than 404 this long
+	completedSessionRetention = 24 * time.Hour
+)
+
+// create a resumable upload session
+func (s *Server) createUploadSession(ctx context.Context, container, fileName, contentType string, length int64) (*store.UploadSession, error) {
+	id, err := secret.Random(32)
+	if err != nil {
+		return nil, err
+	}
+	session := &store.UploadSession{
+		ID:          id,
+		FileName:    fileName,
+		Blob:        newBlobName(fileName),
+		ContentType: contentType,
+		Length:      length,
+		Container:   container,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := s.store.CreateUploadSession(ctx, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// find a resumable upload session
+func (s *Server) findUploadSession(ctx context.Context, id string) (*store.UploadSession, error) {
+	return s.store.FindUploadSession(ctx, id)
+}
+
+// record a staged chunk, failing if another request staged one concurrently
+func (s *Server) advanceUploadSession(ctx context.Context, session *store.UploadSession, written int64) error {
+	if err := s.store.AdvanceUploadSession(ctx, session, written); err != nil {
+		return err
+	}
+	session.Offset += written
+	session.Chunks++
+	return nil
+}
+
+// mark an upload session complete, its secret is not kept
+func (s *Server) completeUploadSession(ctx context.Context, session *store.UploadSession) error {
+	return s.store.CompleteUploadSession(ctx, session.ID, time.Now().UTC())
+}
+
+// drop the sessions completed more than a day ago, run by the janitor
+func (s *Server) pruneUploadSessions(ctx context.Context) {
+	n, err := s.store.PruneUploadSessions(ctx, time.Now().UTC().Add(-completedSessionRetention))
+	if err != nil {
+		s.logger.Error("janitor: failed to prune upload sessions", zap.Error(err))
+		return
+	}
+	if n > 0 {
+		s.logger.Info("janitor: pruned upload sessions", zap.Int64("count", n))
+	}
+}
+
+// Resumable upload
+// POST creates a session, HEAD reports its offset and PATCH appends a chunk.
+// The share secret is returned in the Upload-Secret header of the PATCH
+// completing the upload, and only there.
+func (s *Server) uploadResumableHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Chunk-Size", strconv.Itoa(tusMaxChunkBytes))
+		if limit := s.config.maxUploadBytes(tusRoute); limit > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(limit, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeError(w, r, http.StatusPreconditionFailed, "unsupported Tus-Resumable version")
+		return
+	}
+
+	id := urlParam(r, "id")
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		s.tusCreate(w, r)
+	case r.Method == http.MethodHead && id != "":
+		s.tusHead(w, r, id)
+	case r.Method == http.MethodPatch && id != "":
+		s.tusPatch(w, r, id)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) tusCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		writeError(w, r, http.StatusBadRequest, "missing Upload-Length or filename metadata")
+		return
+	}
+	if limit := s.config.maxUploadBytes(tusRoute); limit > 0 && length > limit {
+		writeTooLarge(w, r, limit)
+		return
+	}
+	meta := tusMetadata(r.Header.Get("Upload-Metadata"))
+	fileName := meta["filename"]
+	if fileName == "" {
+		writeError(w, r, http.StatusBadRequest, "missing filename in Upload-Metadata")
+		return
+	}
+	// the type is checked once the contents are complete
+	if err := s.checkFileType(fileName, ""); err != nil {
+		s.writeRefused(w, r, err)
+		return
+	}
+
+	// tus clients conventionally send the MIME type as "filetype"
+	contentType := defaultContentType
+	if mediaType, _, err := mime.ParseMediaType(meta["filetype"]); err == nil {
+		contentType = mediaType
+	}
+
+	session, err := s.createUploadSession(r.Context(), s.tenantContainer(s.uploader(r)), fileName, contentType, length)
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to create upload session", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to create upload session")
+		return
+	}
+
+	w.Header().Set("Location", tusPath+"/"+session.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) tusHead(w http.ResponseWriter, r *http.Request, id string) {
+	session, err := s.findUploadSession(r.Context(), id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) tusPatch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeError(w, r, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid Upload-Offset")
+		return
+	}
+
+	session, err := s.findUploadSession(r.Context(), id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "upload session not found")
+		return
+	}
+	if offset != session.Offset || session.CompletedAt != nil {
+		writeError(w, r, http.StatusConflict, "Upload-Offset does not match the session offset")
+		return
+	}
+
+	if !s.stageChunk(w, r, session, tusRoute) {
+		return
+	}
+	if session.Offset == session.Length {
+		file := store.File{FileName: session.FileName, Uploader: s.uploader(r), Owner: requestUser(r.Context())}
+		secret, _, ok := s.commitUploadSession(w, r, session, &file, "resumable")
+		if !ok {
+			return
+		}
+		w.Header().Set("Upload-Secret", secret)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stage the request body as the next chunk of session, at most
+// tusMaxChunkBytes of it as the client resumes from the returned offset.
+// Chunks but the last must have tusMinChunkBytes. Reports whether it was
+// staged, answering the error otherwise.
+func (s *Server) stageChunk(w http.ResponseWriter, r *http.Request, session *store.UploadSession, route string) bool {
+	chunked, ok := s.storageFor(session.Container).(storage.ChunkedStorage)
+	if !ok {
+		writeError(w, r, http.StatusNotImplemented, "storage backend does not support resumable uploads")
+		return false
+	}
+	if session.Chunks >= tusMaxChunks {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "upload has too many chunks")
+		return false
+	}
+
+	limit := session.Length - session.Offset
+	if limit > tusMaxChunkBytes {
+		limit = tusMaxChunkBytes
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, limit))
+	if isTooLarge(err) {
+		writeTooLarge(w, r, s.config.maxUploadBytes(route))
+		return false
+	}
+	if err != nil && len(data) == 0 {
+		writeError(w, r, http.StatusBadRequest, "failed to read chunk")
+		return false
+	}
+	if len(data) == 0 {
+		return true
+	}
+	if len(data) < tusMinChunkBytes && int64(len(data)) < limit {
+		writeError(w, r, http.StatusBadRequest, "chunks other than the last must have at least "+strconv.Itoa(tusMinChunkBytes)+" bytes")
+		return false
+	}
+
+	ctx := r.Context()
+	if err := chunked.StageChunk(ctx, session.BlobName(), session.Chunks, data); err != nil {
+		s.logFor(ctx).Error("failed to stage chunk", zap.String("upload_id", session.ID), zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to stage chunk")
+		return false
+	}
+	if err := s.advanceUploadSession(ctx, session, int64(len(data))); err != nil {
+		if err == store.ErrUploadSessionConflict {
+			writeError(w, r, http.StatusConflict, "upload session was modified concurrently")
+			return false
+		}
+		s.logFor(ctx).Error("failed to update upload session", zap.String("upload_id", session.ID), zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to update upload session")
+		return false
+	}
+	return true
+}
+
+// assemble the staged chunks of a complete session and save file as their
+// link under a new secret, returning it with the deletion token
+// Nothing is saved until the blob is committed, and the blob is deleted when
+// the link cannot be saved. Answers the error and reports false otherwise.
+func (s *Server) commitUploadSession(w http.ResponseWriter, r *http.Request, session *store.UploadSession, file *store.File, kind string) (secret, deleteToken string, ok bool) {
+	file.Blob = session.BlobName()
+	file.Size = session.Length
+	file.ContentType = session.ContentType
+	file.Container = session.Container
+
+	// the quota is only charged once the size is final
+	ctx := r.Context()
+	if err := s.reserveQuota(ctx, file.Uploader, file.Size); err != nil {
+		s.writeQuotaError(w, r, err)
+		return "", "", false
+	}
+	file.QuotaCharged = true
+	committed := false
+	defer func() {
+		if ok {
+			return
+		}
+		s.releaseQuota(context.Background(), file.Uploader, file.Size)
+		if committed {
+			s.discardParts(file.Container, []*storedPart{{blob: file.Blob}})
+		}
+	}()
+
+	chunked := s.storageFor(session.Container).(storage.ChunkedStorage)
+	url, err := chunked.CommitChunks(ctx, file.Blob, session.Chunks, storage.PutOptions{ContentType: session.ContentType})
+	if err != nil {
+		s.logFor(ctx).Error("failed to commit chunks", zap.String("upload_id", session.ID), zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to commit upload")
+		return "", "", false
+	}
+	committed = true
+	file.LinkUrl = url
+	if err := s.checkBlobType(ctx, session.Container, file); err != nil {
+		if !s.writeRefused(w, r, err) {
+			s.logFor(ctx).Error("failed to detect content type", zap.String("upload_id", session.ID), zap.Error(err))
+			writeError(w, r, http.StatusInternalServerError, "failed to commit upload")
+		}
+		return "", "", false
+	}
+	if s.inspector != nil {
+		findings, err := s.inspectBlob(ctx, session.Container, file.Blob)
+		if s.writeRefused(w, r, err) {
+			return "", "", false
+		}
+		if err != nil {
+			s.logFor(ctx).Error("failed to inspect upload", zap.String("upload_id", session.ID), zap.Error(err))
+			writeError(w, r, http.StatusInternalServerError, "failed to inspect upload")
+			return "", "", false
+		}
+		addFindings(file, findings)
+	}
+
+	if secret, err = s.newSecret(ctx); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to generate secret")
+		return "", "", false
+	}
+	if deleteToken, err = newDeleteToken(); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to generate deletion token")
+		return "", "", false
+	}
+	file.DeleteToken = s.secrets.Hash(deleteToken)
+	if s.config.ClamdAddress != "" {
+		file.ScanStatus = scanPending
+	}
+	if err := s.create(ctx, file, secret); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to save file link")
+		return "", "", false
+	}
+	uploads.WithLabelValues(kind).Inc()
+	uploadedBytes.Add(float64(file.Size))
+	s.audit(r, auditUpload, file)
+	s.emit(eventFileUploaded, file)
+	if file.ScanStatus == scanPending {
+		saved := *file
+		s.goBackground(func() { s.scan(saved, secret) })
+	}
+	if err := s.completeUploadSession(ctx, session); err != nil {
+		s.logFor(ctx).Error("failed to complete upload session", zap.String("upload_id", session.ID), zap.Error(err))
+	}
+	return secret, deleteToken, true
+}
+
+// parse the Upload-Metadata header ("key base64value,key base64value")
+func tusMetadata(header string) map[string]string {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+		value := ""
+		if len(fields) > 1 {
+			b, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				continue
+			}
+			value = string(b)
+		}
+		meta[fields[0]] = value
+	}
+	return meta
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestResumableUpload(t *testing.T) {
+	tests := []struct {
+		name   string
+		length int
+		// sizes of the chunks sent, each from the offset the last one left
+		chunks []int
+
+		// status of each chunk and the offset after it
+		statuses []int
+		offsets  []int
+	}{
+		{
+			name:     "one chunk",
+			length:   10,
+			chunks:   []int{10},
+			statuses: []int{http.StatusNoContent},
+			offsets:  []int{10},
+		},
+		{
+			name:     "chunks of the minimum size",
+			length:   2*tusMinChunkBytes + 3,
+			chunks:   []int{tusMinChunkBytes, tusMinChunkBytes, 3},
+			statuses: []int{http.StatusNoContent, http.StatusNoContent, http.StatusNoContent},
+			offsets:  []int{tusMinChunkBytes, 2 * tusMinChunkBytes, 2*tusMinChunkBytes + 3},
+		},
+		{
+			// refused as it is not the last, and sent again in full
+			name:     "short chunk before the last",
+			length:   tusMinChunkBytes + 10,
+			chunks:   []int{10, tusMinChunkBytes + 10},
+			statuses: []int{http.StatusBadRequest, http.StatusNoContent},
+			offsets:  []int{0, tusMinChunkBytes + 10},
+		},
+		{
+			// only the maximum is read, the client resumes from there
+			name:     "chunk over the maximum",
+			length:   tusMaxChunkBytes + 1,
+			chunks:   []int{tusMaxChunkBytes + 1, 1},
+			statuses: []int{http.StatusNoContent, http.StatusNoContent},
+			offsets:  []int{tusMaxChunkBytes, tusMaxChunkBytes + 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _, _ := newTestServer(t)
+			content := bytes.Repeat([]byte("0123456789abcdef"), tt.length/16+1)[:tt.length]
+
+			r := httptest.NewRequest(http.MethodPost, tusPath, nil)
+			r.Header.Set("Tus-Resumable", tusVersion)
+			r.Header.Set("Upload-Length", strconv.Itoa(tt.length))
+			r.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("a.txt")))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("create status %d: %s", w.Code, w.Body)
+			}
+			location := w.Header().Get("Location")
+
+			offset, secret := 0, ""
+			for i, size := range tt.chunks {
+				r := httptest.NewRequest(http.MethodPatch, location, bytes.NewReader(content[offset:offset+size]))
+				r.Header.Set("Tus-Resumable", tusVersion)
+				r.Header.Set("Content-Type", "application/offset+octet-stream")
+				r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				if w.Code != tt.statuses[i] {
+					t.Fatalf("chunk %d: status %d, want %d: %s", i, w.Code, tt.statuses[i], w.Body)
+				}
+				if w.Code == http.StatusNoContent {
+					offset, _ = strconv.Atoi(w.Header().Get("Upload-Offset"))
+				}
+				if offset != tt.offsets[i] {
+					t.Fatalf("chunk %d: offset %d, want %d", i, offset, tt.offsets[i])
+				}
+				secret = w.Header().Get("Upload-Secret")
+			}
+			if secret == "" {
+				t.Fatal("no secret once the upload is complete")
+			}
+
+			r = httptest.NewRequest(http.MethodGet, "/api/DownloadTrigger?secret="+url.QueryEscape(secret), nil)
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			data, _ := ioutil.ReadAll(w.Body)
+			if w.Code != http.StatusOK || !bytes.Equal(data, content) {
+				t.Errorf("download status %d, %d bytes of the %d uploaded", w.Code, len(data), len(content))
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// how long clients turned away by a saturated instance are asked to wait
+const uploadSlotRetryAfter = 5 * time.Second
+
+var (
+	uploadsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "filer_uploads_in_flight",
+		Help: "Uploads holding a slot of MAX_CONCURRENT_UPLOADS.",
+	})
+	rejectedUploads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "filer_uploads_rejected_total",
+		Help: "Uploads answered 503 because every slot was taken.",
+	})
+)
+
+// n slots of uploads, nil when n is 0 (unlimited)
+func newUploadSlots(n int) chan struct{} {
+	if n <= 0 {
+		return nil
+	}
+	return make(chan struct{}, n)
+}
+
+// hold one of MAX_CONCURRENT_UPLOADS slots while storing an upload, so a
+// burst of uploads cannot exhaust the memory and connections of the storage
+// backend. Without a free slot the upload is answered 503 with Retry-After
+// rather than queued, leaving the backoff to the client or load balancer.
+func (s *Server) withUploadSlot(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.uploadSlots == nil || (r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch) {
+			next(w, r)
+			return
+		}
+		select {
+		case s.uploadSlots <- struct{}{}:
+		default:
+			rejectedUploads.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(uploadSlotRetryAfter.Seconds()))))
+			writeError(w, r, http.StatusServiceUnavailable, "too many uploads in progress, retry later")
+			return
+		}
+		uploadsInFlight.Inc()
+		defer func() {
+			uploadsInFlight.Dec()
+			<-s.uploadSlots
+		}()
+		next(w, r)
+	}
+}
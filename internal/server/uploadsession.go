@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"filer/internal/storage"
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+// two-phase uploads: the contents are staged in a session, and the file link
+// is only saved when the session is completed, once its blob is committed
+const uploadSessionRoute = "UploadSession"
+
+// answer with the state of session
+func writeUploadSession(w http.ResponseWriter, r *http.Request, code int, session *store.UploadSession) {
+	location := v1UploadsPath + "/" + session.ID
+	res, err := json.Marshal(uploadSession{
+		ID:            session.ID,
+		UploadURL:     location,
+		CompleteURL:   location + "/complete",
+		Size:          session.Length,
+		Offset:        session.Offset,
+		MinChunkBytes: tusMinChunkBytes,
+		MaxChunkBytes: tusMaxChunkBytes,
+		Completed:     session.CompletedAt != nil,
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	if code == http.StatusCreated {
+		w.Header().Set("Location", location)
+	}
+	w.WriteHeader(code)
+	w.Write(res)
+}
+
+// Upload sessions
+// POST opens a session for a file of the given size, its chunks are then
+// sent with PATCH to the upload URL
+func (s *Server) createUploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil || size <= 0 {
+		writeError(w, r, http.StatusBadRequest, "invalid size")
+		return
+	}
+	if limit := s.config.maxUploadBytes(uploadSessionRoute); limit > 0 && size > limit {
+		writeTooLarge(w, r, limit)
+		return
+	}
+	fileName := r.FormValue("filename")
+	if fileName == "" {
+		writeError(w, r, http.StatusBadRequest, "missing filename")
+		return
+	}
+	// the type is checked once the contents are complete
+	if err := s.checkFileType(fileName, ""); err != nil {
+		s.writeRefused(w, r, err)
+		return
+	}
+	contentType := defaultContentType
+	if mediaType, _, err := mime.ParseMediaType(r.FormValue("content_type")); err == nil {
+		contentType = mediaType
+	}
+
+	container := s.tenantContainer(s.uploader(r))
+	if _, ok := s.storageFor(container).(storage.ChunkedStorage); !ok {
+		writeError(w, r, http.StatusNotImplemented, "storage backend does not support upload sessions")
+		return
+	}
+	session, err := s.createUploadSession(r.Context(), container, fileName, contentType, size)
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to create upload session", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "failed to create upload session")
+		return
+	}
+	writeUploadSession(w, r, http.StatusCreated, session)
+}
+
+// Upload session
+// GET reports the offset to resume from, PATCH appends the request body at
+// the offset given in Upload-Offset
+func (s *Server) uploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := s.findUploadSession(r.Context(), urlParam(r, "id"))
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "upload session not found")
+		return
+	}
+	if r.Method != http.MethodPatch {
+		writeUploadSession(w, r, http.StatusOK, session)
+		return
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != defaultContentType {
+		writeError(w, r, http.StatusUnsupportedMediaType, "Content-Type must be "+defaultContentType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid Upload-Offset")
+		return
+	}
+	if session.CompletedAt != nil {
+		writeError(w, r, http.StatusConflict, "upload session is already complete")
+		return
+	}
+	if offset != session.Offset {
+		writeError(w, r, http.StatusConflict, "Upload-Offset does not match the session offset")
+		return
+	}
+	if !s.stageChunk(w, r, session, uploadSessionRoute) {
+		return
+	}
+	writeUploadSession(w, r, http.StatusOK, session)
+}
+
+// Complete an upload session
+// saves the link of the staged file with the options of an upload and
+// answers as an upload does
+func (s *Server) completeUploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := s.findUploadSession(r.Context(), urlParam(r, "id"))
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "upload session not found")
+		return
+	}
+	if session.CompletedAt != nil {
+		writeError(w, r, http.StatusConflict, "upload session is already complete")
+		return
+	}
+	if session.Offset != session.Length {
+		writeError(w, r, http.StatusConflict, "upload session is missing chunks")
+		return
+	}
+
+	file := store.File{FileName: session.FileName, Uploader: s.uploader(r), Owner: requestUser(r.Context())}
+	maxDownloads := 0
+	if v := r.FormValue("max_downloads"); v != "" {
+		if maxDownloads, err = strconv.Atoi(v); err != nil || maxDownloads <= 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid max_downloads")
+			return
+		}
+	}
+	if err := applyLimits(&file, r.FormValue("ttl"), maxDownloads); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if passphrase := r.FormValue("passphrase"); passphrase != "" {
+		hashed, err := s.secrets.HashPassphrase(passphrase)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid passphrase")
+			return
+		}
+		file.PassphraseHash = hashed
+	}
+	if name := r.FormValue("download_as"); name != "" {
+		file.FileName = name
+	}
+	file.FileName = sanitizeFileName(file.FileName)
+	if err := parseLabels(r, &file); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := parseRestrictions(r, &file, s.geoip); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	secret, deleteToken, ok := s.commitUploadSession(w, r, session, &file, "session")
+	if !ok {
+		return
+	}
+	res, err := json.Marshal(s.newUpload(r, &file, secret, deleteToken))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
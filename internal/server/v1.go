@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net/http"
+)
+
+// the versioned API, the trigger routes of the Functions host stay as
+// deprecated aliases
+// /api/v1/files/{secret} addresses a shared file, /api/v1/downloads/{token}
+// a download token and /api/v1/uploads/{id} an upload session.
+const (
+	v1Path          = "/api/v1"
+	v1FilesPath     = v1Path + "/files"
+	v1DownloadsPath = v1Path + "/downloads"
+	v1UploadsPath   = v1Path + "/uploads"
+)
+
+// hand the path parameters to handlers that read them from the query, as
+// the trigger routes take them
+func withQueryParams(names ...string) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			for _, name := range names {
+				q.Set(name, urlParam(r, name))
+			}
+			r.URL.RawQuery = q.Encode()
+			next(w, r)
+		}
+	}
+}
+
+// mark the responses of a trigger route with its successor under /api/v1
+func withDeprecation(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+v1FilesPath+`>; rel="successor-version"`)
+		next(w, r)
+	}
+}
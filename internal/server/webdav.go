@@ -0,0 +1,510 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/webdav"
+)
+
+// WebDAV folder of the files of a user or API key, so they can be browsed
+// and mounted from Finder or Explorer. Files are listed under their names,
+// multi-file shares as folders of their entries. With WEBDAV read-write,
+// PUT shares a new file, replacing one with the same name, and DELETE
+// removes one; the secret of a new file is answered in X-Filer-Secret.
+// Encrypted files are listed but cannot be read, their key is the secret.
+const (
+	webdavRoute = "WebDav"
+	webdavPath  = "/api/" + webdavRoute
+
+	webdavOff       = "off"
+	webdavReadOnly  = "read-only"
+	webdavReadWrite = "read-write"
+
+	// files listed in the folder at most
+	maxWebDAVFiles = 10000
+)
+
+// locks of WebDAV clients, which lock files before writing them
+var webdavLocks = webdav.NewMemLS()
+
+// WebDAV
+// serves the folder of the signed-in user, or of the API key sent as the
+// password of Basic auth, on /api/WebDav/.
+func (s *Server) webdavHandler(w http.ResponseWriter, r *http.Request) {
+	fs, ok := s.webdavPrincipal(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="filer"`)
+		http.Error(w, "login required", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND", "LOCK", "UNLOCK":
+	case http.MethodPut, http.MethodDelete:
+		if s.config.WebDAV != webdavReadWrite {
+			http.Error(w, "the folder is read-only", http.StatusForbidden)
+			return
+		}
+	default:
+		// folders, moves, copies and properties cannot be stored
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fs.r = r.WithContext(fs.ctx(r.Context()))
+	h := &webdav.Handler{
+		Prefix:     webdavPath,
+		FileSystem: fs,
+		LockSystem: webdavLocks,
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !os.IsNotExist(err) {
+				s.logFor(r.Context()).Info("webdav request failed", zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.Error(err))
+			}
+		},
+	}
+	h.ServeHTTP(&webdavResponseWriter{ResponseWriter: w, fs: fs}, fs.r)
+}
+
+// the folder of the user or API key r is authenticated as, bearer tokens of
+// users are checked by withUser, Basic auth passwords may be an upload API
+// key or the token of a user
+func (s *Server) webdavPrincipal(r *http.Request) (*webdavFS, bool) {
+	if sub := requestUser(r.Context()); sub != "" {
+		return &webdavFS{s: s, filter: store.FileFilter{Owner: sub}, owner: sub}, true
+	}
+	_, password, ok := r.BasicAuth()
+	if !ok || password == "" {
+		return nil, false
+	}
+	got := sha256.Sum256([]byte(password))
+	for _, key := range s.config.UploadAPIKeys {
+		want := sha256.Sum256([]byte(key))
+		if subtle.ConstantTimeCompare(want[:], got[:]) == 1 {
+			return &webdavFS{s: s, filter: store.FileFilter{Uploader: apiKeyID(key)}, keyID: apiKeyID(key)}, true
+		}
+	}
+	if s.verifier != nil {
+		if token, err := s.verifier.Verify(r.Context(), password); err == nil {
+			return &webdavFS{s: s, filter: store.FileFilter{Owner: token.Subject}, owner: token.Subject}, true
+		}
+	}
+	return nil, false
+}
+
+// adds the secret of a file shared with PUT to the answer
+type webdavResponseWriter struct {
+	http.ResponseWriter
+	fs *webdavFS
+}
+
+func (w *webdavResponseWriter) WriteHeader(code int) {
+	if w.fs.secret != "" {
+		w.Header().Set("X-Filer-Secret", w.fs.secret)
+		w.Header().Set("X-Filer-Delete-Token", w.fs.deleteToken)
+		if u := w.fs.s.shareURL(w.fs.secret); u != "" {
+			w.Header().Set("X-Filer-Url", u)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// webdav.FileSystem of the files of one principal, made for a single request
+type webdavFS struct {
+	s      *Server
+	r      *http.Request
+	filter store.FileFilter
+	// who new files are recorded for, the user or the API key id
+	owner string
+	keyID string
+	// secret and deletion token of a file shared by the request
+	secret      string
+	deleteToken string
+}
+
+// ctx with the API key of the folder, so uploads are recorded like those of the upload API
+func (fs *webdavFS) ctx(ctx context.Context) context.Context {
+	if fs.keyID != "" {
+		return context.WithValue(ctx, apiKeyIDKey{}, fs.keyID)
+	}
+	if fs.owner != "" && requestUser(ctx) == "" {
+		return context.WithValue(ctx, userKey{}, fs.owner)
+	}
+	return ctx
+}
+
+// unexpired files of the folder by name, the oldest of files sharing a name
+// keeps it and the others get " (2)", " (3)" and so on before the extension
+func (fs *webdavFS) files(ctx context.Context) (map[string]*store.File, error) {
+	const perPage = 500
+	var all []store.File
+	for page := 1; len(all) < maxWebDAVFiles; page++ {
+		files, total, err := fs.s.store.ListFiles(ctx, fs.filter, page, perPage)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, files...)
+		if len(files) < perPage || int64(len(all)) >= total {
+			break
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].CreatedAt.Before(all[j].CreatedAt) })
+
+	now := time.Now()
+	byName := map[string]*store.File{}
+	for i := range all {
+		f := &all[i]
+		if f.ExpiresAt != nil && f.ExpiresAt.Before(now) || f.Exhausted() {
+			continue
+		}
+		name := f.FileName
+		ext := path.Ext(name)
+		for n := 2; byName[name] != nil; n++ {
+			name = strings.TrimSuffix(f.FileName, ext) + " (" + strconv.Itoa(n) + ")" + ext
+		}
+		byName[name] = f
+	}
+	return byName, nil
+}
+
+// the file and, within multi-file shares, the entry at name; both are nil for the root
+func (fs *webdavFS) lookup(ctx context.Context, name string) (*store.File, *store.Entry, error) {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil, nil, nil
+	}
+	parts := strings.SplitN(name, "/", 2)
+	files, err := fs.files(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	file := files[parts[0]]
+	if file == nil {
+		return nil, nil, os.ErrNotExist
+	}
+	if len(parts) == 1 {
+		return file, nil, nil
+	}
+	if e := file.Entry(parts[1]); e != nil {
+		return file, e, nil
+	}
+	return nil, nil, os.ErrNotExist
+}
+
+func (fs *webdavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (fs *webdavFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (fs *webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	file, entry, err := fs.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return newWebDAVInfo(path.Base(path.Clean("/"+name)), file, entry), nil
+}
+
+func (fs *webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return fs.create(ctx, name)
+	}
+	file, entry, err := fs.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	info := newWebDAVInfo(path.Base(path.Clean("/"+name)), file, entry)
+	if info.IsDir() {
+		dir := &webdavDir{info: info}
+		if file == nil {
+			files, err := fs.files(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for n, f := range files {
+				dir.children = append(dir.children, newWebDAVInfo(n, f, nil))
+			}
+		} else {
+			for i := range file.Entries {
+				dir.children = append(dir.children, newWebDAVInfo(file.Entries[i].Name, file, &file.Entries[i]))
+			}
+		}
+		sort.Slice(dir.children, func(i, j int) bool { return dir.children[i].Name() < dir.children[j].Name() })
+		return dir, nil
+	}
+	// the key of encrypted files is the secret, which is only stored hashed
+	if file.Encrypted || !scanPassed(file) {
+		return nil, os.ErrPermission
+	}
+	return &webdavFile{s: fs.s, ctx: ctx, file: file, entry: entry, info: info}, nil
+}
+
+func (fs *webdavFS) RemoveAll(ctx context.Context, name string) error {
+	file, entry, err := fs.lookup(ctx, name)
+	if err != nil {
+		return err
+	}
+	// entries of multi-file shares are removed with their share only
+	if file == nil || entry != nil {
+		return os.ErrPermission
+	}
+	if err := fs.s.remove(ctx, file); err != nil {
+		return err
+	}
+	fs.s.audit(fs.r, auditDelete, file)
+	fs.s.emit(eventFileDeleted, file)
+	return nil
+}
+
+// a file of the root folder being written, it is shared once closed
+func (fs *webdavFS) create(ctx context.Context, name string) (webdav.File, error) {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" || strings.Contains(name, "/") {
+		return nil, os.ErrPermission
+	}
+	tmp, err := ioutil.TempFile("", "filer-webdav-")
+	if err != nil {
+		return nil, err
+	}
+	return &webdavUpload{fs: fs, ctx: ctx, name: name, tmp: tmp}, nil
+}
+
+// information about the root folder, a file, a multi-file share or one of its entries
+type webdavInfo struct {
+	name        string
+	size        int64
+	modTime     time.Time
+	dir         bool
+	contentType string
+	sha256      string
+}
+
+func newWebDAVInfo(name string, file *store.File, entry *store.Entry) *webdavInfo {
+	switch {
+	case file == nil:
+		return &webdavInfo{name: "/", dir: true, modTime: time.Now()}
+	case entry != nil:
+		contentType := entry.ContentType
+		if contentType == "" {
+			contentType = defaultContentType
+		}
+		return &webdavInfo{name: name, size: entry.Size, modTime: file.CreatedAt, contentType: contentType, sha256: entry.SHA256}
+	case len(file.Entries) > 0:
+		return &webdavInfo{name: name, modTime: file.CreatedAt, dir: true}
+	}
+	return &webdavInfo{name: name, size: file.Size, modTime: file.CreatedAt, contentType: downloadContentType(file), sha256: file.SHA256}
+}
+
+func (i *webdavInfo) Name() string       { return i.name }
+func (i *webdavInfo) Size() int64        { return i.size }
+func (i *webdavInfo) ModTime() time.Time { return i.modTime }
+func (i *webdavInfo) IsDir() bool        { return i.dir }
+func (i *webdavInfo) Sys() interface{}   { return nil }
+
+func (i *webdavInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+// stored type of files, so their contents are not read to sniff it
+func (i *webdavInfo) ContentType(ctx context.Context) (string, error) {
+	if i.contentType == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return i.contentType, nil
+}
+
+func (i *webdavInfo) ETag(ctx context.Context) (string, error) {
+	if i.sha256 == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return strconv.Quote(i.sha256), nil
+}
+
+// the root folder or a multi-file share
+type webdavDir struct {
+	info     *webdavInfo
+	children []os.FileInfo
+	read     int
+}
+
+func (d *webdavDir) Close() error                                 { return nil }
+func (d *webdavDir) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (d *webdavDir) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
+func (d *webdavDir) Write(p []byte) (int, error)                  { return 0, os.ErrPermission }
+func (d *webdavDir) Stat() (os.FileInfo, error)                   { return d.info, nil }
+
+func (d *webdavDir) Readdir(count int) ([]os.FileInfo, error) {
+	rest := d.children[d.read:]
+	if count <= 0 {
+		d.read = len(d.children)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.read += count
+	return rest[:count], nil
+}
+
+// contents of a stored file, the blob is opened at the offset of the first
+// read after every seek, so ranged requests only fetch what they need
+type webdavFile struct {
+	s      *Server
+	ctx    context.Context
+	file   *store.File
+	entry  *store.Entry
+	info   *webdavInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *webdavFile) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+func (f *webdavFile) Write(p []byte) (int, error)              { return 0, os.ErrPermission }
+func (f *webdavFile) Stat() (os.FileInfo, error)               { return f.info, nil }
+
+func (f *webdavFile) Read(p []byte) (int, error) {
+	if f.body == nil {
+		if f.offset >= f.info.size {
+			return 0, io.EOF
+		}
+		body, err := f.open()
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	downloadedBytes.Add(float64(n))
+	return n, err
+}
+
+func (f *webdavFile) open() (io.ReadCloser, error) {
+	container := f.file.Container
+	blobName, compressed := f.file.BlobName(), f.file.Compressed
+	if f.entry != nil {
+		blobName, compressed = f.entry.BlobName(), f.entry.Compressed
+	}
+	if !compressed {
+		return f.s.downloadRange(f.ctx, container, blobName, byteRange{f.offset, f.info.size - f.offset})
+	}
+	// compressed blobs are read from the start and the skipped part discarded
+	blob, err := f.s.download(f.ctx, container, blobName)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := newDecompressReader(blob)
+	if err == nil {
+		_, err = io.CopyN(ioutil.Discard, gz, f.offset)
+	}
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, blob}, nil
+}
+
+func (f *webdavFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *webdavFile) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	return f.body.Close()
+}
+
+// a file written with PUT, spooled to a temporary file and shared on Close
+type webdavUpload struct {
+	fs   *webdavFS
+	ctx  context.Context
+	name string
+	tmp  *os.File
+	size int64
+}
+
+func (u *webdavUpload) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (u *webdavUpload) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
+func (u *webdavUpload) Readdir(count int) ([]os.FileInfo, error)     { return nil, os.ErrInvalid }
+
+func (u *webdavUpload) Write(p []byte) (int, error) {
+	n, err := u.tmp.Write(p)
+	u.size += int64(n)
+	return n, err
+}
+
+func (u *webdavUpload) Stat() (os.FileInfo, error) {
+	return &webdavInfo{name: u.name, size: u.size, modTime: time.Now()}, nil
+}
+
+// share the written file, replacing the file shown under the same name
+func (u *webdavUpload) Close() error {
+	defer func() {
+		u.tmp.Close()
+		os.Remove(u.tmp.Name())
+	}()
+	if _, err := u.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fs, s, r := u.fs, u.fs.s, u.fs.r
+	previous, _, err := fs.lookup(u.ctx, u.name)
+	if err != nil && err != os.ErrNotExist {
+		return err
+	}
+
+	file := store.File{Uploader: s.uploader(r), Owner: requestUser(r.Context()), FileName: sanitizeFileName(u.name), Size: u.size}
+	file.Container = s.tenantContainer(file.Uploader)
+	secret, deleteToken, err := s.shareSpooled(r, &file, u.tmp, "", "webdav")
+	if err != nil {
+		return err
+	}
+	fs.secret, fs.deleteToken = secret, deleteToken
+
+	if previous != nil && len(previous.Entries) == 0 {
+		if err := s.remove(u.ctx, previous); err != nil {
+			s.logFor(u.ctx).Error("failed to remove replaced file", zap.String("file_id", previous.ID.Hex()), zap.Error(err))
+			return nil
+		}
+		s.audit(r, auditDelete, previous)
+		s.emit(eventFileDeleted, previous)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"filer/internal/secret"
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+// event types sent to webhooks and the event sink
+const (
+	eventFileUploaded   = "file.uploaded"
+	eventFileDownloaded = "file.downloaded"
+	eventFileDeleted    = "file.deleted"
+	eventFileExpired    = "file.expired"
+)
+
+const (
+	webhookTimeout  = 10 * time.Second
+	webhookAttempts = 3
+	webhookBackoff  = 2 * time.Second
+)
+
+// webhookEvent is the JSON body posted to webhooks
+type webhookEvent struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	FileID    string          `json:"file_id"`
+	Timestamp time.Time       `json:"timestamp"`
+	Metadata  webhookMetadata `json:"metadata"`
+}
+
+// metadata of the file an event is about, secrets are never sent
+type webhookMetadata struct {
+	FileName     string     `json:"filename"`
+	Size         int64      `json:"size"`
+	ContentType  string     `json:"content_type,omitempty"`
+	SHA256       string     `json:"sha256,omitempty"`
+	Uploader     string     `json:"uploader,omitempty"`
+	Owner        string     `json:"owner,omitempty"`
+	Downloads    int        `json:"downloads"`
+	MaxDownloads int        `json:"max_downloads,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+}
+
+// webhooks posts events to the URLs in WEBHOOK_URLS
+// bodies are signed with HMAC-SHA256 of WEBHOOK_SECRET in X-Filer-Signature
+type webhooks struct {
+	urls   []string
+	secret []byte
+	client *http.Client
+	logger *zap.Logger
+	// deliveries in flight, waited for when draining
+	pending sync.WaitGroup
+}
+
+// webhooks from WEBHOOK_URLS (comma separated), nil when none are configured
+func newWebhooks(config *Config, logger *zap.Logger) *webhooks {
+	urls := config.WebhookURLs
+	if len(urls) == 0 {
+		return nil
+	}
+	secret := config.WebhookSecret
+	if secret == "" {
+		logger.Warn("webhook events are sent unsigned", zap.String("env", webhookSecretEnvVarName))
+	}
+	return &webhooks{
+		urls:   urls,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: webhookTimeout},
+		logger: logger,
+	}
+}
+
+// the event of eventType about file, sent to webhooks and the event sink
+func newFileEvent(eventType string, file *store.File) (webhookEvent, error) {
+	id, err := secret.Random(16)
+	if err != nil {
+		return webhookEvent{}, err
+	}
+	return webhookEvent{
+		ID:        id,
+		Type:      eventType,
+		FileID:    file.ID.Hex(),
+		Timestamp: time.Now().UTC(),
+		Metadata: webhookMetadata{
+			FileName:     file.FileName,
+			Size:         file.Size,
+			ContentType:  file.ContentType,
+			SHA256:       file.SHA256,
+			Uploader:     file.Uploader,
+			Owner:        file.Owner,
+			Downloads:    file.Downloads,
+			MaxDownloads: file.MaxDownloads,
+			ExpiresAt:    file.ExpiresAt,
+		},
+	}, nil
+}
+
+// send an event about file to the webhooks and the event sink in the
+// background, through the outbox with EVENT_OUTBOX
+func (s *Server) emit(eventType string, file *store.File) {
+	if s.webhooks == nil && s.events == nil {
+		return
+	}
+	event, err := newFileEvent(eventType, file)
+	if err != nil {
+		s.logger.Error("failed to generate event id", zap.String("event", eventType), zap.Error(err))
+		return
+	}
+	if s.config.EventOutbox && s.saveToOutbox(event) {
+		return
+	}
+	s.webhooks.send(event)
+	s.events.add(event)
+}
+
+// send event to every webhook in the background
+func (wh *webhooks) send(event webhookEvent) {
+	if wh == nil {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		wh.logger.Error("webhook: failed to encode event", zap.String("event", event.Type), zap.Error(err))
+		return
+	}
+	for _, url := range wh.urls {
+		wh.pending.Add(1)
+		go func(url string) {
+			defer wh.pending.Done()
+			wh.deliver(url, event, body)
+		}(url)
+	}
+}
+
+// wait for deliveries in flight
+func (wh *webhooks) wait() {
+	if wh == nil {
+		return
+	}
+	wh.pending.Wait()
+}
+
+// post an event, retrying failed deliveries with a growing backoff
+func (wh *webhooks) deliver(url string, event webhookEvent, body []byte) {
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err := wh.post(url, event, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			wh.logger.Error("webhook: giving up on delivery", zap.String("event", event.Type), zap.String("event_id", event.ID), zap.String("url", url), zap.Error(err))
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (wh *webhooks) post(url string, event webhookEvent, body []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Filer-Event", event.Type)
+	req.Header.Set("X-Filer-Delivery", event.ID)
+	if len(wh.secret) > 0 {
+		req.Header.Set("X-Filer-Signature", "sha256="+signWebhook(wh.secret, body))
+	}
+	res, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+// hex HMAC-SHA256 of a webhook body, receivers recompute it to authenticate events
+func signWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
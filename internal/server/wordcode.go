@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+)
+
+// Word codes such as "paper-tiger-42" can be read out over the phone.
+// They carry about 21 bits, far less than a secret, and rely on the lockout
+// of failed guesses; they are offered in addition to the secret, never instead.
+var (
+	codeAdjectives = []string{
+		"able", "acid", "aged", "airy", "alert", "alive", "amber", "ample", "angry", "arctic",
+		"awake", "azure", "bald", "balmy", "basic", "black", "blank", "bland", "blond", "blue",
+		"bold", "brave", "brief", "bright", "brisk", "broad", "brown", "bumpy", "busy", "calm",
+		"candid", "chief", "civil", "clean", "clear", "clever", "close", "cloudy", "coarse",
+		"cold", "cool", "coral", "cosmic", "cozy", "crisp", "cubic", "curly", "cute", "daily",
+		"damp", "dark", "dear", "deep", "dense", "dizzy", "dry", "dual", "dusty", "eager",
+		"early", "easy", "elder", "empty", "equal", "even", "exact", "faint", "fair", "fancy",
+		"fast", "fierce", "final", "fine", "firm", "first", "fit", "flat", "fluffy", "fond",
+		"frank", "free", "fresh", "full", "funny", "fuzzy", "gentle", "giant", "glad", "gold",
+		"good", "grand", "gray", "great", "green", "happy", "hardy", "hasty", "heavy", "hidden",
+		"high", "hollow", "honest", "huge", "humble", "icy", "ideal", "idle", "inner", "iron",
+		"jolly", "juicy", "keen", "kind",
+	}
+	codeNouns = []string{
+		"acorn", "actor", "anchor", "angle", "ant", "apple", "arrow", "atlas", "autumn",
+		"badge", "bagel", "ball", "bamboo", "banjo", "barn", "basket", "beach", "beacon",
+		"bean", "bear", "beaver", "bell", "berry", "bird", "bison", "blade", "blanket", "bloom",
+		"boat", "bolt", "bone", "book", "boot", "bottle", "boulder", "bowl", "box", "branch",
+		"bread", "brick", "bridge", "brook", "broom", "bubble", "bucket", "bugle", "bunny",
+		"butter", "button", "cabin", "cactus", "cake", "camel", "camera", "candle", "canoe",
+		"canyon", "cape", "carpet", "carrot", "castle", "cat", "cave", "cedar", "chair",
+		"chalk", "cherry", "chess", "cider", "circle", "citrus", "clock", "cloud", "clover",
+		"coast", "cobra", "coconut", "comet", "compass", "copper", "coral", "cotton", "cougar",
+		"crane", "crayon", "creek", "cricket", "crow", "crown", "cup", "daisy", "dart", "deer",
+		"desert", "dew", "diamond", "dingo", "dolphin", "donkey", "door", "dove", "dragon",
+		"drum", "duck", "dune", "eagle", "echo", "eel", "elbow", "elk", "ember", "engine",
+		"falcon", "feather", "fern", "ferry", "fiddle", "field", "fig", "finch", "fire", "flag",
+		"flame", "flute", "fog", "forest", "fossil", "fox", "frog", "frost", "garden", "garlic",
+		"gecko", "geyser", "ginger", "glacier", "globe", "goat", "gopher", "grape", "gravel",
+		"guitar", "gull", "hammer", "harbor", "harp", "hawk", "hazel", "heron", "hill", "honey",
+		"hornet", "horse", "island", "ivy", "jacket", "jaguar", "jam", "jar", "jelly", "jewel",
+		"kayak", "kettle", "kite", "koala", "ladder", "lagoon", "lake", "lamp", "lantern",
+		"lark", "lava", "leaf", "lemon", "lily", "lime", "lion", "llama", "lobster", "lotus",
+		"lynx", "magnet", "mango", "maple", "marble", "meadow", "melon", "meteor", "mint",
+		"mirror", "mole", "moon", "moose", "moss", "moth", "mountain", "mouse", "mule",
+		"nectar", "nest", "needle", "nutmeg", "oak", "oasis", "ocean", "olive", "onion",
+		"orange", "orbit", "orchid", "otter", "owl", "oyster", "paddle", "panda", "panther",
+		"paper", "parrot", "peach", "peanut", "pear", "pebble", "pelican", "pencil", "pepper",
+		"piano", "pigeon", "pine", "planet", "plum", "pond", "poppy", "prairie", "puffin",
+		"pumpkin", "quail", "quartz", "rabbit", "radish", "rain", "raven", "reef", "ribbon",
+		"river", "robin", "rocket", "rose", "saddle", "salmon", "sand", "saturn", "seal",
+		"shadow", "shark", "shell", "shore", "silver", "sparrow", "spider", "spruce", "squid",
+		"star", "stone", "storm", "sun", "swan", "tiger", "timber", "toast", "tomato", "tulip",
+		"turtle", "violet", "walnut", "whale", "willow", "wolf", "zebra",
+	}
+)
+
+// uniformly random integer in [0, n)
+func randomInt(n int) (int, error) {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(v.Int64()), nil
+}
+
+// create a word code "<adjective>-<noun>-<10..99>"
+func makeWordCode() (string, error) {
+	a, err := randomInt(len(codeAdjectives))
+	if err != nil {
+		return "", err
+	}
+	n, err := randomInt(len(codeNouns))
+	if err != nil {
+		return "", err
+	}
+	d, err := randomInt(90)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s-%d", codeAdjectives[a], codeNouns[n], d+10), nil
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"filer/internal/storage"
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+// zip readers issue many small reads, ranges of at least this size are fetched at once
+const zipReadAheadBytes = 1 << 20
+
+var errZipEntryNotFound = errors.New("zip entry not found")
+
+// reads a stored blob at random offsets with ranged requests, so single
+// entries of a zip can be extracted without downloading the archive
+type blobReaderAt struct {
+	ctx     context.Context
+	storage storage.Storage
+	name    string
+	size    int64
+	// last fetched range
+	block    []byte
+	blockOff int64
+}
+
+func (b *blobReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off < b.size {
+		if off < b.blockOff || off >= b.blockOff+int64(len(b.block)) {
+			if err := b.fetch(off, len(p)-n); err != nil {
+				return n, err
+			}
+		}
+		c := copy(p[n:], b.block[off-b.blockOff:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b *blobReaderAt) fetch(off int64, want int) error {
+	count := int64(want)
+	if count < zipReadAheadBytes {
+		count = zipReadAheadBytes
+	}
+	if off+count > b.size {
+		count = b.size - off
+	}
+	blob, err := b.storage.GetRange(b.ctx, b.name, off, count)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	block := make([]byte, count)
+	if _, err := io.ReadFull(blob, block); err != nil {
+		return err
+	}
+	b.block, b.blockOff = block, off
+	return nil
+}
+
+// whether single entries can be extracted from the stored file
+// encrypted or compressed blobs cannot be read at random offsets
+func isZip(f *store.File) bool {
+	if f.Encrypted || f.Compressed || f.ClientEncrypted || len(f.Entries) > 0 || f.Size == 0 {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(f.ContentType)
+	return mediaType == "application/zip" || strings.EqualFold(path.Ext(f.FileName), ".zip")
+}
+
+// find the regular file stored under name in the zip of file
+// only the central directory is read
+func (s *Server) openZipEntry(ctx context.Context, file *store.File, name string) (*zip.File, error) {
+	ra := &blobReaderAt{ctx: ctx, storage: s.storageFor(file.Container), name: file.BlobName(), size: file.Size}
+	zr, err := zip.NewReader(ra, file.Size)
+	if err == zip.ErrFormat {
+		return nil, errNotArchive
+	}
+	if err != nil {
+		return nil, err
+	}
+	name = archivePath(name)
+	for _, zf := range zr.File {
+		if zf.Mode().IsRegular() && archivePath(zf.Name) == name {
+			return zf, nil
+		}
+	}
+	return nil, errZipEntryNotFound
+}
+
+// stream an entry of a stored zip, decompressed
+func (s *Server) writeZipEntry(w http.ResponseWriter, r *http.Request, file *store.File, zf *zip.File, inline bool) {
+	rc, err := zf.Open()
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to open zip entry", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+		writeError(w, r, http.StatusBadGateway, "failed to read archive")
+		return
+	}
+	defer rc.Close()
+
+	contentType, body, err := detectContentType(rc, zf.Name, "")
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to read zip entry", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+		writeError(w, r, http.StatusBadGateway, "failed to read archive")
+		return
+	}
+	disposition := attachmentDisposition(zf.Name)
+	if inline && inlineSafe(contentType) {
+		disposition = inlineDisposition(zf.Name)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.FormatUint(zf.UncompressedSize64, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	n, err := io.Copy(w, body)
+	downloadedBytes.Add(float64(n))
+	if err != nil {
+		s.logFor(r.Context()).Error("failed to stream zip entry", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+		return
+	}
+	downloads.WithLabelValues("entry").Inc()
+}
@@ -0,0 +1,510 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"go.uber.org/zap"
+)
+
+// authentication to the storage account, AZURE_AUTH_MODE
+const (
+	AzureAuthSharedKey       = "shared-key"
+	AzureAuthManagedIdentity = "managed-identity"
+	// environment, managed identity, then Azure CLI credentials
+	AzureAuthDefault = "default"
+)
+
+// AzureOptions locate the storage account and the container of the Azure backend
+type AzureOptions struct {
+	Account string
+	// AccessKey of the account, used with AzureAuthSharedKey
+	AccessKey string
+	// Endpoint of the account, for emulators such as Azurite
+	Endpoint  string
+	Container string
+	// AuthMode is one of the AzureAuth constants
+	AuthMode string
+	// ClientID of a user-assigned managed identity
+	ClientID string
+	// ServiceName is sent as telemetry application id
+	ServiceName string
+}
+
+const (
+	azureStorageScope = "https://storage.azure.com/.default"
+	azureTokenTimeout = 30 * time.Second
+	// attempts of a failed storage request, with exponential backoff
+	azureMaxRetries = 4
+	// uploads are staged in blocks of this size, up to azureUploadBuffers at a time
+	azureBlockSize     = 4 * 1024 * 1024
+	azureUploadBuffers = 16
+	// pending copies of moved blobs are polled this often
+	azureCopyPollInterval = 500 * time.Millisecond
+)
+
+// azureStorage stores blobs in an Azure storage container
+type azureStorage struct {
+	account   *azureAccount
+	container azblob.ContainerClient
+}
+
+// azureAccount is the storage account shared by the containers
+type azureAccount struct {
+	// nil with Azure AD authentication
+	sharedKey *azblob.SharedKeyCredential
+	service   azblob.ServiceClient
+	timeout   time.Duration
+	logger    *zap.Logger
+}
+
+// create azure storage client of the container of opts
+func newAzureStorage(opts Options) (*azureStorage, error) {
+	// From the Azure portal, get your storage account blob service URL endpoint.
+	serviceURL := fmt.Sprintf("https://%s.blob.core.windows.net/", opts.Azure.Account)
+	// emulators such as Azurite serve the account below a path
+	if opts.Azure.Endpoint != "" {
+		serviceURL = opts.Azure.Endpoint + "/"
+	}
+	clientOpts := &azblob.ClientOptions{
+		Retry:     policy.RetryOptions{MaxRetries: azureMaxRetries},
+		Telemetry: policy.TelemetryOptions{ApplicationID: opts.Azure.ServiceName},
+		// the request id of the caller is sent as x-ms-client-request-id so storage
+		// logs can be matched with ours, background work gets a random one
+		PerCallOptions: []policy.Policy{requestIDPolicy{opts.RequestID}, runtime.NewRequestIdPolicy()},
+	}
+
+	account := &azureAccount{timeout: opts.Timeout, logger: opts.Logger}
+	switch mode := opts.Azure.AuthMode; mode {
+	case AzureAuthSharedKey:
+		credential, err := azblob.NewSharedKeyCredential(opts.Azure.Account, opts.Azure.AccessKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credentials: %w", err)
+		}
+		account.sharedKey = credential
+		account.service, err = azblob.NewServiceClientWithSharedKey(serviceURL, credential, clientOpts)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		credential, err := newAzureCredential(mode, opts.Azure.ClientID)
+		if err != nil {
+			return nil, err
+		}
+		account.service, err = azblob.NewServiceClient(serviceURL, credential, clientOpts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return account.container(opts.Azure.Container)
+}
+
+// Container opens another container of the account, creating it if needed
+func (s *azureStorage) Container(name string) (Storage, error) {
+	return s.account.container(name)
+}
+
+// open a container, creating it when it does not exist yet
+// existing containers are left alone, the identity may not be allowed to create them
+func (a *azureAccount) container(name string) (*azureStorage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	container := a.service.NewContainerClient(name)
+	_, err := container.GetProperties(ctx, nil)
+	if storageErrorCode(err) == azblob.StorageErrorCodeContainerNotFound {
+		_, err = container.Create(ctx, nil)
+		if storageErrorCode(err) == azblob.StorageErrorCodeContainerAlreadyExists {
+			err = nil
+		}
+		if err == nil {
+			a.logger.Info("created storage container", zap.String("container", name))
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("container %s: %w", name, err)
+	}
+	return &azureStorage{account: a, container: container}, nil
+}
+
+// Azure AD credential selected by AZURE_AUTH_MODE, a first token is fetched right
+// away so a missing identity fails at startup rather than on the first request.
+// The client refreshes tokens itself.
+func newAzureCredential(mode, clientID string) (azcore.TokenCredential, error) {
+	var (
+		credential azcore.TokenCredential
+		err        error
+	)
+	switch mode {
+	case AzureAuthManagedIdentity:
+		opts := &azidentity.ManagedIdentityCredentialOptions{}
+		// user-assigned identities are selected by client id
+		if clientID != "" {
+			opts.ID = azidentity.ClientID(clientID)
+		}
+		credential, err = azidentity.NewManagedIdentityCredential(opts)
+	case AzureAuthDefault:
+		credential, err = azidentity.NewDefaultAzureCredential(nil)
+	default:
+		return nil, fmt.Errorf("unknown azure auth mode %q", mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), azureTokenTimeout)
+	defer cancel()
+	if _, err := credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{azureStorageScope}}); err != nil {
+		return nil, fmt.Errorf("failed to get a storage token: %w", err)
+	}
+	return credential, nil
+}
+
+// requestIDPolicy sends the request id of the caller as x-ms-client-request-id
+type requestIDPolicy struct {
+	requestID func(ctx context.Context) string
+}
+
+func (p requestIDPolicy) Do(req *policy.Request) (*http.Response, error) {
+	if p.requestID == nil {
+		return req.Next()
+	}
+	if id := p.requestID(req.Raw().Context()); id != "" {
+		req.Raw().Header.Set("x-ms-client-request-id", id)
+	}
+	return req.Next()
+}
+
+// headers a blob is stored with, unset ones are left out
+func azureHeaders(opts PutOptions) *azblob.BlobHTTPHeaders {
+	headers := &azblob.BlobHTTPHeaders{BlobContentMD5: opts.ContentMD5}
+	if opts.ContentType != "" {
+		headers.BlobContentType = &opts.ContentType
+	}
+	return headers
+}
+
+func (s *azureStorage) Put(ctx context.Context, name string, r io.Reader, opts PutOptions) (string, error) {
+	blob := s.container.NewBlockBlobClient(name)
+	s.account.logger.Debug("uploading blob", zap.String("blob", name))
+
+	// blobs fitting in a block are uploaded in one request
+	first := make([]byte, azureBlockSize)
+	n, err := io.ReadFull(r, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err = blob.Upload(ctx, streaming.NopCloser(bytes.NewReader(first[:n])), &azblob.UploadBlockBlobOptions{HTTPHeaders: azureHeaders(opts)})
+		if err != nil {
+			return "", err
+		}
+		return blob.URL(), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// larger ones are streamed from the reader, staging blocks as they fill up
+	ids, err := stageBlocks(ctx, blob, io.MultiReader(bytes.NewReader(first), r))
+	if err != nil {
+		return "", err
+	}
+	// the headers are set on commit, UploadStreamToBlockBlob of this SDK drops them
+	_, err = blob.CommitBlockList(ctx, ids, &azblob.CommitBlockListOptions{BlobHTTPHeaders: azureHeaders(opts)})
+	if err != nil {
+		return "", err
+	}
+	return blob.URL(), nil
+}
+
+// stage the contents of r as blocks of blob, up to azureUploadBuffers concurrently
+// returns the ids of the staged blocks in order
+func stageBlocks(ctx context.Context, blob azblob.BlockBlobClient, r io.Reader) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		stageErr error
+		ids      []string
+	)
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return stageErr
+	}
+	buffers := make(chan struct{}, azureUploadBuffers)
+	for i := 0; failed() == nil; i++ {
+		buf := make([]byte, azureBlockSize)
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			id := blockID(i)
+			ids = append(ids, id)
+			buffers <- struct{}{}
+			wg.Add(1)
+			go func(data []byte) {
+				defer wg.Done()
+				defer func() { <-buffers }()
+				if _, err := blob.StageBlock(ctx, id, streaming.NopCloser(bytes.NewReader(data)), nil); err != nil {
+					mu.Lock()
+					if stageErr == nil {
+						stageErr = err
+						cancel()
+					}
+					mu.Unlock()
+				}
+			}(buf[:n])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			cancel()
+			wg.Wait()
+			return nil, err
+		}
+	}
+	wg.Wait()
+	if err := failed(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (s *azureStorage) Get(ctx context.Context, name string) (*Blob, error) {
+	return s.GetRange(ctx, name, 0, azblob.CountToEnd)
+}
+
+func (s *azureStorage) GetRange(ctx context.Context, name string, offset, count int64) (*Blob, error) {
+	blob := s.container.NewBlobClient(name)
+	res, err := blob.Download(ctx, &azblob.DownloadBlobOptions{Offset: &offset, Count: &count})
+	if err != nil {
+		return nil, azureError(err)
+	}
+	b := &Blob{ReadCloser: res.Body(&azblob.RetryReaderOptions{MaxRetryRequests: 20})}
+	if res.ContentLength != nil {
+		b.Size = *res.ContentLength
+	}
+	if res.ContentType != nil {
+		b.ContentType = *res.ContentType
+	}
+	return b, nil
+}
+
+func (s *azureStorage) Delete(ctx context.Context, name string) error {
+	blob := s.container.NewBlobClient(name)
+	_, err := blob.Delete(ctx, &azblob.DeleteBlobOptions{DeleteSnapshots: azblob.DeleteSnapshotsOptionTypeInclude.ToPtr()})
+	return azureError(err)
+}
+
+// the service cannot rename blobs, they are copied within the container and
+// the source is deleted once the copy succeeded
+func (s *azureStorage) Move(ctx context.Context, from, to string) (string, error) {
+	src := s.container.NewBlobClient(from)
+	dst := s.container.NewBlobClient(to)
+	res, err := dst.StartCopyFromURL(ctx, src.URL(), nil)
+	if err != nil {
+		// a missing source fails the verification of the copy source
+		var serr *azblob.StorageError
+		if errors.As(err, &serr) && serr.ErrorCode == azblob.StorageErrorCodeCannotVerifyCopySource && serr.StatusCode() == http.StatusNotFound {
+			return "", ErrBlobNotFound
+		}
+		return "", azureError(err)
+	}
+	status, description := res.CopyStatus, ""
+	for status != nil && *status == azblob.CopyStatusTypePending {
+		select {
+		case <-ctx.Done():
+			if res.CopyID != nil {
+				dst.AbortCopyFromURL(context.Background(), *res.CopyID, nil)
+			}
+			return "", ctx.Err()
+		case <-time.After(azureCopyPollInterval):
+		}
+		props, err := dst.GetProperties(ctx, nil)
+		if err != nil {
+			return "", azureError(err)
+		}
+		status = props.CopyStatus
+		if props.CopyStatusDescription != nil {
+			description = *props.CopyStatusDescription
+		}
+	}
+	if status != nil && *status != azblob.CopyStatusTypeSuccess {
+		return "", fmt.Errorf("copy of blob %s %s: %s", from, *status, description)
+	}
+	if _, err := src.Delete(ctx, &azblob.DeleteBlobOptions{DeleteSnapshots: azblob.DeleteSnapshotsOptionTypeInclude.ToPtr()}); err != nil {
+		return "", azureError(err)
+	}
+	return dst.URL(), nil
+}
+
+func (s *azureStorage) Exists(ctx context.Context, name string) (bool, error) {
+	blob := s.container.NewBlobClient(name)
+	_, err := blob.GetProperties(ctx, nil)
+	if err = azureError(err); err == ErrBlobNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// uncommitted blocks of resumable uploads are not listed
+func (s *azureStorage) List(ctx context.Context, fn func(BlobInfo) error) error {
+	pager := s.container.ListBlobsFlat(nil)
+	for pager.NextPage(ctx) {
+		segment := pager.PageResponse().Segment
+		if segment == nil {
+			continue
+		}
+		for _, item := range segment.BlobItems {
+			if item.Name == nil {
+				continue
+			}
+			info := BlobInfo{Name: *item.Name}
+			if props := item.Properties; props != nil {
+				if props.ContentLength != nil {
+					info.Size = *props.ContentLength
+				}
+				if props.LastModified != nil {
+					info.Modified = props.LastModified.UTC()
+				}
+			}
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+	}
+	return pager.Err()
+}
+
+func (s *azureStorage) Ping(ctx context.Context) error {
+	_, err := s.container.GetProperties(ctx, nil)
+	return err
+}
+
+// download URLs are signed with the shared key, this SDK cannot get user
+// delegation keys so they are proxied with Azure AD authentication
+func (s *azureStorage) SignedURL(ctx context.Context, name string, expiry time.Duration, opts SignedURLOptions) (string, error) {
+	if s.account.sharedKey == nil {
+		return "", ErrSignedURLNotSupported
+	}
+	blob := s.container.NewBlobClient(name)
+	parts := azblob.NewBlobURLParts(blob.URL())
+	protocol := azblob.SASProtocolHTTPS
+	// emulators are usually reached over plain http
+	if parts.Scheme == "http" {
+		protocol = azblob.SASProtocol("https,http")
+	}
+	sas, err := azblob.BlobSASSignatureValues{
+		Protocol:           protocol,
+		ExpiryTime:         time.Now().UTC().Add(expiry),
+		ContainerName:      parts.ContainerName,
+		BlobName:           parts.BlobName,
+		Permissions:        azblob.BlobSASPermissions{Read: true}.String(),
+		ContentType:        opts.ContentType,
+		ContentDisposition: opts.ContentDisposition,
+	}.NewSASQueryParameters(s.account.sharedKey)
+	if err != nil {
+		return "", err
+	}
+	parts.SAS = sas
+	return parts.URL(), nil
+}
+
+// access tiers of the service by the names of this package
+var azureTiers = map[string]azblob.AccessTier{
+	TierHot:     azblob.AccessTierHot,
+	TierCool:    azblob.AccessTierCool,
+	TierArchive: azblob.AccessTierArchive,
+}
+
+// archived blobs are rehydrated with high priority, someone is waiting for them
+func (s *azureStorage) SetTier(ctx context.Context, name, tier string) error {
+	accessTier, ok := azureTiers[tier]
+	if !ok {
+		return fmt.Errorf("unknown access tier %q", tier)
+	}
+	blob := s.container.NewBlobClient(name)
+	_, err := blob.SetTier(ctx, accessTier, &azblob.SetTierOptions{RehydratePriority: azblob.RehydratePriorityHigh.ToPtr()})
+	return azureError(err)
+}
+
+func (s *azureStorage) Tier(ctx context.Context, name string) (string, error) {
+	blob := s.container.NewBlobClient(name)
+	props, err := blob.GetProperties(ctx, nil)
+	if err != nil {
+		return "", azureError(err)
+	}
+	if props.ArchiveStatus != nil && strings.HasPrefix(*props.ArchiveStatus, "rehydrate-pending") {
+		return TierRehydrating, nil
+	}
+	if props.AccessTier == nil {
+		return TierHot, nil
+	}
+	for tier, accessTier := range azureTiers {
+		if strings.EqualFold(*props.AccessTier, string(accessTier)) {
+			return tier, nil
+		}
+	}
+	return strings.ToLower(*props.AccessTier), nil
+}
+
+func (s *azureStorage) StageChunk(ctx context.Context, name string, index int, data []byte) error {
+	blob := s.container.NewBlockBlobClient(name)
+	_, err := blob.StageBlock(ctx, blockID(index), streaming.NopCloser(bytes.NewReader(data)), nil)
+	return err
+}
+
+func (s *azureStorage) CommitChunks(ctx context.Context, name string, count int, opts PutOptions) (string, error) {
+	blob := s.container.NewBlockBlobClient(name)
+	ids := make([]string, count)
+	for i := range ids {
+		ids[i] = blockID(i)
+	}
+	_, err := blob.CommitBlockList(ctx, ids, &azblob.CommitBlockListOptions{BlobHTTPHeaders: azureHeaders(PutOptions{ContentType: opts.ContentType})})
+	if err != nil {
+		return "", err
+	}
+	return blob.URL(), nil
+}
+
+// block ids must all have the same length within a blob
+func blockID(index int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", index)))
+}
+
+// service error code of a failed request, empty for other errors
+func storageErrorCode(err error) azblob.StorageErrorCode {
+	var serr *azblob.StorageError
+	if errors.As(err, &serr) {
+		return serr.ErrorCode
+	}
+	return ""
+}
+
+// convert "blob not found" service errors to ErrBlobNotFound
+func azureError(err error) error {
+	switch storageErrorCode(err) {
+	case azblob.StorageErrorCodeBlobNotFound:
+		return ErrBlobNotFound
+	case azblob.StorageErrorCodeBlobArchived:
+		return ErrBlobArchived
+	}
+	return err
+}
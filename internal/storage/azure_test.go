@@ -0,0 +1,303 @@
+//go:build integration
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"filer/internal/testenv"
+
+	"go.uber.org/zap"
+)
+
+// storage of a fresh container of the Azurite account at endpoint
+func newAzuriteStorage(t *testing.T, endpoint, container string) *azureStorage {
+	t.Helper()
+	s, err := newAzureStorage(Options{
+		Backend: BackendAzure,
+		Azure: AzureOptions{
+			Account:   testenv.AzuriteAccount,
+			AccessKey: testenv.AzuriteAccessKey,
+			Endpoint:  endpoint,
+			Container: container,
+			AuthMode:  AzureAuthSharedKey,
+		},
+		Timeout: 30 * time.Second,
+		Logger:  zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// contents of the blob name, failing the test when it cannot be read
+func read(t *testing.T, s Storage, name string) []byte {
+	t.Helper()
+	blob, err := s.Get(context.Background(), name)
+	if err != nil {
+		t.Fatalf("get %s: %v", name, err)
+	}
+	defer blob.Close()
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	if blob.Size != int64(len(data)) {
+		t.Errorf("size of %s %d, read %d bytes", name, blob.Size, len(data))
+	}
+	return data
+}
+
+func put(t *testing.T, s Storage, name string, data []byte) {
+	t.Helper()
+	if _, err := s.Put(context.Background(), name, bytes.NewReader(data), PutOptions{}); err != nil {
+		t.Fatalf("put %s: %v", name, err)
+	}
+}
+
+func TestAzureStorage(t *testing.T) {
+	endpoint := testenv.Azurite(t)
+	ctx := context.Background()
+
+	random := make([]byte, 2*azureBlockSize+1)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	t.Run("put and get", func(t *testing.T) {
+		s := newAzuriteStorage(t, endpoint, "put")
+		tests := []struct {
+			name string
+			data []byte
+		}{
+			{"empty", nil},
+			{"small", []byte("hello")},
+			// uploaded in one request
+			{"one block", random[:azureBlockSize]},
+			// staged in blocks and committed
+			{"several blocks", random},
+		}
+		sizes := map[string]int64{}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				url, err := s.Put(ctx, tt.name, bytes.NewReader(tt.data), PutOptions{ContentType: "application/x-test"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if url != s.container.NewBlobClient(tt.name).URL() {
+					t.Errorf("url %s", url)
+				}
+				blob, err := s.Get(ctx, tt.name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer blob.Close()
+				data, err := ioutil.ReadAll(blob)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, tt.data) {
+					t.Errorf("read %d bytes, not the %d stored", len(data), len(tt.data))
+				}
+				if blob.Size != int64(len(tt.data)) {
+					t.Errorf("size %d, want %d", blob.Size, len(tt.data))
+				}
+				// the headers are kept by both kinds of upload
+				if blob.ContentType != "application/x-test" {
+					t.Errorf("content type %q", blob.ContentType)
+				}
+				sizes[tt.name] = int64(len(tt.data))
+			})
+		}
+
+		listed := map[string]int64{}
+		err := s.List(ctx, func(info BlobInfo) error {
+			listed[info.Name] = info.Size
+			if info.Modified.IsZero() {
+				t.Errorf("%s listed without modification time", info.Name)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, size := range sizes {
+			if listed[name] != size {
+				t.Errorf("%s listed with size %d, want %d", name, listed[name], size)
+			}
+		}
+		if len(listed) != len(sizes) {
+			t.Errorf("listed %v, want %v", listed, sizes)
+		}
+	})
+
+	t.Run("get range", func(t *testing.T) {
+		s := newAzuriteStorage(t, endpoint, "range")
+		put(t, s, "a", random)
+		offset := int64(azureBlockSize - 2)
+		blob, err := s.GetRange(ctx, "a", offset, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer blob.Close()
+		data, err := ioutil.ReadAll(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, random[offset:offset+5]) || blob.Size != 5 {
+			t.Errorf("range of %d bytes %x, want %x", blob.Size, data, random[offset:offset+5])
+		}
+	})
+
+	t.Run("exists and delete", func(t *testing.T) {
+		s := newAzuriteStorage(t, endpoint, "delete")
+		put(t, s, "a", []byte("hello"))
+		if ok, err := s.Exists(ctx, "a"); err != nil || !ok {
+			t.Fatalf("exists %v, %v", ok, err)
+		}
+		if err := s.Delete(ctx, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := s.Exists(ctx, "a"); err != nil || ok {
+			t.Errorf("exists %v, %v after delete", ok, err)
+		}
+		if _, err := s.Get(ctx, "a"); err != ErrBlobNotFound {
+			t.Errorf("get of a deleted blob: %v", err)
+		}
+		if err := s.Delete(ctx, "a"); err != ErrBlobNotFound {
+			t.Errorf("delete of a deleted blob: %v", err)
+		}
+	})
+
+	t.Run("move", func(t *testing.T) {
+		s := newAzuriteStorage(t, endpoint, "move")
+		tests := []struct {
+			name string
+			data []byte
+			// contents stored under the destination beforehand
+			replaced []byte
+		}{
+			{name: "small", data: []byte("hello")},
+			{name: "several blocks", data: random},
+			{name: "replace", data: []byte("new"), replaced: []byte("old")},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				from, to := "staging/"+tt.name, "moved/"+tt.name
+				put(t, s, from, tt.data)
+				if tt.replaced != nil {
+					put(t, s, to, tt.replaced)
+				}
+				url, err := s.Move(ctx, from, to)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if url != s.container.NewBlobClient(to).URL() {
+					t.Errorf("url %s", url)
+				}
+				if data := read(t, s, to); !bytes.Equal(data, tt.data) {
+					t.Errorf("moved %d bytes, not the %d stored", len(data), len(tt.data))
+				}
+				if ok, err := s.Exists(ctx, from); err != nil || ok {
+					t.Errorf("source exists %v, %v after the move", ok, err)
+				}
+			})
+		}
+
+		t.Run("missing source", func(t *testing.T) {
+			if _, err := s.Move(ctx, "missing", "moved/missing"); err != ErrBlobNotFound {
+				t.Errorf("move of a missing blob: %v", err)
+			}
+		})
+	})
+
+	t.Run("chunks", func(t *testing.T) {
+		s := newAzuriteStorage(t, endpoint, "chunks")
+		chunks := [][]byte{[]byte("first "), []byte("second "), []byte("third")}
+		// resumable uploads may stage chunks in any order
+		for _, i := range []int{2, 0, 1} {
+			if err := s.StageChunk(ctx, "a", i, chunks[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if ok, err := s.Exists(ctx, "a"); err != nil || ok {
+			t.Errorf("exists %v, %v before the commit", ok, err)
+		}
+		if _, err := s.CommitChunks(ctx, "a", len(chunks), PutOptions{ContentType: "text/plain"}); err != nil {
+			t.Fatal(err)
+		}
+		if data := read(t, s, "a"); string(data) != "first second third" {
+			t.Errorf("committed %q", data)
+		}
+	})
+
+	t.Run("signed url", func(t *testing.T) {
+		s := newAzuriteStorage(t, endpoint, "signed")
+		put(t, s, "a", []byte("hello"))
+		url, err := s.SignedURL(ctx, "a", time.Minute, SignedURLOptions{
+			ContentType:        "text/plain",
+			ContentDisposition: `attachment; filename="a.txt"`,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK || string(data) != "hello" {
+			t.Fatalf("status %d: %s", res.StatusCode, data)
+		}
+		if got := res.Header.Get("Content-Disposition"); got != `attachment; filename="a.txt"` {
+			t.Errorf("content disposition %q", got)
+		}
+
+		// the signature only grants reading
+		r, err := http.NewRequest(http.MethodDelete, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err = http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("delete with a signed url: status %d", res.StatusCode)
+		}
+	})
+
+	t.Run("containers", func(t *testing.T) {
+		s := newAzuriteStorage(t, endpoint, "tenants")
+		put(t, s, "a", []byte("shared"))
+		other, err := s.Container("tenant")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// reopening an existing container leaves its blobs alone
+		put(t, other, "a", []byte("tenant"))
+		other, err = s.Container("tenant")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := read(t, other, "a"); string(data) != "tenant" {
+			t.Errorf("tenant blob %q", data)
+		}
+		if data := read(t, s, "a"); string(data) != "shared" {
+			t.Errorf("shared blob %q", data)
+		}
+		if err := other.Ping(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+}
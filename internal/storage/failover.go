@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// reads go to the secondary backend first for this long after the primary
+// one failed, rather than waiting for it to time out on every call
+const failoverCooldown = 30 * time.Second
+
+// FailoverHook is told about the calls a backend of a failover pair failed
+// while the other one was tried, secondary tells which backend it was.
+type FailoverHook func(operation string, secondary bool, err error)
+
+// failoverStorage reads from a secondary backend holding replicas of the
+// blobs while the primary one is unreachable. Writes only go to the primary
+// backend, copying blobs to the secondary one is left to the caller, and
+// deletions go to both so that replicas do not outlive their blobs.
+// Signed URLs and listings are those of the primary backend.
+type failoverStorage struct {
+	Storage
+	secondary Storage
+	hook      FailoverHook
+
+	mu sync.Mutex
+	// reads try the secondary backend first until then
+	primaryDownUntil time.Time
+}
+
+// WithFailover reads from secondary when primary fails, keeping resumable
+// upload support of primary visible. hook may be nil.
+func WithFailover(primary, secondary Storage, hook FailoverHook) Storage {
+	if hook == nil {
+		hook = func(string, bool, error) {}
+	}
+	s := &failoverStorage{Storage: primary, secondary: secondary, hook: hook}
+	if chunked, ok := primary.(ChunkedStorage); ok {
+		return failoverChunkedStorage{s, chunked}
+	}
+	return s
+}
+
+func (s *failoverStorage) primaryDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().Before(s.primaryDownUntil)
+}
+
+func (s *failoverStorage) setPrimaryDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if down {
+		s.primaryDownUntil = time.Now().Add(failoverCooldown)
+	} else {
+		s.primaryDownUntil = time.Time{}
+	}
+}
+
+// run a read on the primary backend and on the secondary one when it fails
+// A missing or archived blob is an answer of the primary backend, but not
+// of the secondary one: the blob may not be copied yet. Cancelled calls are
+// not failures of either.
+func (s *failoverStorage) read(ctx context.Context, operation string, fn func(Storage) error) error {
+	if s.primaryDown() {
+		err := fn(s.secondary)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if err != ErrBlobNotFound {
+			s.hook(operation, true, err)
+		}
+		if err = fn(s.Storage); err == nil {
+			s.setPrimaryDown(false)
+		}
+		return err
+	}
+
+	err := fn(s.Storage)
+	if err == nil || err == ErrBlobNotFound || err == ErrBlobArchived || ctx.Err() != nil {
+		return err
+	}
+	s.setPrimaryDown(true)
+	s.hook(operation, false, err)
+	if fn(s.secondary) == nil {
+		return nil
+	}
+	return err
+}
+
+func (s *failoverStorage) Get(ctx context.Context, name string) (*Blob, error) {
+	var blob *Blob
+	err := s.read(ctx, "get", func(backend Storage) (err error) {
+		blob, err = backend.Get(ctx, name)
+		return err
+	})
+	return blob, err
+}
+
+func (s *failoverStorage) GetRange(ctx context.Context, name string, offset, count int64) (*Blob, error) {
+	var blob *Blob
+	err := s.read(ctx, "get_range", func(backend Storage) (err error) {
+		blob, err = backend.GetRange(ctx, name, offset, count)
+		return err
+	})
+	return blob, err
+}
+
+func (s *failoverStorage) Exists(ctx context.Context, name string) (bool, error) {
+	err := s.read(ctx, "exists", func(backend Storage) error {
+		exists, err := backend.Exists(ctx, name)
+		if err == nil && !exists {
+			return ErrBlobNotFound
+		}
+		return err
+	})
+	if err == ErrBlobNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// the replica is deleted even when the blob could not be, a failure to
+// delete it only leaves a stray copy behind
+func (s *failoverStorage) Delete(ctx context.Context, name string) error {
+	err := s.Storage.Delete(ctx, name)
+	if rerr := s.secondary.Delete(ctx, name); rerr != nil && rerr != ErrBlobNotFound && ctx.Err() == nil {
+		s.hook("delete", true, rerr)
+	}
+	return err
+}
+
+// failoverChunkedStorage also stages resumable uploads in the primary backend
+type failoverChunkedStorage struct {
+	*failoverStorage
+	chunked ChunkedStorage
+}
+
+func (s failoverChunkedStorage) StageChunk(ctx context.Context, name string, index int, data []byte) error {
+	return s.chunked.StageChunk(ctx, name, index, data)
+}
+
+func (s failoverChunkedStorage) CommitChunks(ctx context.Context, name string, count int, opts PutOptions) (string, error) {
+	return s.chunked.CommitChunks(ctx, name, count, opts)
+}
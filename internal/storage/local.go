@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrInvalidBlobName is returned by the local backend for names outside of its directory.
+var ErrInvalidBlobName = errors.New("invalid blob name")
+
+// localStorage stores blobs as files under a directory on local disk
+type localStorage struct {
+	root string
+}
+
+// create local storage rooted at dir
+func newLocalStorage(dir string) (*localStorage, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &localStorage{root: root}, nil
+}
+
+// resolve blob name to a path inside the root directory
+func (s *localStorage) path(name string) (string, error) {
+	if name == "" || strings.ContainsRune(name, 0) {
+		return "", ErrInvalidBlobName
+	}
+	// blob names always use "/" as separator, whatever the OS
+	clean := filepath.Clean(filepath.FromSlash("/" + name))
+	p := filepath.Join(s.root, clean)
+	if p == s.root || !strings.HasPrefix(p, s.root+string(filepath.Separator)) {
+		return "", ErrInvalidBlobName
+	}
+	return p, nil
+}
+
+// local blobs carry no properties, opts are ignored
+func (s *localStorage) Put(ctx context.Context, name string, r io.Reader, opts PutOptions) (string, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return "", err
+	}
+
+	// write to a temp file first so readers never see a partial blob
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return "", err
+	}
+
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(p)}
+	return u.String(), nil
+}
+
+func (s *localStorage) Get(ctx context.Context, name string) (*Blob, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Blob{ReadCloser: f, Size: info.Size()}, nil
+}
+
+func (s *localStorage) GetRange(ctx context.Context, name string, offset, count int64) (*Blob, error) {
+	blob, err := s.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	f := blob.ReadCloser.(*os.File)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if rest := blob.Size - offset; count > rest {
+		count = rest
+	}
+	return &Blob{
+		ReadCloser: struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(f, count), f},
+		Size: count,
+	}, nil
+}
+
+func (s *localStorage) Delete(ctx context.Context, name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+func (s *localStorage) Move(ctx context.Context, from, to string) (string, error) {
+	src, err := s.path(from)
+	if err != nil {
+		return "", err
+	}
+	dst, err := s.path(to)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return "", err
+	}
+	err = os.Rename(src, dst)
+	if os.IsNotExist(err) {
+		return "", ErrBlobNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(dst)}
+	return u.String(), nil
+}
+
+func (s *localStorage) Exists(ctx context.Context, name string) (bool, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// blobs being written are left out, staged chunks live outside the root
+func (s *localStorage) List(ctx context.Context, fn func(BlobInfo) error) error {
+	return filepath.Walk(s.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".upload-") {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		return fn(BlobInfo{Name: filepath.ToSlash(rel), Size: info.Size(), Modified: info.ModTime().UTC()})
+	})
+}
+
+func (s *localStorage) Ping(ctx context.Context) error {
+	info, err := os.Stat(s.root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.root)
+	}
+	return nil
+}
+
+func (s *localStorage) SignedURL(ctx context.Context, name string, expiry time.Duration, opts SignedURLOptions) (string, error) {
+	return "", ErrSignedURLNotSupported
+}
+
+func (s *localStorage) SetTier(ctx context.Context, name, tier string) error {
+	return ErrTiersNotSupported
+}
+
+func (s *localStorage) Tier(ctx context.Context, name string) (string, error) {
+	return "", ErrTiersNotSupported
+}
+
+// staged chunks live next to the root so they never clash with blob names
+func (s *localStorage) chunkDir(name string) (string, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(s.root, p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root+".chunks", rel), nil
+}
+
+func (s *localStorage) StageChunk(ctx context.Context, name string, index int, data []byte) error {
+	dir, err := s.chunkDir(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%08d", index)), data, 0o644)
+}
+
+func (s *localStorage) CommitChunks(ctx context.Context, name string, count int, opts PutOptions) (string, error) {
+	dir, err := s.chunkDir(name)
+	if err != nil {
+		return "", err
+	}
+
+	chunks := &chunkReader{dir: dir, count: count}
+	defer chunks.Close()
+	u, err := s.Put(ctx, name, chunks, opts)
+	if err != nil {
+		return "", err
+	}
+	os.RemoveAll(dir)
+	return u, nil
+}
+
+// reads the staged chunks of dir in order, opening them one at a time so
+// that uploads of many chunks don't run out of file descriptors
+type chunkReader struct {
+	dir   string
+	count int
+	next  int
+	f     *os.File
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.f == nil {
+			if c.next == c.count {
+				return 0, io.EOF
+			}
+			f, err := os.Open(filepath.Join(c.dir, fmt.Sprintf("%08d", c.next)))
+			if err != nil {
+				return 0, err
+			}
+			c.f = f
+			c.next++
+		}
+		n, err := c.f.Read(p)
+		if err == io.EOF {
+			c.f.Close()
+			c.f = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestLocalCommitChunks(t *testing.T) {
+	s, err := newLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// more chunks than the usual limit of 1024 open files, empty ones among them
+	var want bytes.Buffer
+	const count = 5000
+	for i := 0; i < count; i++ {
+		chunk := []byte(fmt.Sprint(i))
+		if i%100 == 0 {
+			chunk = nil
+		}
+		want.Write(chunk)
+		if err := s.StageChunk(ctx, "a", i, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.CommitChunks(ctx, "a", count, PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := s.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want.Bytes()) {
+		t.Errorf("committed %d bytes, want %d", len(data), want.Len())
+	}
+
+	if _, err := s.CommitChunks(ctx, "b", 1, PutOptions{}); err == nil {
+		t.Error("commit of chunks never staged")
+	}
+}
@@ -0,0 +1,228 @@
+// Package storage keeps the contents of the shared files in a blob backend.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrBlobNotFound is returned by a Storage when the requested blob does not exist.
+	ErrBlobNotFound = errors.New("blob not found")
+	// ErrSignedURLNotSupported is returned by backends that cannot sign URLs.
+	ErrSignedURLNotSupported = errors.New("signed urls are not supported")
+	// ErrTiersNotSupported is returned by backends without access tiers.
+	ErrTiersNotSupported = errors.New("access tiers are not supported")
+	// ErrBlobArchived is returned when reading a blob in the archive tier,
+	// which has to be rehydrated first.
+	ErrBlobArchived = errors.New("blob is archived")
+)
+
+// access tiers of blobs, from the most to the least expensive to keep
+const (
+	TierHot     = "hot"
+	TierCool    = "cool"
+	TierArchive = "archive"
+	// an archived blob on its way back to the hot tier
+	TierRehydrating = "rehydrating"
+)
+
+// backends, STORAGE_BACKEND
+const (
+	BackendAzure = "azure"
+	BackendLocal = "local"
+)
+
+// Blob is an open blob returned by Storage.Get
+type Blob struct {
+	io.ReadCloser
+	// Size is the length of the blob in bytes
+	Size int64
+	// ContentType is the MIME type the blob was stored with, if known
+	ContentType string
+}
+
+// PutOptions are the properties a blob is stored with
+type PutOptions struct {
+	ContentType string
+	// ContentMD5 is checked by backends that support it
+	ContentMD5 []byte
+}
+
+// BlobInfo describes a blob listed by Storage.List
+type BlobInfo struct {
+	Name string
+	Size int64
+	// Modified is the time the blob was last written
+	Modified time.Time
+}
+
+// SignedURLOptions override response headers of requests made with a signed URL
+type SignedURLOptions struct {
+	ContentType        string
+	ContentDisposition string
+}
+
+// Storage is a blob backend holding the uploaded file contents.
+// Handlers only talk to this interface, so new backends can be added
+// without touching them.
+type Storage interface {
+	// Put stores the data read from r under name and returns the blob URL.
+	Put(ctx context.Context, name string, r io.Reader, opts PutOptions) (string, error)
+	// Get opens the blob stored under name. The caller must close it.
+	Get(ctx context.Context, name string) (*Blob, error)
+	// GetRange opens count bytes of the blob stored under name, starting at offset.
+	// Blob.Size is the length of the range.
+	GetRange(ctx context.Context, name string, offset, count int64) (*Blob, error)
+	// Delete removes the blob stored under name.
+	Delete(ctx context.Context, name string) error
+	// Move renames the blob stored under from to to, replacing any blob
+	// stored there, and returns the URL of the moved blob.
+	Move(ctx context.Context, from, to string) (string, error)
+	// Exists reports whether a blob is stored under name.
+	Exists(ctx context.Context, name string) (bool, error)
+	// SignedURL returns a URL granting read access to the blob until expiry.
+	SignedURL(ctx context.Context, name string, expiry time.Duration, opts SignedURLOptions) (string, error)
+	// SetTier moves the blob to an access tier. Moving an archived blob
+	// rehydrates it, which takes hours.
+	SetTier(ctx context.Context, name, tier string) error
+	// Tier returns the access tier of the blob, TierRehydrating while it
+	// leaves the archive tier.
+	Tier(ctx context.Context, name string) (string, error)
+	// List calls fn with every blob, in no particular order, and stops at
+	// the first error fn returns.
+	List(ctx context.Context, fn func(BlobInfo) error) error
+	// Ping checks that the backend is reachable and the container exists.
+	Ping(ctx context.Context) error
+}
+
+// ContainerStorage is implemented by backends that can keep the blobs of a
+// tenant apart in a container of its own.
+type ContainerStorage interface {
+	Storage
+	// Container opens the container name of the same account, creating it if needed.
+	Container(name string) (Storage, error)
+}
+
+// Options select the backend and configure it
+type Options struct {
+	// Backend is BackendAzure or BackendLocal
+	Backend string
+	// LocalDir is the root directory of the local backend
+	LocalDir string
+	Azure    AzureOptions
+	// Timeout bounds the calls made to open containers
+	Timeout time.Duration
+	Logger  *zap.Logger
+	// RequestID returns the id of the request of ctx, empty for background work
+	RequestID func(ctx context.Context) string
+}
+
+// New creates the backend selected by opts.
+func New(opts Options) (Storage, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	switch opts.Backend {
+	case BackendAzure:
+		return newAzureStorage(opts)
+	case BackendLocal:
+		return newLocalStorage(opts.LocalDir)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", opts.Backend)
+	}
+}
+
+// ChunkedStorage is implemented by backends that can assemble a blob from
+// chunks staged over several requests, used by resumable uploads.
+type ChunkedStorage interface {
+	Storage
+	// StageChunk stores chunk number index of the blob name.
+	StageChunk(ctx context.Context, name string, index int, data []byte) error
+	// CommitChunks assembles the first count staged chunks into the blob
+	// name and returns the blob URL.
+	CommitChunks(ctx context.Context, name string, count int, opts PutOptions) (string, error)
+}
+
+// timeoutStorage bounds the calls of a backend that do not stream file contents
+// by STORAGE_TIMEOUT. Transfers are only bound by the request, so they are
+// cancelled when the client disconnects but large files are not cut short.
+// Listings are not bound either, they take longer the more blobs there are.
+type timeoutStorage struct {
+	Storage
+	timeout time.Duration
+}
+
+// WithTimeout bounds the calls of storage other than transfers by timeout,
+// keeping resumable upload support visible.
+func WithTimeout(storage Storage, timeout time.Duration) Storage {
+	s := timeoutStorage{storage, timeout}
+	if chunked, ok := storage.(ChunkedStorage); ok {
+		return timeoutChunkedStorage{s, chunked}
+	}
+	return s
+}
+
+func (s timeoutStorage) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, s.timeout)
+}
+
+func (s timeoutStorage) Delete(ctx context.Context, name string) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+	return s.Storage.Delete(ctx, name)
+}
+
+func (s timeoutStorage) Exists(ctx context.Context, name string) (bool, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+	return s.Storage.Exists(ctx, name)
+}
+
+func (s timeoutStorage) SignedURL(ctx context.Context, name string, expiry time.Duration, opts SignedURLOptions) (string, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+	return s.Storage.SignedURL(ctx, name, expiry, opts)
+}
+
+func (s timeoutStorage) SetTier(ctx context.Context, name, tier string) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+	return s.Storage.SetTier(ctx, name, tier)
+}
+
+func (s timeoutStorage) Tier(ctx context.Context, name string) (string, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+	return s.Storage.Tier(ctx, name)
+}
+
+func (s timeoutStorage) Ping(ctx context.Context) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+	return s.Storage.Ping(ctx)
+}
+
+// timeoutChunkedStorage also bounds resumable upload operations, a chunk is
+// already buffered when it is staged
+type timeoutChunkedStorage struct {
+	timeoutStorage
+	chunked ChunkedStorage
+}
+
+func (s timeoutChunkedStorage) StageChunk(ctx context.Context, name string, index int, data []byte) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+	return s.chunked.StageChunk(ctx, name, index, data)
+}
+
+func (s timeoutChunkedStorage) CommitChunks(ctx context.Context, name string, count int, opts PutOptions) (string, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+	return s.chunked.CommitChunks(ctx, name, count, opts)
+}
@@ -0,0 +1,246 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"filer/internal/secret"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+const (
+	// cache calls slower than this fall through to the metadata store
+	cacheTimeout   = 500 * time.Millisecond
+	cacheKeyPrefix = "filer:"
+)
+
+var cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "filer_cache_lookups_total",
+	Help: "Secret lookups in the Redis cache by result (hit, miss).",
+}, []string{"result"})
+
+// cachedStore answers secret lookups from Redis in front of the metadata store.
+// Secrets map to file ids and ids to the files, so a file is invalidated by its
+// id whichever secret or word code it was looked up with. Secrets still
+// mapping to the id of a file after it was given a new one are misses.
+// Downloads are always claimed in the store, a file deleted while cached is
+// shown for at most CACHE_TTL but cannot be downloaded.
+type cachedStore struct {
+	Store
+	redis   *redis.Client
+	ttl     time.Duration
+	secrets *secret.Hasher
+	log     func(ctx context.Context) *zap.Logger
+}
+
+// connect to REDIS_URL and put it in front of store
+func newCachedStore(store Store, opts Options) (*cachedStore, error) {
+	redisOpts, err := redis.ParseURL(opts.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	client := redis.NewClient(redisOpts)
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("unable to connect to redis: %w", err)
+	}
+	return &cachedStore{Store: store, redis: client, ttl: opts.CacheTTL, secrets: opts.Secrets, log: opts.Logger}, nil
+}
+
+func (c *cachedStore) secretCacheKey(secret string) string {
+	return cacheKeyPrefix + "secret:" + c.secrets.Hash(secret)
+}
+
+func fileCacheKey(id string) string {
+	return cacheKeyPrefix + "file:" + id
+}
+
+func (c *cachedStore) FindFile(ctx context.Context, secret string) (*File, error) {
+	if file := c.cached(ctx, secret); file != nil {
+		return file, nil
+	}
+	file, err := c.Store.FindFile(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	c.cache(ctx, secret, file)
+	return file, nil
+}
+
+// file cached for secret, nil on a miss
+// cache errors are logged and treated as misses
+func (c *cachedStore) cached(ctx context.Context, secret string) *File {
+	ctx, cancel := context.WithTimeout(ctx, cacheTimeout)
+	defer cancel()
+
+	var data []byte
+	id, err := c.redis.Get(ctx, c.secretCacheKey(secret)).Result()
+	if err == nil {
+		data, err = c.redis.Get(ctx, fileCacheKey(id)).Bytes()
+	}
+	var file File
+	if err == nil {
+		err = bson.Unmarshal(data, &file)
+	}
+	if err != nil {
+		if err != redis.Nil {
+			c.log(ctx).Warn("cache lookup failed", zap.Error(err))
+		}
+		cacheLookups.WithLabelValues("miss").Inc()
+		return nil
+	}
+	// the key outlives the file by less than a second at most, but an expired
+	// file must not be found
+	if file.ExpiresAt != nil && !file.ExpiresAt.After(time.Now()) || !c.sharedWith(&file, secret) {
+		cacheLookups.WithLabelValues("miss").Inc()
+		return nil
+	}
+	cacheLookups.WithLabelValues("hit").Inc()
+	return &file
+}
+
+// whether file is still shared with secret, as its secret or word code
+func (c *cachedStore) sharedWith(file *File, secret string) bool {
+	return file.SecretHash == c.secrets.Hash(secret) ||
+		file.CodeHash != "" && file.CodeHash == c.secrets.HashWordCode(secret) ||
+		file.UUID != "" && file.UUID == secret
+}
+
+// cache a file found by secret until CACHE_TTL or its expiry, whichever is first
+func (c *cachedStore) cache(ctx context.Context, secret string, file *File) {
+	ttl := c.ttl
+	if file.ExpiresAt != nil {
+		if d := time.Until(*file.ExpiresAt); d < ttl {
+			ttl = d
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+	data, err := bson.Marshal(file)
+	if err != nil {
+		c.log(ctx).Warn("failed to encode file for the cache", zap.Error(err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cacheTimeout)
+	defer cancel()
+	pipe := c.redis.TxPipeline()
+	pipe.Set(ctx, fileCacheKey(file.ID.Hex()), data, ttl)
+	pipe.Set(ctx, c.secretCacheKey(secret), file.ID.Hex(), ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		c.log(ctx).Warn("failed to cache file", zap.Error(err))
+	}
+}
+
+// drop the cached copy of a file after it changed
+func (c *cachedStore) invalidate(ctx context.Context, id primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(ctx, cacheTimeout)
+	defer cancel()
+	if err := c.redis.Del(ctx, fileCacheKey(id.Hex())).Err(); err != nil {
+		c.log(ctx).Error("failed to invalidate cached file", zap.String("file_id", id.Hex()), zap.Error(err))
+	}
+}
+
+// the download count of a cached file goes stale with every download
+func (c *cachedStore) ClaimDownload(ctx context.Context, secret string) (*File, error) {
+	file, err := c.Store.ClaimDownload(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	c.invalidate(ctx, file.ID)
+	return file, nil
+}
+
+func (c *cachedStore) DeleteFile(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	deleted, err := c.Store.DeleteFile(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	c.invalidate(ctx, id)
+	return deleted, nil
+}
+
+func (c *cachedStore) TrashFile(ctx context.Context, id primitive.ObjectID, at time.Time) (bool, error) {
+	trashed, err := c.Store.TrashFile(ctx, id, at)
+	if err != nil {
+		return false, err
+	}
+	c.invalidate(ctx, id)
+	return trashed, nil
+}
+
+func (c *cachedStore) SetExpiry(ctx context.Context, id primitive.ObjectID, expiresAt time.Time) error {
+	if err := c.Store.SetExpiry(ctx, id, expiresAt); err != nil {
+		return err
+	}
+	c.invalidate(ctx, id)
+	return nil
+}
+
+func (c *cachedStore) SetReplication(ctx context.Context, id primitive.ObjectID, status string) error {
+	if err := c.Store.SetReplication(ctx, id, status); err != nil {
+		return err
+	}
+	c.invalidate(ctx, id)
+	return nil
+}
+
+func (c *cachedStore) SetTier(ctx context.Context, id primitive.ObjectID, tier string) error {
+	if err := c.Store.SetTier(ctx, id, tier); err != nil {
+		return err
+	}
+	c.invalidate(ctx, id)
+	return nil
+}
+
+// the former secret and word code still map to the id, which is looked up
+// again once the file is dropped
+func (c *cachedStore) RotateSecret(ctx context.Context, id primitive.ObjectID, secretHash, codeHash string) (bool, error) {
+	rotated, err := c.Store.RotateSecret(ctx, id, secretHash, codeHash)
+	if err != nil {
+		return false, err
+	}
+	c.invalidate(ctx, id)
+	return rotated, nil
+}
+
+func (c *cachedStore) SetReview(ctx context.Context, id primitive.ObjectID, review string) error {
+	if err := c.Store.SetReview(ctx, id, review); err != nil {
+		return err
+	}
+	c.invalidate(ctx, id)
+	return nil
+}
+
+// the file may be cached under its word code too, so its id is looked up in the store
+func (c *cachedStore) SetScanStatus(ctx context.Context, secret, status string) error {
+	if err := c.Store.SetScanStatus(ctx, secret, status); err != nil {
+		return err
+	}
+	file, err := c.Store.FindFile(ctx, secret)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.invalidate(ctx, file.ID)
+	return nil
+}
+
+func (c *cachedStore) Close(ctx context.Context) error {
+	if err := c.redis.Close(); err != nil {
+		c.log(ctx).Error("failed to close the redis connections", zap.Error(err))
+	}
+	return c.Store.Close(ctx)
+}
@@ -0,0 +1,246 @@
+package store
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// File is the link of a shared file or multi-file share
+type File struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	LinkUrl      string             `bson:"url"`
+	UUID         string             `bson:"uuid,omitempty"`
+	SecretHash   string             `bson:"secret_hash,omitempty"`
+	FileName     string             `bson:"filename"`
+	Size         int64              `bson:"size"`
+	ContentType  string             `bson:"content_type,omitempty"`
+	CreatedAt    time.Time          `bson:"created_at"`
+	ExpiresAt    *time.Time         `bson:"expires_at,omitempty"`
+	MaxDownloads int                `bson:"max_downloads,omitempty"`
+	Downloads    int                `bson:"downloads"`
+	Encrypted    bool               `bson:"encrypted,omitempty"`
+	// client side encrypted files are stored as-is, the key stays in the URL fragment
+	ClientEncrypted bool   `bson:"client_encrypted,omitempty"`
+	ClientMetadata  string `bson:"client_metadata,omitempty"`
+	DeleteToken     string `bson:"delete_token,omitempty"`
+	// bcrypt hash of the optional download passphrase
+	PassphraseHash string `bson:"passphrase_hash,omitempty"`
+	// files of a multi-file share, empty for single files
+	Entries []Entry `bson:"entries,omitempty"`
+	// entries are relative paths of an expanded archive rather than flat names
+	Tree bool `bson:"tree,omitempty"`
+	// blob holding the contents, shared by files with the same SHA-256
+	Blob   string `bson:"blob,omitempty"`
+	SHA256 string `bson:"sha256,omitempty"`
+	// base64 MD5, as in Content-MD5
+	MD5 string `bson:"md5,omitempty"`
+	// user, API key id or address the file was uploaded from
+	Uploader string `bson:"uploader,omitempty"`
+	// hash of the optional word code, an alternative to the secret
+	CodeHash string `bson:"code_hash,omitempty"`
+	// subject of the signed-in user who uploaded the file
+	Owner string `bson:"owner,omitempty"`
+	// whether Size counts towards the quotas of Uploader
+	QuotaCharged bool `bson:"quota_charged,omitempty"`
+	// virus scan state, files are only served once clean
+	ScanStatus string `bson:"scan_status,omitempty"`
+	// tenant container of the blobs, empty for the default container
+	Container string `bson:"container,omitempty"`
+	// blob of the preview image of an image file, empty when there is none
+	Thumbnail     string `bson:"thumbnail,omitempty"`
+	ThumbnailType string `bson:"thumbnail_type,omitempty"`
+	// text snippet shared through PasteTrigger, with its optional syntax hint
+	Paste  bool   `bson:"paste,omitempty"`
+	Syntax string `bson:"syntax,omitempty"`
+	// the blob is gzip compressed, Size is that of the contents
+	Compressed bool `bson:"compressed,omitempty"`
+	// set by the uploader, tags are lower case
+	Description string            `bson:"description,omitempty"`
+	Tags        []string          `bson:"tags,omitempty"`
+	Meta        map[string]string `bson:"meta,omitempty"`
+	// set while the file is in the trash, where it can still be restored
+	DeletedAt *time.Time `bson:"deleted_at,omitempty"`
+	// expiry of a file in the trash as MongoDB keeps it, out of reach of the
+	// TTL index on expires_at, moved back to ExpiresAt when it is read
+	TrashExpiresAt *time.Time `bson:"trash_expires_at,omitempty"`
+	// copy state of the blobs in the secondary storage, empty without one
+	Replication string `bson:"replication,omitempty"`
+	// time of the last download, nil before the first one
+	AccessedAt *time.Time `bson:"accessed_at,omitempty"`
+	// access tier of the blobs, empty for the hot tier
+	Tier string `bson:"tier,omitempty"`
+	// CIDR ranges and ISO 3166-1 country codes downloads are restricted to,
+	// empty when they are not
+	AllowedNetworks  []string `bson:"allowed_networks,omitempty"`
+	AllowedCountries []string `bson:"allowed_countries,omitempty"`
+	// kinds of sensitive data content inspection found, and whether admins
+	// reviewed the file since
+	Findings []string `bson:"findings,omitempty"`
+	Review   string   `bson:"review,omitempty"`
+}
+
+// Entry is a file of a multi-file share
+type Entry struct {
+	Name        string `bson:"name" json:"name"`
+	Blob        string `bson:"blob,omitempty" json:"-"`
+	SHA256      string `bson:"sha256,omitempty" json:"sha256,omitempty"`
+	MD5         string `bson:"md5,omitempty" json:"md5,omitempty"`
+	Size        int64  `bson:"size" json:"size"`
+	ContentType string `bson:"content_type,omitempty" json:"content_type,omitempty"`
+	Compressed  bool   `bson:"compressed,omitempty" json:"-"`
+}
+
+// Exhausted reports whether the download limit of the file has been reached.
+func (f *File) Exhausted() bool {
+	return f.MaxDownloads > 0 && f.Downloads >= f.MaxDownloads
+}
+
+// BlobName is the name of the blob holding a single file, older files are stored
+// under their file name and may be overwritten by uploads with the same name.
+func (f *File) BlobName() string {
+	if f.Blob == "" {
+		return f.FileName
+	}
+	return f.Blob
+}
+
+// BlobName is the name of the blob holding a file of a multi-file share.
+func (e *Entry) BlobName() string {
+	if e.Blob == "" {
+		return e.Name
+	}
+	return e.Blob
+}
+
+// BlobNames are the names of the blobs holding the file contents.
+func (f *File) BlobNames() []string {
+	if len(f.Entries) == 0 {
+		return []string{f.BlobName()}
+	}
+	names := make([]string, len(f.Entries))
+	for i, e := range f.Entries {
+		names[i] = e.BlobName()
+	}
+	return names
+}
+
+// Entry returns the entry of a multi-file share stored under path.
+func (f *File) Entry(path string) *Entry {
+	for i := range f.Entries {
+		if f.Entries[i].Name == path {
+			return &f.Entries[i]
+		}
+	}
+	return nil
+}
+
+// UploadSession is a resumable upload in progress
+type UploadSession struct {
+	ID          string    `bson:"_id"`
+	FileName    string    `bson:"filename"`
+	ContentType string    `bson:"content_type"`
+	Length      int64     `bson:"length"`
+	Offset      int64     `bson:"offset"`
+	Chunks      int       `bson:"chunks"`
+	Container   string    `bson:"container,omitempty"`
+	Blob        string    `bson:"blob,omitempty"`
+	CreatedAt   time.Time `bson:"created_at"`
+	// set once the link is saved, whose secret is only given to the client
+	// completing the session
+	CompletedAt *time.Time `bson:"completed_at,omitempty"`
+}
+
+// BlobName is the name of the blob the chunks are staged in, sessions created
+// before blobs were named by uuid use the file name.
+func (u *UploadSession) BlobName() string {
+	if u.Blob == "" {
+		return u.FileName
+	}
+	return u.Blob
+}
+
+// Quota is the number of bytes stored by a principal, Limit overrides the default quota
+type Quota struct {
+	ID    string `bson:"_id" json:"id"`
+	Used  int64  `bson:"used" json:"used"`
+	Limit *int64 `bson:"limit,omitempty" json:"limit,omitempty"`
+}
+
+// AuditEvent is an entry of the audit log, recorded when AUDIT_LOG is set.
+// Events outlive the files they refer to, so the file name is kept too.
+type AuditEvent struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Time     time.Time          `bson:"time" json:"time"`
+	Action   string             `bson:"action" json:"action"`
+	FileID   string             `bson:"file_id,omitempty" json:"file_id,omitempty"`
+	FileName string             `bson:"filename,omitempty" json:"filename,omitempty"`
+	// user, API key id or address acting
+	Principal string `bson:"principal,omitempty" json:"principal,omitempty"`
+	Client    string `bson:"client" json:"client"`
+	UserAgent string `bson:"user_agent,omitempty" json:"user_agent,omitempty"`
+	RequestID string `bson:"request_id,omitempty" json:"request_id,omitempty"`
+	// route and status of failed attempts
+	Path   string `bson:"path,omitempty" json:"path,omitempty"`
+	Status int    `bson:"status,omitempty" json:"status,omitempty"`
+}
+
+// AuditFilter selects events listed by the admin API, zero fields match every event
+type AuditFilter struct {
+	Action    string
+	FileID    string
+	Client    string
+	Principal string
+	// bounds of the event time, inclusive
+	After  time.Time
+	Before time.Time
+}
+
+// OutboxEntry is an event waiting for delivery to one destination, kept
+// until it is delivered so that events outlive the instance emitting them.
+type OutboxEntry struct {
+	ID primitive.ObjectID `bson:"_id,omitempty"`
+	// webhook URL or event sink the event is delivered to
+	Destination string `bson:"destination"`
+	// the event as it is delivered, JSON
+	Event     []byte    `bson:"event"`
+	CreatedAt time.Time `bson:"created_at"`
+	// failed deliveries so far
+	Attempts int `bson:"attempts"`
+	// the entry is not delivered before
+	NextAttempt time.Time `bson:"next_attempt"`
+}
+
+// IdempotencyKey records an upload sent with an Idempotency-Key header, so
+// that its retries are answered like it instead of storing the file again.
+type IdempotencyKey struct {
+	// hash of the principal, the route and the key
+	ID        string    `bson:"_id"`
+	CreatedAt time.Time `bson:"created_at"`
+	// the answer of the upload, sealed with the key, empty while the upload
+	// is in progress
+	Response    string `bson:"response"`
+	ContentType string `bson:"content_type"`
+}
+
+// Collection groups files shared together under one secret, like a folder.
+// The secrets of its files are sealed with that of the collection, which is
+// only stored hashed, so the database alone does not give the files away.
+type Collection struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	SecretHash string             `bson:"secret_hash"`
+	// user who created the collection, the only one who may change it
+	Owner     string    `bson:"owner"`
+	Name      string    `bson:"name"`
+	CreatedAt time.Time `bson:"created_at"`
+	// the files in the order they were added
+	Items []CollectionItem `bson:"items"`
+}
+
+// CollectionItem is a file of a collection.
+type CollectionItem struct {
+	FileID primitive.ObjectID `bson:"file_id"`
+	// secret of the file, sealed with that of the collection
+	Secret  string    `bson:"secret"`
+	AddedAt time.Time `bson:"added_at"`
+}
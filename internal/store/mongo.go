@@ -0,0 +1,953 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"filer/internal/secret"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.uber.org/zap"
+)
+
+// mongoStore keeps the metadata in MongoDB or CosmosDB
+// the client keeps a connection pool, so it is created once at startup
+type mongoStore struct {
+	client  *mongo.Client
+	files   *mongo.Collection
+	uploads *mongo.Collection
+	blobs   *mongo.Collection
+	quotas  *mongo.Collection
+	audit   *mongo.Collection
+	outbox  *mongo.Collection
+	replays *mongo.Collection
+	folders *mongo.Collection
+	secrets *secret.Hasher
+	log     func(ctx context.Context) *zap.Logger
+
+	// whether the indexes of the files collection exist, Ping retries creating them
+	indexMu sync.Mutex
+	indexed bool
+}
+
+// expired documents left behind by the janitor are removed by MongoDB this
+// long after their expiry, giving the janitor time to delete their blobs first
+const expiredDocumentGrace = 7 * 24 * time.Hour
+
+// reference count of a shared blob
+type blobRef struct {
+	Name string `bson:"_id"`
+	URL  string `bson:"url,omitempty"`
+	Refs int    `bson:"refs"`
+}
+
+// MongoOptions locate the MongoDB or CosmosDB database
+type MongoOptions struct {
+	ConnectionString string
+	Database         string
+	// Collection of the file links, the other collections are named after it
+	Collection  string
+	MaxPoolSize uint64
+	// Monitor observes the commands, for tracing and metrics
+	Monitor *event.CommandMonitor
+}
+
+// connect to MONGODB_DATABASE, the collections are named after MONGODB_COLLECTION
+func newMongoStore(opts Options) (*mongoStore, error) {
+	c, err := connect(opts)
+	if err != nil {
+		return nil, err
+	}
+	db := c.Database(opts.Mongo.Database)
+	name := opts.Mongo.Collection
+	m := &mongoStore{
+		client: c,
+		files:  db.Collection(name),
+		// resumable upload sessions are kept next to the file links
+		uploads: db.Collection(name + "_uploads"),
+		// reference counts of deduplicated blobs
+		blobs:   db.Collection(name + "_blobs"),
+		quotas:  db.Collection(name + "_quotas"),
+		audit:   db.Collection(name + "_audit"),
+		outbox:  db.Collection(name + "_outbox"),
+		replays: db.Collection(name + "_idempotency"),
+		folders: db.Collection(name + "_collections"),
+		secrets: opts.Secrets,
+		log:     opts.Logger,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+	if err := m.ensureIndexes(ctx); err != nil {
+		// the instance reports not ready until Ping manages to create them
+		m.log(ctx).Error("failed to create the indexes", zap.Error(err))
+	}
+	return m, nil
+}
+
+// create the indexes of the files collection unless they already were
+func (m *mongoStore) ensureIndexes(ctx context.Context) error {
+	m.indexMu.Lock()
+	defer m.indexMu.Unlock()
+	if m.indexed {
+		return nil
+	}
+	if err := m.createIndexes(ctx); err != nil {
+		return fmt.Errorf("unable to create indexes: %w", err)
+	}
+	m.indexed = true
+	return nil
+}
+
+// indexes of the secret lookups, the expiry and the listings and searches
+// Creating an existing index is a no-op, one with the same keys but other
+// options fails.
+func (m *mongoStore) createIndexes(ctx context.Context) error {
+	// documents only hold some of the secret fields
+	sparseUnique := options.Index().SetSparse(true).SetUnique(true)
+	_, err := m.files.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "uuid", Value: 1}}, Options: sparseUnique},
+		{Keys: bson.D{{Key: "secret_hash", Value: 1}}, Options: sparseUnique},
+		{Keys: bson.D{{Key: "code_hash", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(expiredDocumentGrace / time.Second))},
+		{Keys: bson.D{{Key: "sha256", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "deleted_at", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "replication", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "filename", Value: 1}}},
+		{Keys: bson.D{{Key: "tags", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+	// files trashed before their expiry was moved aside
+	_, err = m.files.UpdateMany(ctx,
+		bson.D{{Key: "deleted_at", Value: bson.D{{Key: "$exists", Value: true}}}, {Key: "expires_at", Value: bson.D{{Key: "$exists", Value: true}}}},
+		bson.D{{Key: "$rename", Value: bson.D{{Key: "expires_at", Value: "trash_expires_at"}}}})
+	return err
+}
+
+// connects to MongoDB
+// every command fails after MONGODB_TIMEOUT instead of hanging on an unresponsive server
+func connect(opts Options) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	clientOptions := options.Client().ApplyURI(opts.Mongo.ConnectionString).SetDirect(true).
+		SetServerSelectionTimeout(opts.Timeout).
+		SetSocketTimeout(opts.Timeout)
+	if opts.Mongo.Monitor != nil {
+		clientOptions.SetMonitor(opts.Mongo.Monitor)
+	}
+	if opts.Mongo.MaxPoolSize > 0 {
+		clientOptions.SetMaxPoolSize(opts.Mongo.MaxPoolSize)
+	}
+	c, err := mongo.NewClient(clientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize connection: %w", err)
+	}
+
+	err = c.Connect(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize connection: %w", err)
+	}
+	err = c.Ping(ctx, nil)
+	if err != nil {
+		c.Disconnect(context.Background())
+		return nil, fmt.Errorf("unable to connect: %w", err)
+	}
+	return c, nil
+}
+
+// mongo.ErrNoDocuments as ErrNotFound
+func mongoError(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
+
+// filter matching the document of a secret or word code
+// documents written before hashing was introduced still hold it in "uuid"
+func (m *mongoStore) secretFilter(secret string) bson.D {
+	return bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "secret_hash", Value: m.secrets.Hash(secret)}},
+		bson.D{{Key: "code_hash", Value: m.secrets.HashWordCode(secret)}},
+		bson.D{{Key: "uuid", Value: secret}},
+	}}}
+}
+
+// filter matching documents that have not expired yet
+func notExpired() bson.D {
+	return bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "expires_at", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: time.Now().UTC()}}}},
+	}}}
+}
+
+// filter matching documents that are not in the trash
+func notTrashed() bson.D {
+	return bson.D{{Key: "deleted_at", Value: bson.D{{Key: "$exists", Value: false}}}}
+}
+
+// files in the trash keep their expiry in trash_expires_at, where the TTL
+// index does not delete them before TRASH_RETENTION is over
+func withTrashExpiry(files []File) []File {
+	for i := range files {
+		if f := &files[i]; f.TrashExpiresAt != nil {
+			f.ExpiresAt, f.TrashExpiresAt = f.TrashExpiresAt, nil
+		}
+	}
+	return files
+}
+
+// filter matching documents that still have downloads left
+func downloadsLeft() bson.D {
+	return bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "max_downloads", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "$expr", Value: bson.D{{Key: "$lt", Value: bson.A{"$downloads", "$max_downloads"}}}}},
+	}}}
+}
+
+func (m *mongoStore) SecretInUse(ctx context.Context, secret string) (bool, error) {
+	n, err := m.files.CountDocuments(ctx, m.secretFilter(secret), options.Count().SetLimit(1))
+	return n > 0, err
+}
+
+func (m *mongoStore) CreateFile(ctx context.Context, file *File) error {
+	r, err := m.files.InsertOne(ctx, file)
+	if err != nil {
+		return err
+	}
+	if id, ok := r.InsertedID.(primitive.ObjectID); ok {
+		file.ID = id
+	}
+	return nil
+}
+
+func (m *mongoStore) FindFile(ctx context.Context, secret string) (*File, error) {
+	filter := bson.D{{Key: "$and", Value: bson.A{m.secretFilter(secret), notExpired(), notTrashed()}}}
+	var file File
+	if err := m.files.FindOne(ctx, filter).Decode(&file); err != nil {
+		return nil, mongoError(err)
+	}
+	m.migrateFound(ctx, &file)
+	return &file, nil
+}
+
+func (m *mongoStore) FindFileByContent(ctx context.Context, uploader, sha256 string, size int64) (*File, error) {
+	content := bson.D{
+		{Key: "sha256", Value: sha256},
+		{Key: "size", Value: size},
+		{Key: "uploader", Value: uploader},
+		{Key: "client_encrypted", Value: bson.D{{Key: "$ne", Value: true}}},
+		{Key: "encrypted", Value: bson.D{{Key: "$ne", Value: true}}},
+	}
+	filter := bson.D{{Key: "$and", Value: bson.A{content, notExpired(), notTrashed()}}}
+	opts := options.FindOne().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	var file File
+	if err := m.files.FindOne(ctx, filter, opts).Decode(&file); err != nil {
+		return nil, mongoError(err)
+	}
+	return &file, nil
+}
+
+func (m *mongoStore) ClaimDownload(ctx context.Context, secret string) (*File, error) {
+	filter := bson.D{{Key: "$and", Value: bson.A{m.secretFilter(secret), notExpired(), notTrashed(), downloadsLeft()}}}
+	update := bson.D{
+		{Key: "$inc", Value: bson.D{{Key: "downloads", Value: 1}}},
+		{Key: "$set", Value: bson.D{{Key: "accessed_at", Value: time.Now().UTC()}}},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var file File
+	if err := m.files.FindOneAndUpdate(ctx, filter, update, opts).Decode(&file); err != nil {
+		return nil, mongoError(err)
+	}
+	m.migrateFound(ctx, &file)
+	return &file, nil
+}
+
+// hash the plaintext secret of a legacy document found by it, failures are
+// logged as the document is still usable
+func (m *mongoStore) migrateFound(ctx context.Context, file *File) {
+	if err := m.migrateSecret(ctx, file); err != nil {
+		m.log(ctx).Error("failed to migrate secret", zap.String("file_id", file.ID.Hex()), zap.Error(err))
+	}
+}
+
+// replace the plaintext secret of a legacy document with its hash
+func (m *mongoStore) migrateSecret(ctx context.Context, file *File) error {
+	if file.UUID == "" {
+		return nil
+	}
+
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "secret_hash", Value: m.secrets.Hash(file.UUID)}}},
+		{Key: "$unset", Value: bson.D{{Key: "uuid", Value: ""}}},
+	}
+	_, err := m.files.UpdateOne(ctx, bson.D{{Key: "_id", Value: file.ID}}, update)
+	if err != nil {
+		return err
+	}
+	file.SecretHash, file.UUID = m.secrets.Hash(file.UUID), ""
+	return nil
+}
+
+func (m *mongoStore) MigrateSecrets(ctx context.Context) (int, error) {
+	cur, err := m.files.Find(ctx, bson.D{{Key: "uuid", Value: bson.D{{Key: "$exists", Value: true}}}})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	migrated := 0
+	for cur.Next(ctx) {
+		var file File
+		if err := cur.Decode(&file); err != nil {
+			return migrated, err
+		}
+		if err := m.migrateSecret(ctx, &file); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, cur.Err()
+}
+
+func (m *mongoStore) FindFileByID(ctx context.Context, id primitive.ObjectID) (*File, error) {
+	var file File
+	if err := m.files.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&file); err != nil {
+		return nil, mongoError(err)
+	}
+	return &withTrashExpiry([]File{file})[0], nil
+}
+
+func (m *mongoStore) DeleteFile(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	r, err := m.files.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}})
+	if err != nil {
+		return false, err
+	}
+	return r.DeletedCount > 0, nil
+}
+
+func (m *mongoStore) TrashFile(ctx context.Context, id primitive.ObjectID, at time.Time) (bool, error) {
+	filter := bson.D{{Key: "_id", Value: id}, notTrashed()[0]}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "deleted_at", Value: at}}},
+		{Key: "$rename", Value: bson.D{{Key: "expires_at", Value: "trash_expires_at"}}},
+	}
+	r, err := m.files.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return r.ModifiedCount > 0, nil
+}
+
+func (m *mongoStore) RestoreFile(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	filter := bson.D{{Key: "_id", Value: id}, {Key: "deleted_at", Value: bson.D{{Key: "$exists", Value: true}}}}
+	update := bson.D{
+		{Key: "$unset", Value: bson.D{{Key: "deleted_at", Value: ""}}},
+		{Key: "$rename", Value: bson.D{{Key: "trash_expires_at", Value: "expires_at"}}},
+	}
+	r, err := m.files.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return r.ModifiedCount > 0, nil
+}
+
+func (m *mongoStore) TrashedFiles(ctx context.Context, before time.Time) ([]File, error) {
+	cur, err := m.files.Find(ctx, bson.D{{Key: "deleted_at", Value: bson.D{{Key: "$lt", Value: before}}}})
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	if err := cur.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	return withTrashExpiry(files), nil
+}
+
+// query of a file filter
+func (f FileFilter) bson() bson.D {
+	filter := bson.D{}
+	if f.Trashed {
+		filter = append(filter, bson.E{Key: "deleted_at", Value: bson.D{{Key: "$exists", Value: true}}})
+	} else {
+		filter = append(filter, notTrashed()[0])
+	}
+	created := bson.D{}
+	size := bson.D{}
+	if !f.CreatedAfter.IsZero() {
+		created = append(created, bson.E{Key: "$gte", Value: f.CreatedAfter})
+	}
+	if !f.CreatedBefore.IsZero() {
+		created = append(created, bson.E{Key: "$lte", Value: f.CreatedBefore})
+	}
+	if f.MinSize != nil {
+		size = append(size, bson.E{Key: "$gte", Value: *f.MinSize})
+	}
+	if f.MaxSize != nil {
+		size = append(size, bson.E{Key: "$lte", Value: *f.MaxSize})
+	}
+	if len(created) > 0 {
+		filter = append(filter, bson.E{Key: "created_at", Value: created})
+	}
+	if len(size) > 0 {
+		filter = append(filter, bson.E{Key: "size", Value: size})
+	}
+	if f.Uploader != "" {
+		filter = append(filter, bson.E{Key: "uploader", Value: f.Uploader})
+	}
+	if f.Owner != "" {
+		filter = append(filter, bson.E{Key: "owner", Value: f.Owner})
+	}
+	if f.Tag != "" {
+		filter = append(filter, bson.E{Key: "tags", Value: f.Tag})
+	}
+	if f.Review != "" {
+		filter = append(filter, bson.E{Key: "review", Value: f.Review})
+	}
+	if f.FileNamePrefix != "" {
+		// an anchored, case-sensitive pattern is answered from the filename index
+		filter = append(filter, bson.E{Key: "filename", Value: primitive.Regex{Pattern: "^" + regexp.QuoteMeta(f.FileNamePrefix)}})
+	}
+	return filter
+}
+
+func (m *mongoStore) ListFiles(ctx context.Context, filter FileFilter, page, perPage int) ([]File, int64, error) {
+	query := filter.bson()
+	total, err := m.files.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetSkip(int64((page - 1) * perPage)).
+		SetLimit(int64(perPage))
+	cur, err := m.files.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	files := []File{}
+	if err := cur.All(ctx, &files); err != nil {
+		return nil, 0, err
+	}
+	return withTrashExpiry(files), total, nil
+}
+
+func (m *mongoStore) AllFiles(ctx context.Context) ([]File, error) {
+	cur, err := m.files.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	if err := cur.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	return withTrashExpiry(files), nil
+}
+
+func (m *mongoStore) ExpiredFiles(ctx context.Context, now time.Time) ([]File, error) {
+	cur, err := m.files.Find(ctx, bson.D{{Key: "expires_at", Value: bson.D{{Key: "$lte", Value: now}}}, notTrashed()[0]})
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	if err := cur.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (m *mongoStore) SetExpiry(ctx context.Context, id primitive.ObjectID, expiresAt time.Time) error {
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "expires_at", Value: expiresAt}}}}
+	r, err := m.files.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}, notTrashed()[0]}, update)
+	if err != nil || r.MatchedCount > 0 {
+		return err
+	}
+	// extended in the trash, before it is restored
+	update = bson.D{{Key: "$set", Value: bson.D{{Key: "trash_expires_at", Value: expiresAt}}}}
+	_, err = m.files.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, update)
+	return err
+}
+
+// files saved before secrets were hashed lose their uuid
+func (m *mongoStore) RotateSecret(ctx context.Context, id primitive.ObjectID, secretHash, codeHash string) (bool, error) {
+	set := bson.D{{Key: "secret_hash", Value: secretHash}}
+	unset := bson.D{{Key: "uuid", Value: ""}}
+	if codeHash != "" {
+		set = append(set, bson.E{Key: "code_hash", Value: codeHash})
+	} else {
+		unset = append(unset, bson.E{Key: "code_hash", Value: ""})
+	}
+	filter := bson.D{{Key: "$and", Value: bson.A{bson.D{{Key: "_id", Value: id}}, notTrashed()}}}
+	r, err := m.files.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: set}, {Key: "$unset", Value: unset}})
+	if err != nil {
+		return false, err
+	}
+	return r.MatchedCount > 0, nil
+}
+
+func (m *mongoStore) SetReview(ctx context.Context, id primitive.ObjectID, review string) error {
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "review", Value: review}}}}
+	_, err := m.files.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, update)
+	return err
+}
+
+func (m *mongoStore) SetScanStatus(ctx context.Context, secret, status string) error {
+	filter := bson.D{{Key: "secret_hash", Value: m.secrets.Hash(secret)}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "scan_status", Value: status}}}}
+	_, err := m.files.UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (m *mongoStore) SetReplication(ctx context.Context, id primitive.ObjectID, status string) error {
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "replication", Value: status}}}}
+	_, err := m.files.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, update)
+	return err
+}
+
+func (m *mongoStore) FilesReplicating(ctx context.Context, status string) ([]File, error) {
+	cur, err := m.files.Find(ctx, bson.D{{Key: "replication", Value: status}, notTrashed()[0]})
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	if err := cur.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (m *mongoStore) SetTier(ctx context.Context, id primitive.ObjectID, tier string) error {
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "tier", Value: tier}}}}
+	if tier == "" {
+		update = bson.D{{Key: "$unset", Value: bson.D{{Key: "tier", Value: ""}}}}
+	}
+	_, err := m.files.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, update)
+	return err
+}
+
+func (m *mongoStore) UntouchedFiles(ctx context.Context, before time.Time, tiers []string) ([]File, error) {
+	// the hot tier is left out of the documents, null matches missing fields
+	in := bson.A{}
+	for _, tier := range tiers {
+		if tier == "" {
+			in = append(in, nil)
+		} else {
+			in = append(in, tier)
+		}
+	}
+	filter := bson.D{
+		notTrashed()[0],
+		{Key: "created_at", Value: bson.D{{Key: "$lt", Value: before}}},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "accessed_at", Value: bson.D{{Key: "$exists", Value: false}}}},
+			bson.D{{Key: "accessed_at", Value: bson.D{{Key: "$lt", Value: before}}}},
+		}},
+		{Key: "tier", Value: bson.D{{Key: "$in", Value: in}}},
+	}
+	cur, err := m.files.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	if err := cur.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (m *mongoStore) CreateUploadSession(ctx context.Context, session *UploadSession) error {
+	_, err := m.uploads.InsertOne(ctx, session)
+	return err
+}
+
+func (m *mongoStore) FindUploadSession(ctx context.Context, id string) (*UploadSession, error) {
+	var doc struct {
+		UploadSession `bson:",inline"`
+		// sessions completed before they were marked so hold their secret
+		Secret string `bson:"secret,omitempty"`
+	}
+	if err := m.uploads.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&doc); err != nil {
+		return nil, mongoError(err)
+	}
+	session := doc.UploadSession
+	if doc.Secret != "" && session.CompletedAt == nil {
+		session.CompletedAt = &session.CreatedAt
+	}
+	return &session, nil
+}
+
+func (m *mongoStore) AdvanceUploadSession(ctx context.Context, session *UploadSession, written int64) error {
+	filter := bson.D{
+		{Key: "_id", Value: session.ID},
+		{Key: "offset", Value: session.Offset},
+		{Key: "chunks", Value: session.Chunks},
+	}
+	update := bson.D{{Key: "$inc", Value: bson.D{
+		{Key: "offset", Value: written},
+		{Key: "chunks", Value: 1},
+	}}}
+	r, err := m.uploads.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if r.MatchedCount == 0 {
+		return ErrUploadSessionConflict
+	}
+	return nil
+}
+
+func (m *mongoStore) CompleteUploadSession(ctx context.Context, id string, at time.Time) error {
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "completed_at", Value: at}}}}
+	_, err := m.uploads.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, update)
+	return err
+}
+
+func (m *mongoStore) PruneUploadSessions(ctx context.Context, before time.Time) (int64, error) {
+	r, err := m.uploads.DeleteMany(ctx, bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "completed_at", Value: bson.D{{Key: "$lt", Value: before}}}},
+		bson.D{{Key: "secret", Value: bson.D{{Key: "$exists", Value: true}}}},
+	}}})
+	if err != nil {
+		return 0, err
+	}
+	return r.DeletedCount, nil
+}
+
+func (m *mongoStore) AcquireBlob(ctx context.Context, id string) (string, error) {
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "refs", Value: 1}}}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var ref blobRef
+	if err := m.blobs.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: id}}, update, opts).Decode(&ref); err != nil {
+		return "", err
+	}
+	return ref.URL, nil
+}
+
+func (m *mongoStore) StoredBlob(ctx context.Context, id, url string) error {
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "url", Value: url}}}}
+	_, err := m.blobs.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, update)
+	return err
+}
+
+func (m *mongoStore) ReleaseBlob(ctx context.Context, id string) (bool, error) {
+	filter := bson.D{{Key: "_id", Value: id}}
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "refs", Value: -1}}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var ref blobRef
+	err := m.blobs.FindOneAndUpdate(ctx, filter, update, opts).Decode(&ref)
+	if err == mongo.ErrNoDocuments {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if ref.Refs > 0 {
+		return false, nil
+	}
+
+	// only the request that removes the counter deletes the blob
+	r, err := m.blobs.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}, {Key: "refs", Value: bson.D{{Key: "$lte", Value: 0}}}})
+	if err != nil {
+		return false, err
+	}
+	if r.DeletedCount == 0 {
+		m.log(ctx).Warn("blob was shared again while being released", zap.String("blob", id))
+		return false, nil
+	}
+	return true, nil
+}
+
+func (m *mongoStore) ChargeQuota(ctx context.Context, id string, size, def int64) (bool, error) {
+	// make sure the document exists so the conditional update below can match it
+	_, err := m.quotas.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: id}},
+		bson.D{{Key: "$setOnInsert", Value: bson.D{{Key: "used", Value: int64(0)}}}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return false, err
+	}
+
+	limit := bson.D{{Key: "$ifNull", Value: bson.A{"$limit", def}}}
+	filter := bson.D{
+		{Key: "_id", Value: id},
+		{Key: "$expr", Value: bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "$lte", Value: bson.A{limit, 0}}},
+			bson.D{{Key: "$lte", Value: bson.A{bson.D{{Key: "$add", Value: bson.A{"$used", size}}}, limit}}},
+		}}}},
+	}
+	r, err := m.quotas.UpdateOne(ctx, filter, bson.D{{Key: "$inc", Value: bson.D{{Key: "used", Value: size}}}})
+	if err != nil {
+		return false, err
+	}
+	return r.MatchedCount > 0, nil
+}
+
+func (m *mongoStore) UnchargeQuota(ctx context.Context, id string, size int64) error {
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "used", Value: -size}}}}
+	_, err := m.quotas.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, update)
+	return err
+}
+
+func (m *mongoStore) ListQuotas(ctx context.Context) ([]Quota, error) {
+	cur, err := m.quotas.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "used", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	quotas := []Quota{}
+	if err := cur.All(ctx, &quotas); err != nil {
+		return nil, err
+	}
+	return quotas, nil
+}
+
+func (m *mongoStore) SetQuotaLimit(ctx context.Context, id string, limit *int64) error {
+	if limit == nil {
+		update := bson.D{{Key: "$unset", Value: bson.D{{Key: "limit", Value: ""}}}}
+		_, err := m.quotas.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, update)
+		return err
+	}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "limit", Value: *limit}}},
+		{Key: "$setOnInsert", Value: bson.D{{Key: "used", Value: int64(0)}}},
+	}
+	// limits may be set before the principal uploads anything
+	_, err := m.quotas.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (m *mongoStore) RecordAudit(ctx context.Context, event *AuditEvent) error {
+	r, err := m.audit.InsertOne(ctx, event)
+	if err != nil {
+		return err
+	}
+	if id, ok := r.InsertedID.(primitive.ObjectID); ok {
+		event.ID = id
+	}
+	return nil
+}
+
+func (f AuditFilter) bson() bson.D {
+	filter := bson.D{}
+	for _, field := range []struct{ key, value string }{
+		{"action", f.Action}, {"file_id", f.FileID}, {"client", f.Client}, {"principal", f.Principal},
+	} {
+		if field.value != "" {
+			filter = append(filter, bson.E{Key: field.key, Value: field.value})
+		}
+	}
+	t := bson.D{}
+	if !f.After.IsZero() {
+		t = append(t, bson.E{Key: "$gte", Value: f.After})
+	}
+	if !f.Before.IsZero() {
+		t = append(t, bson.E{Key: "$lte", Value: f.Before})
+	}
+	if len(t) > 0 {
+		filter = append(filter, bson.E{Key: "time", Value: t})
+	}
+	return filter
+}
+
+func (m *mongoStore) ListAudit(ctx context.Context, filter AuditFilter, page, perPage int) ([]AuditEvent, int64, error) {
+	query := filter.bson()
+	total, err := m.audit.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "time", Value: -1}}).
+		SetSkip(int64((page - 1) * perPage)).
+		SetLimit(int64(perPage))
+	cur, err := m.audit.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	events := []AuditEvent{}
+	if err := cur.All(ctx, &events); err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
+
+func (m *mongoStore) PruneAudit(ctx context.Context, before time.Time) (int64, error) {
+	r, err := m.audit.DeleteMany(ctx, bson.D{{Key: "time", Value: bson.D{{Key: "$lt", Value: before}}}})
+	if err != nil {
+		return 0, err
+	}
+	return r.DeletedCount, nil
+}
+
+func (m *mongoStore) AddOutbox(ctx context.Context, entries []OutboxEntry) error {
+	docs := make([]interface{}, len(entries))
+	for i := range entries {
+		entries[i].ID = primitive.NewObjectID()
+		docs[i] = entries[i]
+	}
+	_, err := m.outbox.InsertMany(ctx, docs)
+	return err
+}
+
+// entries are claimed one by one, each update only matches an entry still due
+func (m *mongoStore) ClaimOutbox(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]OutboxEntry, error) {
+	filter := bson.D{{Key: "next_attempt", Value: bson.D{{Key: "$lte", Value: now}}}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "next_attempt", Value: now.Add(lease)}}}}
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt", Value: 1}}).SetReturnDocument(options.After)
+	var claimed []OutboxEntry
+	for len(claimed) < limit {
+		var e OutboxEntry
+		err := m.outbox.FindOneAndUpdate(ctx, filter, update, opts).Decode(&e)
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, e)
+	}
+	return claimed, nil
+}
+
+func (m *mongoStore) RetryOutbox(ctx context.Context, id primitive.ObjectID, attempts int, next time.Time) error {
+	_, err := m.outbox.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, bson.D{{Key: "$set", Value: bson.D{
+		{Key: "attempts", Value: attempts},
+		{Key: "next_attempt", Value: next},
+	}}})
+	return err
+}
+
+func (m *mongoStore) DeleteOutbox(ctx context.Context, id primitive.ObjectID) error {
+	_, err := m.outbox.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}})
+	return err
+}
+
+func (m *mongoStore) CreateCollection(ctx context.Context, collection *Collection) error {
+	collection.ID = primitive.NewObjectID()
+	if collection.Items == nil {
+		// items are pushed to the array, which must not be null
+		collection.Items = []CollectionItem{}
+	}
+	_, err := m.folders.InsertOne(ctx, collection)
+	return err
+}
+
+func (m *mongoStore) FindCollection(ctx context.Context, secret string) (*Collection, error) {
+	var collection Collection
+	if err := m.folders.FindOne(ctx, bson.D{{Key: "secret_hash", Value: m.secrets.Hash(secret)}}).Decode(&collection); err != nil {
+		return nil, mongoError(err)
+	}
+	return &collection, nil
+}
+
+func (m *mongoStore) ListCollections(ctx context.Context, owner string) ([]Collection, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cur, err := m.folders.Find(ctx, bson.D{{Key: "owner", Value: owner}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	collections := []Collection{}
+	if err := cur.All(ctx, &collections); err != nil {
+		return nil, err
+	}
+	return collections, nil
+}
+
+// the update only matches a collection without the file
+func (m *mongoStore) AddToCollection(ctx context.Context, id primitive.ObjectID, item CollectionItem) (bool, error) {
+	filter := bson.D{
+		{Key: "_id", Value: id},
+		{Key: "items.file_id", Value: bson.D{{Key: "$ne", Value: item.FileID}}},
+	}
+	r, err := m.folders.UpdateOne(ctx, filter, bson.D{{Key: "$push", Value: bson.D{{Key: "items", Value: item}}}})
+	if err != nil {
+		return false, err
+	}
+	return r.ModifiedCount > 0, nil
+}
+
+func (m *mongoStore) RemoveFromCollection(ctx context.Context, id, fileID primitive.ObjectID) (bool, error) {
+	update := bson.D{{Key: "$pull", Value: bson.D{{Key: "items", Value: bson.D{{Key: "file_id", Value: fileID}}}}}}
+	r, err := m.folders.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, update)
+	if err != nil {
+		return false, err
+	}
+	return r.ModifiedCount > 0, nil
+}
+
+func (m *mongoStore) DeleteCollection(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	r, err := m.folders.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}})
+	if err != nil {
+		return false, err
+	}
+	return r.DeletedCount > 0, nil
+}
+
+// the upsert only matches a stale key, inserting the key when it exists
+// fails and the existing key is read
+func (m *mongoStore) ReserveIdempotencyKey(ctx context.Context, key *IdempotencyKey, stale time.Time) (*IdempotencyKey, error) {
+	filter := bson.D{
+		{Key: "_id", Value: key.ID},
+		{Key: "response", Value: ""},
+		{Key: "created_at", Value: bson.D{{Key: "$lt", Value: stale}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "created_at", Value: key.CreatedAt},
+		{Key: "content_type", Value: ""},
+	}}}
+	_, err := m.replays.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	var existing IdempotencyKey
+	if err := m.replays.FindOne(ctx, bson.D{{Key: "_id", Value: key.ID}}).Decode(&existing); err != nil {
+		return nil, mongoError(err)
+	}
+	return &existing, nil
+}
+
+func (m *mongoStore) CompleteIdempotencyKey(ctx context.Context, id, response, contentType string) error {
+	_, err := m.replays.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, bson.D{{Key: "$set", Value: bson.D{
+		{Key: "response", Value: response},
+		{Key: "content_type", Value: contentType},
+	}}})
+	return err
+}
+
+func (m *mongoStore) ReleaseIdempotencyKey(ctx context.Context, id string) error {
+	_, err := m.replays.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}, {Key: "response", Value: ""}})
+	return err
+}
+
+func (m *mongoStore) PruneIdempotencyKeys(ctx context.Context, before time.Time) (int64, error) {
+	r, err := m.replays.DeleteMany(ctx, bson.D{{Key: "created_at", Value: bson.D{{Key: "$lt", Value: before}}}})
+	if err != nil {
+		return 0, err
+	}
+	return r.DeletedCount, nil
+}
+
+// Ping also fails while the indexes could not be created
+func (m *mongoStore) Ping(ctx context.Context) error {
+	if err := m.client.Ping(ctx, readpref.Primary()); err != nil {
+		return err
+	}
+	return m.ensureIndexes(ctx)
+}
+
+func (m *mongoStore) Close(ctx context.Context) error {
+	return m.client.Disconnect(ctx)
+}
@@ -0,0 +1,1094 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"filer/internal/secret"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// sqlStore keeps the metadata in SQLite, for single instances, or PostgreSQL.
+// Queries are written in the dialect both understand: $n placeholders numbered
+// in order of appearance, ON CONFLICT upserts and RETURNING.
+type sqlStore struct {
+	db      *sql.DB
+	secrets *secret.Hasher
+	log     func(ctx context.Context) *zap.Logger
+}
+
+// time the tables may take to be created at startup
+const sqlSetupTimeout = 30 * time.Second
+
+// tables are created at startup when missing
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS files (
+		id TEXT PRIMARY KEY,
+		secret_hash TEXT NOT NULL DEFAULT '',
+		code_hash TEXT NOT NULL DEFAULT '',
+		url TEXT NOT NULL DEFAULT '',
+		filename TEXT NOT NULL DEFAULT '',
+		size BIGINT NOT NULL DEFAULT 0,
+		content_type TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP,
+		max_downloads INTEGER NOT NULL DEFAULT 0,
+		downloads INTEGER NOT NULL DEFAULT 0,
+		encrypted BOOLEAN NOT NULL DEFAULT FALSE,
+		client_encrypted BOOLEAN NOT NULL DEFAULT FALSE,
+		client_metadata TEXT NOT NULL DEFAULT '',
+		delete_token TEXT NOT NULL DEFAULT '',
+		passphrase_hash TEXT NOT NULL DEFAULT '',
+		entries TEXT NOT NULL DEFAULT '',
+		blob TEXT NOT NULL DEFAULT '',
+		sha256 TEXT NOT NULL DEFAULT '',
+		md5 TEXT NOT NULL DEFAULT '',
+		uploader TEXT NOT NULL DEFAULT '',
+		owner TEXT NOT NULL DEFAULT '',
+		quota_charged BOOLEAN NOT NULL DEFAULT FALSE,
+		scan_status TEXT NOT NULL DEFAULT '',
+		container TEXT NOT NULL DEFAULT '',
+		thumbnail TEXT NOT NULL DEFAULT '',
+		thumbnail_type TEXT NOT NULL DEFAULT '',
+		paste BOOLEAN NOT NULL DEFAULT FALSE,
+		syntax TEXT NOT NULL DEFAULT '',
+		tree BOOLEAN NOT NULL DEFAULT FALSE,
+		compressed BOOLEAN NOT NULL DEFAULT FALSE
+	)`,
+	`CREATE INDEX IF NOT EXISTS files_secret_hash ON files (secret_hash)`,
+	`CREATE INDEX IF NOT EXISTS files_code_hash ON files (code_hash)`,
+	`CREATE INDEX IF NOT EXISTS files_expires_at ON files (expires_at)`,
+	`CREATE INDEX IF NOT EXISTS files_created_at ON files (created_at)`,
+	`CREATE INDEX IF NOT EXISTS files_filename ON files (filename)`,
+	`CREATE INDEX IF NOT EXISTS files_sha256 ON files (sha256)`,
+	`CREATE TABLE IF NOT EXISTS upload_sessions (
+		id TEXT PRIMARY KEY,
+		filename TEXT NOT NULL DEFAULT '',
+		content_type TEXT NOT NULL DEFAULT '',
+		length BIGINT NOT NULL,
+		upload_offset BIGINT NOT NULL DEFAULT 0,
+		chunks INTEGER NOT NULL DEFAULT 0,
+		secret TEXT NOT NULL DEFAULT '',
+		container TEXT NOT NULL DEFAULT '',
+		blob TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS blob_refs (
+		id TEXT PRIMARY KEY,
+		url TEXT NOT NULL DEFAULT '',
+		refs INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS quotas (
+		id TEXT PRIMARY KEY,
+		used BIGINT NOT NULL DEFAULT 0,
+		limit_bytes BIGINT
+	)`,
+	`CREATE TABLE IF NOT EXISTS audit_events (
+		id TEXT PRIMARY KEY,
+		time TIMESTAMP NOT NULL,
+		action TEXT NOT NULL,
+		file_id TEXT NOT NULL DEFAULT '',
+		filename TEXT NOT NULL DEFAULT '',
+		principal TEXT NOT NULL DEFAULT '',
+		client TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		request_id TEXT NOT NULL DEFAULT '',
+		path TEXT NOT NULL DEFAULT '',
+		status INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_events_time ON audit_events (time)`,
+	`CREATE TABLE IF NOT EXISTS outbox (
+		id TEXT PRIMARY KEY,
+		destination TEXT NOT NULL,
+		event TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS outbox_next_attempt ON outbox (next_attempt)`,
+	`CREATE TABLE IF NOT EXISTS collections (
+		id TEXT PRIMARY KEY,
+		secret_hash TEXT NOT NULL,
+		owner TEXT NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS collections_secret_hash ON collections (secret_hash)`,
+	`CREATE INDEX IF NOT EXISTS collections_owner ON collections (owner)`,
+	`CREATE TABLE IF NOT EXISTS collection_items (
+		collection_id TEXT NOT NULL,
+		file_id TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		added_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (collection_id, file_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		response TEXT NOT NULL DEFAULT '',
+		content_type TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS idempotency_keys_created_at ON idempotency_keys (created_at)`,
+}
+
+// columns added to the tables after their first release, added to older
+// databases at startup
+var sqlAddedColumns = []struct {
+	table, column, definition string
+}{
+	{"files", "description", "TEXT NOT NULL DEFAULT ''"},
+	{"files", "tags", "TEXT NOT NULL DEFAULT ''"},
+	{"files", "meta", "TEXT NOT NULL DEFAULT ''"},
+	{"files", "deleted_at", "TIMESTAMP"},
+	{"files", "replication", "TEXT NOT NULL DEFAULT ''"},
+	{"files", "accessed_at", "TIMESTAMP"},
+	{"files", "tier", "TEXT NOT NULL DEFAULT ''"},
+	{"files", "allowed_networks", "TEXT NOT NULL DEFAULT ''"},
+	{"files", "allowed_countries", "TEXT NOT NULL DEFAULT ''"},
+	{"files", "findings", "TEXT NOT NULL DEFAULT ''"},
+	{"files", "review", "TEXT NOT NULL DEFAULT ''"},
+	{"upload_sessions", "completed_at", "TIMESTAMP"},
+}
+
+// open the database of METADATA_DSN and create the missing tables
+// the DSN is a file path for sqlite and a connection URL for postgres
+func newSQLStore(opts Options) (*sqlStore, error) {
+	driver := "postgres"
+	if opts.Backend == BackendSQLite {
+		driver = "sqlite3"
+	}
+	db, err := sql.Open(driver, opts.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize connection: %w", err)
+	}
+	// SQLite allows a single writer, one connection avoids "database is locked"
+	if opts.Backend == BackendSQLite {
+		db.SetMaxOpenConns(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sqlSetupTimeout)
+	defer cancel()
+	for _, stmt := range sqlSchema {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("unable to create tables: %w", err)
+		}
+	}
+	for _, c := range sqlAddedColumns {
+		if err := addSQLColumn(ctx, db, c.table, c.column, c.definition); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("unable to add column %s.%s: %w", c.table, c.column, err)
+		}
+	}
+	return &sqlStore{db: db, secrets: opts.Secrets, log: opts.Logger}, nil
+}
+
+// add a column to table unless it exists already
+func addSQLColumn(ctx context.Context, db *sql.DB, table, column, definition string) error {
+	// selecting a missing column fails in SQLite and PostgreSQL alike
+	rows, err := db.QueryContext(ctx, "SELECT "+column+" FROM "+table+" LIMIT 0")
+	if err == nil {
+		return rows.Close()
+	}
+	_, err = db.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN "+column+" "+definition)
+	return err
+}
+
+// columns of a file, in the order of scanFile
+const sqlFileColumns = `id, secret_hash, code_hash, url, filename, size, content_type, created_at, expires_at,
+	max_downloads, downloads, encrypted, client_encrypted, client_metadata, delete_token, passphrase_hash,
+	entries, blob, sha256, md5, uploader, owner, quota_charged, scan_status, container, thumbnail, thumbnail_type,
+	paste, syntax, tree, compressed, description, tags, meta, deleted_at, replication,
+	accessed_at, tier, allowed_networks, allowed_countries, findings, review`
+
+// an entry as stored in the entries column, unlike the API it includes the blob
+type sqlEntry struct {
+	Name        string `json:"name"`
+	Blob        string `json:"blob,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	MD5         string `json:"md5,omitempty"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+	Compressed  bool   `json:"compressed,omitempty"`
+}
+
+func encodeEntries(entries []Entry) (string, error) {
+	if len(entries) == 0 {
+		return "", nil
+	}
+	stored := make([]sqlEntry, len(entries))
+	for i, e := range entries {
+		stored[i] = sqlEntry(e)
+	}
+	b, err := json.Marshal(stored)
+	return string(b), err
+}
+
+func decodeEntries(s string) ([]Entry, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var stored []sqlEntry
+	if err := json.Unmarshal([]byte(s), &stored); err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, len(stored))
+	for i, e := range stored {
+		entries[i] = Entry(e)
+	}
+	return entries, nil
+}
+
+// allowed networks and countries are stored comma separated, empty when there are none
+func encodeList(list []string) string {
+	return strings.Join(list, ",")
+}
+
+func decodeList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// tags and meta are stored as JSON, empty when there are none
+func encodeLabels(file *File) (tags, meta string, err error) {
+	if len(file.Tags) > 0 {
+		b, err := json.Marshal(file.Tags)
+		if err != nil {
+			return "", "", err
+		}
+		tags = string(b)
+	}
+	if len(file.Meta) > 0 {
+		b, err := json.Marshal(file.Meta)
+		if err != nil {
+			return "", "", err
+		}
+		meta = string(b)
+	}
+	return tags, meta, nil
+}
+
+func decodeLabels(file *File, tags, meta string) error {
+	if tags != "" {
+		if err := json.Unmarshal([]byte(tags), &file.Tags); err != nil {
+			return err
+		}
+	}
+	if meta != "" {
+		if err := json.Unmarshal([]byte(meta), &file.Meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escape the wildcards of a LIKE pattern, with \ as the escape character
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// sql.Row and sql.Rows
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanFile(row sqlScanner) (*File, error) {
+	var (
+		file       File
+		id         string
+		expiresAt  sql.NullTime
+		deletedAt  sql.NullTime
+		accessedAt sql.NullTime
+		entries    string
+		tags       string
+		meta       string
+		networks   string
+		countries  string
+		findings   string
+	)
+	err := row.Scan(&id, &file.SecretHash, &file.CodeHash, &file.LinkUrl, &file.FileName, &file.Size, &file.ContentType,
+		&file.CreatedAt, &expiresAt, &file.MaxDownloads, &file.Downloads, &file.Encrypted, &file.ClientEncrypted,
+		&file.ClientMetadata, &file.DeleteToken, &file.PassphraseHash, &entries, &file.Blob, &file.SHA256, &file.MD5,
+		&file.Uploader, &file.Owner, &file.QuotaCharged, &file.ScanStatus, &file.Container, &file.Thumbnail, &file.ThumbnailType,
+		&file.Paste, &file.Syntax, &file.Tree, &file.Compressed, &file.Description, &tags, &meta, &deletedAt, &file.Replication,
+		&accessedAt, &file.Tier, &networks, &countries, &findings, &file.Review)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if file.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return nil, err
+	}
+	file.CreatedAt = file.CreatedAt.UTC()
+	if expiresAt.Valid {
+		t := expiresAt.Time.UTC()
+		file.ExpiresAt = &t
+	}
+	if deletedAt.Valid {
+		t := deletedAt.Time.UTC()
+		file.DeletedAt = &t
+	}
+	if accessedAt.Valid {
+		t := accessedAt.Time.UTC()
+		file.AccessedAt = &t
+	}
+	if file.Entries, err = decodeEntries(entries); err != nil {
+		return nil, err
+	}
+	if err := decodeLabels(&file, tags, meta); err != nil {
+		return nil, err
+	}
+	file.AllowedNetworks, file.AllowedCountries = decodeList(networks), decodeList(countries)
+	file.Findings = decodeList(findings)
+	return &file, nil
+}
+
+func scanFiles(rows *sql.Rows) ([]File, error) {
+	defer rows.Close()
+	files := []File{}
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, *file)
+	}
+	return files, rows.Err()
+}
+
+// condition matching the file of a secret or word code that has not expired
+// yet and is not in the trash, taking the first three placeholders
+const sqlFindFile = `(secret_hash = $1 OR code_hash = $2) AND (expires_at IS NULL OR expires_at > $3) AND deleted_at IS NULL`
+
+func (q *sqlStore) secretArgs(secret string) []interface{} {
+	return []interface{}{q.secrets.Hash(secret), q.secrets.HashWordCode(secret), time.Now().UTC()}
+}
+
+func (q *sqlStore) SecretInUse(ctx context.Context, secret string) (bool, error) {
+	var n int
+	err := q.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM files WHERE secret_hash = $1 OR code_hash = $2`,
+		q.secrets.Hash(secret), q.secrets.HashWordCode(secret)).Scan(&n)
+	return n > 0, err
+}
+
+func (q *sqlStore) CreateFile(ctx context.Context, file *File) error {
+	entries, err := encodeEntries(file.Entries)
+	if err != nil {
+		return err
+	}
+	tags, meta, err := encodeLabels(file)
+	if err != nil {
+		return err
+	}
+	id := primitive.NewObjectID()
+	var expiresAt sql.NullTime
+	if file.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: *file.ExpiresAt, Valid: true}
+	}
+	_, err = q.db.ExecContext(ctx, `INSERT INTO files (`+sqlFileColumns+`) VALUES
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, $34, $35, $36, $37, $38, $39, $40, $41, $42)`,
+		id.Hex(), file.SecretHash, file.CodeHash, file.LinkUrl, file.FileName, file.Size, file.ContentType,
+		file.CreatedAt, expiresAt, file.MaxDownloads, file.Downloads, file.Encrypted, file.ClientEncrypted,
+		file.ClientMetadata, file.DeleteToken, file.PassphraseHash, entries, file.Blob, file.SHA256, file.MD5,
+		file.Uploader, file.Owner, file.QuotaCharged, file.ScanStatus, file.Container, file.Thumbnail, file.ThumbnailType,
+		file.Paste, file.Syntax, file.Tree, file.Compressed, file.Description, tags, meta, sql.NullTime{}, file.Replication,
+		sql.NullTime{}, file.Tier, encodeList(file.AllowedNetworks), encodeList(file.AllowedCountries),
+		encodeList(file.Findings), file.Review)
+	if err != nil {
+		return err
+	}
+	file.ID = id
+	return nil
+}
+
+func (q *sqlStore) FindFile(ctx context.Context, secret string) (*File, error) {
+	return scanFile(q.db.QueryRowContext(ctx, `SELECT `+sqlFileColumns+` FROM files WHERE `+sqlFindFile, q.secretArgs(secret)...))
+}
+
+func (q *sqlStore) ClaimDownload(ctx context.Context, secret string) (*File, error) {
+	// sqlite numbers the parameters in the order they first appear, the
+	// time of the download comes before those of sqlFindFile
+	now := time.Now().UTC()
+	return scanFile(q.db.QueryRowContext(ctx, `UPDATE files SET downloads = downloads + 1, accessed_at = $1
+		WHERE (secret_hash = $2 OR code_hash = $3) AND (expires_at IS NULL OR expires_at > $1) AND deleted_at IS NULL
+		AND (max_downloads = 0 OR downloads < max_downloads)
+		RETURNING `+sqlFileColumns, now, q.secrets.Hash(secret), q.secrets.HashWordCode(secret)))
+}
+
+func (q *sqlStore) FindFileByContent(ctx context.Context, uploader, sha256 string, size int64) (*File, error) {
+	return scanFile(q.db.QueryRowContext(ctx, `SELECT `+sqlFileColumns+` FROM files
+		WHERE sha256 = $1 AND size = $2 AND uploader = $3 AND client_encrypted = FALSE AND encrypted = FALSE
+		AND (expires_at IS NULL OR expires_at > $4) AND deleted_at IS NULL
+		ORDER BY created_at DESC LIMIT 1`, sha256, size, uploader, time.Now().UTC()))
+}
+
+func (q *sqlStore) FindFileByID(ctx context.Context, id primitive.ObjectID) (*File, error) {
+	return scanFile(q.db.QueryRowContext(ctx, `SELECT `+sqlFileColumns+` FROM files WHERE id = $1`, id.Hex()))
+}
+
+func (q *sqlStore) DeleteFile(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	r, err := q.db.ExecContext(ctx, `DELETE FROM files WHERE id = $1`, id.Hex())
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	return n > 0, err
+}
+
+func (q *sqlStore) TrashFile(ctx context.Context, id primitive.ObjectID, at time.Time) (bool, error) {
+	r, err := q.db.ExecContext(ctx, `UPDATE files SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL`, at, id.Hex())
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	return n > 0, err
+}
+
+func (q *sqlStore) RestoreFile(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	r, err := q.db.ExecContext(ctx, `UPDATE files SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL`, id.Hex())
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	return n > 0, err
+}
+
+func (q *sqlStore) TrashedFiles(ctx context.Context, before time.Time) ([]File, error) {
+	rows, err := q.db.QueryContext(ctx, `SELECT `+sqlFileColumns+` FROM files WHERE deleted_at < $1`, before)
+	if err != nil {
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// WHERE clause of a file filter and its arguments
+func (f FileFilter) sql() (string, []interface{}) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if f.Trashed {
+		conds = append(conds, "deleted_at IS NOT NULL")
+	} else {
+		conds = append(conds, "deleted_at IS NULL")
+	}
+	if !f.CreatedAfter.IsZero() {
+		add("created_at >= $%d", f.CreatedAfter)
+	}
+	if !f.CreatedBefore.IsZero() {
+		add("created_at <= $%d", f.CreatedBefore)
+	}
+	if f.MinSize != nil {
+		add("size >= $%d", *f.MinSize)
+	}
+	if f.MaxSize != nil {
+		add("size <= $%d", *f.MaxSize)
+	}
+	if f.Uploader != "" {
+		add("uploader = $%d", f.Uploader)
+	}
+	if f.Owner != "" {
+		add("owner = $%d", f.Owner)
+	}
+	if f.Tag != "" {
+		// tags are stored as a JSON array, the quoted tag matches a whole element
+		tag, _ := json.Marshal(f.Tag)
+		add(`tags LIKE $%d ESCAPE '\'`, "%"+escapeLike(string(tag))+"%")
+	}
+	if f.Review != "" {
+		add("review = $%d", f.Review)
+	}
+	if f.FileNamePrefix != "" {
+		add(`filename LIKE $%d ESCAPE '\'`, escapeLike(f.FileNamePrefix)+"%")
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func (q *sqlStore) ListFiles(ctx context.Context, filter FileFilter, page, perPage int) ([]File, int64, error) {
+	where, args := filter.sql()
+	var total int64
+	if err := q.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM files`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	args = append(args, perPage, (page-1)*perPage)
+	rows, err := q.db.QueryContext(ctx, fmt.Sprintf(`SELECT `+sqlFileColumns+` FROM files%s
+		ORDER BY created_at DESC LIMIT $%d OFFSET $%d`, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	files, err := scanFiles(rows)
+	return files, total, err
+}
+
+func (q *sqlStore) AllFiles(ctx context.Context) ([]File, error) {
+	rows, err := q.db.QueryContext(ctx, `SELECT `+sqlFileColumns+` FROM files`)
+	if err != nil {
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+func (q *sqlStore) ExpiredFiles(ctx context.Context, now time.Time) ([]File, error) {
+	rows, err := q.db.QueryContext(ctx, `SELECT `+sqlFileColumns+` FROM files WHERE expires_at <= $1 AND deleted_at IS NULL`, now)
+	if err != nil {
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+func (q *sqlStore) SetExpiry(ctx context.Context, id primitive.ObjectID, expiresAt time.Time) error {
+	_, err := q.db.ExecContext(ctx, `UPDATE files SET expires_at = $1 WHERE id = $2`, expiresAt, id.Hex())
+	return err
+}
+
+func (q *sqlStore) RotateSecret(ctx context.Context, id primitive.ObjectID, secretHash, codeHash string) (bool, error) {
+	r, err := q.db.ExecContext(ctx, `UPDATE files SET secret_hash = $1, code_hash = $2 WHERE id = $3 AND deleted_at IS NULL`,
+		secretHash, codeHash, id.Hex())
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	return n > 0, err
+}
+
+func (q *sqlStore) SetReview(ctx context.Context, id primitive.ObjectID, review string) error {
+	_, err := q.db.ExecContext(ctx, `UPDATE files SET review = $1 WHERE id = $2`, review, id.Hex())
+	return err
+}
+
+func (q *sqlStore) SetScanStatus(ctx context.Context, secret, status string) error {
+	_, err := q.db.ExecContext(ctx, `UPDATE files SET scan_status = $1 WHERE secret_hash = $2`, status, q.secrets.Hash(secret))
+	return err
+}
+
+func (q *sqlStore) SetReplication(ctx context.Context, id primitive.ObjectID, status string) error {
+	_, err := q.db.ExecContext(ctx, `UPDATE files SET replication = $1 WHERE id = $2`, status, id.Hex())
+	return err
+}
+
+func (q *sqlStore) FilesReplicating(ctx context.Context, status string) ([]File, error) {
+	rows, err := q.db.QueryContext(ctx, `SELECT `+sqlFileColumns+` FROM files WHERE replication = $1 AND deleted_at IS NULL`, status)
+	if err != nil {
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+func (q *sqlStore) SetTier(ctx context.Context, id primitive.ObjectID, tier string) error {
+	_, err := q.db.ExecContext(ctx, `UPDATE files SET tier = $1 WHERE id = $2`, tier, id.Hex())
+	return err
+}
+
+func (q *sqlStore) UntouchedFiles(ctx context.Context, before time.Time, tiers []string) ([]File, error) {
+	args := []interface{}{before}
+	placeholders := make([]string, len(tiers))
+	for i, tier := range tiers {
+		args = append(args, tier)
+		placeholders[i] = fmt.Sprintf("$%d", len(args))
+	}
+	rows, err := q.db.QueryContext(ctx, `SELECT `+sqlFileColumns+` FROM files WHERE deleted_at IS NULL
+		AND created_at < $1 AND (accessed_at IS NULL OR accessed_at < $1) AND tier IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// secrets were always hashed in SQL databases
+func (q *sqlStore) MigrateSecrets(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (q *sqlStore) CreateUploadSession(ctx context.Context, session *UploadSession) error {
+	_, err := q.db.ExecContext(ctx, `INSERT INTO upload_sessions
+		(id, filename, content_type, length, upload_offset, chunks, container, blob, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		session.ID, session.FileName, session.ContentType, session.Length, session.Offset, session.Chunks,
+		session.Container, session.Blob, session.CreatedAt)
+	return err
+}
+
+func (q *sqlStore) FindUploadSession(ctx context.Context, id string) (*UploadSession, error) {
+	var session UploadSession
+	var secret string
+	err := q.db.QueryRowContext(ctx, `SELECT id, filename, content_type, length, upload_offset, chunks, container, blob, created_at,
+		completed_at, secret FROM upload_sessions WHERE id = $1`, id).Scan(&session.ID, &session.FileName, &session.ContentType,
+		&session.Length, &session.Offset, &session.Chunks, &session.Container, &session.Blob, &session.CreatedAt,
+		&session.CompletedAt, &secret)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	// sessions completed before they were marked so hold their secret
+	if secret != "" && session.CompletedAt == nil {
+		session.CompletedAt = &session.CreatedAt
+	}
+	return &session, nil
+}
+
+func (q *sqlStore) AdvanceUploadSession(ctx context.Context, session *UploadSession, written int64) error {
+	r, err := q.db.ExecContext(ctx, `UPDATE upload_sessions SET upload_offset = upload_offset + $1, chunks = chunks + 1
+		WHERE id = $2 AND upload_offset = $3 AND chunks = $4`, written, session.ID, session.Offset, session.Chunks)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = ErrUploadSessionConflict
+		}
+		return err
+	}
+	return nil
+}
+
+func (q *sqlStore) CompleteUploadSession(ctx context.Context, id string, at time.Time) error {
+	_, err := q.db.ExecContext(ctx, `UPDATE upload_sessions SET completed_at = $1 WHERE id = $2`, at, id)
+	return err
+}
+
+func (q *sqlStore) PruneUploadSessions(ctx context.Context, before time.Time) (int64, error) {
+	r, err := q.db.ExecContext(ctx, `DELETE FROM upload_sessions WHERE completed_at < $1 OR secret <> ''`, before)
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
+
+func (q *sqlStore) AcquireBlob(ctx context.Context, id string) (string, error) {
+	var url string
+	err := q.db.QueryRowContext(ctx, `INSERT INTO blob_refs (id, refs) VALUES ($1, 1)
+		ON CONFLICT (id) DO UPDATE SET refs = blob_refs.refs + 1 RETURNING url`, id).Scan(&url)
+	return url, err
+}
+
+func (q *sqlStore) StoredBlob(ctx context.Context, id, url string) error {
+	_, err := q.db.ExecContext(ctx, `UPDATE blob_refs SET url = $1 WHERE id = $2`, url, id)
+	return err
+}
+
+func (q *sqlStore) ReleaseBlob(ctx context.Context, id string) (bool, error) {
+	var refs int
+	err := q.db.QueryRowContext(ctx, `UPDATE blob_refs SET refs = refs - 1 WHERE id = $1 RETURNING refs`, id).Scan(&refs)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if refs > 0 {
+		return false, nil
+	}
+
+	// only the request that removes the counter deletes the blob
+	r, err := q.db.ExecContext(ctx, `DELETE FROM blob_refs WHERE id = $1 AND refs <= 0`, id)
+	if err != nil {
+		return false, err
+	}
+	if n, err := r.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			q.log(ctx).Warn("blob was shared again while being released", zap.String("blob", id))
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (q *sqlStore) ChargeQuota(ctx context.Context, id string, size, def int64) (bool, error) {
+	// make sure the row exists so the conditional update below can match it
+	_, err := q.db.ExecContext(ctx, `INSERT INTO quotas (id, used) VALUES ($1, 0) ON CONFLICT (id) DO NOTHING`, id)
+	if err != nil {
+		return false, err
+	}
+	r, err := q.db.ExecContext(ctx, `UPDATE quotas SET used = used + $1
+		WHERE id = $2 AND (COALESCE(limit_bytes, $3) <= 0 OR used + $1 <= COALESCE(limit_bytes, $3))`, size, id, def)
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	return n > 0, err
+}
+
+func (q *sqlStore) UnchargeQuota(ctx context.Context, id string, size int64) error {
+	_, err := q.db.ExecContext(ctx, `UPDATE quotas SET used = used - $1 WHERE id = $2`, size, id)
+	return err
+}
+
+func (q *sqlStore) ListQuotas(ctx context.Context) ([]Quota, error) {
+	rows, err := q.db.QueryContext(ctx, `SELECT id, used, limit_bytes FROM quotas ORDER BY used DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	quotas := []Quota{}
+	for rows.Next() {
+		var (
+			qu    Quota
+			limit sql.NullInt64
+		)
+		if err := rows.Scan(&qu.ID, &qu.Used, &limit); err != nil {
+			return nil, err
+		}
+		if limit.Valid {
+			qu.Limit = &limit.Int64
+		}
+		quotas = append(quotas, qu)
+	}
+	return quotas, rows.Err()
+}
+
+func (q *sqlStore) SetQuotaLimit(ctx context.Context, id string, limit *int64) error {
+	if limit == nil {
+		_, err := q.db.ExecContext(ctx, `UPDATE quotas SET limit_bytes = NULL WHERE id = $1`, id)
+		return err
+	}
+	// limits may be set before the principal uploads anything
+	_, err := q.db.ExecContext(ctx, `INSERT INTO quotas (id, used, limit_bytes) VALUES ($1, 0, $2)
+		ON CONFLICT (id) DO UPDATE SET limit_bytes = excluded.limit_bytes`, id, *limit)
+	return err
+}
+
+func (q *sqlStore) RecordAudit(ctx context.Context, event *AuditEvent) error {
+	id := primitive.NewObjectID()
+	_, err := q.db.ExecContext(ctx, `INSERT INTO audit_events
+		(id, time, action, file_id, filename, principal, client, user_agent, request_id, path, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		id.Hex(), event.Time, event.Action, event.FileID, event.FileName, event.Principal, event.Client,
+		event.UserAgent, event.RequestID, event.Path, event.Status)
+	if err != nil {
+		return err
+	}
+	event.ID = id
+	return nil
+}
+
+func (f AuditFilter) sql() (string, []interface{}) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	for _, field := range []struct{ column, value string }{
+		{"action", f.Action}, {"file_id", f.FileID}, {"client", f.Client}, {"principal", f.Principal},
+	} {
+		if field.value != "" {
+			add(field.column+" = $%d", field.value)
+		}
+	}
+	if !f.After.IsZero() {
+		add("time >= $%d", f.After)
+	}
+	if !f.Before.IsZero() {
+		add("time <= $%d", f.Before)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func (q *sqlStore) ListAudit(ctx context.Context, filter AuditFilter, page, perPage int) ([]AuditEvent, int64, error) {
+	where, args := filter.sql()
+	var total int64
+	if err := q.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM audit_events`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	args = append(args, perPage, (page-1)*perPage)
+	rows, err := q.db.QueryContext(ctx, fmt.Sprintf(`SELECT id, time, action, file_id, filename, principal, client,
+		user_agent, request_id, path, status FROM audit_events%s
+		ORDER BY time DESC LIMIT $%d OFFSET $%d`, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	events := []AuditEvent{}
+	for rows.Next() {
+		var (
+			e  AuditEvent
+			id string
+		)
+		if err := rows.Scan(&id, &e.Time, &e.Action, &e.FileID, &e.FileName, &e.Principal, &e.Client,
+			&e.UserAgent, &e.RequestID, &e.Path, &e.Status); err != nil {
+			return nil, 0, err
+		}
+		if e.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+			return nil, 0, err
+		}
+		e.Time = e.Time.UTC()
+		events = append(events, e)
+	}
+	return events, total, rows.Err()
+}
+
+func (q *sqlStore) PruneAudit(ctx context.Context, before time.Time) (int64, error) {
+	r, err := q.db.ExecContext(ctx, `DELETE FROM audit_events WHERE time < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
+
+func (q *sqlStore) AddOutbox(ctx context.Context, entries []OutboxEntry) error {
+	for i := range entries {
+		e := &entries[i]
+		id := primitive.NewObjectID()
+		_, err := q.db.ExecContext(ctx, `INSERT INTO outbox (id, destination, event, created_at, attempts, next_attempt)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			id.Hex(), e.Destination, string(e.Event), e.CreatedAt, e.Attempts, e.NextAttempt)
+		if err != nil {
+			return err
+		}
+		e.ID = id
+	}
+	return nil
+}
+
+// entries are claimed one by one by moving their next attempt, an entry
+// another instance moved first is skipped
+func (q *sqlStore) ClaimOutbox(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]OutboxEntry, error) {
+	rows, err := q.db.QueryContext(ctx, `SELECT id, destination, event, created_at, attempts, next_attempt FROM outbox
+		WHERE next_attempt <= $1 ORDER BY next_attempt LIMIT $2`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	var due []OutboxEntry
+	for rows.Next() {
+		var (
+			e     OutboxEntry
+			id    string
+			event string
+		)
+		if err := rows.Scan(&id, &e.Destination, &event, &e.CreatedAt, &e.Attempts, &e.NextAttempt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if e.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		e.Event = []byte(event)
+		due = append(due, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	claimed := due[:0]
+	for _, e := range due {
+		next := now.Add(lease)
+		r, err := q.db.ExecContext(ctx, `UPDATE outbox SET next_attempt = $1 WHERE id = $2 AND next_attempt = $3`,
+			next, e.ID.Hex(), e.NextAttempt)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := r.RowsAffected(); err != nil || n == 0 {
+			continue
+		}
+		e.NextAttempt = next
+		claimed = append(claimed, e)
+	}
+	return claimed, nil
+}
+
+func (q *sqlStore) RetryOutbox(ctx context.Context, id primitive.ObjectID, attempts int, next time.Time) error {
+	_, err := q.db.ExecContext(ctx, `UPDATE outbox SET attempts = $1, next_attempt = $2 WHERE id = $3`, attempts, next, id.Hex())
+	return err
+}
+
+func (q *sqlStore) DeleteOutbox(ctx context.Context, id primitive.ObjectID) error {
+	_, err := q.db.ExecContext(ctx, `DELETE FROM outbox WHERE id = $1`, id.Hex())
+	return err
+}
+
+func (q *sqlStore) CreateCollection(ctx context.Context, collection *Collection) error {
+	id := primitive.NewObjectID()
+	_, err := q.db.ExecContext(ctx, `INSERT INTO collections (id, secret_hash, owner, name, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		id.Hex(), collection.SecretHash, collection.Owner, collection.Name, collection.CreatedAt)
+	if err != nil {
+		return err
+	}
+	collection.ID = id
+	return nil
+}
+
+// read the collections selected by where and their items
+func (q *sqlStore) queryCollections(ctx context.Context, where string, args ...interface{}) ([]Collection, error) {
+	rows, err := q.db.QueryContext(ctx, `SELECT id, secret_hash, owner, name, created_at FROM collections
+		WHERE `+where+` ORDER BY created_at DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	collections := []Collection{}
+	for rows.Next() {
+		var (
+			c  Collection
+			id string
+		)
+		if err := rows.Scan(&id, &c.SecretHash, &c.Owner, &c.Name, &c.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if c.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		c.CreatedAt = c.CreatedAt.UTC()
+		collections = append(collections, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range collections {
+		if collections[i].Items, err = q.collectionItems(ctx, collections[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return collections, nil
+}
+
+func (q *sqlStore) collectionItems(ctx context.Context, id primitive.ObjectID) ([]CollectionItem, error) {
+	rows, err := q.db.QueryContext(ctx, `SELECT file_id, secret, added_at FROM collection_items
+		WHERE collection_id = $1 ORDER BY added_at`, id.Hex())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []CollectionItem{}
+	for rows.Next() {
+		var (
+			item   CollectionItem
+			fileID string
+		)
+		if err := rows.Scan(&fileID, &item.Secret, &item.AddedAt); err != nil {
+			return nil, err
+		}
+		if item.FileID, err = primitive.ObjectIDFromHex(fileID); err != nil {
+			return nil, err
+		}
+		item.AddedAt = item.AddedAt.UTC()
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (q *sqlStore) FindCollection(ctx context.Context, secret string) (*Collection, error) {
+	collections, err := q.queryCollections(ctx, `secret_hash = $1`, q.secrets.Hash(secret))
+	if err != nil {
+		return nil, err
+	}
+	if len(collections) == 0 {
+		return nil, ErrNotFound
+	}
+	return &collections[0], nil
+}
+
+func (q *sqlStore) ListCollections(ctx context.Context, owner string) ([]Collection, error) {
+	return q.queryCollections(ctx, `owner = $1`, owner)
+}
+
+func (q *sqlStore) AddToCollection(ctx context.Context, id primitive.ObjectID, item CollectionItem) (bool, error) {
+	r, err := q.db.ExecContext(ctx, `INSERT INTO collection_items (collection_id, file_id, secret, added_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (collection_id, file_id) DO NOTHING`, id.Hex(), item.FileID.Hex(), item.Secret, item.AddedAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	return n > 0, err
+}
+
+func (q *sqlStore) RemoveFromCollection(ctx context.Context, id, fileID primitive.ObjectID) (bool, error) {
+	r, err := q.db.ExecContext(ctx, `DELETE FROM collection_items WHERE collection_id = $1 AND file_id = $2`, id.Hex(), fileID.Hex())
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	return n > 0, err
+}
+
+func (q *sqlStore) DeleteCollection(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	if _, err := q.db.ExecContext(ctx, `DELETE FROM collection_items WHERE collection_id = $1`, id.Hex()); err != nil {
+		return false, err
+	}
+	r, err := q.db.ExecContext(ctx, `DELETE FROM collections WHERE id = $1`, id.Hex())
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	return n > 0, err
+}
+
+// a stale key is taken over by the upsert, any other existing key is left
+// alone and read
+func (q *sqlStore) ReserveIdempotencyKey(ctx context.Context, key *IdempotencyKey, stale time.Time) (*IdempotencyKey, error) {
+	r, err := q.db.ExecContext(ctx, `INSERT INTO idempotency_keys (id, created_at) VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET created_at = excluded.created_at
+		WHERE idempotency_keys.response = '' AND idempotency_keys.created_at < $3`, key.ID, key.CreatedAt, stale)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := r.RowsAffected(); err != nil || n > 0 {
+		return nil, err
+	}
+
+	var existing IdempotencyKey
+	err = q.db.QueryRowContext(ctx, `SELECT id, created_at, response, content_type FROM idempotency_keys WHERE id = $1`,
+		key.ID).Scan(&existing.ID, &existing.CreatedAt, &existing.Response, &existing.ContentType)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	existing.CreatedAt = existing.CreatedAt.UTC()
+	return &existing, nil
+}
+
+func (q *sqlStore) CompleteIdempotencyKey(ctx context.Context, id, response, contentType string) error {
+	_, err := q.db.ExecContext(ctx, `UPDATE idempotency_keys SET response = $1, content_type = $2 WHERE id = $3`,
+		response, contentType, id)
+	return err
+}
+
+func (q *sqlStore) ReleaseIdempotencyKey(ctx context.Context, id string) error {
+	_, err := q.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE id = $1 AND response = ''`, id)
+	return err
+}
+
+func (q *sqlStore) PruneIdempotencyKeys(ctx context.Context, before time.Time) (int64, error) {
+	r, err := q.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE created_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
+
+func (q *sqlStore) Ping(ctx context.Context) error {
+	return q.db.PingContext(ctx)
+}
+
+func (q *sqlStore) Close(ctx context.Context) error {
+	return q.db.Close()
+}
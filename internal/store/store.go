@@ -0,0 +1,241 @@
+// Package store keeps the links of the shared files and the other metadata in
+// a database.
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"filer/internal/secret"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// metadata backends, METADATA_BACKEND
+const (
+	BackendMongo    = "mongo"
+	BackendSQLite   = "sqlite"
+	BackendPostgres = "postgres"
+)
+
+var (
+	// ErrNotFound is returned by a Store when no record matches.
+	ErrNotFound = errors.New("not found")
+	// ErrUploadSessionConflict is returned when the offset of a resumable upload moved.
+	ErrUploadSessionConflict = errors.New("upload offset mismatch")
+)
+
+// FileFilter selects files listed by the admin and "my files" APIs,
+// zero fields match every file
+type FileFilter struct {
+	Uploader string
+	Owner    string
+	// bounds of the upload time, inclusive
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// bounds of the size, inclusive
+	MinSize *int64
+	MaxSize *int64
+	// files carrying the tag
+	Tag string
+	// files whose name starts with the prefix, the case matters
+	FileNamePrefix string
+	// list the trashed files instead of the others
+	Trashed bool
+	// files in the review state, see File.Review
+	Review string
+}
+
+// Store keeps the file links, resumable upload sessions, blob
+// reference counts, quotas and the audit log. Handlers only talk to this interface, so
+// deployments can choose a database without touching them.
+type Store interface {
+	// SecretInUse reports whether a file is stored under the secret or word code.
+	SecretInUse(ctx context.Context, secret string) (bool, error)
+	// CreateFile saves a file link and sets its ID.
+	CreateFile(ctx context.Context, file *File) error
+	// FindFile returns the unexpired file of a secret or word code.
+	FindFile(ctx context.Context, secret string) (*File, error)
+	// ClaimDownload counts a download of the unexpired file of a secret and
+	// returns it, ErrNotFound once its download limit is reached. The time of
+	// the download is recorded as AccessedAt.
+	ClaimDownload(ctx context.Context, secret string) (*File, error)
+	// FindFileByContent returns the newest unexpired file of uploader holding
+	// the plain contents of the given SHA-256 and size.
+	FindFileByContent(ctx context.Context, uploader, sha256 string, size int64) (*File, error)
+	// FindFileByID returns the file with the given id, expired or not.
+	FindFileByID(ctx context.Context, id primitive.ObjectID) (*File, error)
+	// DeleteFile removes a file link, reporting whether it still existed.
+	DeleteFile(ctx context.Context, id primitive.ObjectID) (bool, error)
+	// TrashFile marks a file deleted at the given time, reporting whether it
+	// was not already. Trashed files are only found by id.
+	TrashFile(ctx context.Context, id primitive.ObjectID, at time.Time) (bool, error)
+	// RestoreFile takes a file out of the trash, reporting whether it was in it.
+	RestoreFile(ctx context.Context, id primitive.ObjectID) (bool, error)
+	// TrashedFiles returns the files trashed before the given time.
+	TrashedFiles(ctx context.Context, before time.Time) ([]File, error)
+	// ListFiles returns a page of the files matching filter, newest first,
+	// and the number of matching files.
+	ListFiles(ctx context.Context, filter FileFilter, page, perPage int) ([]File, int64, error)
+	// AllFiles returns every file, expired or not, read in a single query
+	// so files deleted meanwhile do not hide others.
+	AllFiles(ctx context.Context) ([]File, error)
+	// ExpiredFiles returns the files that expired before now, leaving out
+	// trashed files.
+	ExpiredFiles(ctx context.Context, now time.Time) ([]File, error)
+	// SetExpiry moves the expiry of a file.
+	SetExpiry(ctx context.Context, id primitive.ObjectID, expiresAt time.Time) error
+	// RotateSecret replaces the secret and the word code of a file, codeHash
+	// is empty for files without one, reporting whether the file was found.
+	// The former secret and word code no longer match the file.
+	RotateSecret(ctx context.Context, id primitive.ObjectID, secretHash, codeHash string) (bool, error)
+	// SetReview records the review state of a file flagged by content inspection.
+	SetReview(ctx context.Context, id primitive.ObjectID, review string) error
+	// SetScanStatus records the virus scan outcome of the file of a secret.
+	SetScanStatus(ctx context.Context, secret, status string) error
+	// SetReplication records the copy state of the blobs of a file in the
+	// secondary storage.
+	SetReplication(ctx context.Context, id primitive.ObjectID, status string) error
+	// FilesReplicating returns the files with the given copy state, leaving
+	// out trashed files.
+	FilesReplicating(ctx context.Context, status string) ([]File, error)
+	// SetTier records the access tier of the blobs of a file.
+	SetTier(ctx context.Context, id primitive.ObjectID, tier string) error
+	// UntouchedFiles returns the files in one of tiers that were neither
+	// uploaded nor downloaded since before, leaving out trashed files.
+	UntouchedFiles(ctx context.Context, before time.Time, tiers []string) ([]File, error)
+	// MigrateSecrets hashes secrets stored in plaintext by older versions.
+	MigrateSecrets(ctx context.Context) (int, error)
+
+	// CreateUploadSession saves a new resumable upload session.
+	CreateUploadSession(ctx context.Context, session *UploadSession) error
+	// FindUploadSession returns the resumable upload session with the given id.
+	FindUploadSession(ctx context.Context, id string) (*UploadSession, error)
+	// AdvanceUploadSession adds a staged chunk of written bytes to the session,
+	// ErrUploadSessionConflict if its offset moved since it was read.
+	AdvanceUploadSession(ctx context.Context, session *UploadSession, written int64) error
+	// CompleteUploadSession records that the link of a session was saved.
+	CompleteUploadSession(ctx context.Context, id string, at time.Time) error
+	// PruneUploadSessions deletes the sessions completed before the given time.
+	PruneUploadSessions(ctx context.Context, before time.Time) (int64, error)
+
+	// AcquireBlob adds a reference to a shared blob and returns its url,
+	// empty until StoredBlob recorded it.
+	AcquireBlob(ctx context.Context, id string) (string, error)
+	// StoredBlob records the url of an uploaded shared blob.
+	StoredBlob(ctx context.Context, id, url string) error
+	// ReleaseBlob drops a reference to a shared blob, reporting whether it
+	// was the last one and the blob can be deleted.
+	ReleaseBlob(ctx context.Context, id string) (bool, error)
+
+	// ChargeQuota adds size to the usage of a principal if it stays within its
+	// limit, or def when it has none. Limits of 0 or less are unlimited.
+	ChargeQuota(ctx context.Context, id string, size, def int64) (bool, error)
+	// UnchargeQuota gives back size bytes of a principal.
+	UnchargeQuota(ctx context.Context, id string, size int64) error
+	// ListQuotas returns the usage of every principal, largest first.
+	ListQuotas(ctx context.Context) ([]Quota, error)
+	// SetQuotaLimit overrides the quota of a principal, nil restores the default.
+	SetQuotaLimit(ctx context.Context, id string, limit *int64) error
+
+	// RecordAudit appends an event to the audit log and sets its ID.
+	RecordAudit(ctx context.Context, event *AuditEvent) error
+	// ListAudit returns a page of the audit events matching filter, newest
+	// first, and the number of matching events.
+	ListAudit(ctx context.Context, filter AuditFilter, page, perPage int) ([]AuditEvent, int64, error)
+	// PruneAudit deletes the audit events recorded before the given time.
+	PruneAudit(ctx context.Context, before time.Time) (int64, error)
+
+	// CreateCollection saves a collection and sets its ID.
+	CreateCollection(ctx context.Context, collection *Collection) error
+	// FindCollection returns the collection of a secret.
+	FindCollection(ctx context.Context, secret string) (*Collection, error)
+	// ListCollections returns the collections of owner, newest first.
+	ListCollections(ctx context.Context, owner string) ([]Collection, error)
+	// AddToCollection appends a file to a collection, reporting whether it
+	// was not in it already.
+	AddToCollection(ctx context.Context, id primitive.ObjectID, item CollectionItem) (bool, error)
+	// RemoveFromCollection takes a file out of a collection, reporting
+	// whether it was in it.
+	RemoveFromCollection(ctx context.Context, id, fileID primitive.ObjectID) (bool, error)
+	// DeleteCollection removes a collection, leaving its files alone, and
+	// reports whether it still existed.
+	DeleteCollection(ctx context.Context, id primitive.ObjectID) (bool, error)
+
+	// AddOutbox saves events waiting for delivery and sets their IDs.
+	AddOutbox(ctx context.Context, entries []OutboxEntry) error
+	// ClaimOutbox returns at most limit entries due at now, oldest due first,
+	// and delays them by lease so that other instances leave them alone
+	// while they are delivered.
+	ClaimOutbox(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]OutboxEntry, error)
+	// RetryOutbox records a failed delivery of an entry and when to retry it.
+	RetryOutbox(ctx context.Context, id primitive.ObjectID, attempts int, next time.Time) error
+	// DeleteOutbox removes a delivered entry.
+	DeleteOutbox(ctx context.Context, id primitive.ObjectID) error
+
+	// ReserveIdempotencyKey saves a key whose upload is in progress and
+	// returns nil, or returns the record of the key when it exists. Keys
+	// still in progress since before stale are taken over.
+	ReserveIdempotencyKey(ctx context.Context, key *IdempotencyKey, stale time.Time) (*IdempotencyKey, error)
+	// CompleteIdempotencyKey records the answer of the upload of a key.
+	CompleteIdempotencyKey(ctx context.Context, id, response, contentType string) error
+	// ReleaseIdempotencyKey removes a key whose upload failed, so it can be retried.
+	ReleaseIdempotencyKey(ctx context.Context, id string) error
+	// PruneIdempotencyKeys deletes the keys saved before the given time.
+	PruneIdempotencyKeys(ctx context.Context, before time.Time) (int64, error)
+
+	// Ping checks that the database is reachable and set up.
+	Ping(ctx context.Context) error
+	// Close releases the connections.
+	Close(ctx context.Context) error
+}
+
+// Options select the database and configure it
+type Options struct {
+	// Backend is BackendMongo, BackendSQLite or BackendPostgres
+	Backend string
+	// DSN of the SQL database, a file path for sqlite and a connection URL for postgres
+	DSN   string
+	Mongo MongoOptions
+	// RedisURL puts a Redis cache in front of the database when set
+	RedisURL string
+	// CacheTTL is the longest time a file is cached
+	CacheTTL time.Duration
+	// Timeout bounds connecting to and every command of MongoDB and Redis
+	Timeout time.Duration
+	// Secrets hashes the secrets files are looked up with
+	Secrets *secret.Hasher
+	// Logger returns the logger of the request of ctx
+	Logger func(ctx context.Context) *zap.Logger
+}
+
+// New connects to the database selected by opts, behind the Redis cache when
+// RedisURL is set.
+func New(opts Options) (Store, error) {
+	if opts.Logger == nil {
+		nop := zap.NewNop()
+		opts.Logger = func(context.Context) *zap.Logger { return nop }
+	}
+	var store Store
+	var err error
+	switch opts.Backend {
+	case BackendMongo:
+		store, err = newMongoStore(opts)
+	case BackendSQLite, BackendPostgres:
+		store, err = newSQLStore(opts)
+	default:
+		return nil, fmt.Errorf("unknown metadata backend %q", opts.Backend)
+	}
+	if err != nil || opts.RedisURL == "" {
+		return store, err
+	}
+	cached, err := newCachedStore(store, opts)
+	if err != nil {
+		store.Close(context.Background())
+		return nil, err
+	}
+	return cached, nil
+}
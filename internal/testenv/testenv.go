@@ -0,0 +1,80 @@
+//go:build integration
+
+// Package testenv starts the emulators the integration tests run against in
+// containers, so that no cloud account is needed. Docker must be available.
+//
+//	go test -tags integration ./...
+package testenv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// well-known development account of Azurite
+const (
+	AzuriteAccount   = "devstoreaccount1"
+	AzuriteAccessKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+const (
+	azuriteImage = "mcr.microsoft.com/azure-storage/azurite:3.17.1"
+	mongoImage   = "mongo:4.4"
+	// time an image may take to be pulled and start listening
+	startupTimeout = 2 * time.Minute
+)
+
+// Azurite starts the blob service of Azurite and returns the URL of its
+// development account, the value of AZURE_STORAGE_ENDPOINT. The container
+// is removed when the test ends.
+func Azurite(t testing.TB) string {
+	t.Helper()
+	endpoint := start(t, testcontainers.ContainerRequest{
+		Image: azuriteImage,
+		// the SDK may speak a newer API version than the emulator knows
+		Cmd:          []string{"azurite-blob", "--blobHost", "0.0.0.0", "--skipApiVersionCheck", "--loose"},
+		ExposedPorts: []string{"10000/tcp"},
+		WaitingFor:   wait.ForListeningPort("10000/tcp").WithStartupTimeout(startupTimeout),
+	}, "10000/tcp", "http")
+	return endpoint + "/" + AzuriteAccount
+}
+
+// Mongo starts a MongoDB server and returns its connection string. The
+// container is removed when the test ends.
+func Mongo(t testing.TB) string {
+	t.Helper()
+	return start(t, testcontainers.ContainerRequest{
+		Image:        mongoImage,
+		ExposedPorts: []string{"27017/tcp"},
+		WaitingFor:   wait.ForListeningPort("27017/tcp").WithStartupTimeout(startupTimeout),
+	}, "27017/tcp", "mongodb")
+}
+
+// start the container of req and return the proto://host:port address port
+// is mapped to
+func start(t testing.TB, req testcontainers.ContainerRequest, port nat.Port, proto string) string {
+	t.Helper()
+	ctx := context.Background()
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		t.Fatalf("unable to start %s: %v", req.Image, err)
+	}
+	t.Cleanup(func() {
+		if err := container.Terminate(context.Background()); err != nil {
+			t.Logf("unable to remove the %s container: %v", req.Image, err)
+		}
+	})
+	endpoint, err := container.PortEndpoint(ctx, port, proto)
+	if err != nil {
+		t.Fatalf("unable to find the address of %s: %v", req.Image, err)
+	}
+	return endpoint
+}
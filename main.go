@@ -0,0 +1,64 @@
+// Command filer is the custom handler of the Azure Functions app, serving the
+// API on FUNCTIONS_CUSTOMHANDLER_PORT.
+package main
+
+//go:generate go run ./tools/openapigen
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"filer/internal/secret"
+	"filer/internal/server"
+	"filer/internal/storage"
+	"filer/internal/store"
+
+	"go.uber.org/zap"
+)
+
+// time left to release connections once draining is over
+const closeTimeout = 5 * time.Second
+
+func main() {
+	config, err := server.Configure(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger := server.NewLogger(config.LogLevel)
+	defer logger.Sync()
+
+	shutdownTracing, err := server.InitTracing(context.Background(), config)
+	if err != nil {
+		logger.Fatal("failed to set up tracing", zap.Error(err))
+	}
+	blobs, err := storage.New(config.StorageOptions(logger))
+	if err != nil {
+		logger.Fatal("invalid storage configuration", zap.Error(err))
+	}
+	secrets := secret.NewHasher(config.SecretHMACKey)
+	metadata, err := store.New(config.StoreOptions(secrets, logger))
+	if err != nil {
+		logger.Fatal("failed to start", zap.Error(err))
+	}
+	s, err := server.New(config, logger, blobs, metadata, secrets)
+	if err != nil {
+		logger.Fatal("failed to start", zap.Error(err))
+	}
+	s.Run()
+
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	if err := metadata.Close(ctx); err != nil {
+		logger.Error("failed to close the metadata store", zap.Error(err))
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Error("failed to flush traces", zap.Error(err))
+	}
+}
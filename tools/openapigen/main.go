@@ -0,0 +1,324 @@
+// Command openapigen generates the request and response types of the API
+// from openapi.json, for the server and for the client package.
+//
+// Run from the repository root with go generate.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const header = "// Code generated by openapigen from openapi.json. DO NOT EDIT.\n\n"
+
+type schema struct {
+	Ref                  string     `json:"$ref"`
+	Type                 string     `json:"type"`
+	Format               string     `json:"format"`
+	Description          string     `json:"description"`
+	Nullable             bool       `json:"nullable"`
+	Required             []string   `json:"required"`
+	Properties           properties `json:"properties"`
+	Items                *schema    `json:"items"`
+	AdditionalProperties *schema    `json:"additionalProperties"`
+	// name of the type in the server, which defaults to the schema name
+	GoName string `json:"x-go-name"`
+	// hand-written type of the server, "-" for schemas without one
+	GoType string `json:"x-go-type"`
+}
+
+// named schemas in the order of the document, so fields keep their order
+type property struct {
+	name   string
+	schema *schema
+}
+
+type properties []property
+
+func (p *properties) UnmarshalJSON(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		s := &schema{}
+		if err := dec.Decode(s); err != nil {
+			return err
+		}
+		*p = append(*p, property{key.(string), s})
+	}
+	_, err := dec.Token()
+	return err
+}
+
+type document struct {
+	Components struct {
+		Schemas properties `json:"schemas"`
+	} `json:"components"`
+}
+
+var initialisms = map[string]string{
+	"api":    "API",
+	"id":     "ID",
+	"ip":     "IP",
+	"md5":    "MD5",
+	"sha256": "SHA256",
+	"ttl":    "TTL",
+	"url":    "URL",
+}
+
+// Go name of a JSON field, snake_case names are turned into CamelCase
+func fieldName(name string) string {
+	if r := []rune(name); len(r) > 0 && unicode.IsUpper(r[0]) {
+		return name
+	}
+	parts := strings.Split(name, "_")
+	for i, part := range parts {
+		if v, ok := initialisms[part]; ok {
+			parts[i] = v
+		} else if part != "" {
+			parts[i] = strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+type generator struct {
+	schemas map[string]*schema
+	// types of the server rather than of the client package
+	server bool
+	time   bool
+	// import paths of the packages of qualified x-go-type names, such as store.Quota
+	imports map[string]bool
+}
+
+// packages of qualified x-go-type names live under internal
+const internalPackages = "filer/internal/"
+
+// Go type of a named schema
+func (g *generator) typeName(name string, s *schema) string {
+	if !g.server {
+		return name
+	}
+	if s.GoType != "" && s.GoType != "-" {
+		if i := strings.IndexByte(s.GoType, '.'); i > 0 {
+			g.imports[internalPackages+s.GoType[:i]] = true
+		}
+		return s.GoType
+	}
+	if s.GoName != "" {
+		return s.GoName
+	}
+	return name
+}
+
+func (g *generator) goType(s *schema) (string, error) {
+	if s.Ref != "" {
+		name := strings.TrimPrefix(s.Ref, "#/components/schemas/")
+		target, ok := g.schemas[name]
+		if !ok {
+			return "", fmt.Errorf("unknown schema %s", s.Ref)
+		}
+		if target.Type == "object" && target.AdditionalProperties == nil {
+			return g.typeName(name, target), nil
+		}
+		return g.goType(target)
+	}
+	var t string
+	switch s.Type {
+	case "string":
+		t = "string"
+		if s.Format == "date-time" {
+			t = "time.Time"
+			g.time = true
+		}
+	case "integer":
+		t = "int"
+		if s.Format == "int64" {
+			t = "int64"
+		}
+	case "number":
+		t = "float64"
+	case "boolean":
+		t = "bool"
+	case "array":
+		if s.Items == nil {
+			return "", fmt.Errorf("array without items")
+		}
+		item, err := g.goType(s.Items)
+		if err != nil {
+			return "", err
+		}
+		return "[]" + item, nil
+	case "object":
+		if s.AdditionalProperties == nil {
+			return "map[string]interface{}", nil
+		}
+		value, err := g.goType(s.AdditionalProperties)
+		if err != nil {
+			return "", err
+		}
+		return "map[string]" + value, nil
+	default:
+		return "", fmt.Errorf("unsupported type %q", s.Type)
+	}
+	// absent and zero differ for nullable values
+	if s.Nullable {
+		t = "*" + t
+	}
+	return t, nil
+}
+
+// write the comment lines of a description
+func comment(buf *bytes.Buffer, text string) {
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		fmt.Fprintf(buf, "// %s\n", line)
+	}
+}
+
+func (g *generator) writeType(buf *bytes.Buffer, name string, s *schema) error {
+	typeName := g.typeName(name, s)
+	if s.Description != "" {
+		if g.server {
+			comment(buf, s.Description)
+		} else {
+			comment(buf, typeName+" is "+article(s.Description))
+		}
+	}
+	required := map[string]bool{}
+	for _, name := range s.Required {
+		required[name] = true
+	}
+	fmt.Fprintf(buf, "type %s struct {\n", typeName)
+	for _, p := range s.Properties {
+		t, err := g.goType(p.schema)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %v", name, p.name, err)
+		}
+		field := p.schema.GoName
+		if field == "" {
+			field = fieldName(p.name)
+		}
+		tag := p.name
+		if !required[p.name] {
+			tag += ",omitempty"
+		}
+		if p.schema.Description != "" {
+			comment(buf, p.schema.Description)
+		}
+		fmt.Fprintf(buf, "%s %s `json:%q`\n", field, t, tag)
+	}
+	buf.WriteString("}\n\n")
+	return nil
+}
+
+// a description read as the complement of "is"
+func article(description string) string {
+	for _, prefix := range []string{"a ", "an ", "the "} {
+		if strings.HasPrefix(description, prefix) {
+			return description
+		}
+	}
+	return "the " + description
+}
+
+// generate the types of doc, plus the constant holding the document for the server
+func (g *generator) generate(pkg string, doc *document, spec []byte) ([]byte, error) {
+	var body bytes.Buffer
+	for _, p := range doc.Components.Schemas {
+		s := p.schema
+		if s.Type != "object" || s.AdditionalProperties != nil || s.GoType == "-" || g.server && s.GoType != "" {
+			continue
+		}
+		if err := g.writeType(&body, p.name, s); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	fmt.Fprintf(&buf, "package %s\n\n", pkg)
+	var imports []string
+	if g.time {
+		imports = append(imports, "time")
+	}
+	if len(g.imports) > 0 {
+		local := make([]string, 0, len(g.imports))
+		for path := range g.imports {
+			local = append(local, path)
+		}
+		sort.Strings(local)
+		imports = append(imports, "")
+		imports = append(imports, local...)
+	}
+	switch {
+	case len(imports) == 1:
+		fmt.Fprintf(&buf, "import %q\n\n", imports[0])
+	case len(imports) > 1:
+		buf.WriteString("import (\n")
+		for _, path := range imports {
+			if path != "" {
+				fmt.Fprintf(&buf, "\t%q", path)
+			}
+			buf.WriteString("\n")
+		}
+		buf.WriteString(")\n\n")
+	}
+	if g.server {
+		if bytes.IndexByte(spec, '`') >= 0 {
+			return nil, fmt.Errorf("openapi.json must not contain backquotes")
+		}
+		buf.WriteString("// OpenAPI document of the API, served at /api/openapi.json\n")
+		fmt.Fprintf(&buf, "const openAPIDocument = `%s`\n\n", spec)
+	}
+	buf.Write(body.Bytes())
+	return format.Source(buf.Bytes())
+}
+
+func main() {
+	specPath := flag.String("spec", "openapi.json", "OpenAPI document")
+	serverOut := flag.String("server", "internal/server/openapi_gen.go", "output of the server types")
+	clientOut := flag.String("client", "client/types_gen.go", "output of the client types")
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("openapigen: ")
+
+	spec, err := ioutil.ReadFile(*specPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var doc document
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		log.Fatalf("%s: %v", *specPath, err)
+	}
+	schemas := map[string]*schema{}
+	for _, p := range doc.Components.Schemas {
+		schemas[p.name] = p.schema
+	}
+
+	for _, out := range []struct {
+		path, pkg string
+		server    bool
+	}{{*serverOut, "server", true}, {*clientOut, "client", false}} {
+		g := &generator{schemas: schemas, server: out.server, imports: map[string]bool{}}
+		src, err := g.generate(out.pkg, &doc, spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := ioutil.WriteFile(out.path, src, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}